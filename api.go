@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// DirectoryListing is the JSON representation of a directory listing
+type DirectoryListing struct {
+	Path       string     `json:"path"`
+	ParentPath string     `json:"parent_path,omitempty"`
+	Total      int        `json:"total"`
+	Page       int        `json:"page"`
+	PageSize   int        `json:"page_size"`
+	TotalPages int        `json:"total_pages"`
+	Sort       string     `json:"sort"`
+	Order      string     `json:"order"`
+	Files      []FileInfo `json:"files"`
+}
+
+// handleAPIList serves directory listings as JSON under /api/list/<path>
+func (s *MediaServer) handleAPIList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	urlPath := strings.TrimPrefix(r.URL.Path, "/api/list")
+	cleanPath, fullPath, err := s.resolvePath(r, urlPath)
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+
+	fileInfo, err := s.statMedia(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "directory not found")
+		} else {
+			log.Printf("Error accessing directory %s: %v", fullPath, err)
+			writeJSONError(w, http.StatusInternalServerError, "internal server error")
+		}
+		return
+	}
+
+	if !fileInfo.IsDir() {
+		writeJSONError(w, http.StatusBadRequest, "path is not a directory")
+		return
+	}
+
+	s.serveDirectoryJSON(w, r, fullPath, cleanPath)
+}
+
+// serveDirectoryJSON writes a sorted, paginated directory listing as JSON
+func (s *MediaServer) serveDirectoryJSON(w http.ResponseWriter, r *http.Request, fullPath, urlPath string) {
+	files, err := s.listDirectory(userFromContext(r.Context()), fullPath, urlPath)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "unable to read directory")
+		return
+	}
+	s.attachProgress(r, files)
+
+	query := r.URL.Query()
+
+	sortKey := query.Get("sort")
+	if sortKey == "" {
+		sortKey = "name"
+	}
+	order := strings.ToLower(query.Get("order"))
+	if order == "" {
+		order = "asc"
+	}
+	if order != "asc" && order != "desc" {
+		writeJSONError(w, http.StatusBadRequest, "invalid order: must be asc or desc")
+		return
+	}
+	if !sortFiles(files, sortKey, order == "desc") {
+		writeJSONError(w, http.StatusBadRequest, "invalid sort: must be one of name, size, mtime, type")
+		return
+	}
+
+	page, err := parsePositiveInt(query.Get("page"), 1)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid page")
+		return
+	}
+	pageSize, err := parsePositiveInt(query.Get("page_size"), defaultPageSize)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid page_size")
+		return
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	// Pages past the end are empty; comparing before multiplying keeps
+	// huge page numbers from overflowing
+	total := len(files)
+	start := total
+	if page-1 <= total/pageSize {
+		start = min((page-1)*pageSize, total)
+	}
+	end := start + min(pageSize, total-start)
+
+	listing := DirectoryListing{
+		Path:       urlPath,
+		ParentPath: parentPath(urlPath),
+		Total:      total,
+		Page:       page,
+		PageSize:   pageSize,
+		TotalPages: (total + pageSize - 1) / pageSize,
+		Sort:       sortKey,
+		Order:      order,
+		Files:      files[start:end],
+	}
+	if listing.Files == nil {
+		listing.Files = []FileInfo{}
+	}
+
+	writeJSON(w, http.StatusOK, listing)
+}
+
+// handleAPIEvents streams catalog change events as Server-Sent Events
+func (s *MediaServer) handleAPIEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.catalog == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "media indexing is disabled")
+		return
+	}
+
+	// Event streams are long-lived, so lift the server write deadline
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Unable to clear write deadline for event stream: %v", err)
+	}
+
+	user := userFromContext(r.Context())
+	events, unsubscribe := s.catalog.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			// Shutting down or replaced by a reload; clients reconnect
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			if !s.library.Allows(user, event.Path) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Op, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// sortFiles sorts a listing in place by the given key, keeping directories
+// first. It reports false if the key is unknown.
+func sortFiles(files []FileInfo, key string, desc bool) bool {
+	var less func(a, b FileInfo) bool
+	byName := func(a, b FileInfo) bool {
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	}
+
+	switch key {
+	case "name":
+		less = byName
+	case "size":
+		less = func(a, b FileInfo) bool {
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+			return byName(a, b)
+		}
+	case "mtime":
+		less = func(a, b FileInfo) bool {
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+			return byName(a, b)
+		}
+	case "type":
+		less = func(a, b FileInfo) bool {
+			if a.MimeType != b.MimeType {
+				return a.MimeType < b.MimeType
+			}
+			return byName(a, b)
+		}
+	default:
+		return false
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].IsDir != files[j].IsDir {
+			return files[i].IsDir
+		}
+		if desc {
+			return less(files[j], files[i])
+		}
+		return less(files[i], files[j])
+	})
+	return true
+}
+
+// wantsJSON reports whether the client prefers a JSON response to HTML,
+// weighing the Accept header's media ranges by their q-values. Equal
+// weights go to the type named more specifically, and HTML wins the
+// remaining ties, so browsers and clients without a preference get the page.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	jsonQuality, jsonSpecificity := acceptQuality(accept, "application/json")
+	htmlQuality, htmlSpecificity := acceptQuality(accept, "text/html")
+	if jsonQuality != htmlQuality {
+		return jsonQuality > htmlQuality
+	}
+	return jsonQuality > 0 && jsonSpecificity > htmlSpecificity
+}
+
+// acceptQuality returns the q-value an Accept header gives a media type,
+// taken from the most specific media ranges that match it, and how
+// specific those ranges are: 2 for the type itself, 1 for type/* and 0 for
+// */*, or -1 if none match
+func acceptQuality(accept, mediaType string) (quality float64, specificity int) {
+	specificity = -1
+	for _, part := range strings.Split(accept, ",") {
+		accepted, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		var rank int
+		switch {
+		case accepted == mediaType:
+			rank = 2
+		case strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*")):
+			rank = 1
+		case accepted == "*/*":
+			rank = 0
+		default:
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		switch {
+		case rank > specificity:
+			quality, specificity = q, rank
+		case rank == specificity:
+			quality = max(quality, q)
+		}
+	}
+	return quality, specificity
+}
+
+// parsePositiveInt parses an optional positive integer query parameter
+func parsePositiveInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, strconv.ErrSyntax
+	}
+	return n, nil
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+// isScriptRequest reports whether a request could only have been sent by
+// a script: it has a JSON body or an X-Requested-With header. Browsers
+// send neither from plain forms, and cross-site scripts must first pass a
+// CORS preflight, so requiring one protects changes made with cached
+// credentials against cross-site request forgery.
+func isScriptRequest(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") != "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// writeJSONError writes an error message as a JSON response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
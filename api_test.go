@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// apiTestServer serves a media directory holding n files
+func apiTestServer(t *testing.T, n int) *MediaServer {
+	t.Helper()
+	dir := t.TempDir()
+	for i := 0; i < n; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%02d.txt", i)), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &MediaServer{
+		library: NewLibrary(MediaConfig{Directory: dir}),
+		types:   NewMediaTypes(nil, nil),
+	}
+}
+
+func TestAPIListPagination(t *testing.T) {
+	s := apiTestServer(t, 5)
+
+	tests := []struct {
+		name         string
+		query        string
+		wantStatus   int
+		wantFiles    []string
+		wantPageSize int
+		wantPages    int
+	}{
+		{"defaults", "", http.StatusOK, []string{"f00.txt", "f01.txt", "f02.txt", "f03.txt", "f04.txt"}, defaultPageSize, 1},
+		{"first page", "?page=1&page_size=2", http.StatusOK, []string{"f00.txt", "f01.txt"}, 2, 3},
+		{"last page", "?page=3&page_size=2", http.StatusOK, []string{"f04.txt"}, 2, 3},
+		{"past the end", "?page=4&page_size=2", http.StatusOK, []string{}, 2, 3},
+		{"huge page", "?page=9223372036854775807", http.StatusOK, []string{}, defaultPageSize, 1},
+		{"huge page size", "?page_size=9223372036854775807", http.StatusOK, []string{"f00.txt", "f01.txt", "f02.txt", "f03.txt", "f04.txt"}, maxPageSize, 1},
+		{"huge page and page size", "?page=9223372036854775807&page_size=9223372036854775807", http.StatusOK, []string{}, maxPageSize, 1},
+		{"second page of huge pages", "?page=2&page_size=9223372036854775807", http.StatusOK, []string{}, maxPageSize, 1},
+		{"descending", "?order=desc&page_size=2", http.StatusOK, []string{"f04.txt", "f03.txt"}, 2, 3},
+		{"page zero", "?page=0", http.StatusBadRequest, nil, 0, 0},
+		{"negative page", "?page=-1", http.StatusBadRequest, nil, 0, 0},
+		{"page out of range", "?page=99999999999999999999", http.StatusBadRequest, nil, 0, 0},
+		{"page size zero", "?page_size=0", http.StatusBadRequest, nil, 0, 0},
+		{"invalid order", "?order=up", http.StatusBadRequest, nil, 0, 0},
+		{"invalid sort", "?sort=color", http.StatusBadRequest, nil, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleAPIList(w, httptest.NewRequest("GET", "/api/list/"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var listing DirectoryListing
+			if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+				t.Fatal(err)
+			}
+			if listing.Total != 5 || listing.PageSize != tt.wantPageSize || listing.TotalPages != tt.wantPages {
+				t.Errorf("total %d, page size %d, pages %d, want 5, %d, %d", listing.Total, listing.PageSize, listing.TotalPages, tt.wantPageSize, tt.wantPages)
+			}
+			if listing.Files == nil {
+				t.Fatal("files = null, want a list")
+			}
+			var names []string
+			for _, file := range listing.Files {
+				names = append(names, file.Name)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(tt.wantFiles) {
+				t.Errorf("files = %v, want %v", names, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"application/json", true},
+		{"application/json, text/plain, */*", true},
+		{"text/html;q=0.5, application/json", true},
+		{"application/json;q=0.5, text/html", false},
+		{"application/json;q=0, */*", false},
+		{"text/html;q=0, */*", true},
+		{"application/*", true},
+		{"application/json;q=abc", false},
+		{"application/json;q=2, text/html", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := wantsJSON(r); got != tt.want {
+			t.Errorf("wantsJSON(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
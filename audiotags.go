@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// maxTagSize bounds the ID3v2 tags and FLAC comment blocks read into
+	// memory; embedded cover art can make them large. Tags claiming more
+	// than the rest of the file are skipped as well.
+	maxTagSize = 16 << 20
+
+	// mp3SyncWindow is how far after the ID3 tag the first frame is sought
+	mp3SyncWindow = 64 << 10
+)
+
+var (
+	errNotMP3  = errors.New("not an MP3 file")
+	errNotFLAC = errors.New("not a FLAC file")
+)
+
+// id3TagNames maps ID3v2.3/2.4 and ID3v2.2 text frames to tag names
+var id3TagNames = map[string]string{
+	"TIT2": "title",
+	"TPE1": "artist",
+	"TPE2": "album_artist",
+	"TALB": "album",
+	"TDRC": "date",
+	"TYER": "date",
+	"TCON": "genre",
+	"TRCK": "track",
+	"TT2":  "title",
+	"TP1":  "artist",
+	"TP2":  "album_artist",
+	"TAL":  "album",
+	"TYE":  "date",
+	"TCO":  "genre",
+	"TRK":  "track",
+}
+
+// vorbisTagNames maps Vorbis comment fields to tag names
+var vorbisTagNames = map[string]string{
+	"TITLE":       "title",
+	"ARTIST":      "artist",
+	"ALBUMARTIST": "album_artist",
+	"ALBUM":       "album",
+	"DATE":        "date",
+	"GENRE":       "genre",
+	"TRACKNUMBER": "track",
+	"COMMENT":     "comment",
+	"DESCRIPTION": "description",
+}
+
+// MPEG audio layer III bitrates in kbit/s, indexed by the header bitrate
+// index, for MPEG-1 and for MPEG-2 and 2.5
+var (
+	mp3BitratesV1 = [...]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mp3BitratesV2 = [...]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	mp3Rates      = [...]int{44100, 48000, 32000, 0}
+)
+
+// probeMP3 reads the ID3v2 tag and the first frame header of an MP3
+// file. The duration comes from a Xing or VBRI header when present and is
+// otherwise estimated from the bitrate.
+func probeMP3(r io.ReaderAt, size int64) (*MediaMetadata, error) {
+	meta := &MediaMetadata{Format: "mp3", AudioCodec: "MP3"}
+
+	var header [10]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, errNotMP3
+	}
+	offset := int64(0)
+	if string(header[:3]) == "ID3" {
+		tagSize := int64(syncsafe(header[6:]))
+		offset = 10 + tagSize
+		if header[5]&0x10 != 0 {
+			offset += 10 // footer
+		}
+		if tagSize <= maxTagSize && tagSize <= size-10 {
+			body := make([]byte, tagSize)
+			if _, err := r.ReadAt(body, 10); err != nil {
+				return nil, err
+			}
+			parseID3(body, header[3], header[5], meta)
+		}
+	}
+
+	buf := make([]byte, mp3SyncWindow)
+	// A file holding only a tag has no frames to read; it is still
+	// reported when the tag has text
+	n, _ := r.ReadAt(buf, offset)
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xff || buf[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		version := buf[i+1] >> 3 & 0x03 // 0: MPEG-2.5, 2: MPEG-2, 3: MPEG-1
+		layer := buf[i+1] >> 1 & 0x03   // 1: layer III
+		bitrateIndex := buf[i+2] >> 4
+		rateIndex := buf[i+2] >> 2 & 0x03
+		if version == 1 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+			continue
+		}
+
+		bitrate := mp3BitratesV2[bitrateIndex]
+		meta.SampleRate = mp3Rates[rateIndex]
+		samplesPerFrame := 576
+		sideInfo := 17
+		if version == 3 {
+			bitrate = mp3BitratesV1[bitrateIndex]
+			samplesPerFrame = 1152
+			sideInfo = 32
+		} else {
+			meta.SampleRate /= 2
+			if version == 0 {
+				meta.SampleRate /= 2
+			}
+		}
+		meta.Channels = 2
+		if buf[i+3]>>6 == 3 {
+			meta.Channels = 1
+			sideInfo /= 2
+		}
+
+		if frames := mp3FrameCount(buf[i:], sideInfo); frames > 0 {
+			meta.Duration = float64(frames) * float64(samplesPerFrame) / float64(meta.SampleRate)
+		} else {
+			meta.Duration = float64(size-offset-int64(i)) * 8 / float64(bitrate*1000)
+		}
+		return meta, nil
+	}
+
+	if meta.Tags == nil {
+		return nil, errNotMP3
+	}
+	return meta, nil
+}
+
+// mp3FrameCount reads the frame count from a Xing, Info or VBRI header in
+// the first frame, returning 0 if there is none
+func mp3FrameCount(frame []byte, sideInfo int) uint32 {
+	xing := 4 + sideInfo
+	if len(frame) >= xing+12 {
+		if tag := string(frame[xing : xing+4]); tag == "Xing" || tag == "Info" {
+			if binary.BigEndian.Uint32(frame[xing+4:])&0x01 != 0 {
+				return binary.BigEndian.Uint32(frame[xing+8:])
+			}
+			return 0
+		}
+	}
+	if len(frame) >= 36+18 && string(frame[36:40]) == "VBRI" {
+		return binary.BigEndian.Uint32(frame[36+14:])
+	}
+	return 0
+}
+
+// syncsafe decodes a 28-bit integer stored in the low 7 bits of 4 bytes
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+// parseID3 reads the text frames of an ID3v2 tag body
+func parseID3(body []byte, version, flags byte, meta *MediaMetadata) {
+	if flags&0x80 != 0 && version < 4 {
+		// Remove unsynchronisation: 0xff 0x00 stands for 0xff
+		body = bytes.ReplaceAll(body, []byte{0xff, 0x00}, []byte{0xff})
+	}
+	if flags&0x40 != 0 && version >= 3 && len(body) >= 4 {
+		// Skip the extended header
+		skip := int(binary.BigEndian.Uint32(body)) + 4
+		if version == 4 {
+			skip = int(syncsafe(body))
+		}
+		if skip > len(body) {
+			return
+		}
+		body = body[skip:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(body) >= headerLen && body[0] != 0 {
+		id := string(body[:idLen])
+		var frameSize int
+		switch version {
+		case 2:
+			frameSize = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[4:]))
+		default:
+			frameSize = int(syncsafe(body[4:]))
+		}
+		if frameSize < 0 || frameSize > len(body)-headerLen {
+			return
+		}
+		frame := body[headerLen : headerLen+frameSize]
+		body = body[headerLen+frameSize:]
+
+		key, ok := id3TagNames[id]
+		if !ok || len(frame) < 2 {
+			continue
+		}
+		value := decodeID3Text(frame[0], frame[1:])
+		if key == "track" {
+			// "3/12" means track 3 of 12
+			value, _, _ = strings.Cut(value, "/")
+		}
+		meta.setTag(key, value)
+	}
+}
+
+// decodeID3Text decodes the first string of a text frame in the given
+// ID3 encoding
+func decodeID3Text(encoding byte, b []byte) string {
+	switch encoding {
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(b) >= 2 {
+			switch {
+			case b[0] == 0xff && b[1] == 0xfe:
+				bigEndian, b = false, b[2:]
+			case b[0] == 0xfe && b[1] == 0xff:
+				bigEndian, b = true, b[2:]
+			}
+		}
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			var u uint16
+			if bigEndian {
+				u = binary.BigEndian.Uint16(b[i:])
+			} else {
+				u = binary.LittleEndian.Uint16(b[i:])
+			}
+			if u == 0 {
+				break
+			}
+			units = append(units, u)
+		}
+		return string(utf16.Decode(units))
+	case 3:
+		text, _, _ := strings.Cut(string(b), "\x00")
+		return text
+	default:
+		// ISO-8859-1 maps directly onto the first 256 code points
+		runes := make([]rune, 0, len(b))
+		for _, c := range b {
+			if c == 0 {
+				break
+			}
+			runes = append(runes, rune(c))
+		}
+		return string(runes)
+	}
+}
+
+// probeFLAC reads the stream information and Vorbis comments of a FLAC
+// file
+func probeFLAC(r io.ReaderAt, size int64) (*MediaMetadata, error) {
+	var header [4]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil || string(header[:]) != "fLaC" {
+		return nil, errNotFLAC
+	}
+
+	meta := &MediaMetadata{Format: "flac", AudioCodec: "FLAC"}
+	for offset := int64(4); offset+4 <= size; {
+		if _, err := r.ReadAt(header[:], offset); err != nil {
+			return nil, err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		offset += 4
+
+		switch {
+		case blockType == 0 && length >= 18:
+			var info [18]byte
+			if _, err := r.ReadAt(info[:], offset); err != nil {
+				return nil, err
+			}
+			meta.SampleRate = int(info[10])<<12 | int(info[11])<<4 | int(info[12])>>4
+			meta.Channels = int(info[12]>>1&0x07) + 1
+			samples := uint64(info[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(info[14:]))
+			if meta.SampleRate > 0 {
+				meta.Duration = float64(samples) / float64(meta.SampleRate)
+			}
+		case blockType == 4 && length <= maxTagSize && length <= size-offset:
+			block := make([]byte, length)
+			if _, err := r.ReadAt(block, offset); err != nil {
+				return nil, err
+			}
+			parseVorbisComments(block, meta)
+		}
+
+		offset += length
+		if last {
+			break
+		}
+	}
+	return meta, nil
+}
+
+// parseVorbisComments reads a little-endian Vorbis comment block
+func parseVorbisComments(b []byte, meta *MediaMetadata) {
+	if len(b) < 4 {
+		return
+	}
+	vendor := int(binary.LittleEndian.Uint32(b))
+	if vendor > len(b)-8 {
+		return
+	}
+	b = b[4+vendor:]
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+
+	for i := 0; i < count && len(b) >= 4; i++ {
+		n := int(binary.LittleEndian.Uint32(b))
+		if n > len(b)-4 {
+			return
+		}
+		field := string(b[4 : 4+n])
+		b = b[4+n:]
+
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		if key, ok := vorbisTagNames[strings.ToUpper(name)]; ok {
+			if key == "track" {
+				value, _, _ = strings.Cut(value, "/")
+			}
+			meta.setTag(key, value)
+		}
+	}
+}
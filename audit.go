@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a change made to the media library
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	User        string    `json:"user,omitempty"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Action      string    `json:"action"`
+	Path        string    `json:"path"`
+	Destination string    `json:"destination,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// AuditLog appends entries to a file as JSON lines. The file is opened
+// for each entry, so it can be rotated by moving it away.
+type AuditLog struct {
+	file string
+	mu   sync.Mutex
+}
+
+// NewAuditLog creates an audit log writing to file
+func NewAuditLog(file string) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	return &AuditLog{file: file}, nil
+}
+
+// Record appends an entry for an action requested by r. A failed action
+// is recorded along with its error.
+func (a *AuditLog) Record(r *http.Request, action, urlPath, destination string, actionErr error) error {
+	entry := AuditEntry{
+		Time:        time.Now().UTC(),
+		User:        userFromContext(r.Context()),
+		RemoteAddr:  r.RemoteAddr,
+		Action:      action,
+		Path:        urlPath,
+		Destination: destination,
+	}
+	if actionErr != nil {
+		entry.Error = actionErr.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
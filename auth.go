@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authCacheTTL is how long a verified username/password pair is trusted
+// before bcrypt is consulted again. Media players issue many range
+// requests per file, and bcrypt is deliberately slow.
+const authCacheTTL = 5 * time.Minute
+
+// dummyHash is compared against for unknown users so that lookups take
+// the same time whether or not the user exists
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+// authExemptPaths are served without authentication
+var authExemptPaths = map[string]bool{
+	"/health": true,
+}
+
+// isAuthExempt reports whether a request bypasses authentication. Share
+// links carry their own signed authorization. DLNA paths may be opened to
+// the DLNA networks without credentials, since most TVs cannot
+// authenticate; they are still limited to those networks by handleDLNA.
+func (s *MediaServer) isAuthExempt(r *http.Request) bool {
+	urlPath := r.URL.Path
+	if authExemptPaths[urlPath] || strings.HasPrefix(urlPath, "/s/") {
+		return true
+	}
+	return strings.HasPrefix(urlPath, "/dlna/") && s.dlna != nil && s.dlna.allowUnauthenticated
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	davRequestContextKey
+)
+
+// Authenticator verifies HTTP Basic credentials against bcrypt hashes
+type Authenticator struct {
+	realm string
+	users map[string][]byte
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+// NewAuthenticator creates an authenticator for the configured users
+func NewAuthenticator(config AuthConfig) *Authenticator {
+	users := make(map[string][]byte, len(config.Users))
+	for _, user := range config.Users {
+		users[user.Username] = []byte(user.PasswordHash)
+	}
+
+	return &Authenticator{
+		realm:    config.Realm,
+		users:    users,
+		verified: make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// Verify reports whether the username and password are valid
+func (a *Authenticator) Verify(username, password string) bool {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+
+	a.mu.Lock()
+	expires, ok := a.verified[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(expires) {
+		return true
+	}
+
+	hash, known := a.users[username]
+	if !known {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	a.mu.Lock()
+	now := time.Now()
+	for k, exp := range a.verified {
+		if now.After(exp) {
+			delete(a.verified, k)
+		}
+	}
+	a.verified[key] = now.Add(authCacheTTL)
+	a.mu.Unlock()
+
+	return true
+}
+
+// authMiddleware requires HTTP Basic authentication for all requests
+// except exempt paths. The authenticated username is stored in the
+// request context.
+func (s *MediaServer) authMiddleware(next http.Handler) http.Handler {
+	if s.auth == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.isAuthExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok || !s.auth.Verify(username, password) {
+			if ok {
+				log.Printf("Authentication failed for user %q from %s", username, r.RemoteAddr)
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", s.auth.realm))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, username)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// userFromContext returns the authenticated username, or "" when
+// authentication is disabled
+func userFromContext(ctx context.Context) string {
+	username, _ := ctx.Value(userContextKey).(string)
+	return username
+}
+
+// hashPassword returns the bcrypt hash of a password for use in config.yaml
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPasswordHash returns a cheap bcrypt hash of password
+func testPasswordHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+// loadTestConfig loads a configuration file with the given YAML contents
+func loadTestConfig(t *testing.T, contents string) (*Config, error) {
+	t.Helper()
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(configPath)
+}
+
+func TestAuthenticatorVerify(t *testing.T) {
+	auth := NewAuthenticator(AuthConfig{Users: []UserConfig{
+		{Username: "alice", PasswordHash: testPasswordHash(t, "secret")},
+		{Username: "bob", PasswordHash: "not a hash"},
+	}})
+
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "secret", true}, // cached
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"Alice", "secret", false},
+		{"bob", "not a hash", false},
+		{"carol", "secret", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := auth.Verify(tt.username, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	s := &MediaServer{auth: NewAuthenticator(AuthConfig{
+		Realm: "Media",
+		Users: []UserConfig{{Username: "alice", PasswordHash: testPasswordHash(t, "secret")}},
+	})}
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "user=%s", userFromContext(r.Context()))
+	}))
+
+	tests := []struct {
+		name       string
+		path       string
+		username   string
+		password   string
+		dlna       *DLNAServer
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "no credentials", path: "/", wantStatus: http.StatusUnauthorized},
+		{name: "wrong password", path: "/", username: "alice", password: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "unknown user", path: "/", username: "mallory", password: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "valid credentials", path: "/movies/", username: "alice", password: "secret", wantStatus: http.StatusOK, wantBody: "user=alice"},
+		{name: "health check", path: "/health", wantStatus: http.StatusOK, wantBody: "user="},
+		{name: "share link", path: "/s/token", wantStatus: http.StatusOK, wantBody: "user="},
+		{name: "health prefix", path: "/healthz", wantStatus: http.StatusUnauthorized},
+		{name: "dlna disabled", path: "/dlna/device.xml", wantStatus: http.StatusUnauthorized},
+		{name: "dlna with authentication", path: "/dlna/device.xml", dlna: &DLNAServer{}, wantStatus: http.StatusUnauthorized},
+		{name: "dlna without authentication", path: "/dlna/device.xml", dlna: &DLNAServer{allowUnauthenticated: true}, wantStatus: http.StatusOK, wantBody: "user="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.dlna = tt.dlna
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.username != "" {
+				r.SetBasicAuth(tt.username, tt.password)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized {
+				if got := w.Header().Get("WWW-Authenticate"); got != `Basic realm="Media", charset="UTF-8"` {
+					t.Errorf("WWW-Authenticate = %q", got)
+				}
+				return
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareDisabled(t *testing.T) {
+	s := &MediaServer{}
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "user=%s", userFromContext(r.Context()))
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("alice", "anything")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "user=" {
+		t.Errorf("response = %d %q, want 200 %q", w.Code, w.Body, "user=")
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	auth := NewAuthenticator(AuthConfig{})
+
+	tests := []struct {
+		name            string
+		origins         []string
+		auth            *Authenticator
+		origin          string
+		preflight       bool
+		wantOrigin      string
+		wantCredentials bool
+		wantStatus      int
+	}{
+		{name: "any origin without auth", origin: "https://a.example", wantOrigin: "*", wantStatus: http.StatusOK},
+		{name: "no origins with auth", auth: auth, origin: "https://a.example", wantStatus: http.StatusOK},
+		{name: "listed origin", origins: []string{"https://a.example"}, auth: auth, origin: "https://A.example", wantOrigin: "https://A.example", wantCredentials: true, wantStatus: http.StatusOK},
+		{name: "unlisted origin", origins: []string{"https://a.example"}, auth: auth, origin: "https://b.example", wantStatus: http.StatusOK},
+		{name: "no origin header", origins: []string{"https://a.example"}, wantStatus: http.StatusOK},
+		{name: "wildcard", origins: []string{"*"}, origin: "https://b.example", wantOrigin: "*", wantStatus: http.StatusOK},
+		{name: "preflight", origins: []string{"https://a.example"}, auth: auth, origin: "https://a.example", preflight: true, wantOrigin: "https://a.example", wantCredentials: true, wantStatus: http.StatusNoContent},
+		{name: "preflight from unlisted origin", origins: []string{"https://a.example"}, auth: auth, origin: "https://b.example", preflight: true, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &MediaServer{config: &Config{Server: ServerConfig{CORSOrigins: tt.origins}}, auth: tt.auth}
+			handler := s.corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodOptions {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				}
+			}))
+
+			r := httptest.NewRequest("GET", "/api/list/", nil)
+			if tt.preflight {
+				r.Method = http.MethodOptions
+				r.Header.Set("Access-Control-Request-Method", "GET")
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %v, want %v", got, tt.wantCredentials)
+			}
+		})
+	}
+}
+
+func TestAuthConfigValidation(t *testing.T) {
+	hash := testPasswordHash(t, "secret")
+
+	tests := []struct {
+		name    string
+		auth    string
+		wantErr string
+	}{
+		{"disabled", "enabled: false", ""},
+		{"one user", "enabled: true\n  users: [{username: alice, password_hash: '" + hash + "'}]", ""},
+		{"no users", "enabled: true", "no users are configured"},
+		{"empty username", "enabled: true\n  users: [{username: '', password_hash: '" + hash + "'}]", "username cannot be empty"},
+		{"duplicate user", "enabled: true\n  users: [{username: alice, password_hash: '" + hash + "'}, {username: alice, password_hash: '" + hash + "'}]", "configured more than once"},
+		{"plain text password", "enabled: true\n  users: [{username: alice, password_hash: secret}]", "invalid bcrypt password hash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, "auth:\n  "+tt.auth+"\n")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				if config.Auth.Realm != "HTTP Media Server" {
+					t.Errorf("realm = %q, want the default", config.Auth.Realm)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Catalog is an in-memory index of the media library. It holds a FileInfo
+// record for every visible file and directory, keyed by URL path, along
+// with the sorted listing of each directory. When probing is enabled the
+// media metadata of each file is read in the background and attached to
+// its records.
+type Catalog struct {
+	library *Library
+	types   *MediaTypes
+	probe   bool
+
+	mu       sync.RWMutex
+	entries  map[string]FileInfo
+	dirs     map[string][]FileInfo
+	lastScan time.Time
+	scanTime time.Duration
+
+	// metadata is kept apart from entries so that rescans do not discard
+	// it; probeWake signals Run that files are waiting to be probed
+	metadata  map[string]metadataEntry
+	probeWake chan struct{}
+
+	subMu       sync.Mutex
+	subscribers map[chan CatalogEvent]struct{}
+}
+
+// metadataEntry is the probed metadata of one version of a file. meta is
+// nil for files whose metadata could not be read.
+type metadataEntry struct {
+	modTime time.Time
+	size    int64
+	meta    *MediaMetadata
+}
+
+// CatalogStats summarizes the catalog contents
+type CatalogStats struct {
+	Files       int       `json:"files"`
+	Directories int       `json:"directories"`
+	Ready       bool      `json:"ready"`
+	LastScan    time.Time `json:"last_scan,omitempty"`
+	ScanTime    string    `json:"scan_time,omitempty"`
+}
+
+// Catalog event operations
+const (
+	EventCreate = "create"
+	EventModify = "modify"
+	EventRemove = "remove"
+)
+
+// CatalogEvent describes a change to the catalog
+type CatalogEvent struct {
+	Op    string    `json:"op"`
+	Path  string    `json:"path"`
+	IsDir bool      `json:"is_dir"`
+	Time  time.Time `json:"time"`
+}
+
+// NewCatalog creates an empty catalog for the given media library.
+// probe enables reading media metadata from indexed files.
+func NewCatalog(library *Library, types *MediaTypes, probe bool) *Catalog {
+	return &Catalog{
+		library:     library,
+		types:       types,
+		probe:       probe,
+		metadata:    make(map[string]metadataEntry),
+		probeWake:   make(chan struct{}, 1),
+		subscribers: make(map[chan CatalogEvent]struct{}),
+	}
+}
+
+// Run performs an initial scan, unless a previous server instance already
+// did, and then rescans the media directory every interval until the
+// context is cancelled. A zero interval disables rescans. Metadata of new
+// and changed files is probed between scans.
+func (c *Catalog) Run(ctx context.Context, interval time.Duration) {
+	c.mu.RLock()
+	scanned := !c.lastScan.IsZero()
+	c.mu.RUnlock()
+	if !scanned {
+		if err := c.Scan(); err != nil {
+			log.Printf("Catalog scan failed: %v", err)
+		}
+	}
+
+	var rescan <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rescan:
+			if err := c.Scan(); err != nil {
+				log.Printf("Catalog rescan failed: %v", err)
+			}
+		case <-c.probeWake:
+			c.probeMetadata(ctx)
+		}
+	}
+}
+
+// Scan walks the media directories and replaces the catalog contents.
+// Differences from the previous contents are published as events.
+func (c *Catalog) Scan() error {
+	start := time.Now()
+	entries := make(map[string]FileInfo)
+	dirs := map[string][]FileInfo{"/": nil}
+
+	for _, root := range c.library.Roots() {
+		if root.Mount != "/" {
+			// Roots of a library with several roots are top-level folders
+			info, err := os.Stat(root.Directory)
+			if err != nil || !info.IsDir() {
+				log.Printf("Catalog: skipping media root %s: %v", root.Name, err)
+				continue
+			}
+			file := newFileInfo(root.Mount, root.Directory, info, c.types)
+			file.Name = root.Name
+			entries[root.Mount] = file
+			dirs["/"] = append(dirs["/"], file)
+			dirs[root.Mount] = nil
+		}
+		if err := c.walk(root, root.Directory, root.Mount, entries, dirs); err != nil {
+			return err
+		}
+	}
+
+	for _, files := range dirs {
+		sortByName(files)
+	}
+
+	elapsed := time.Since(start)
+
+	c.mu.Lock()
+	var events []CatalogEvent
+	if c.entries != nil {
+		events = diffEntries(c.entries, entries)
+	}
+	c.entries = entries
+	c.dirs = dirs
+	c.lastScan = start
+	c.scanTime = elapsed
+	for p := range c.metadata {
+		if _, ok := entries[p]; !ok {
+			delete(c.metadata, p)
+		}
+	}
+	c.mu.Unlock()
+
+	c.publish(events)
+	c.wakeProber()
+	log.Printf("Catalog indexed %d entries in %d directories (%v)", len(entries), len(dirs), elapsed)
+	return nil
+}
+
+// ScanRoot walks a single media root and replaces its part of the
+// catalog, leaving the other roots alone. Differences from the previous
+// contents are published as events.
+func (c *Catalog) ScanRoot(root *MediaRoot) error {
+	c.mu.RLock()
+	scanned := c.dirs != nil
+	c.mu.RUnlock()
+	if root.Mount == "/" || !scanned {
+		return c.Scan()
+	}
+
+	start := time.Now()
+	entries := make(map[string]FileInfo)
+	dirs := map[string][]FileInfo{root.Mount: nil}
+	if err := c.walk(root, root.Directory, root.Mount, entries, dirs); err != nil {
+		return err
+	}
+	for _, files := range dirs {
+		sortByName(files)
+	}
+
+	prefix := root.Mount + "/"
+	c.mu.Lock()
+	previous := make(map[string]FileInfo)
+	for p, e := range c.entries {
+		if strings.HasPrefix(p, prefix) {
+			previous[p] = e
+			delete(c.entries, p)
+		}
+	}
+	for p := range c.dirs {
+		if p == root.Mount || strings.HasPrefix(p, prefix) {
+			delete(c.dirs, p)
+		}
+	}
+	for p, e := range entries {
+		c.entries[p] = e
+	}
+	for p, files := range dirs {
+		c.dirs[p] = files
+	}
+	for p := range c.metadata {
+		if _, ok := entries[p]; !ok && strings.HasPrefix(p, prefix) {
+			delete(c.metadata, p)
+		}
+	}
+	events := diffEntries(previous, entries)
+	c.mu.Unlock()
+
+	c.publish(events)
+	c.wakeProber()
+	log.Printf("Catalog indexed %d entries of media root %s (%v)", len(entries), root.Name, time.Since(start))
+	return nil
+}
+
+// walk indexes the visible subtree rooted at fullDir, whose URL path is
+// urlDir, into entries and dirs. root decides which files are hidden.
+func (c *Catalog) walk(root *MediaRoot, fullDir, urlDir string, entries map[string]FileInfo, dirs map[string][]FileInfo) error {
+	return filepath.WalkDir(fullDir, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Skip unreadable subtrees but keep indexing the rest
+			log.Printf("Catalog: skipping %s: %v", fullPath, err)
+			if d != nil && d.IsDir() && fullPath != fullDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if fullPath == fullDir {
+			return nil
+		}
+
+		if root.Hidden(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		rel, err := filepath.Rel(fullDir, fullPath)
+		if err != nil {
+			return nil
+		}
+		urlPath := path.Join(urlDir, filepath.ToSlash(rel))
+
+		file := newFileInfo(urlPath, fullPath, info, c.types)
+		entries[urlPath] = file
+		parent := path.Dir(urlPath)
+		dirs[parent] = append(dirs[parent], file)
+		if file.IsDir {
+			if _, ok := dirs[urlPath]; !ok {
+				dirs[urlPath] = nil
+			}
+		}
+		return nil
+	})
+}
+
+// Refresh re-reads a single path from disk and updates the catalog
+// incrementally. New directories are indexed recursively and removed
+// directories are dropped along with their contents.
+func (c *Catalog) Refresh(urlPath string) {
+	urlPath = path.Clean("/" + urlPath)
+	root := c.library.Root(urlPath)
+	if root == nil || c.library.IsMount(urlPath) || c.library.Hidden(urlPath) {
+		return
+	}
+
+	fullPath := root.FullPath(urlPath)
+	info, statErr := os.Lstat(fullPath)
+
+	// Index new directories before taking the lock
+	var subEntries map[string]FileInfo
+	var subDirs map[string][]FileInfo
+	if statErr == nil && info.IsDir() {
+		c.mu.RLock()
+		_, known := c.dirs[urlPath]
+		c.mu.RUnlock()
+		if !known {
+			subEntries = make(map[string]FileInfo)
+			subDirs = map[string][]FileInfo{urlPath: nil}
+			if err := c.walk(root, fullPath, urlPath, subEntries, subDirs); err != nil {
+				log.Printf("Catalog: failed to index %s: %v", fullPath, err)
+			}
+			for _, files := range subDirs {
+				sortByName(files)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	if c.dirs == nil {
+		c.mu.Unlock()
+		return
+	}
+
+	parent := path.Dir(urlPath)
+	if _, ok := c.dirs[parent]; !ok {
+		// Parent is not indexed, so neither is this path
+		c.mu.Unlock()
+		return
+	}
+
+	var events []CatalogEvent
+	now := time.Now()
+	old, existed := c.entries[urlPath]
+
+	if statErr != nil {
+		if existed {
+			events = c.removeLocked(urlPath, now)
+		}
+		c.mu.Unlock()
+		c.publish(events)
+		return
+	}
+
+	file := newFileInfo(urlPath, fullPath, info, c.types)
+	switch {
+	case !existed:
+		events = append(events, CatalogEvent{Op: EventCreate, Path: urlPath, IsDir: file.IsDir, Time: now})
+	case old.IsDir != file.IsDir:
+		events = c.removeLocked(urlPath, now)
+		events = append(events, CatalogEvent{Op: EventCreate, Path: urlPath, IsDir: file.IsDir, Time: now})
+	case old.Size != file.Size || !old.ModTime.Equal(file.ModTime):
+		events = append(events, CatalogEvent{Op: EventModify, Path: urlPath, IsDir: file.IsDir, Time: now})
+	}
+
+	c.entries[urlPath] = file
+	c.setChildLocked(parent, file)
+
+	for p, e := range subEntries {
+		if _, ok := c.entries[p]; !ok {
+			events = append(events, CatalogEvent{Op: EventCreate, Path: p, IsDir: e.IsDir, Time: now})
+		}
+		c.entries[p] = e
+	}
+	for p, files := range subDirs {
+		c.dirs[p] = files
+	}
+	c.mu.Unlock()
+
+	c.publish(events)
+	if len(events) > 0 {
+		c.wakeProber()
+	}
+}
+
+// removeLocked drops a path and everything below it. The caller must
+// hold the write lock.
+func (c *Catalog) removeLocked(urlPath string, now time.Time) []CatalogEvent {
+	var events []CatalogEvent
+	prefix := urlPath + "/"
+
+	for p, e := range c.entries {
+		if p == urlPath || strings.HasPrefix(p, prefix) {
+			delete(c.entries, p)
+			delete(c.metadata, p)
+			events = append(events, CatalogEvent{Op: EventRemove, Path: p, IsDir: e.IsDir, Time: now})
+		}
+	}
+	for p := range c.dirs {
+		if p == urlPath || strings.HasPrefix(p, prefix) {
+			delete(c.dirs, p)
+		}
+	}
+
+	parent := path.Dir(urlPath)
+	name := path.Base(urlPath)
+	files := c.dirs[parent]
+	kept := files[:0]
+	for _, f := range files {
+		if f.Name != name {
+			kept = append(kept, f)
+		}
+	}
+	c.dirs[parent] = kept
+
+	return events
+}
+
+// setChildLocked inserts or replaces an entry in its parent's listing.
+// The caller must hold the write lock.
+func (c *Catalog) setChildLocked(parent string, file FileInfo) {
+	files := c.dirs[parent]
+	for i := range files {
+		if files[i].Name == file.Name {
+			files[i] = file
+			sortByName(files)
+			return
+		}
+	}
+
+	c.dirs[parent] = append(files, file)
+	sortByName(c.dirs[parent])
+}
+
+// List returns a copy of the listing for a directory URL path. It reports
+// false if the directory has not been indexed.
+func (c *Catalog) List(urlPath string) ([]FileInfo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	files, ok := c.dirs[urlPath]
+	if !ok {
+		return nil, false
+	}
+
+	result := make([]FileInfo, len(files))
+	for i, file := range files {
+		result[i] = c.withMetadataLocked(file)
+	}
+	return result, true
+}
+
+// Lookup returns the catalog record for a URL path
+func (c *Catalog) Lookup(urlPath string) (FileInfo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	file, ok := c.entries[urlPath]
+	return c.withMetadataLocked(file), ok
+}
+
+// Ready reports whether the initial scan has completed
+func (c *Catalog) Ready() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.dirs != nil
+}
+
+// Walk calls fn for every catalog entry in no particular order. The
+// catalog is read-locked while fn runs, so fn must not modify it.
+func (c *Catalog) Walk(fn func(FileInfo)) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, file := range c.entries {
+		fn(c.withMetadataLocked(file))
+	}
+}
+
+// Stats returns a summary of the catalog contents
+func (c *Catalog) Stats() CatalogStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	stats := CatalogStats{
+		Directories: len(c.dirs),
+		Ready:       c.dirs != nil,
+	}
+	for _, file := range c.entries {
+		if !file.IsDir {
+			stats.Files++
+		}
+	}
+	if !c.lastScan.IsZero() {
+		stats.LastScan = c.lastScan
+		stats.ScanTime = c.scanTime.String()
+	}
+	return stats
+}
+
+// withMetadataLocked returns file with its probed metadata attached, if
+// the metadata is current. The caller must hold the read lock.
+func (c *Catalog) withMetadataLocked(file FileInfo) FileInfo {
+	if entry, ok := c.metadata[file.Path]; ok && entry.matches(file) {
+		file.Metadata = entry.meta
+	}
+	return file
+}
+
+// matches reports whether the entry was probed from the current version
+// of file
+func (e metadataEntry) matches(file FileInfo) bool {
+	return e.size == file.Size && e.modTime.Equal(file.ModTime)
+}
+
+// wakeProber asks Run to probe files that have no current metadata
+func (c *Catalog) wakeProber() {
+	if !c.probe {
+		return
+	}
+	select {
+	case c.probeWake <- struct{}{}:
+	default:
+	}
+}
+
+// probeMetadata reads the metadata of every supported file that has no
+// current metadata, stopping early if ctx is cancelled
+func (c *Catalog) probeMetadata(ctx context.Context) {
+	var pending []FileInfo
+	c.mu.RLock()
+	for _, file := range c.entries {
+		if file.IsDir || !hasMetadataProber(file.Name) {
+			continue
+		}
+		if entry, ok := c.metadata[file.Path]; ok && entry.matches(file) {
+			continue
+		}
+		pending = append(pending, file)
+	}
+	c.mu.RUnlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	start := time.Now()
+	probed := 0
+	for _, file := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+
+		root := c.library.Root(file.Path)
+		if root == nil {
+			continue
+		}
+		meta, err := ProbeFile(root.FullPath(file.Path))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		c.mu.Lock()
+		if current, ok := c.entries[file.Path]; ok && current.Size == file.Size && current.ModTime.Equal(file.ModTime) {
+			c.metadata[file.Path] = metadataEntry{modTime: file.ModTime, size: file.Size, meta: meta}
+			if meta != nil {
+				probed++
+			}
+		}
+		c.mu.Unlock()
+	}
+	log.Printf("Catalog read metadata of %d of %d files (%v)", probed, len(pending), time.Since(start))
+}
+
+// Subscribe registers for catalog change events. The returned function
+// must be called to unsubscribe. Events are dropped for subscribers that
+// do not keep up.
+func (c *Catalog) Subscribe() (<-chan CatalogEvent, func()) {
+	ch := make(chan CatalogEvent, 64)
+
+	c.subMu.Lock()
+	c.subscribers[ch] = struct{}{}
+	c.subMu.Unlock()
+
+	return ch, func() {
+		c.subMu.Lock()
+		delete(c.subscribers, ch)
+		c.subMu.Unlock()
+	}
+}
+
+// publish delivers events to all subscribers without blocking
+func (c *Catalog) publish(events []CatalogEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	for _, event := range events {
+		for ch := range c.subscribers {
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+	}
+}
+
+// diffEntries returns the events that turn old into new
+func diffEntries(old, new map[string]FileInfo) []CatalogEvent {
+	var events []CatalogEvent
+	now := time.Now()
+
+	for p, n := range new {
+		o, ok := old[p]
+		switch {
+		case !ok:
+			events = append(events, CatalogEvent{Op: EventCreate, Path: p, IsDir: n.IsDir, Time: now})
+		case o.IsDir != n.IsDir || o.Size != n.Size || !o.ModTime.Equal(n.ModTime):
+			events = append(events, CatalogEvent{Op: EventModify, Path: p, IsDir: n.IsDir, Time: now})
+		}
+	}
+	for p, o := range old {
+		if _, ok := new[p]; !ok {
+			events = append(events, CatalogEvent{Op: EventRemove, Path: p, IsDir: o.IsDir, Time: now})
+		}
+	}
+
+	return events
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeTestFiles creates the named files below dir, with their parent
+// directories. Names ending in a slash are created as directories.
+func writeTestFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(full, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listNames returns the names in a catalog directory listing
+func listNames(t *testing.T, c *Catalog, urlPath string) []string {
+	t.Helper()
+	files, ok := c.List(urlPath)
+	if !ok {
+		t.Fatalf("List(%q) not indexed", urlPath)
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// drainEvents returns the pending events of a subscription as sorted
+// "op path" strings
+func drainEvents(ch <-chan CatalogEvent) []string {
+	var events []string
+	for {
+		select {
+		case e := <-ch:
+			events = append(events, e.Op+" "+e.Path)
+		default:
+			sort.Strings(events)
+			return events
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// twoRootCatalog creates a scanned catalog of a library with the roots
+// "movies" and "music"
+func twoRootCatalog(t *testing.T) (*Catalog, string, string) {
+	t.Helper()
+	movies, music := t.TempDir(), t.TempDir()
+	writeTestFiles(t, movies, "a.mp4", "sub/b.mkv")
+	writeTestFiles(t, music, "song.mp3")
+
+	library := NewLibrary(MediaConfig{Roots: []MediaRootConfig{
+		{Name: "movies", Directory: movies},
+		{Name: "music", Directory: music},
+	}})
+	c := NewCatalog(library, NewMediaTypes(nil, nil), false)
+	if err := c.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	return c, movies, music
+}
+
+func TestCatalogScan(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "b.mp4", "A.mkv", "sub/c.mp3", "empty/", ".hidden", ".cache/x.mp4", trashDirName+"/old.mp4")
+	c := NewCatalog(NewLibrary(MediaConfig{Directory: dir}), NewMediaTypes(nil, nil), false)
+
+	if c.Ready() {
+		t.Fatal("Ready() before the first scan")
+	}
+	if _, ok := c.List("/"); ok {
+		t.Fatal("List(/) indexed before the first scan")
+	}
+	if err := c.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Ready() {
+		t.Fatal("Ready() = false after a scan")
+	}
+
+	listings := []struct {
+		dir  string
+		want []string
+	}{
+		{"/", []string{"empty", "sub", "A.mkv", "b.mp4"}},
+		{"/sub", []string{"c.mp3"}},
+		{"/empty", []string{}},
+	}
+	for _, l := range listings {
+		if got := listNames(t, c, l.dir); !equalStrings(got, l.want) {
+			t.Errorf("List(%q) = %v, want %v", l.dir, got, l.want)
+		}
+	}
+	for _, p := range []string{"/.hidden", "/.cache/x.mp4", "/" + trashDirName} {
+		if _, ok := c.Lookup(p); ok {
+			t.Errorf("Lookup(%q) found a hidden path", p)
+		}
+	}
+	if file, ok := c.Lookup("/sub/c.mp3"); !ok || file.IsDir || file.Size != int64(len("sub/c.mp3")) {
+		t.Errorf("Lookup(/sub/c.mp3) = %+v, %v", file, ok)
+	}
+
+	stats := c.Stats()
+	if stats.Files != 3 || stats.Directories != 3 || !stats.Ready || stats.LastScan.IsZero() {
+		t.Errorf("Stats() = %+v, want 3 files in 3 directories", stats)
+	}
+
+	// A rescan publishes the differences from the previous scan
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+	if err := os.Remove(filepath.Join(dir, "b.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, dir, "d.mp3")
+	if err := c.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"create /d.mp3", "remove /b.mp4"}
+	if got := drainEvents(events); !equalStrings(got, want) {
+		t.Errorf("Scan() events = %v, want %v", got, want)
+	}
+}
+
+func TestCatalogScanMissingRoot(t *testing.T) {
+	movies := t.TempDir()
+	writeTestFiles(t, movies, "a.mp4")
+	library := NewLibrary(MediaConfig{Roots: []MediaRootConfig{
+		{Name: "movies", Directory: movies},
+		{Name: "gone", Directory: filepath.Join(movies, "missing")},
+	}})
+	c := NewCatalog(library, NewMediaTypes(nil, nil), false)
+	if err := c.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := listNames(t, c, "/"), []string{"movies"}; !equalStrings(got, want) {
+		t.Errorf("List(/) = %v, want %v", got, want)
+	}
+	if got, want := listNames(t, c, "/movies"), []string{"a.mp4"}; !equalStrings(got, want) {
+		t.Errorf("List(/movies) = %v, want %v", got, want)
+	}
+}
+
+func TestCatalogScanRoot(t *testing.T) {
+	c, movies, music := twoRootCatalog(t)
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	// Change both roots on disk, but rescan only the movies
+	writeTestFiles(t, movies, "c.mp4")
+	if err := os.RemoveAll(filepath.Join(movies, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, music, "new.mp3")
+
+	if err := c.ScanRoot(c.library.Roots()[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := listNames(t, c, "/movies"), []string{"a.mp4", "c.mp4"}; !equalStrings(got, want) {
+		t.Errorf("List(/movies) = %v, want %v", got, want)
+	}
+	if got, want := listNames(t, c, "/music"), []string{"song.mp3"}; !equalStrings(got, want) {
+		t.Errorf("List(/music) = %v, want %v", got, want)
+	}
+	if got, want := listNames(t, c, "/"), []string{"movies", "music"}; !equalStrings(got, want) {
+		t.Errorf("List(/) = %v, want %v", got, want)
+	}
+	if _, ok := c.List("/movies/sub"); ok {
+		t.Error("List(/movies/sub) still indexed after removal")
+	}
+
+	want := []string{"create /movies/c.mp4", "remove /movies/sub", "remove /movies/sub/b.mkv"}
+	if got := drainEvents(events); !equalStrings(got, want) {
+		t.Errorf("ScanRoot() events = %v, want %v", got, want)
+	}
+}
+
+func TestCatalogRefresh(t *testing.T) {
+	tests := []struct {
+		name       string
+		change     func(t *testing.T, movies string)
+		path       string
+		wantEvents []string
+		wantMovies []string
+	}{
+		{
+			name:       "new file",
+			change:     func(t *testing.T, movies string) { writeTestFiles(t, movies, "c.mp4") },
+			path:       "/movies/c.mp4",
+			wantEvents: []string{"create /movies/c.mp4"},
+			wantMovies: []string{"sub", "a.mp4", "c.mp4"},
+		},
+		{
+			name:       "new directory",
+			change:     func(t *testing.T, movies string) { writeTestFiles(t, movies, "new/x.mp4", "new/deep/y.mp4") },
+			path:       "/movies/new",
+			wantEvents: []string{"create /movies/new", "create /movies/new/deep", "create /movies/new/deep/y.mp4", "create /movies/new/x.mp4"},
+			wantMovies: []string{"new", "sub", "a.mp4"},
+		},
+		{
+			name: "removed directory",
+			change: func(t *testing.T, movies string) {
+				if err := os.RemoveAll(filepath.Join(movies, "sub")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			path:       "/movies/sub",
+			wantEvents: []string{"remove /movies/sub", "remove /movies/sub/b.mkv"},
+			wantMovies: []string{"a.mp4"},
+		},
+		{
+			name: "modified file",
+			change: func(t *testing.T, movies string) {
+				if err := os.WriteFile(filepath.Join(movies, "a.mp4"), []byte("longer contents"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			path:       "/movies/a.mp4",
+			wantEvents: []string{"modify /movies/a.mp4"},
+			wantMovies: []string{"sub", "a.mp4"},
+		},
+		{
+			name:       "hidden file",
+			change:     func(t *testing.T, movies string) { writeTestFiles(t, movies, ".hidden") },
+			path:       "/movies/.hidden",
+			wantMovies: []string{"sub", "a.mp4"},
+		},
+		{
+			name:       "mount point",
+			change:     func(t *testing.T, movies string) {},
+			path:       "/movies",
+			wantMovies: []string{"sub", "a.mp4"},
+		},
+		{
+			name:       "unknown root",
+			change:     func(t *testing.T, movies string) {},
+			path:       "/other/a.mp4",
+			wantMovies: []string{"sub", "a.mp4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, movies, _ := twoRootCatalog(t)
+			events, unsubscribe := c.Subscribe()
+			defer unsubscribe()
+
+			tt.change(t, movies)
+			c.Refresh(tt.path)
+
+			if got := drainEvents(events); !equalStrings(got, tt.wantEvents) {
+				t.Errorf("Refresh(%q) events = %v, want %v", tt.path, got, tt.wantEvents)
+			}
+			if got := listNames(t, c, "/movies"); !equalStrings(got, tt.wantMovies) {
+				t.Errorf("List(/movies) = %v, want %v", got, tt.wantMovies)
+			}
+		})
+	}
+}
+
+func TestWatcherRefreshesItsRoot(t *testing.T) {
+	c, movies, music := twoRootCatalog(t)
+	roots := c.library.Roots()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		NewWatcher(c, roots[0], 0).Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// A change below another root must not show up through this watcher
+	writeTestFiles(t, music, "other.mp3")
+	time.Sleep(2 * watchDebounce)
+	writeTestFiles(t, movies, "watched.mp4")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := c.Lookup("/movies/watched.mp4"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watcher did not pick up /movies/watched.mp4")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, ok := c.Lookup("/music/other.mp3"); ok {
+		t.Error("watcher of /movies indexed /music/other.mp3")
+	}
+}
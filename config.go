@@ -1,31 +1,236 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"mime"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 )
 
 // Config holds the application configuration
 type Config struct {
-	Server ServerConfig `yaml:"server"`
-	Media  MediaConfig  `yaml:"media"`
+	Server     ServerConfig    `yaml:"server"`
+	Media      MediaConfig     `yaml:"media"`
+	Index      IndexConfig     `yaml:"index"`
+	Auth       AuthConfig      `yaml:"auth"`
+	Data       DataConfig      `yaml:"data"`
+	Share      ShareConfig     `yaml:"share"`
+	Thumbnails ThumbnailConfig `yaml:"thumbnails"`
+	HLS        HLSConfig       `yaml:"hls"`
+	DASH       DASHConfig      `yaml:"dash"`
+	Player     PlayerConfig    `yaml:"player"`
+	Progress   ProgressConfig  `yaml:"progress"`
+	Playlists  PlaylistConfig  `yaml:"playlists"`
+	DLNA       DLNAConfig      `yaml:"dlna"`
+	WebDAV     WebDAVConfig    `yaml:"webdav"`
+	Uploads    UploadConfig    `yaml:"uploads"`
+	Files      FilesConfig     `yaml:"file_management"`
 }
 
-// ServerConfig holds server-related configuration
+// ServerConfig holds server-related configuration. CORSOrigins lists the
+// web origins that may call the server from a browser; when it is empty
+// any origin may, unless authentication is enabled, in which case none may.
 type ServerConfig struct {
-	Port int    `yaml:"port"`
-	Host string `yaml:"host"`
+	Port            int           `yaml:"port"`
+	Host            string        `yaml:"host"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	Timeouts        TimeoutConfig `yaml:"timeouts"`
+	TLS             TLSConfig     `yaml:"tls"`
+	CORSOrigins     []string      `yaml:"cors_origins"`
 }
 
-// MediaConfig holds media directory configuration
+// TimeoutConfig holds HTTP timeouts. Write applies to pages and API
+// responses; media streams instead use StreamIdle, the longest time a
+// stream may go without the client accepting more data.
+type TimeoutConfig struct {
+	ReadHeader time.Duration `yaml:"read_header"`
+	Read       time.Duration `yaml:"read"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+	StreamIdle time.Duration `yaml:"stream_idle"`
+}
+
+// TLSConfig holds HTTPS configuration
+type TLSConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	SelfSigned   bool     `yaml:"self_signed"`
+	Hosts        []string `yaml:"hosts"`
+	RedirectPort int      `yaml:"redirect_port"`
+}
+
+// MediaConfig holds media directory configuration. The library is either
+// a single Directory served at the top level, or a list of Roots, each
+// shown as a top-level folder.
 type MediaConfig struct {
+	Directory string            `yaml:"directory"`
+	Roots     []MediaRootConfig `yaml:"roots"`
+	Symlinks  SymlinkPolicy     `yaml:"symlinks"`
+	MimeTypes map[string]string `yaml:"mime_types"`
+	Types     []MediaTypeConfig `yaml:"types"`
+}
+
+// MediaRootConfig defines a named root of the media library. A read-only
+// root cannot be changed through WebDAV, uploads or file management.
+// ShowHidden lists hidden files. Symlinks overrides the library's symlink
+// policy for the root. When Users is set, only those users may access the
+// root.
+type MediaRootConfig struct {
+	Name       string        `yaml:"name"`
+	Directory  string        `yaml:"directory"`
+	ReadOnly   bool          `yaml:"read_only"`
+	ShowHidden bool          `yaml:"show_hidden"`
+	Symlinks   SymlinkPolicy `yaml:"symlinks"`
+	Users      []string      `yaml:"users"`
+}
+
+// MediaTypeConfig defines a category of the media type registry. Files
+// belong to the first category whose MIME types match their detected type,
+// or whose extensions match when the type is unknown. Extensions map to
+// the MIME type served for them; an empty type uses the system MIME table.
+type MediaTypeConfig struct {
+	Name       string            `yaml:"name"`
+	Label      string            `yaml:"label"`
+	Icon       string            `yaml:"icon"`
+	Class      string            `yaml:"class"`
+	MimeTypes  []string          `yaml:"mime_types"`
+	Extensions map[string]string `yaml:"extensions"`
+}
+
+// IndexConfig holds media library indexer configuration
+type IndexConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	RescanInterval time.Duration `yaml:"rescan_interval"`
+	Watch          bool          `yaml:"watch"`
+	PollInterval   time.Duration `yaml:"poll_interval"`
+	Metadata       bool          `yaml:"metadata"`
+}
+
+// AuthConfig holds authentication configuration
+type AuthConfig struct {
+	Enabled bool         `yaml:"enabled"`
+	Realm   string       `yaml:"realm"`
+	Users   []UserConfig `yaml:"users"`
+}
+
+// UserConfig holds a user's credentials. PasswordHash is a bcrypt hash
+// as generated by the -hash-password flag.
+type UserConfig struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"`
+}
+
+// DataConfig holds the location of persistent server state
+type DataConfig struct {
 	Directory string `yaml:"directory"`
 }
 
+// ShareConfig holds share link configuration
+type ShareConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	SigningKey    string        `yaml:"signing_key"`
+	DefaultExpiry time.Duration `yaml:"default_expiry"`
+	MaxExpiry     time.Duration `yaml:"max_expiry"`
+}
+
+// ThumbnailConfig holds image thumbnail configuration. CacheSize is the
+// disk space, in megabytes, the cached thumbnails may take up before the
+// least recently used ones are removed.
+type ThumbnailConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	CacheDirectory string `yaml:"cache_directory"`
+	CacheSize      int    `yaml:"cache_size_mb"`
+	DefaultWidth   int    `yaml:"default_width"`
+	MaxWidth       int    `yaml:"max_width"`
+	Quality        int    `yaml:"quality"`
+}
+
+// HLSConfig holds HLS packaging configuration. CacheSize is the memory,
+// in megabytes, used to cache segment plans and generated segments.
+type HLSConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	SegmentDuration time.Duration `yaml:"segment_duration"`
+	CacheSize       int           `yaml:"cache_size_mb"`
+}
+
+// DASHConfig holds MPEG-DASH manifest configuration
+type DASHConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// PlayerConfig holds in-browser player configuration
+type PlayerConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// PlaylistConfig holds folder playlist configuration
+type PlaylistConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// ProgressConfig holds watch progress configuration. Positions are stored
+// in the data directory.
+type ProgressConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// DLNAConfig holds UPnP/DLNA media server configuration. FriendlyName is
+// the name shown on TVs and receivers. UUID identifies the device; when
+// empty a stable one is derived from the host name and media directory.
+// Networks lists the CIDRs DLNA is served to, by default the subnets of
+// the host's interfaces. Most TVs cannot authenticate, so with
+// AllowUnauthenticated those clients may use DLNA without credentials.
+type DLNAConfig struct {
+	Enabled              bool     `yaml:"enabled"`
+	FriendlyName         string   `yaml:"friendly_name"`
+	UUID                 string   `yaml:"uuid"`
+	AllowUnauthenticated bool     `yaml:"allow_unauthenticated"`
+	Networks             []string `yaml:"networks"`
+}
+
+// WebDAVConfig holds WebDAV access configuration. In read-only mode the
+// library can be browsed and downloaded but not modified.
+type WebDAVConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	ReadOnly bool `yaml:"read_only"`
+}
+
+// UploadConfig holds resumable upload configuration. Sizes and quotas are
+// in megabytes, where zero means unlimited; UserQuotas overrides Quota for
+// individual users. AllowedTypes lists the media type names or extensions
+// that may be uploaded, allowing any file when empty. Incomplete uploads
+// are kept in StagingDirectory until they expire.
+type UploadConfig struct {
+	Enabled          bool           `yaml:"enabled"`
+	StagingDirectory string         `yaml:"staging_directory"`
+	MaxFileSize      int            `yaml:"max_file_size_mb"`
+	Quota            int            `yaml:"quota_mb"`
+	UserQuotas       map[string]int `yaml:"user_quotas_mb"`
+	AllowedTypes     []string       `yaml:"allowed_types"`
+	Expiry           time.Duration  `yaml:"expiry"`
+}
+
+// FilesConfig holds file management configuration, which requires
+// authentication so that every change is attributed to a user. Deleted
+// files are moved to a trash folder and removed for good after
+// TrashRetention. Every operation, and every completed upload, is
+// appended to AuditLog.
+type FilesConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	TrashRetention time.Duration `yaml:"trash_retention"`
+	AuditLog       string        `yaml:"audit_log"`
+}
+
 // LoadConfig loads configuration from a YAML file
 func LoadConfig(configPath string) (*Config, error) {
 	data, err := os.ReadFile(configPath)
@@ -45,9 +250,73 @@ func LoadConfig(configPath string) (*Config, error) {
 	if config.Server.Port == 0 {
 		config.Server.Port = 8080
 	}
-	if config.Media.Directory == "" {
+	if config.Server.ShutdownTimeout == 0 {
+		config.Server.ShutdownTimeout = 15 * time.Second
+	}
+	config.Server.Timeouts.applyDefaults()
+	if config.Media.Directory == "" && len(config.Media.Roots) == 0 {
 		config.Media.Directory = "./media"
 	}
+	if config.Media.Symlinks == "" {
+		config.Media.Symlinks = SymlinksWithinRoot
+	}
+	if len(config.Media.Types) == 0 {
+		config.Media.Types = defaultMediaTypes()
+	}
+	if config.Auth.Realm == "" {
+		config.Auth.Realm = "HTTP Media Server"
+	}
+	if config.Data.Directory == "" {
+		config.Data.Directory = "./data"
+	}
+	if config.Server.TLS.CertFile == "" {
+		config.Server.TLS.CertFile = filepath.Join(config.Data.Directory, "tls", "cert.pem")
+	}
+	if config.Server.TLS.KeyFile == "" {
+		config.Server.TLS.KeyFile = filepath.Join(config.Data.Directory, "tls", "key.pem")
+	}
+	if config.Share.DefaultExpiry == 0 {
+		config.Share.DefaultExpiry = 24 * time.Hour
+	}
+	if config.Share.MaxExpiry == 0 {
+		config.Share.MaxExpiry = 30 * 24 * time.Hour
+	}
+	if config.Thumbnails.CacheDirectory == "" {
+		config.Thumbnails.CacheDirectory = filepath.Join(config.Data.Directory, "thumbnails")
+	}
+	if config.Thumbnails.CacheSize == 0 {
+		config.Thumbnails.CacheSize = 1024
+	}
+	if config.Thumbnails.DefaultWidth == 0 {
+		config.Thumbnails.DefaultWidth = 256
+	}
+	if config.Thumbnails.MaxWidth == 0 {
+		config.Thumbnails.MaxWidth = 1024
+	}
+	if config.Thumbnails.Quality == 0 {
+		config.Thumbnails.Quality = 80
+	}
+	if config.HLS.SegmentDuration == 0 {
+		config.HLS.SegmentDuration = 6 * time.Second
+	}
+	if config.HLS.CacheSize == 0 {
+		config.HLS.CacheSize = 256
+	}
+	if config.Uploads.StagingDirectory == "" {
+		config.Uploads.StagingDirectory = filepath.Join(config.Data.Directory, "uploads")
+	}
+	if config.Uploads.Expiry == 0 {
+		config.Uploads.Expiry = 24 * time.Hour
+	}
+	if config.Files.TrashRetention == 0 {
+		config.Files.TrashRetention = 30 * 24 * time.Hour
+	}
+	if config.Files.AuditLog == "" {
+		config.Files.AuditLog = filepath.Join(config.Data.Directory, "audit.log")
+	}
+	if config.DLNA.FriendlyName == "" {
+		config.DLNA.FriendlyName = "HTTP Media Server"
+	}
 
 	// Validate configuration
 	if err := config.Validate(); err != nil {
@@ -59,13 +328,92 @@ func LoadConfig(configPath string) (*Config, error) {
 
 // CreateDefaultConfig creates a default configuration file
 func CreateDefaultConfig(configPath string) error {
+	signingKey, err := generateSigningKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate share signing key: %w", err)
+	}
+
 	defaultConfig := Config{
 		Server: ServerConfig{
-			Port: 8080,
-			Host: "0.0.0.0",
+			Port:            8080,
+			Host:            "0.0.0.0",
+			ShutdownTimeout: 15 * time.Second,
+			Timeouts:        defaultTimeouts(),
+			TLS: TLSConfig{
+				Enabled:    false,
+				SelfSigned: true,
+				Hosts:      []string{},
+			},
 		},
 		Media: MediaConfig{
 			Directory: "./media",
+			Symlinks:  SymlinksWithinRoot,
+			Types:     defaultMediaTypes(),
+		},
+		Index: IndexConfig{
+			Enabled:        true,
+			RescanInterval: 10 * time.Minute,
+			Watch:          true,
+			PollInterval:   30 * time.Second,
+			Metadata:       true,
+		},
+		Auth: AuthConfig{
+			Enabled: false,
+			Realm:   "HTTP Media Server",
+			Users:   []UserConfig{},
+		},
+		Data: DataConfig{
+			Directory: "./data",
+		},
+		Share: ShareConfig{
+			Enabled:       true,
+			SigningKey:    signingKey,
+			DefaultExpiry: 24 * time.Hour,
+			MaxExpiry:     30 * 24 * time.Hour,
+		},
+		Thumbnails: ThumbnailConfig{
+			Enabled:      true,
+			CacheSize:    1024,
+			DefaultWidth: 256,
+			MaxWidth:     1024,
+			Quality:      80,
+		},
+		HLS: HLSConfig{
+			Enabled:         true,
+			SegmentDuration: 6 * time.Second,
+			CacheSize:       256,
+		},
+		DASH: DASHConfig{
+			Enabled: true,
+		},
+		Player: PlayerConfig{
+			Enabled: true,
+		},
+		Progress: ProgressConfig{
+			Enabled: true,
+		},
+		Playlists: PlaylistConfig{
+			Enabled: true,
+		},
+		DLNA: DLNAConfig{
+			Enabled:      false,
+			FriendlyName: "HTTP Media Server",
+		},
+		WebDAV: WebDAVConfig{
+			Enabled:  true,
+			ReadOnly: true,
+		},
+		Uploads: UploadConfig{
+			Enabled:      false,
+			MaxFileSize:  0,
+			Quota:        0,
+			UserQuotas:   map[string]int{},
+			AllowedTypes: []string{"video", "audio", "image", "subtitle"},
+			Expiry:       24 * time.Hour,
+		},
+		Files: FilesConfig{
+			Enabled:        false,
+			TrashRetention: 30 * 24 * time.Hour,
 		},
 	}
 
@@ -92,51 +440,280 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("host cannot be empty")
 	}
 
+	if c.Server.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid shutdown timeout: %s (must not be negative)", c.Server.ShutdownTimeout)
+	}
+
+	timeouts := c.Server.Timeouts
+	if timeouts.ReadHeader < 0 || timeouts.Read < 0 || timeouts.Write < 0 || timeouts.Idle < 0 || timeouts.StreamIdle < 0 {
+		return fmt.Errorf("server timeouts must not be negative")
+	}
+
+	if c.Server.TLS.RedirectPort < 0 || c.Server.TLS.RedirectPort > 65535 {
+		return fmt.Errorf("invalid redirect port number: %d (must be between 1-65535)", c.Server.TLS.RedirectPort)
+	}
+	if c.Server.TLS.Enabled && c.Server.TLS.RedirectPort == c.Server.Port {
+		return fmt.Errorf("redirect port must differ from the HTTPS port %d", c.Server.Port)
+	}
+	for _, origin := range c.Server.CORSOrigins {
+		if origin == "*" {
+			if c.Auth.Enabled {
+				return fmt.Errorf("invalid CORS origin: %q (not allowed with authentication)", origin)
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("invalid CORS origin: %q (must be a scheme and host such as https://example.com)", origin)
+		}
+	}
+
 	// Validate media configuration
-	if c.Media.Directory == "" {
+	if c.Media.Directory == "" && len(c.Media.Roots) == 0 {
 		return fmt.Errorf("media directory cannot be empty")
 	}
+	if c.Media.Directory != "" && len(c.Media.Roots) > 0 {
+		return fmt.Errorf("media directory and media roots cannot both be configured")
+	}
+	if !c.Media.Symlinks.valid() {
+		return fmt.Errorf("invalid symlink policy: %q (must be %s, %s or %s)",
+			c.Media.Symlinks, SymlinksDeny, SymlinksWithinRoot, SymlinksAllowAll)
+	}
+	roots := make(map[string]bool)
+	for i, root := range c.Media.Roots {
+		if !validFileName(root.Name) {
+			return fmt.Errorf("invalid name for media root %d: %q (must be a visible folder name)", i+1, root.Name)
+		}
+		if roots[root.Name] {
+			return fmt.Errorf("media root %q is configured more than once", root.Name)
+		}
+		roots[root.Name] = true
+		if root.Directory == "" {
+			return fmt.Errorf("media root %q: directory cannot be empty", root.Name)
+		}
+		if root.Symlinks != "" && !root.Symlinks.valid() {
+			return fmt.Errorf("invalid symlink policy for media root %q: %q (must be %s, %s or %s)",
+				root.Name, root.Symlinks, SymlinksDeny, SymlinksWithinRoot, SymlinksAllowAll)
+		}
+		if len(root.Users) > 0 && !c.Auth.Enabled {
+			return fmt.Errorf("media root %q restricts users but authentication is disabled", root.Name)
+		}
+		for _, user := range root.Users {
+			known := false
+			for _, configured := range c.Auth.Users {
+				known = known || configured.Username == user
+			}
+			if !known {
+				return fmt.Errorf("media root %q: unknown user %q", root.Name, user)
+			}
+		}
+	}
 
-	// Check if media directory path is valid
-	if _, err := os.Stat(c.Media.Directory); err != nil {
-		if os.IsNotExist(err) {
-			// Directory doesn't exist, but that's okay - we'll create it
-			return nil
+	// Validate index configuration
+	if c.Index.RescanInterval < 0 {
+		return fmt.Errorf("invalid rescan interval: %s (must not be negative)", c.Index.RescanInterval)
+	}
+	if c.Index.PollInterval < 0 {
+		return fmt.Errorf("invalid poll interval: %s (must not be negative)", c.Index.PollInterval)
+	}
+
+	// Validate authentication configuration
+	if c.Auth.Enabled && len(c.Auth.Users) == 0 {
+		return fmt.Errorf("authentication is enabled but no users are configured")
+	}
+	seen := make(map[string]bool)
+	for i, user := range c.Auth.Users {
+		if user.Username == "" {
+			return fmt.Errorf("auth user %d: username cannot be empty", i+1)
+		}
+		if seen[user.Username] {
+			return fmt.Errorf("auth user %q is configured more than once", user.Username)
+		}
+		seen[user.Username] = true
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return fmt.Errorf("auth user %q: invalid bcrypt password hash: %w", user.Username, err)
+		}
+	}
+
+	// Validate share configuration
+	if c.Share.Enabled && len(c.Share.SigningKey) < 32 {
+		return fmt.Errorf("share signing key must be at least 32 characters")
+	}
+	if c.Share.DefaultExpiry < 0 || c.Share.MaxExpiry < 0 {
+		return fmt.Errorf("share expiry durations must not be negative")
+	}
+	if c.Share.DefaultExpiry > c.Share.MaxExpiry {
+		return fmt.Errorf("share default expiry %s exceeds max expiry %s", c.Share.DefaultExpiry, c.Share.MaxExpiry)
+	}
+
+	// Validate thumbnail configuration
+	if c.Thumbnails.DefaultWidth < 1 || c.Thumbnails.MaxWidth < 1 {
+		return fmt.Errorf("thumbnail widths must be positive")
+	}
+	if c.Thumbnails.DefaultWidth > c.Thumbnails.MaxWidth {
+		return fmt.Errorf("thumbnail default width %d exceeds max width %d", c.Thumbnails.DefaultWidth, c.Thumbnails.MaxWidth)
+	}
+	if c.Thumbnails.CacheSize < 0 {
+		return fmt.Errorf("invalid thumbnail cache size: %d (must not be negative)", c.Thumbnails.CacheSize)
+	}
+	if c.Thumbnails.Quality < 1 || c.Thumbnails.Quality > 100 {
+		return fmt.Errorf("invalid thumbnail quality: %d (must be between 1 and 100)", c.Thumbnails.Quality)
+	}
+
+	// Validate HLS configuration
+	if c.HLS.SegmentDuration < time.Second {
+		return fmt.Errorf("invalid HLS segment duration: %s (must be at least 1s)", c.HLS.SegmentDuration)
+	}
+	if c.HLS.CacheSize < 0 {
+		return fmt.Errorf("invalid HLS cache size: %d (must not be negative)", c.HLS.CacheSize)
+	}
+
+	// Validate DLNA configuration
+	if c.DLNA.UUID != "" && !dlnaUUIDPattern.MatchString(c.DLNA.UUID) {
+		return fmt.Errorf("invalid DLNA UUID: %q (must be formatted as xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx)", c.DLNA.UUID)
+	}
+	for _, network := range c.DLNA.Networks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("invalid DLNA network: %q (must be a CIDR such as 192.168.1.0/24)", network)
+		}
+	}
+
+	// Validate upload configuration
+	if c.Uploads.MaxFileSize < 0 || c.Uploads.Quota < 0 {
+		return fmt.Errorf("upload size limits must not be negative")
+	}
+	for user, quota := range c.Uploads.UserQuotas {
+		if quota < 0 {
+			return fmt.Errorf("invalid upload quota for %q: %d (must not be negative)", user, quota)
+		}
+	}
+	if c.Uploads.Expiry < 0 {
+		return fmt.Errorf("invalid upload expiry: %s (must not be negative)", c.Uploads.Expiry)
+	}
+	for _, t := range c.Uploads.AllowedTypes {
+		if strings.HasPrefix(t, ".") {
+			if t == "." {
+				return fmt.Errorf("invalid allowed upload type: empty extension")
+			}
+			continue
+		}
+		known := false
+		for _, category := range c.Media.Types {
+			known = known || category.Name == t
+		}
+		if !known {
+			return fmt.Errorf("invalid allowed upload type: %q (must be a media type name or an extension such as .mkv)", t)
+		}
+	}
+
+	// Validate file management configuration
+	if c.Files.Enabled && !c.Auth.Enabled {
+		return fmt.Errorf("file management requires authentication to be enabled")
+	}
+	if c.Files.TrashRetention < 0 {
+		return fmt.Errorf("invalid trash retention: %s (must not be negative)", c.Files.TrashRetention)
+	}
+
+	// Validate MIME type overrides
+	for ext, mimeType := range c.Media.MimeTypes {
+		if strings.TrimPrefix(ext, ".") == "" {
+			return fmt.Errorf("invalid MIME type override: empty extension")
+		}
+		if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+			return fmt.Errorf("invalid MIME type for %s: %q", ext, mimeType)
+		}
+	}
+
+	// Validate media type registry
+	categories := make(map[string]bool)
+	for i, category := range c.Media.Types {
+		if category.Name == "" {
+			return fmt.Errorf("media type %d: name cannot be empty", i+1)
+		}
+		if category.Name == "directory" || category.Name == "other" {
+			return fmt.Errorf("invalid media type name: %q (reserved for search filters)", category.Name)
+		}
+		if categories[category.Name] {
+			return fmt.Errorf("media type %q is configured more than once", category.Name)
+		}
+		categories[category.Name] = true
+		for _, pattern := range category.MimeTypes {
+			if _, _, err := mime.ParseMediaType(strings.TrimSuffix(pattern, "*") + "x"); err != nil {
+				return fmt.Errorf("media type %q: invalid MIME type pattern %q", category.Name, pattern)
+			}
+		}
+		for ext, mimeType := range category.Extensions {
+			if strings.TrimPrefix(ext, ".") == "" {
+				return fmt.Errorf("media type %q: empty extension", category.Name)
+			}
+			if mimeType == "" {
+				continue
+			}
+			if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+				return fmt.Errorf("media type %q: invalid MIME type for %s: %q", category.Name, ext, mimeType)
+			}
+		}
+	}
+
+	// Check if media directory paths are valid
+	for _, dir := range c.MediaDirectories() {
+		if _, err := os.Stat(dir); err != nil && !os.IsNotExist(err) {
+			// Missing directories are fine - we'll create them
+			return fmt.Errorf("media directory is not accessible: %w", err)
 		}
-		return fmt.Errorf("media directory is not accessible: %w", err)
 	}
 
 	return nil
 }
 
-// GetAbsMediaPath returns the absolute path of the media directory
-func (c *Config) GetAbsMediaPath() (string, error) {
-	absPath, err := filepath.Abs(c.Media.Directory)
-	if err != nil {
-		return "", fmt.Errorf("failed to get absolute path for media directory: %w", err)
+// MediaDirectories returns the directories of the media library
+func (c *Config) MediaDirectories() []string {
+	if len(c.Media.Roots) == 0 {
+		return []string{c.Media.Directory}
+	}
+	dirs := make([]string, len(c.Media.Roots))
+	for i, root := range c.Media.Roots {
+		dirs[i] = root.Directory
 	}
-	return absPath, nil
+	return dirs
 }
 
-// IsValidMediaPath checks if a given path is within the media directory
-func (c *Config) IsValidMediaPath(requestPath string) (bool, error) {
-	absMediaPath, err := c.GetAbsMediaPath()
-	if err != nil {
-		return false, err
+// defaultTimeouts returns the default HTTP timeouts
+func defaultTimeouts() TimeoutConfig {
+	return TimeoutConfig{
+		ReadHeader: 10 * time.Second,
+		Read:       30 * time.Second,
+		Write:      30 * time.Second,
+		Idle:       120 * time.Second,
+		StreamIdle: 60 * time.Second,
 	}
+}
 
-	// Clean the request path and join with media directory
-	cleanPath := filepath.Clean(requestPath)
-	if cleanPath == "." || cleanPath == "/" {
-		return true, nil
+// applyDefaults fills in unset timeouts with their default values
+func (t *TimeoutConfig) applyDefaults() {
+	defaults := defaultTimeouts()
+	if t.ReadHeader == 0 {
+		t.ReadHeader = defaults.ReadHeader
 	}
-
-	fullPath := filepath.Join(absMediaPath, cleanPath)
-	absFullPath, err := filepath.Abs(fullPath)
-	if err != nil {
-		return false, fmt.Errorf("failed to get absolute path: %w", err)
+	if t.Read == 0 {
+		t.Read = defaults.Read
+	}
+	if t.Write == 0 {
+		t.Write = defaults.Write
 	}
+	if t.Idle == 0 {
+		t.Idle = defaults.Idle
+	}
+	if t.StreamIdle == 0 {
+		t.StreamIdle = defaults.StreamIdle
+	}
+}
 
-	// Check if the path is within the media directory
-	return strings.HasPrefix(absFullPath, absMediaPath), nil
+// generateSigningKey returns a random hex-encoded key for signing share links
+func generateSigningKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
 }
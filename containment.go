@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy controls which symbolic links below a media root are
+// followed
+type SymlinkPolicy string
+
+const (
+	// SymlinksDeny refuses every path that passes through a symlink
+	SymlinksDeny SymlinkPolicy = "deny"
+
+	// SymlinksWithinRoot follows symlinks whose targets stay inside the
+	// media root
+	SymlinksWithinRoot SymlinkPolicy = "within_root"
+
+	// SymlinksAllowAll follows symlinks wherever they point
+	SymlinksAllowAll SymlinkPolicy = "allow_all"
+)
+
+// valid reports whether the policy is one of the known policies
+func (p SymlinkPolicy) valid() bool {
+	switch p {
+	case SymlinksDeny, SymlinksWithinRoot, SymlinksAllowAll:
+		return true
+	}
+	return false
+}
+
+// Contain checks that a filesystem path stays inside the root. The path
+// must be below the root's directory element by element, so a sibling
+// such as /media-secret is not inside /media, and the symlinks it passes
+// through must be allowed by the root's policy. Paths that do not exist
+// yet are checked up to their deepest existing parent. Violations are
+// reported as errForbiddenPath.
+func (root *MediaRoot) Contain(fullPath string) error {
+	dir, err := filepath.Abs(root.Directory)
+	if err != nil {
+		return err
+	}
+	absPath, err := filepath.Abs(fullPath)
+	if err != nil {
+		return err
+	}
+	if !withinDir(dir, absPath) {
+		return errForbiddenPath
+	}
+
+	switch root.Symlinks {
+	case SymlinksAllowAll:
+		return nil
+	case SymlinksDeny:
+		return containNoLinks(dir, absPath)
+	default:
+		return containLinks(dir, absPath)
+	}
+}
+
+// containNoLinks checks that no element of absPath below dir is a symlink.
+// The root directory itself may be one.
+func containNoLinks(dir, absPath string) error {
+	rel, err := filepath.Rel(dir, absPath)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	current := dir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			// The rest of the path does not exist, so it holds no links
+			return nil
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return errForbiddenPath
+		}
+	}
+	return nil
+}
+
+// containLinks checks that absPath still resolves inside dir once all
+// symlinks are followed. The root directory itself may be a symlink.
+func containLinks(dir, absPath string) error {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	for current := absPath; ; current = filepath.Dir(current) {
+		real, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			if !withinDir(realDir, real) {
+				return errForbiddenPath
+			}
+			return nil
+		}
+
+		// A dangling link could still be created through, wherever it
+		// points, so it is refused rather than treated as missing
+		if info, lerr := os.Lstat(current); lerr == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return errForbiddenPath
+		}
+		if current == dir {
+			return err
+		}
+	}
+}
+
+// withinDir reports whether path is dir or below it. Both must be clean
+// absolute paths; the comparison is made on whole path elements.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
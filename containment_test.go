@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// containmentTree creates a media directory next to a sibling whose name
+// shares its prefix:
+//
+//	media/sub/f.txt
+//	media/in     -> sub
+//	media/out    -> ../media-secret
+//	media/dangle -> missing (outside the root)
+//	media-secret/s.txt
+//	medialink    -> media
+func containmentTree(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+
+	for _, dir := range []string{"media/sub", "media-secret"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"media/sub/f.txt", "media-secret/s.txt"} {
+		if err := os.WriteFile(filepath.Join(base, file), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"media/in":     "sub",
+		"media/out":    "../media-secret",
+		"media/dangle": filepath.Join(base, "missing"),
+		"medialink":    "media",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, link)); err != nil {
+			t.Skipf("symlinks are not supported: %v", err)
+		}
+	}
+	return base
+}
+
+func TestMediaRootContain(t *testing.T) {
+	base := containmentTree(t)
+
+	tests := []struct {
+		name   string
+		root   string
+		path   string
+		policy SymlinkPolicy
+		want   error
+	}{
+		{"root itself", "media", "media", SymlinksDeny, nil},
+		{"plain file", "media", "media/sub/f.txt", SymlinksDeny, nil},
+		{"missing file", "media", "media/sub/new/file.txt", SymlinksDeny, nil},
+		{"sibling prefix", "media", "media-secret/s.txt", SymlinksAllowAll, errForbiddenPath},
+		{"sibling prefix directory", "media", "media-secret", SymlinksAllowAll, errForbiddenPath},
+		{"dot-dot escape", "media", "media/../media-secret/s.txt", SymlinksAllowAll, errForbiddenPath},
+		{"dot-dot to parent", "media", "media/sub/../..", SymlinksAllowAll, errForbiddenPath},
+		{"dot-dot staying inside", "media", "media/sub/../sub/f.txt", SymlinksDeny, nil},
+
+		{"inner link denied", "media", "media/in/f.txt", SymlinksDeny, errForbiddenPath},
+		{"inner link within root", "media", "media/in/f.txt", SymlinksWithinRoot, nil},
+		{"inner link allowed", "media", "media/in/f.txt", SymlinksAllowAll, nil},
+
+		{"escaping link denied", "media", "media/out/s.txt", SymlinksDeny, errForbiddenPath},
+		{"escaping link within root", "media", "media/out/s.txt", SymlinksWithinRoot, errForbiddenPath},
+		{"escaping link directory within root", "media", "media/out", SymlinksWithinRoot, errForbiddenPath},
+		{"escaping link allowed", "media", "media/out/s.txt", SymlinksAllowAll, nil},
+
+		{"dangling link denied", "media", "media/dangle", SymlinksDeny, errForbiddenPath},
+		{"dangling link within root", "media", "media/dangle", SymlinksWithinRoot, errForbiddenPath},
+		{"below dangling link within root", "media", "media/dangle/new.txt", SymlinksWithinRoot, errForbiddenPath},
+		{"dangling link allowed", "media", "media/dangle", SymlinksAllowAll, nil},
+
+		{"linked root denied", "medialink", "medialink/sub/f.txt", SymlinksDeny, nil},
+		{"linked root within root", "medialink", "medialink/in/f.txt", SymlinksWithinRoot, nil},
+		{"linked root escaping link", "medialink", "medialink/out/s.txt", SymlinksWithinRoot, errForbiddenPath},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := &MediaRoot{Directory: filepath.Join(base, tt.root), Mount: "/", Symlinks: tt.policy}
+			err := root.Contain(filepath.Join(base, tt.path))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Contain(%q) with %s = %v, want %v", tt.path, tt.policy, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithinDir(t *testing.T) {
+	tests := []struct {
+		dir, path string
+		want      bool
+	}{
+		{"/media", "/media", true},
+		{"/media", "/media/a", true},
+		{"/media", "/media/a/b", true},
+		{"/media", "/media-secret", false},
+		{"/media", "/media-secret/a", false},
+		{"/media", "/medi", false},
+		{"/media", "/", false},
+		{"/media", "/other/media", false},
+		{"/media", "/media/..secret", true},
+	}
+
+	for _, tt := range tests {
+		if got := withinDir(tt.dir, tt.path); got != tt.want {
+			t.Errorf("withinDir(%q, %q) = %v, want %v", tt.dir, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestResolveMediaPath(t *testing.T) {
+	base := containmentTree(t)
+	mediaDir := filepath.Join(base, "media")
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		policy   SymlinkPolicy
+		wantPath string
+		wantErr  error
+	}{
+		{"top level", "/", SymlinksWithinRoot, "/", nil},
+		{"file", "/sub/f.txt", SymlinksWithinRoot, "/sub/f.txt", nil},
+		{"dot-dot is clamped to the root", "/../media-secret/s.txt", SymlinksWithinRoot, "/media-secret/s.txt", nil},
+		{"encoded dot-dot is clamped to the root", "/%2e%2e/media-secret/s.txt", SymlinksWithinRoot, "/media-secret/s.txt", nil},
+		{"encoded slashes are clamped to the root", "/sub%2f..%2f..%2f..%2fetc%2fpasswd", SymlinksWithinRoot, "/etc/passwd", nil},
+		{"inner link", "/in/f.txt", SymlinksWithinRoot, "/in/f.txt", nil},
+		{"inner link denied", "/in/f.txt", SymlinksDeny, "", errForbiddenPath},
+		{"escaping link", "/out/s.txt", SymlinksWithinRoot, "", errForbiddenPath},
+		{"encoded escaping link", "/%6fut/s.txt", SymlinksWithinRoot, "", errForbiddenPath},
+		{"escaping link allowed", "/out/s.txt", SymlinksAllowAll, "/out/s.txt", nil},
+		{"dangling link", "/dangle", SymlinksWithinRoot, "", errForbiddenPath},
+		{"invalid encoding", "/%zz", SymlinksWithinRoot, "", errInvalidPath},
+		{"hidden file", "/sub/.hidden", SymlinksWithinRoot, "", errHiddenPath},
+		{"trash", "/.trash/id/f.txt", SymlinksWithinRoot, "", errHiddenPath},
+		{"encoded trash", "/%2etrash", SymlinksWithinRoot, "", errHiddenPath},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &MediaServer{library: NewLibrary(MediaConfig{Directory: mediaDir, Symlinks: tt.policy})}
+			r := httptest.NewRequest("GET", "/", nil)
+
+			cleanPath, fullPath, err := s.resolvePath(r, tt.urlPath)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolvePath(%q) error = %v, want %v", tt.urlPath, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cleanPath != tt.wantPath {
+				t.Errorf("resolvePath(%q) path = %q, want %q", tt.urlPath, cleanPath, tt.wantPath)
+			}
+			if fullPath != mediaDir && !strings.HasPrefix(fullPath, mediaDir+string(filepath.Separator)) {
+				t.Errorf("resolvePath(%q) = %q, outside %q", tt.urlPath, fullPath, mediaDir)
+			}
+		})
+	}
+}
+
+func TestResolveMediaPathRoots(t *testing.T) {
+	base := containmentTree(t)
+	s := &MediaServer{library: NewLibrary(MediaConfig{
+		Symlinks: SymlinksWithinRoot,
+		Roots: []MediaRootConfig{
+			{Name: "media", Directory: filepath.Join(base, "media")},
+			{Name: "secret", Directory: filepath.Join(base, "media-secret"), Symlinks: SymlinksDeny},
+			{Name: "linked", Directory: filepath.Join(base, "media"), Symlinks: SymlinksAllowAll},
+		},
+	})}
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		wantPath string
+		wantErr  error
+	}{
+		{"virtual top level", "/", "/", nil},
+		{"root", "/media", "/media", nil},
+		{"sibling mount prefix", "/media-secret/s.txt", "", errUnknownRoot},
+		{"dot-dot into another root", "/media/../secret/s.txt", "/secret/s.txt", nil},
+		{"dot-dot out of the library", "/media/../../etc/passwd", "", errUnknownRoot},
+		{"root policy", "/media/out/s.txt", "", errForbiddenPath},
+		{"root policy override", "/linked/out/s.txt", "/linked/out/s.txt", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleanPath, _, err := s.resolveMediaPath(tt.urlPath)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolveMediaPath(%q) error = %v, want %v", tt.urlPath, err, tt.wantErr)
+			}
+			if err == nil && cleanPath != tt.wantPath {
+				t.Errorf("resolveMediaPath(%q) path = %q, want %q", tt.urlPath, cleanPath, tt.wantPath)
+			}
+		})
+	}
+}
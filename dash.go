@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dashCacheSize bounds the memory used to cache parsed fragment indexes
+const dashCacheSize = 32 << 20
+
+var errNoDASH = errors.New("DASH manifests are only supported for MP4 files")
+
+// DASHPackager generates MPEG-DASH manifests for MP4 files. Fragmented
+// files are described as byte ranges of the original file, which clients
+// fetch through the regular file path. Progressive files are described
+// using the segments generated by the HLS packager.
+type DASHPackager struct {
+	cache *lruCache
+}
+
+// dashIndex is the parsed structure of one fragmented source file
+type dashIndex struct {
+	modTime   time.Time
+	size      int64
+	movie     *mp4Movie
+	initSize  int64
+	timescale uint32
+	fragments []mp4Fragment
+}
+
+// NewDASHPackager creates a DASH manifest generator
+func NewDASHPackager() *DASHPackager {
+	return &DASHPackager{cache: newLRUCache(dashCacheSize)}
+}
+
+// Index returns the fragment index of a fragmented MP4 file, reusing the
+// cached index while the file is unchanged. It returns a nil index for
+// progressive files.
+func (p *DASHPackager) Index(file io.ReaderAt, fullPath string, info fs.FileInfo) (*dashIndex, error) {
+	key := fullPath
+	if cached, ok := p.cache.Get(key); ok {
+		idx := cached.(*dashIndex)
+		if idx.modTime.Equal(info.ModTime()) && idx.size == info.Size() {
+			return idx, nil
+		}
+	}
+
+	movie, err := parseMP4(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if !movie.fragmented {
+		return nil, nil
+	}
+
+	track := referenceTrack(movie.tracks)
+	if track == nil {
+		return nil, fmt.Errorf("%w: no audio or video tracks", errNoDASH)
+	}
+	fragments, err := readFragments(file, movie, track)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &dashIndex{
+		modTime:   info.ModTime(),
+		size:      info.Size(),
+		movie:     movie,
+		timescale: track.timescale,
+		fragments: fragments,
+	}
+	for _, box := range movie.boxes {
+		if box.typ == "moov" {
+			idx.initSize = box.offset + box.size
+			break
+		}
+	}
+
+	p.cache.Add(key, idx, int64(len(fragments))*32+int64(len(movie.mvhd)))
+	return idx, nil
+}
+
+// referenceTrack returns the track that segment timing is based on: the
+// first video track, or the first audio track for audio-only files
+func referenceTrack(tracks []*mp4Track) *mp4Track {
+	var audio *mp4Track
+	for _, track := range tracks {
+		switch track.handler {
+		case "vide":
+			return track
+		case "soun":
+			if audio == nil {
+				audio = track
+			}
+		}
+	}
+	return audio
+}
+
+// MPD document structure, limited to what the generated manifests use
+type dashMPD struct {
+	XMLName       xml.Name          `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Type          string            `xml:"type,attr"`
+	Profiles      string            `xml:"profiles,attr"`
+	MinBuffer     string            `xml:"minBufferTime,attr"`
+	Duration      string            `xml:"mediaPresentationDuration,attr"`
+	AdaptationSet dashAdaptationSet `xml:"Period>AdaptationSet"`
+}
+
+type dashAdaptationSet struct {
+	MimeType         string             `xml:"mimeType,attr"`
+	SegmentAlignment bool               `xml:"segmentAlignment,attr"`
+	Representation   dashRepresentation `xml:"Representation"`
+}
+
+type dashRepresentation struct {
+	ID          string          `xml:"id,attr"`
+	Codecs      string          `xml:"codecs,attr,omitempty"`
+	Bandwidth   int64           `xml:"bandwidth,attr"`
+	Width       uint32          `xml:"width,attr,omitempty"`
+	Height      uint32          `xml:"height,attr,omitempty"`
+	BaseURL     string          `xml:"BaseURL"`
+	SegmentList dashSegmentList `xml:"SegmentList"`
+}
+
+type dashSegmentList struct {
+	Timescale      uint32         `xml:"timescale,attr"`
+	Initialization dashURL        `xml:"Initialization"`
+	Timeline       []dashTimeline `xml:"SegmentTimeline>S"`
+	Segments       []dashURL      `xml:"SegmentURL"`
+}
+
+// dashURL is used for both Initialization and SegmentURL elements
+type dashURL struct {
+	SourceURL  string `xml:"sourceURL,attr,omitempty"`
+	Range      string `xml:"range,attr,omitempty"`
+	Media      string `xml:"media,attr,omitempty"`
+	MediaRange string `xml:"mediaRange,attr,omitempty"`
+}
+
+// dashTimeline is a run of Repeat+1 segments of equal duration
+type dashTimeline struct {
+	Start    uint64 `xml:"t,attr"`
+	Duration uint64 `xml:"d,attr"`
+	Repeat   int    `xml:"r,attr,omitempty"`
+}
+
+// dashSpan is the start and duration of a segment
+type dashSpan struct {
+	start    uint64
+	duration uint64
+}
+
+// newDASHManifest builds a static manifest with a single representation
+// holding all packaged tracks
+func newDASHManifest(tracks []*mp4Track, timescale uint32, spans []dashSpan, mediaBytes int64) *dashMPD {
+	var total uint64
+	for _, span := range spans {
+		total += span.duration
+	}
+	seconds := float64(total) / float64(timescale)
+
+	mimeType := "audio/mp4"
+	var codecs []string
+	rep := dashRepresentation{ID: "0"}
+	for _, track := range tracks {
+		if track.handler != "vide" && track.handler != "soun" {
+			continue
+		}
+		if track.handler == "vide" {
+			mimeType = "video/mp4"
+			rep.Width, rep.Height = track.width, track.height
+		}
+		if codec := track.codec(); codec != "" {
+			codecs = append(codecs, codec)
+		}
+	}
+	rep.Codecs = strings.Join(codecs, ",")
+	if seconds > 0 {
+		rep.Bandwidth = int64(float64(mediaBytes*8) / seconds)
+	}
+
+	rep.SegmentList.Timescale = timescale
+	for _, span := range spans {
+		if n := len(rep.SegmentList.Timeline); n > 0 {
+			last := &rep.SegmentList.Timeline[n-1]
+			if last.Duration == span.duration && last.Start+uint64(last.Repeat+1)*last.Duration == span.start {
+				last.Repeat++
+				continue
+			}
+		}
+		rep.SegmentList.Timeline = append(rep.SegmentList.Timeline, dashTimeline{Start: span.start, Duration: span.duration})
+	}
+
+	return &dashMPD{
+		Type:      "static",
+		Profiles:  "urn:mpeg:dash:profile:isoff-main:2011",
+		MinBuffer: "PT2S",
+		Duration:  fmt.Sprintf("PT%.3fS", seconds),
+		AdaptationSet: dashAdaptationSet{
+			MimeType:         mimeType,
+			SegmentAlignment: true,
+			Representation:   rep,
+		},
+	}
+}
+
+// manifest describes a fragmented file as byte ranges of the file itself
+func (idx *dashIndex) manifest(fileURL string) *dashMPD {
+	spans := make([]dashSpan, len(idx.fragments))
+	var mediaBytes int64
+	for i, fragment := range idx.fragments {
+		spans[i] = dashSpan{start: fragment.start, duration: fragment.duration}
+		mediaBytes += fragment.size
+	}
+
+	mpd := newDASHManifest(idx.movie.tracks, idx.timescale, spans, mediaBytes)
+	list := &mpd.AdaptationSet.Representation.SegmentList
+	mpd.AdaptationSet.Representation.BaseURL = fileURL
+	list.Initialization = dashURL{Range: byteRange(0, idx.initSize)}
+	for _, fragment := range idx.fragments {
+		list.Segments = append(list.Segments, dashURL{MediaRange: byteRange(fragment.offset, fragment.size)})
+	}
+	return mpd
+}
+
+// dashManifest describes a progressive file using its HLS segments
+func (idx *hlsIndex) dashManifest(hlsURL string) *dashMPD {
+	ref := idx.tracks[0]
+	spans := make([]dashSpan, len(idx.segments))
+	var mediaBytes int64
+	for i, segment := range idx.segments {
+		first, last := segment.ranges[0][0], segment.ranges[0][1]
+		end := ref.endTime()
+		if last < len(ref.samples) {
+			end = ref.samples[last].dts
+		}
+		spans[i] = dashSpan{start: ref.samples[first].dts, duration: end - ref.samples[first].dts}
+	}
+	for _, track := range idx.tracks {
+		for _, sample := range track.samples {
+			mediaBytes += int64(sample.size)
+		}
+	}
+
+	mpd := newDASHManifest(idx.tracks, ref.timescale, spans, mediaBytes)
+	list := &mpd.AdaptationSet.Representation.SegmentList
+	mpd.AdaptationSet.Representation.BaseURL = hlsURL
+	list.Initialization = dashURL{SourceURL: "init.mp4"}
+	for i := range idx.segments {
+		list.Segments = append(list.Segments, dashURL{Media: fmt.Sprintf("seg-%d.m4s", i)})
+	}
+	return mpd
+}
+
+// byteRange formats an inclusive HTTP byte range
+func byteRange(offset, size int64) string {
+	return fmt.Sprintf("%d-%d", offset, offset+size-1)
+}
+
+// handleDASH serves /dash/<path>/manifest.mpd
+func (s *MediaServer) handleDASH(w http.ResponseWriter, r *http.Request) {
+	if s.dash == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dir, name := path.Split(strings.TrimPrefix(r.URL.Path, "/dash"))
+	if name != "manifest.mpd" {
+		http.NotFound(w, r)
+		return
+	}
+	cleanPath, fullPath, err := s.resolvePath(r, strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+	if !hlsExtensions[strings.ToLower(filepath.Ext(fullPath))] {
+		http.Error(w, errNoDASH.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	idx, err := s.dash.Index(file, fullPath, info)
+	var mpd *dashMPD
+	switch {
+	case err != nil:
+	case idx != nil:
+		mpd = idx.manifest(escapeURLPath(cleanPath))
+	case s.hls == nil:
+		err = fmt.Errorf("%w: progressive MP4 files require HLS packaging to be enabled", errNoDASH)
+	default:
+		var hlsIdx *hlsIndex
+		hlsIdx, err = s.hls.Index(file, fullPath, info)
+		if err == nil {
+			mpd = hlsIdx.dashManifest("/hls" + escapeURLPath(cleanPath) + "/")
+		}
+	}
+	if err != nil {
+		if errors.Is(err, errNotMP4) || errors.Is(err, errNoDASH) || errors.Is(err, errNoHLS) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		log.Printf("DASH: failed to index %s: %v", fullPath, err)
+		http.Error(w, "Unable to package file", http.StatusUnprocessableEntity)
+		return
+	}
+
+	data, err := xml.MarshalIndent(mpd, "", "  ")
+	if err != nil {
+		log.Printf("DASH: failed to encode manifest for %s: %v", fullPath, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	data = append([]byte(xml.Header), data...)
+
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", s.cacheControl(time.Hour))
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(data))
+}
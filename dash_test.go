@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testFragment builds a moof box for track 1 starting at start, with
+// samples of the given durations, followed by an mdat box of mdatSize
+// bytes
+func testFragment(start uint32, mdatSize int, durations ...uint32) []byte {
+	trun := u32s(trunSampleDuration, uint32(len(durations)))
+	trun = append(trun, u32s(durations...)...)
+	moof := testBox("moof", testBox("traf",
+		testBox("tfhd", u32s(0, 1)),
+		testBox("tfdt", u32s(0, start)),
+		testBox("trun", trun),
+	))
+	return append(moof, testBox("mdat", make([]byte, mdatSize))...)
+}
+
+// testFragmentedFile builds a fragmented MP4 file from an empty
+// progressive movie header followed by the given fragments
+func testFragmentedFile(fragments ...[]byte) []byte {
+	file := testTrackFile(nil, testBox("stco", u32s(0, 0)))
+	for _, fragment := range fragments {
+		file = append(file, fragment...)
+	}
+	return file
+}
+
+func TestReadFragments(t *testing.T) {
+	header := testFragmentedFile()
+	first := testFragment(0, 100, 1000, 1000)
+	styp := testBox("styp", []byte("msdh"))
+	second := testFragment(2000, 50, 1000)
+	otherTrack := testBox("moof", testBox("traf", testBox("tfhd", u32s(0, 2)), testBox("trun", u32s(0, 1))))
+	otherMdat := testBox("mdat", make([]byte, 10))
+	data := testFragmentedFile(first, styp, second, otherTrack, otherMdat)
+
+	movie, err := parseMP4(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !movie.fragmented {
+		t.Fatal("parseMP4() did not detect fragments")
+	}
+	fragments, err := readFragments(bytes.NewReader(data), movie, movie.tracks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secondStart := int64(len(header) + len(first))
+	want := []mp4Fragment{
+		{offset: int64(len(header)), size: int64(len(first)), start: 0, duration: 2000},
+		// The styp box belongs to the following fragment, and the
+		// fragment without samples of the track is merged into it
+		{offset: secondStart, size: int64(len(data)) - secondStart, start: 2000, duration: 1000},
+	}
+	if len(fragments) != len(want) {
+		t.Fatalf("readFragments() = %+v, want %+v", fragments, want)
+	}
+	for i := range want {
+		if fragments[i] != want[i] {
+			t.Errorf("fragment %d = %+v, want %+v", i, fragments[i], want[i])
+		}
+	}
+
+	if _, err := readFragments(bytes.NewReader(header), &mp4Movie{}, movie.tracks[0]); err == nil {
+		t.Error("readFragments() of a file without fragments succeeded")
+	}
+}
+
+func TestHandleDASH(t *testing.T) {
+	dir := t.TempDir()
+	fragmented := testFragmentedFile(
+		testFragment(0, 100, 1000, 1000),
+		testFragment(2000, 100, 1000, 1000),
+		testFragment(4000, 40, 1000),
+	)
+	files := map[string][]byte{
+		"fragmented.mp4":  fragmented,
+		"progressive.mp4": testTrackFile([]uint32{10, 20, 30}, testBox("stco", u32s(0, 1, 24))),
+		"broken.mp4":      testFragmentedFile(testBox("moof", testBox("traf", testBox("tfhd", u32s(0, 1)), testBox("trun", []byte{0, 0, 1, 5, 0, 0, 0, 1})))),
+		"notes.txt":       []byte("text"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		hls          bool
+		wantStatus   int
+		wantBaseURL  string
+		wantDuration string
+		wantTimeline []dashTimeline
+		wantSegments []dashURL
+	}{
+		{
+			name:         "fragmented file",
+			path:         "/dash/fragmented.mp4/manifest.mpd",
+			wantStatus:   http.StatusOK,
+			wantBaseURL:  "/fragmented.mp4",
+			wantDuration: "PT5.000S",
+			wantTimeline: []dashTimeline{{Start: 0, Duration: 2000, Repeat: 1}, {Start: 4000, Duration: 1000}},
+		},
+		{
+			name:         "progressive file",
+			path:         "/dash/progressive.mp4/manifest.mpd",
+			hls:          true,
+			wantStatus:   http.StatusOK,
+			wantBaseURL:  "/hls/progressive.mp4/",
+			wantDuration: "PT3.000S",
+			wantTimeline: []dashTimeline{{Start: 0, Duration: 1000, Repeat: 2}},
+			wantSegments: []dashURL{{Media: "seg-0.m4s"}, {Media: "seg-1.m4s"}, {Media: "seg-2.m4s"}},
+		},
+		{name: "progressive file without hls", path: "/dash/progressive.mp4/manifest.mpd", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "truncated trun", path: "/dash/broken.mp4/manifest.mpd", wantStatus: http.StatusUnprocessableEntity},
+		{name: "not an mp4 file", path: "/dash/notes.txt/manifest.mpd", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "missing file", path: "/dash/missing.mp4/manifest.mpd", wantStatus: http.StatusNotFound},
+		{name: "other file name", path: "/dash/fragmented.mp4/index.mpd", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &MediaServer{
+				config:  &Config{},
+				library: NewLibrary(MediaConfig{Directory: dir}),
+				types:   NewMediaTypes(nil, nil),
+				dash:    NewDASHPackager(),
+			}
+			if tt.hls {
+				s.hls = NewHLSPackager(time.Second, 1<<20)
+			}
+			w := httptest.NewRecorder()
+			s.handleDASH(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var mpd dashMPD
+			if err := xml.Unmarshal(w.Body.Bytes(), &mpd); err != nil {
+				t.Fatal(err)
+			}
+			rep := mpd.AdaptationSet.Representation
+			if rep.BaseURL != tt.wantBaseURL || mpd.AdaptationSet.MimeType != "video/mp4" || mpd.Duration != tt.wantDuration {
+				t.Errorf("manifest base URL %q, type %q, duration %q, want %q, video/mp4, %q",
+					rep.BaseURL, mpd.AdaptationSet.MimeType, mpd.Duration, tt.wantBaseURL, tt.wantDuration)
+			}
+			if len(rep.SegmentList.Timeline) != len(tt.wantTimeline) {
+				t.Fatalf("timeline = %+v, want %+v", rep.SegmentList.Timeline, tt.wantTimeline)
+			}
+			for i := range tt.wantTimeline {
+				if rep.SegmentList.Timeline[i] != tt.wantTimeline[i] {
+					t.Errorf("timeline entry %d = %+v, want %+v", i, rep.SegmentList.Timeline[i], tt.wantTimeline[i])
+				}
+			}
+			if tt.wantSegments != nil {
+				for i := range tt.wantSegments {
+					if i >= len(rep.SegmentList.Segments) || rep.SegmentList.Segments[i] != tt.wantSegments[i] {
+						t.Errorf("segments = %+v, want %+v", rep.SegmentList.Segments, tt.wantSegments)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDASHManifestByteRanges(t *testing.T) {
+	header := testFragmentedFile()
+	first := testFragment(0, 100, 1000, 1000)
+	second := testFragment(2000, 40, 1000)
+	data := testFragmentedFile(first, second)
+
+	fullPath := filepath.Join(t.TempDir(), "test.mp4")
+	if err := os.WriteFile(fullPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewDASHPackager().Index(bytes.NewReader(data), fullPath, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpd := idx.manifest("/test.mp4")
+	list := mpd.AdaptationSet.Representation.SegmentList
+
+	if want := byteRange(0, int64(len(header))); list.Initialization.Range != want {
+		t.Errorf("initialization range = %q, want %q", list.Initialization.Range, want)
+	}
+	wantRanges := []string{
+		byteRange(int64(len(header)), int64(len(first))),
+		byteRange(int64(len(header)+len(first)), int64(len(second))),
+	}
+	if len(list.Segments) != len(wantRanges) {
+		t.Fatalf("segments = %+v, want ranges %v", list.Segments, wantRanges)
+	}
+	for i, want := range wantRanges {
+		if list.Segments[i].MediaRange != want {
+			t.Errorf("segment %d range = %q, want %q", i, list.Segments[i].MediaRange, want)
+		}
+	}
+	if mpd.Duration != "PT3.000S" {
+		t.Errorf("duration = %q, want PT3.000S", mpd.Duration)
+	}
+}
@@ -0,0 +1,941 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// UPnP device and service types of the DLNA media server
+const (
+	dlnaDeviceType            = "urn:schemas-upnp-org:device:MediaServer:1"
+	dlnaContentDirectoryType  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	dlnaConnectionManagerType = "urn:schemas-upnp-org:service:ConnectionManager:1"
+)
+
+const (
+	// dlnaRootID is the object ID of the media directory; its parent is "-1"
+	dlnaRootID = "0"
+
+	// dlnaStreamingFlags marks audio and video as streamable with range
+	// requests, for DLNA 1.5 renderers
+	dlnaStreamingFlags = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+
+	// dlnaInteractiveFlags marks images as interactive transfers
+	dlnaInteractiveFlags = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=00D00000000000000000000000000000"
+)
+
+// dlnaUUIDPattern matches a configured device UUID
+var dlnaUUIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// dlnaClasses maps player kinds to the UPnP classes of their items
+var dlnaClasses = map[string]string{
+	"video": "object.item.videoItem",
+	"audio": "object.item.audioItem.musicTrack",
+	"image": "object.item.imageItem.photo",
+}
+
+// DLNAServer holds the state of the UPnP/DLNA media server. The
+// ContentDirectory service maps the media directory onto containers and
+// items whose resources stream through /dlna/media.
+type DLNAServer struct {
+	udn          string
+	friendlyName string
+	ssdp         *SSDPAnnouncer
+
+	// networks limits the clients DLNA is served to; nil allows the
+	// subnets of the host's interfaces
+	networks             []*net.IPNet
+	allowUnauthenticated bool
+
+	// updateID is the ContentDirectory SystemUpdateID, bumped on every
+	// catalog change so that control points refresh their views
+	updateID atomic.Uint32
+}
+
+// NewDLNAServer creates the DLNA media server for a configuration
+func NewDLNAServer(config *Config) *DLNAServer {
+	uuid := config.DLNA.UUID
+	if uuid == "" {
+		uuid = deriveDeviceUUID(config.MediaDirectories())
+	}
+
+	scheme := "http"
+	if config.Server.TLS.Enabled {
+		scheme = "https"
+	}
+
+	d := &DLNAServer{
+		udn:                  "uuid:" + strings.ToLower(uuid),
+		friendlyName:         config.DLNA.FriendlyName,
+		allowUnauthenticated: config.DLNA.AllowUnauthenticated,
+	}
+	for _, network := range config.DLNA.Networks {
+		if _, ipNet, err := net.ParseCIDR(network); err == nil {
+			d.networks = append(d.networks, ipNet)
+		}
+	}
+	d.ssdp = NewSSDPAnnouncer(d.udn, scheme, config.Server.Port, "/dlna/device.xml")
+	d.ssdp.allows = d.allowsIP
+	d.updateID.Store(uint32(time.Now().Unix()))
+	return d
+}
+
+// allowsClient reports whether a request comes directly from a client on
+// one of the DLNA networks. Requests relayed by a reverse proxy carry
+// forwarding headers and are refused, since their remote address is the
+// proxy's rather than the client's.
+func (d *DLNAServer) allowsClient(r *http.Request) bool {
+	for _, header := range []string{"Forwarded", "X-Forwarded-For", "X-Real-Ip"} {
+		if r.Header.Get(header) != "" {
+			return false
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return d.allowsIP(net.ParseIP(host))
+}
+
+// allowsIP reports whether an address is on one of the DLNA networks
+func (d *DLNAServer) allowsIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	networks := d.networks
+	if networks == nil {
+		networks = localNetworks()
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveDeviceUUID returns a UUID that stays the same across restarts for
+// a host and its media directories, so control points keep recognizing
+// the server
+func deriveDeviceUUID(mediaDirs []string) string {
+	hostname, _ := os.Hostname()
+	key := hostname
+	for _, mediaDir := range mediaDirs {
+		if abs, err := filepath.Abs(mediaDir); err == nil {
+			mediaDir = abs
+		}
+		key += "\x00" + mediaDir
+	}
+	sum := sha1.Sum([]byte(key))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// Run announces the server until ctx is cancelled, tracking catalog
+// changes when an index is available
+func (d *DLNAServer) Run(ctx context.Context, catalog *Catalog) {
+	if catalog != nil {
+		go func() {
+			events, unsubscribe := catalog.Subscribe()
+			defer unsubscribe()
+			for {
+				select {
+				case <-events:
+					d.updateID.Add(1)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	d.ssdp.Run(ctx)
+}
+
+// handleDLNA serves the UPnP device and service descriptions, SOAP
+// control, event subscriptions and media streams under /dlna/. Renderers
+// cannot authenticate, so these paths bypass authentication and are
+// instead limited to clients on the local network.
+func (s *MediaServer) handleDLNA(w http.ResponseWriter, r *http.Request) {
+	if s.dlna == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.dlna.allowsClient(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch p := strings.TrimPrefix(r.URL.Path, "/dlna"); {
+	case strings.HasPrefix(p, "/media/"):
+		s.serveDLNAMedia(w, r, strings.TrimPrefix(p, "/media"))
+	case p == "/device.xml":
+		s.serveDLNADescription(w, r, s.dlnaDeviceDescription())
+	case p == "/ContentDirectory.xml":
+		s.serveDLNADescription(w, r, contentDirectorySCPD)
+	case p == "/ConnectionManager.xml":
+		s.serveDLNADescription(w, r, connectionManagerSCPD)
+	case p == "/control/ContentDirectory":
+		s.serveSOAP(w, r, dlnaContentDirectoryType, s.contentDirectoryAction)
+	case p == "/control/ConnectionManager":
+		s.serveSOAP(w, r, dlnaConnectionManagerType, s.connectionManagerAction)
+	case strings.HasPrefix(p, "/event/"):
+		handleDLNAEvent(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveDLNADescription writes a device or service description document
+func (s *MediaServer) serveDLNADescription(w http.ResponseWriter, r *http.Request, doc string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(doc)))
+	if r.Method == http.MethodGet {
+		io.WriteString(w, doc)
+	}
+}
+
+// serveDLNAMedia streams a file with the DLNA transfer headers renderers
+// expect, then hands off to serveFile for range requests
+func (s *MediaServer) serveDLNAMedia(w http.ResponseWriter, r *http.Request, urlPath string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, fullPath, err := s.resolvePath(r, urlPath)
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	kind := playerKind(s.types.TypeOf(fullPath, info))
+	transferMode := "Streaming"
+	if kind == "image" {
+		transferMode = "Interactive"
+	}
+	switch mode := r.Header.Get("transferMode.dlna.org"); mode {
+	case "Streaming", "Interactive", "Background":
+		transferMode = mode
+	}
+
+	w.Header().Set("transferMode.dlna.org", transferMode)
+	w.Header().Set("contentFeatures.dlna.org", dlnaContentFeatures(kind))
+	s.serveFile(w, r, fullPath, info)
+}
+
+// handleDLNAEvent accepts event subscriptions. The server sends no events;
+// control points poll SystemUpdateID instead.
+func handleDLNAEvent(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("SID")
+		if sid == "" {
+			buf := make([]byte, 16)
+			rand.Read(buf)
+			sid = "uuid:" + hex.EncodeToString(buf)
+		}
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", fmt.Sprintf("Second-%d", ssdpMaxAge))
+	case "UNSUBSCRIBE":
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// dlnaContentFeatures returns the DLNA content features of a player kind
+func dlnaContentFeatures(kind string) string {
+	if kind == "image" {
+		return dlnaInteractiveFlags
+	}
+	return dlnaStreamingFlags
+}
+
+// dlnaDeviceDescription returns the root device description
+func (s *MediaServer) dlnaDeviceDescription() string {
+	return xml.Header + `<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>` + dlnaDeviceType + `</deviceType>
+    <friendlyName>` + xmlEscape(s.dlna.friendlyName) + `</friendlyName>
+    <manufacturer>HTTP Media Server</manufacturer>
+    <modelName>HTTP Media Server</modelName>
+    <modelNumber>2.0.0</modelNumber>
+    <UDN>` + s.dlna.udn + `</UDN>
+    <dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+    <serviceList>
+      <service>
+        <serviceType>` + dlnaContentDirectoryType + `</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>/dlna/ContentDirectory.xml</SCPDURL>
+        <controlURL>/dlna/control/ContentDirectory</controlURL>
+        <eventSubURL>/dlna/event/ContentDirectory</eventSubURL>
+      </service>
+      <service>
+        <serviceType>` + dlnaConnectionManagerType + `</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>/dlna/ConnectionManager.xml</SCPDURL>
+        <controlURL>/dlna/control/ConnectionManager</controlURL>
+        <eventSubURL>/dlna/event/ConnectionManager</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>
+`
+}
+
+// soapEnvelope is a SOAP request carrying one UPnP action
+type soapEnvelope struct {
+	Body struct {
+		Action struct {
+			XMLName xml.Name
+			Args    []soapArg `xml:",any"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// soapArg is an input or output argument of a UPnP action
+type soapArg struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// soapAction handles one UPnP action, returning its output arguments in
+// order
+type soapAction func(r *http.Request, action string, args map[string]string) ([]soapArg, error)
+
+// upnpError is a UPnP action failure, returned as a SOAP fault
+type upnpError struct {
+	code        int
+	description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.code, e.description)
+}
+
+// UPnP error codes used by the services
+var (
+	errInvalidAction   = &upnpError{401, "Invalid Action"}
+	errInvalidArgs     = &upnpError{402, "Invalid Args"}
+	errNoSuchObject    = &upnpError{701, "No such object"}
+	errNoSuchContainer = &upnpError{710, "No such container"}
+)
+
+// newArg returns an output argument
+func newArg(name string, value interface{}) soapArg {
+	return soapArg{XMLName: xml.Name{Local: name}, Value: fmt.Sprint(value)}
+}
+
+// serveSOAP decodes a UPnP control request, runs the action and writes the
+// response envelope or a SOAP fault
+func (s *MediaServer) serveSOAP(w http.ResponseWriter, r *http.Request, serviceType string, handle soapAction) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var envelope soapEnvelope
+	if err := xml.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&envelope); err != nil {
+		http.Error(w, "Invalid SOAP request", http.StatusBadRequest)
+		return
+	}
+	action := envelope.Body.Action.XMLName.Local
+	args := make(map[string]string, len(envelope.Body.Action.Args))
+	for _, arg := range envelope.Body.Action.Args {
+		args[arg.XMLName.Local] = arg.Value
+	}
+
+	out, err := handle(r, action, args)
+	if err != nil {
+		upnpErr, ok := err.(*upnpError)
+		if !ok {
+			log.Printf("DLNA %s failed: %v", action, err)
+			upnpErr = &upnpError{501, "Action Failed"}
+		}
+		writeSOAP(w, http.StatusInternalServerError, `<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+			`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+			fmt.Sprintf("<errorCode>%d</errorCode><errorDescription>%s</errorDescription>", upnpErr.code, upnpErr.description)+
+			`</UPnPError></detail></s:Fault>`)
+		return
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, `<u:%sResponse xmlns:u="%s">`, action, serviceType)
+	for _, arg := range out {
+		fmt.Fprintf(&body, "<%s>%s</%s>", arg.XMLName.Local, xmlEscape(arg.Value), arg.XMLName.Local)
+	}
+	fmt.Fprintf(&body, "</u:%sResponse>", action)
+	writeSOAP(w, http.StatusOK, body.String())
+}
+
+// writeSOAP writes a SOAP envelope around body
+func writeSOAP(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header+`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+
+		body+`</s:Body></s:Envelope>`)
+}
+
+// connectionManagerAction implements the ConnectionManager service, which
+// only reports a single output connection
+func (s *MediaServer) connectionManagerAction(r *http.Request, action string, args map[string]string) ([]soapArg, error) {
+	switch action {
+	case "GetProtocolInfo":
+		return []soapArg{newArg("Source", "http-get:*:*:*"), newArg("Sink", "")}, nil
+	case "GetCurrentConnectionIDs":
+		return []soapArg{newArg("ConnectionIDs", "0")}, nil
+	case "GetCurrentConnectionInfo":
+		if args["ConnectionID"] != "0" {
+			return nil, &upnpError{706, "Invalid connection reference"}
+		}
+		return []soapArg{
+			newArg("RcsID", -1),
+			newArg("AVTransportID", -1),
+			newArg("ProtocolInfo", ""),
+			newArg("PeerConnectionManager", ""),
+			newArg("PeerConnectionID", -1),
+			newArg("Direction", "Output"),
+			newArg("Status", "OK"),
+		}, nil
+	}
+	return nil, errInvalidAction
+}
+
+// contentDirectoryAction implements the ContentDirectory service
+func (s *MediaServer) contentDirectoryAction(r *http.Request, action string, args map[string]string) ([]soapArg, error) {
+	switch action {
+	case "Browse":
+		return s.dlnaBrowse(r, args)
+	case "Search":
+		return s.dlnaSearch(r, args)
+	case "GetSearchCapabilities":
+		return []soapArg{newArg("SearchCaps", "dc:title,dc:creator,upnp:class,upnp:artist,upnp:album")}, nil
+	case "GetSortCapabilities":
+		return []soapArg{newArg("SortCaps", "")}, nil
+	case "GetSystemUpdateID":
+		return []soapArg{newArg("Id", s.dlna.updateID.Load())}, nil
+	}
+	return nil, errInvalidAction
+}
+
+// dlnaBrowse returns the metadata of an object, or a page of the children
+// of a container in listing order
+func (s *MediaServer) dlnaBrowse(r *http.Request, args map[string]string) ([]soapArg, error) {
+	start, count, err := dlnaPaging(args)
+	if err != nil {
+		return nil, err
+	}
+
+	urlPath := args["ObjectID"]
+	if urlPath == dlnaRootID {
+		urlPath = "/"
+	}
+	cleanPath, fullPath, err := s.resolveUserPath("", urlPath)
+	if err != nil {
+		return nil, errNoSuchObject
+	}
+	info, err := s.statMedia(fullPath)
+	if err != nil {
+		return nil, errNoSuchObject
+	}
+
+	var objects []FileInfo
+	total := 1
+	switch args["BrowseFlag"] {
+	case "BrowseMetadata":
+		file := newFileInfo(cleanPath, fullPath, info, s.types)
+		if s.catalog != nil {
+			if indexed, ok := s.catalog.Lookup(cleanPath); ok {
+				file = indexed
+			}
+		}
+		if !file.IsDir && playerKind(file.MimeType) == "" {
+			return nil, errNoSuchObject
+		}
+		objects = []FileInfo{file}
+	case "BrowseDirectChildren":
+		if !info.IsDir() {
+			return nil, errNoSuchContainer
+		}
+		children, err := s.dlnaChildren(fullPath, cleanPath)
+		if err != nil {
+			return nil, err
+		}
+		total = len(children)
+		objects = dlnaPage(children, start, count)
+	default:
+		return nil, errInvalidArgs
+	}
+
+	result, err := s.didl(r, objects)
+	if err != nil {
+		return nil, err
+	}
+	return []soapArg{
+		newArg("Result", result),
+		newArg("NumberReturned", len(objects)),
+		newArg("TotalMatches", total),
+		newArg("UpdateID", s.dlna.updateID.Load()),
+	}, nil
+}
+
+// dlnaSearchCriterion matches one "property operator value" term of a
+// search criteria string
+var dlnaSearchCriterion = regexp.MustCompile(`([a-zA-Z]+:[a-zA-Z]+)\s+(derivedfrom|contains|=)\s+"((?:[^"\\]|\\.)*)"`)
+
+// dlnaSearch returns the media items below a container matching the search
+// criteria, sorted by path. Terms on the same property are alternatives;
+// terms on different properties must all match.
+func (s *MediaServer) dlnaSearch(r *http.Request, args map[string]string) ([]soapArg, error) {
+	start, count, err := dlnaPaging(args)
+	if err != nil {
+		return nil, err
+	}
+
+	root := args["ContainerID"]
+	if root == dlnaRootID {
+		root = "/"
+	}
+	root, fullRoot, err := s.resolveUserPath("", root)
+	if err != nil {
+		return nil, errNoSuchContainer
+	}
+	if info, err := s.statMedia(fullRoot); err != nil || !info.IsDir() {
+		return nil, errNoSuchContainer
+	}
+
+	criteria := make(map[string][]dlnaCriterion)
+	for _, match := range dlnaSearchCriterion.FindAllStringSubmatch(args["SearchCriteria"], -1) {
+		value := strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(match[3])
+		criteria[match[1]] = append(criteria[match[1]], dlnaCriterion{match[2], value})
+	}
+
+	var matches []FileInfo
+	visit := func(file FileInfo) {
+		if file.IsDir || (root != "/" && !strings.HasPrefix(file.Path, root+"/")) {
+			return
+		}
+		if !s.library.Allows("", file.Path) {
+			return
+		}
+		kind := playerKind(file.MimeType)
+		if kind == "" {
+			return
+		}
+		for property, alternatives := range criteria {
+			value := dlnaProperty(file, kind, property)
+			matched := false
+			for _, criterion := range alternatives {
+				if criterion.matches(value) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return
+			}
+		}
+		matches = append(matches, file)
+	}
+	if s.catalog != nil && s.catalog.Ready() {
+		s.catalog.Walk(visit)
+	} else {
+		s.walkMedia(fullRoot, root, visit)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return strings.ToLower(matches[i].Path) < strings.ToLower(matches[j].Path)
+	})
+	objects := dlnaPage(matches, start, count)
+
+	result, err := s.didl(r, objects)
+	if err != nil {
+		return nil, err
+	}
+	return []soapArg{
+		newArg("Result", result),
+		newArg("NumberReturned", len(objects)),
+		newArg("TotalMatches", len(matches)),
+		newArg("UpdateID", s.dlna.updateID.Load()),
+	}, nil
+}
+
+// dlnaCriterion is one search term on a property
+type dlnaCriterion struct {
+	op    string
+	value string
+}
+
+// matches reports whether a property value satisfies the criterion
+func (c dlnaCriterion) matches(value string) bool {
+	switch c.op {
+	case "derivedfrom":
+		return value == c.value || strings.HasPrefix(value, c.value+".")
+	case "contains":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(c.value))
+	}
+	return strings.EqualFold(value, c.value)
+}
+
+// dlnaProperty returns the value of a searchable property of a file
+func dlnaProperty(file FileInfo, kind, property string) string {
+	switch property {
+	case "upnp:class":
+		return dlnaClasses[kind]
+	case "dc:title":
+		return dlnaTitle(file)
+	case "dc:creator", "upnp:artist":
+		return dlnaTag(file, "artist")
+	case "upnp:album":
+		return dlnaTag(file, "album")
+	}
+	return ""
+}
+
+// dlnaChildren returns the subdirectories and playable files of a
+// directory, which are the children of its container
+func (s *MediaServer) dlnaChildren(fullPath, urlPath string) ([]FileInfo, error) {
+	files, err := s.listDirectory("", fullPath, urlPath)
+	if err != nil {
+		return nil, err
+	}
+	children := files[:0]
+	for _, file := range files {
+		if file.IsDir || playerKind(file.MimeType) != "" {
+			children = append(children, file)
+		}
+	}
+	return children, nil
+}
+
+// dlnaPaging reads the StartingIndex and RequestedCount arguments. A zero
+// count requests all remaining objects.
+func dlnaPaging(args map[string]string) (int, int, error) {
+	start, err := strconv.Atoi(defaultString(args["StartingIndex"], "0"))
+	if err != nil || start < 0 {
+		return 0, 0, errInvalidArgs
+	}
+	count, err := strconv.Atoi(defaultString(args["RequestedCount"], "0"))
+	if err != nil || count < 0 {
+		return 0, 0, errInvalidArgs
+	}
+	return start, count, nil
+}
+
+// dlnaPage returns count objects from start, or all remaining for count 0
+func dlnaPage(files []FileInfo, start, count int) []FileInfo {
+	if start >= len(files) {
+		return nil
+	}
+	files = files[start:]
+	if count > 0 && count < len(files) {
+		files = files[:count]
+	}
+	return files
+}
+
+// defaultString returns value, or fallback if value is empty
+func defaultString(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// didlLite is a DIDL-Lite document describing ContentDirectory objects
+type didlLite struct {
+	XMLName    xml.Name     `xml:"DIDL-Lite"`
+	Xmlns      string       `xml:"xmlns,attr"`
+	XmlnsDC    string       `xml:"xmlns:dc,attr"`
+	XmlnsUPnP  string       `xml:"xmlns:upnp,attr"`
+	XmlnsDLNA  string       `xml:"xmlns:dlna,attr"`
+	Containers []didlObject `xml:"container"`
+	Items      []didlObject `xml:"item"`
+}
+
+// didlObject is a container or item
+type didlObject struct {
+	ID         string    `xml:"id,attr"`
+	ParentID   string    `xml:"parentID,attr"`
+	Restricted int       `xml:"restricted,attr"`
+	ChildCount string    `xml:"childCount,attr,omitempty"`
+	Searchable string    `xml:"searchable,attr,omitempty"`
+	Title      string    `xml:"dc:title"`
+	Class      string    `xml:"upnp:class"`
+	Creator    string    `xml:"dc:creator,omitempty"`
+	Artist     string    `xml:"upnp:artist,omitempty"`
+	Album      string    `xml:"upnp:album,omitempty"`
+	Genre      string    `xml:"upnp:genre,omitempty"`
+	Date       string    `xml:"dc:date,omitempty"`
+	Res        []didlRes `xml:"res"`
+}
+
+// didlRes is the streamable resource of an item
+type didlRes struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	Size         int64  `xml:"size,attr,omitempty"`
+	Duration     string `xml:"duration,attr,omitempty"`
+	Resolution   string `xml:"resolution,attr,omitempty"`
+	URL          string `xml:",chardata"`
+}
+
+// didl describes files as DIDL-Lite containers and items
+func (s *MediaServer) didl(r *http.Request, files []FileInfo) (string, error) {
+	doc := didlLite{
+		Xmlns:     "urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/",
+		XmlnsDC:   "http://purl.org/dc/elements/1.1/",
+		XmlnsUPnP: "urn:schemas-upnp-org:metadata-1-0/upnp/",
+		XmlnsDLNA: "urn:schemas-dlna-org:metadata-1-0/",
+	}
+	base := baseURL(r)
+
+	for _, file := range files {
+		object := didlObject{
+			ID:         file.Path,
+			ParentID:   dlnaObjectID(path.Dir(file.Path)),
+			Restricted: 1,
+			Title:      dlnaTitle(file),
+		}
+		if file.Path == "/" {
+			object.ID, object.ParentID = dlnaRootID, "-1"
+		}
+
+		if file.IsDir {
+			var children []FileInfo
+			if _, fullPath, err := s.resolveMediaPath(file.Path); err == nil {
+				children, _ = s.dlnaChildren(fullPath, file.Path)
+			}
+			object.ChildCount = strconv.Itoa(len(children))
+			object.Searchable = "1"
+			object.Class = "object.container.storageFolder"
+			doc.Containers = append(doc.Containers, object)
+			continue
+		}
+
+		kind := playerKind(file.MimeType)
+		mimeType := strings.TrimSpace(strings.SplitN(file.MimeType, ";", 2)[0])
+		res := didlRes{
+			ProtocolInfo: "http-get:*:" + mimeType + ":" + dlnaContentFeatures(kind),
+			Size:         file.Size,
+			URL:          base + "/dlna/media" + escapeURLPath(file.Path),
+		}
+		object.Class = dlnaClasses[kind]
+		object.Date = file.ModTime.Format("2006-01-02")
+		if meta := file.Metadata; meta != nil {
+			if meta.Duration > 0 {
+				res.Duration = formatDIDLDuration(meta.Duration)
+			}
+			if meta.Width > 0 && meta.Height > 0 {
+				res.Resolution = fmt.Sprintf("%dx%d", meta.Width, meta.Height)
+			}
+			object.Artist = meta.Tags["artist"]
+			object.Creator = meta.Tags["artist"]
+			object.Album = meta.Tags["album"]
+			object.Genre = meta.Tags["genre"]
+		}
+		object.Res = []didlRes{res}
+		doc.Items = append(doc.Items, object)
+	}
+
+	data, err := xml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// dlnaObjectID returns the object ID of a URL path
+func dlnaObjectID(urlPath string) string {
+	if urlPath == "/" {
+		return dlnaRootID
+	}
+	return urlPath
+}
+
+// dlnaTitle returns the display title of a file, preferring its media tags
+func dlnaTitle(file FileInfo) string {
+	if file.Path == "/" {
+		return "Media"
+	}
+	if file.IsDir {
+		return file.Name
+	}
+	if title := dlnaTag(file, "title"); title != "" {
+		return title
+	}
+	return strings.TrimSuffix(file.Name, filepath.Ext(file.Name))
+}
+
+// dlnaTag returns a media tag of a file, or "" if it has none
+func dlnaTag(file FileInfo, name string) string {
+	if file.Metadata == nil {
+		return ""
+	}
+	return file.Metadata.Tags[name]
+}
+
+// formatDIDLDuration formats seconds as H:MM:SS.mmm
+func formatDIDLDuration(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// xmlEscape escapes text for inclusion in an XML document
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+const contentDirectorySCPD = xml.Header + `<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action>
+      <name>Browse</name>
+      <argumentList>
+        <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+        <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+        <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+        <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+        <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+        <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+        <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>Search</name>
+      <argumentList>
+        <argument><name>ContainerID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+        <argument><name>SearchCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SearchCriteria</relatedStateVariable></argument>
+        <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+        <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+        <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+        <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+        <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetSearchCapabilities</name>
+      <argumentList>
+        <argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetSortCapabilities</name>
+      <argumentList>
+        <argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetSystemUpdateID</name>
+      <argumentList>
+        <argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SearchCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
+
+const connectionManagerSCPD = xml.Header + `<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action>
+      <name>GetProtocolInfo</name>
+      <argumentList>
+        <argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+        <argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetCurrentConnectionIDs</name>
+      <argumentList>
+        <argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetCurrentConnectionInfo</name>
+      <argumentList>
+        <argument><name>ConnectionID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+        <argument><name>RcsID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_RcsID</relatedStateVariable></argument>
+        <argument><name>AVTransportID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_AVTransportID</relatedStateVariable></argument>
+        <argument><name>ProtocolInfo</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ProtocolInfo</relatedStateVariable></argument>
+        <argument><name>PeerConnectionManager</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionManager</relatedStateVariable></argument>
+        <argument><name>PeerConnectionID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+        <argument><name>Direction</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Direction</relatedStateVariable></argument>
+        <argument><name>Status</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionStatus</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionStatus</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>OK</allowedValue><allowedValue>ContentFormatMismatch</allowedValue><allowedValue>InsufficientBandwidth</allowedValue><allowedValue>UnreliableChannel</allowedValue><allowedValue>Unknown</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionManager</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Direction</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>Input</allowedValue><allowedValue>Output</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionID</name><dataType>i4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_AVTransportID</name><dataType>i4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_RcsID</name><dataType>i4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/xml"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDeriveDeviceUUID(t *testing.T) {
+	first := deriveDeviceUUID([]string{"/srv/media"})
+	if !dlnaUUIDPattern.MatchString(first) {
+		t.Fatalf("deriveDeviceUUID() = %q, want a UUID", first)
+	}
+	if first[14] != '5' || !strings.ContainsRune("89ab", rune(first[19])) {
+		t.Errorf("deriveDeviceUUID() = %q, want a version 5 RFC 4122 UUID", first)
+	}
+	if again := deriveDeviceUUID([]string{"/srv/media"}); again != first {
+		t.Errorf("deriveDeviceUUID() = %q, then %q, want it stable", first, again)
+	}
+	if other := deriveDeviceUUID([]string{"/srv/media", "/srv/music"}); other == first {
+		t.Errorf("deriveDeviceUUID() of other directories = %q, want it to differ", other)
+	}
+}
+
+func TestDLNAAllowsClient(t *testing.T) {
+	d := NewDLNAServer(&Config{DLNA: DLNAConfig{Networks: []string{"192.168.1.0/24", "fd00::/8"}}})
+	local := NewDLNAServer(&Config{})
+
+	tests := []struct {
+		name       string
+		server     *DLNAServer
+		remoteAddr string
+		header     string
+		want       bool
+	}{
+		{"configured network", d, "192.168.1.20:5000", "", true},
+		{"ipv6 network", d, "[fd00::1]:5000", "", true},
+		{"other network", d, "192.168.2.20:5000", "", false},
+		{"loopback outside the configured networks", d, "127.0.0.1:5000", "", false},
+		{"address without port", d, "192.168.1.20", "", true},
+		{"invalid address", d, "client:5000", "", false},
+		{"forwarded request", d, "192.168.1.20:5000", "X-Forwarded-For", false},
+		{"real ip header", d, "192.168.1.20:5000", "X-Real-IP", false},
+		{"loopback on the local networks", local, "127.0.0.1:5000", "", true},
+		{"documentation address", local, "203.0.113.5:5000", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/dlna/device.xml", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				r.Header.Set(tt.header, "10.0.0.1")
+			}
+			if got := tt.server.allowsClient(r); got != tt.want {
+				t.Errorf("allowsClient() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// dlnaTestServer serves a media directory over DLNA to the address
+// httptest requests come from
+func dlnaTestServer(t *testing.T) *MediaServer {
+	t.Helper()
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "Movies/b.mp4", "Movies/a.mkv", "Movies/notes.txt", "Music/song.mp3", "photo.jpg", ".hidden.mp4")
+	return &MediaServer{
+		config:  &Config{},
+		library: NewLibrary(MediaConfig{Directory: dir}),
+		types:   NewMediaTypes(defaultMediaTypes(), nil),
+		dlna:    NewDLNAServer(&Config{DLNA: DLNAConfig{FriendlyName: "Media & More", UUID: "0A1B2C3D-0000-4000-8000-000000000000", Networks: []string{"192.0.2.0/24"}}}),
+	}
+}
+
+// testDIDL is the part of a DIDL-Lite result the tests check
+type testDIDL struct {
+	Objects []struct {
+		XMLName    xml.Name
+		ID         string `xml:"id,attr"`
+		ParentID   string `xml:"parentID,attr"`
+		ChildCount string `xml:"childCount,attr"`
+		Title      string `xml:"title"`
+		Class      string `xml:"class"`
+		Res        struct {
+			ProtocolInfo string `xml:"protocolInfo,attr"`
+			URL          string `xml:",chardata"`
+		} `xml:"res"`
+	} `xml:",any"`
+}
+
+var upnpErrorCode = regexp.MustCompile(`<errorCode>(\d+)</errorCode>`)
+
+func TestDLNAControl(t *testing.T) {
+	s := dlnaTestServer(t)
+	browse := func(id, flag string, extra ...string) []string {
+		return append([]string{"ObjectID", id, "BrowseFlag", flag}, extra...)
+	}
+	search := func(container, criteria string) []string {
+		return []string{"ContainerID", container, "SearchCriteria", criteria}
+	}
+
+	tests := []struct {
+		name      string
+		service   string
+		action    string
+		args      []string
+		wantError string
+		wantArgs  map[string]string
+		wantIDs   []string
+		check     func(t *testing.T, result testDIDL)
+	}{
+		{
+			name:     "browse the root",
+			action:   "Browse",
+			args:     browse("0", "BrowseDirectChildren"),
+			wantArgs: map[string]string{"NumberReturned": "3", "TotalMatches": "3"},
+			wantIDs:  []string{"/Movies", "/Music", "/photo.jpg"},
+			check: func(t *testing.T, result testDIDL) {
+				movies, photo := result.Objects[0], result.Objects[2]
+				if movies.XMLName.Local != "container" || movies.ParentID != "0" || movies.ChildCount != "2" || movies.Class != "object.container.storageFolder" {
+					t.Errorf("Movies container = %+v", movies)
+				}
+				if photo.XMLName.Local != "item" || photo.Class != "object.item.imageItem.photo" || !strings.HasSuffix(photo.Res.ProtocolInfo, dlnaInteractiveFlags) {
+					t.Errorf("photo item = %+v", photo)
+				}
+			},
+		},
+		{
+			name:     "browse a page",
+			action:   "Browse",
+			args:     browse("0", "BrowseDirectChildren", "StartingIndex", "1", "RequestedCount", "1"),
+			wantArgs: map[string]string{"NumberReturned": "1", "TotalMatches": "3"},
+			wantIDs:  []string{"/Music"},
+		},
+		{
+			name:     "browse past the end",
+			action:   "Browse",
+			args:     browse("0", "BrowseDirectChildren", "StartingIndex", "99999999"),
+			wantArgs: map[string]string{"NumberReturned": "0", "TotalMatches": "3"},
+		},
+		{
+			name:     "browse a folder",
+			action:   "Browse",
+			args:     browse("/Movies", "BrowseDirectChildren"),
+			wantArgs: map[string]string{"NumberReturned": "2"},
+			wantIDs:  []string{"/Movies/a.mkv", "/Movies/b.mp4"},
+		},
+		{
+			name:    "root metadata",
+			action:  "Browse",
+			args:    browse("0", "BrowseMetadata"),
+			wantIDs: []string{"0"},
+			check: func(t *testing.T, result testDIDL) {
+				if root := result.Objects[0]; root.ParentID != "-1" || root.Title != "Media" {
+					t.Errorf("root container = %+v", root)
+				}
+			},
+		},
+		{
+			name:    "item metadata",
+			action:  "Browse",
+			args:    browse("/Movies/b.mp4", "BrowseMetadata"),
+			wantIDs: []string{"/Movies/b.mp4"},
+			check: func(t *testing.T, result testDIDL) {
+				item := result.Objects[0]
+				if item.ParentID != "/Movies" || item.Title != "b" || item.Class != "object.item.videoItem" {
+					t.Errorf("item = %+v", item)
+				}
+				if item.Res.URL != "http://example.com/dlna/media/Movies/b.mp4" || item.Res.ProtocolInfo != "http-get:*:video/mp4:"+dlnaStreamingFlags {
+					t.Errorf("resource = %+v", item.Res)
+				}
+			},
+		},
+		{name: "metadata of an unplayable file", action: "Browse", args: browse("/Movies/notes.txt", "BrowseMetadata"), wantError: "701"},
+		{name: "children of a file", action: "Browse", args: browse("/Movies/b.mp4", "BrowseDirectChildren"), wantError: "710"},
+		{name: "missing object", action: "Browse", args: browse("/missing", "BrowseMetadata"), wantError: "701"},
+		{name: "hidden object", action: "Browse", args: browse("/.hidden.mp4", "BrowseMetadata"), wantError: "701"},
+		{name: "escaping object", action: "Browse", args: browse("/../etc", "BrowseDirectChildren"), wantError: "701"},
+		{name: "invalid browse flag", action: "Browse", args: browse("0", "BrowseEverything"), wantError: "402"},
+		{name: "negative index", action: "Browse", args: browse("0", "BrowseDirectChildren", "StartingIndex", "-1"), wantError: "402"},
+		{name: "invalid count", action: "Browse", args: browse("0", "BrowseDirectChildren", "RequestedCount", "many"), wantError: "402"},
+		{
+			name:     "search by class",
+			action:   "Search",
+			args:     search("0", `upnp:class derivedfrom "object.item.videoItem"`),
+			wantArgs: map[string]string{"TotalMatches": "2"},
+			wantIDs:  []string{"/Movies/a.mkv", "/Movies/b.mp4"},
+		},
+		{
+			name:    "search by title",
+			action:  "Search",
+			args:    search("0", `dc:title contains "SONG" or dc:title = "photo"`),
+			wantIDs: []string{"/Music/song.mp3", "/photo.jpg"},
+		},
+		{
+			name:    "search on several properties",
+			action:  "Search",
+			args:    search("0", `upnp:class derivedfrom "object.item" and dc:title = "a"`),
+			wantIDs: []string{"/Movies/a.mkv"},
+		},
+		{
+			name:     "search in a folder",
+			action:   "Search",
+			args:     search("/Music", `upnp:class derivedfrom "object.item.videoItem"`),
+			wantArgs: map[string]string{"TotalMatches": "0"},
+		},
+		{name: "search a missing container", action: "Search", args: search("/missing", "*"), wantError: "710"},
+		{name: "search a file", action: "Search", args: search("/photo.jpg", "*"), wantError: "710"},
+		{name: "search capabilities", action: "GetSearchCapabilities", wantArgs: map[string]string{"SearchCaps": "dc:title,dc:creator,upnp:class,upnp:artist,upnp:album"}},
+		{name: "unknown action", action: "DestroyObject", args: []string{"ObjectID", "0"}, wantError: "401"},
+		{name: "protocol info", service: "ConnectionManager", action: "GetProtocolInfo", wantArgs: map[string]string{"Source": "http-get:*:*:*"}},
+		{name: "connection info", service: "ConnectionManager", action: "GetCurrentConnectionInfo", args: []string{"ConnectionID", "0"}, wantArgs: map[string]string{"Direction": "Output"}},
+		{name: "unknown connection", service: "ConnectionManager", action: "GetCurrentConnectionInfo", args: []string{"ConnectionID", "1"}, wantError: "706"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, serviceType := "ContentDirectory", dlnaContentDirectoryType
+			if tt.service == "ConnectionManager" {
+				service, serviceType = tt.service, dlnaConnectionManagerType
+			}
+			var body strings.Builder
+			body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`)
+			body.WriteString(`<u:` + tt.action + ` xmlns:u="` + serviceType + `">`)
+			for i := 0; i+1 < len(tt.args); i += 2 {
+				body.WriteString("<" + tt.args[i] + ">" + xmlEscape(tt.args[i+1]) + "</" + tt.args[i] + ">")
+			}
+			body.WriteString(`</u:` + tt.action + `></s:Body></s:Envelope>`)
+
+			w := httptest.NewRecorder()
+			s.handleDLNA(w, httptest.NewRequest("POST", "/dlna/control/"+service, strings.NewReader(body.String())))
+
+			if tt.wantError != "" {
+				m := upnpErrorCode.FindStringSubmatch(w.Body.String())
+				if w.Code != http.StatusInternalServerError || m == nil || m[1] != tt.wantError {
+					t.Fatalf("status %d, fault %v, want UPnP error %s: %s", w.Code, m, tt.wantError, w.Body)
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			var envelope soapEnvelope
+			if err := xml.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatal(err)
+			}
+			if got := envelope.Body.Action.XMLName; got.Local != tt.action+"Response" || got.Space != serviceType {
+				t.Errorf("response element = %v, want %sResponse in %s", got, tt.action, serviceType)
+			}
+			args := make(map[string]string)
+			for _, arg := range envelope.Body.Action.Args {
+				args[arg.XMLName.Local] = arg.Value
+			}
+			for name, want := range tt.wantArgs {
+				if args[name] != want {
+					t.Errorf("%s = %q, want %q", name, args[name], want)
+				}
+			}
+			if tt.wantIDs == nil && tt.check == nil {
+				return
+			}
+
+			var result testDIDL
+			if err := xml.Unmarshal([]byte(args["Result"]), &result); err != nil {
+				t.Fatalf("invalid DIDL-Lite result: %v\n%s", err, args["Result"])
+			}
+			var ids []string
+			for _, object := range result.Objects {
+				ids = append(ids, object.ID)
+			}
+			if !equalStrings(ids, tt.wantIDs) {
+				t.Fatalf("object IDs = %v, want %v", ids, tt.wantIDs)
+			}
+			if tt.check != nil {
+				tt.check(t, result)
+			}
+		})
+	}
+}
+
+func TestHandleDLNA(t *testing.T) {
+	s := dlnaTestServer(t)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		remoteAddr  string
+		header      http.Header
+		body        string
+		wantStatus  int
+		wantHeaders map[string]string
+		wantBody    []string
+	}{
+		{
+			name:        "device description",
+			path:        "/dlna/device.xml",
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Content-Type": `text/xml; charset="utf-8"`},
+			wantBody:    []string{"<friendlyName>Media &amp; More</friendlyName>", "<UDN>uuid:0a1b2c3d-0000-4000-8000-000000000000</UDN>"},
+		},
+		{name: "content directory description", path: "/dlna/ContentDirectory.xml", wantStatus: http.StatusOK, wantBody: []string{"<name>Browse</name>"}},
+		{name: "connection manager description", path: "/dlna/ConnectionManager.xml", wantStatus: http.StatusOK, wantBody: []string{"<name>GetProtocolInfo</name>"}},
+		{name: "description with post", method: "POST", path: "/dlna/device.xml", wantStatus: http.StatusMethodNotAllowed},
+		{
+			name:        "video stream",
+			path:        "/dlna/media/Movies/b.mp4",
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"transferMode.dlna.org": "Streaming", "contentFeatures.dlna.org": dlnaStreamingFlags, "Content-Type": "video/mp4"},
+		},
+		{
+			name:        "image",
+			path:        "/dlna/media/photo.jpg",
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"transferMode.dlna.org": "Interactive", "contentFeatures.dlna.org": dlnaInteractiveFlags},
+		},
+		{
+			name:        "requested transfer mode",
+			path:        "/dlna/media/Music/song.mp3",
+			header:      http.Header{"Transfermode.dlna.org": {"Background"}},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"transferMode.dlna.org": "Background"},
+		},
+		{
+			name:        "unknown transfer mode",
+			path:        "/dlna/media/Music/song.mp3",
+			header:      http.Header{"Transfermode.dlna.org": {"Teleport"}},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"transferMode.dlna.org": "Streaming"},
+		},
+		{name: "range request", path: "/dlna/media/Movies/b.mp4", header: http.Header{"Range": {"bytes=0-0"}}, wantStatus: http.StatusPartialContent},
+		{name: "stream of a folder", path: "/dlna/media/Movies", wantStatus: http.StatusNotFound},
+		{name: "stream of a hidden file", path: "/dlna/media/.hidden.mp4", wantStatus: http.StatusNotFound},
+		{name: "upload", method: "PUT", path: "/dlna/media/Movies/c.mp4", wantStatus: http.StatusMethodNotAllowed},
+		{
+			name:        "subscribe",
+			method:      "SUBSCRIBE",
+			path:        "/dlna/event/ContentDirectory",
+			header:      http.Header{"Sid": {"uuid:existing"}},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"SID": "uuid:existing", "TIMEOUT": "Second-1800"},
+		},
+		{name: "unsubscribe", method: "UNSUBSCRIBE", path: "/dlna/event/ContentDirectory", wantStatus: http.StatusOK},
+		{name: "event with get", path: "/dlna/event/ContentDirectory", wantStatus: http.StatusMethodNotAllowed},
+		{name: "control with get", path: "/dlna/control/ContentDirectory", wantStatus: http.StatusMethodNotAllowed},
+		{name: "invalid soap", method: "POST", path: "/dlna/control/ContentDirectory", body: "<Envelope", wantStatus: http.StatusBadRequest},
+		{name: "unknown path", path: "/dlna/other.xml", wantStatus: http.StatusNotFound},
+		{name: "client on another network", path: "/dlna/device.xml", remoteAddr: "203.0.113.5:5000", wantStatus: http.StatusForbidden},
+		{name: "forwarded request", path: "/dlna/device.xml", header: http.Header{"Forwarded": {"for=192.0.2.7"}}, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			r := httptest.NewRequest(method, tt.path, strings.NewReader(tt.body))
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			s.handleDLNA(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("body does not contain %q", want)
+				}
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	s.handleDLNA(w, httptest.NewRequest("SUBSCRIBE", "/dlna/event/ContentDirectory", nil))
+	if sid := w.Header().Get("SID"); !strings.HasPrefix(sid, "uuid:") || len(sid) != 37 {
+		t.Errorf("new subscription SID = %q, want a random uuid", sid)
+	}
+
+	w = httptest.NewRecorder()
+	(&MediaServer{}).handleDLNA(w, httptest.NewRequest("GET", "/dlna/device.xml", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status with DLNA disabled = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestDLNACriterionMatches(t *testing.T) {
+	tests := []struct {
+		criterion dlnaCriterion
+		value     string
+		want      bool
+	}{
+		{dlnaCriterion{"derivedfrom", "object.item"}, "object.item.videoItem", true},
+		{dlnaCriterion{"derivedfrom", "object.item"}, "object.item", true},
+		{dlnaCriterion{"derivedfrom", "object.item"}, "object.itemized", false},
+		{dlnaCriterion{"contains", "BEAT"}, "The Beatles", true},
+		{dlnaCriterion{"contains", "stones"}, "The Beatles", false},
+		{dlnaCriterion{"=", "abbey road"}, "Abbey Road", true},
+		{dlnaCriterion{"=", "abbey"}, "Abbey Road", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.criterion.matches(tt.value); got != tt.want {
+			t.Errorf("%+v.matches(%q) = %v, want %v", tt.criterion, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDLNAPage(t *testing.T) {
+	files := []FileInfo{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	tests := []struct {
+		start int
+		count int
+		want  string
+	}{
+		{0, 0, "abc"},
+		{1, 0, "bc"},
+		{1, 1, "b"},
+		{2, 5, "c"},
+		{3, 0, ""},
+		{1 << 40, 1, ""},
+	}
+
+	for _, tt := range tests {
+		var got string
+		for _, file := range dlnaPage(files, tt.start, tt.count) {
+			got += file.Name
+		}
+		if got != tt.want {
+			t.Errorf("dlnaPage(%d, %d) = %q, want %q", tt.start, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestFormatDIDLDuration(t *testing.T) {
+	tests := map[float64]string{
+		0:       "0:00:00.000",
+		61.5:    "0:01:01.500",
+		3725.25: "1:02:05.250",
+		0.0004:  "0:00:00.000",
+	}
+
+	for seconds, want := range tests {
+		if got := formatDIDLDuration(seconds); got != want {
+			t.Errorf("formatDIDLDuration(%v) = %q, want %q", seconds, got, want)
+		}
+	}
+}
+
+func TestNewDLNAServer(t *testing.T) {
+	config := &Config{
+		Server: ServerConfig{Port: 8443, TLS: TLSConfig{Enabled: true}},
+		DLNA:   DLNAConfig{UUID: "0A1B2C3D-0000-4000-8000-000000000000", Networks: []string{"10.0.0.0/8", "not a network"}},
+	}
+	d := NewDLNAServer(config)
+	if d.udn != "uuid:0a1b2c3d-0000-4000-8000-000000000000" {
+		t.Errorf("udn = %q, want the configured UUID in lower case", d.udn)
+	}
+	if len(d.networks) != 1 {
+		t.Errorf("networks = %v, want the one valid network", d.networks)
+	}
+	if got, want := d.ssdp.location(net.IPv4(10, 0, 0, 2)), "https://10.0.0.2:8443/dlna/device.xml"; got != want {
+		t.Errorf("location() = %q, want %q", got, want)
+	}
+	if d.ssdp.allows == nil || d.ssdp.allows(net.IPv4(192, 168, 1, 2)) || !d.ssdp.allows(net.IPv4(10, 1, 2, 3)) {
+		t.Error("SSDP responses are not limited to the DLNA networks")
+	}
+}
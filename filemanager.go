@@ -0,0 +1,695 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// trashDirName is the hidden folder of each media root holding its
+	// deleted files
+	trashDirName = ".trash"
+
+	// trashCleanupInterval is how often expired trash is removed
+	trashCleanupInterval = time.Hour
+)
+
+// File management errors
+var (
+	errInvalidFileName = errors.New("invalid name")
+	errProtectedPath   = errors.New("path cannot be changed")
+	errReadOnly        = errors.New("media root is read-only")
+	errCrossRoot       = errors.New("cannot move between media roots")
+	errNotFolder       = errors.New("destination is not a folder")
+	errMoveIntoSelf    = errors.New("cannot move a folder into itself")
+	errTrashNotFound   = errors.New("trash item not found")
+)
+
+// TrashRecord describes a deleted file or folder kept in the trash
+type TrashRecord struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"is_dir"`
+	User      string    `json:"user,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// FileManager makes changes to the media library. Deleted files are moved
+// to a hidden trash folder in their media root, so deleting is a rename on
+// the same filesystem, and tracked in a JSON file in the data directory
+// until they are restored or expire. Changes are serialized so that a
+// name checked to be free is still free when it is used.
+type FileManager struct {
+	file      string
+	library   *Library
+	retention time.Duration
+
+	mu    sync.Mutex
+	trash map[string]*TrashRecord
+}
+
+// NewFileManager loads the trash from the data directory
+func NewFileManager(dataDir string, library *Library, retention time.Duration) (*FileManager, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	fm := &FileManager{
+		file:      filepath.Join(dataDir, "trash.json"),
+		library:   library,
+		retention: retention,
+		trash:     make(map[string]*TrashRecord),
+	}
+
+	data, err := os.ReadFile(fm.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fm, nil
+		}
+		return nil, fmt.Errorf("failed to read trash: %w", err)
+	}
+
+	var records []*TrashRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse trash: %w", err)
+	}
+	for _, record := range records {
+		fm.trash[record.ID] = record
+	}
+
+	return fm, nil
+}
+
+// Reconfigure applies a reloaded library and trash retention
+func (fm *FileManager) Reconfigure(library *Library, retention time.Duration) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.library = library
+	fm.retention = retention
+}
+
+// Mkdir creates a folder
+func (fm *FileManager) Mkdir(fullPath string) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	return os.Mkdir(fullPath, 0755)
+}
+
+// Move renames a file or folder, refusing to replace an existing one
+func (fm *FileManager) Move(oldFull, newFull string) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	if _, err := os.Lstat(oldFull); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(newFull); err == nil {
+		return fs.ErrExist
+	}
+	return renameTree(oldFull, newFull)
+}
+
+// Trash moves the file or folder at urlPath to the trash
+func (fm *FileManager) Trash(user, urlPath, fullPath string) (TrashRecord, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return TrashRecord{}, err
+	}
+
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return TrashRecord{}, err
+	}
+
+	now := time.Now()
+	record := &TrashRecord{
+		ID:        hex.EncodeToString(id),
+		Path:      urlPath,
+		IsDir:     info.IsDir(),
+		User:      user,
+		DeletedAt: now,
+		ExpiresAt: now.Add(fm.retention).Truncate(time.Second),
+	}
+
+	// Each item keeps its name inside a folder of its own, so the trash
+	// can also be recovered by hand
+	itemDir, ok := fm.itemDir(record)
+	if !ok {
+		return TrashRecord{}, errProtectedPath
+	}
+	if err := os.MkdirAll(itemDir, 0755); err != nil {
+		return TrashRecord{}, err
+	}
+	if err := renameTree(fullPath, filepath.Join(itemDir, path.Base(urlPath))); err != nil {
+		os.Remove(itemDir)
+		return TrashRecord{}, err
+	}
+
+	fm.trash[record.ID] = record
+	if err := fm.saveLocked(); err != nil {
+		log.Printf("Failed to save trash: %v", err)
+	}
+	return *record, nil
+}
+
+// Get returns a trash item by ID
+func (fm *FileManager) Get(id string) (TrashRecord, bool) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	record, ok := fm.trash[id]
+	if !ok {
+		return TrashRecord{}, false
+	}
+	return *record, true
+}
+
+// List returns the trash of the roots a user may access, most recently
+// deleted first
+func (fm *FileManager) List(user string) []TrashRecord {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	records := make([]TrashRecord, 0, len(fm.trash))
+	for _, record := range fm.trash {
+		if fm.library.Allows(user, record.Path) {
+			records = append(records, *record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].DeletedAt.After(records[j].DeletedAt)
+	})
+	return records
+}
+
+// Restore moves a trash item back to fullPath, recreating its parent
+// folders if they were deleted since
+func (fm *FileManager) Restore(id, fullPath string) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	record, ok := fm.trash[id]
+	if !ok {
+		return errTrashNotFound
+	}
+	itemDir, ok := fm.itemDir(record)
+	if !ok {
+		return errTrashNotFound
+	}
+	if _, err := os.Lstat(fullPath); err == nil {
+		return fs.ErrExist
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	if err := renameTree(filepath.Join(itemDir, path.Base(record.Path)), fullPath); err != nil {
+		return err
+	}
+	os.Remove(itemDir)
+
+	delete(fm.trash, id)
+	if err := fm.saveLocked(); err != nil {
+		log.Printf("Failed to save trash: %v", err)
+	}
+	return nil
+}
+
+// Purge deletes a trash item for good. Items of read-only roots are kept
+// until they expire.
+func (fm *FileManager) Purge(id string) (TrashRecord, error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	record, ok := fm.trash[id]
+	if !ok {
+		return TrashRecord{}, errTrashNotFound
+	}
+	if root := fm.library.Root(record.Path); root != nil && root.ReadOnly {
+		return *record, errReadOnly
+	}
+	if itemDir, ok := fm.itemDir(record); ok {
+		if err := os.RemoveAll(itemDir); err != nil {
+			return TrashRecord{}, err
+		}
+	}
+
+	delete(fm.trash, id)
+	if err := fm.saveLocked(); err != nil {
+		log.Printf("Failed to save trash: %v", err)
+	}
+	return *record, nil
+}
+
+// Run removes expired trash periodically until ctx is cancelled
+func (fm *FileManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(trashCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		fm.removeExpired()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// removeExpired deletes trash items past their retention
+func (fm *FileManager) removeExpired() {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for id, record := range fm.trash {
+		if now.After(record.ExpiresAt) {
+			if itemDir, ok := fm.itemDir(record); ok {
+				if err := os.RemoveAll(itemDir); err != nil {
+					log.Printf("Failed to empty trash item %s: %v", id, err)
+					continue
+				}
+			}
+			delete(fm.trash, id)
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		log.Printf("Removed %d expired trash item(s)", removed)
+		if err := fm.saveLocked(); err != nil {
+			log.Printf("Failed to save trash: %v", err)
+		}
+	}
+}
+
+// itemDir returns the folder a trash item is kept in, inside the trash of
+// the root it was deleted from. It reports false if that root is no longer
+// part of the library.
+func (fm *FileManager) itemDir(record *TrashRecord) (string, bool) {
+	root := fm.library.Root(record.Path)
+	if root == nil {
+		return "", false
+	}
+	return filepath.Join(root.Directory, trashDirName, record.ID), true
+}
+
+// renameTree renames a file or folder. A root can span several
+// filesystems, where renames fail, so the tree is then copied and the
+// original removed.
+func renameTree(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies a file, symlink or folder with its contents, keeping
+// modes and the modification times of files
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(srcPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dstPath)
+		case d.IsDir():
+			return os.Mkdir(dstPath, info.Mode().Perm())
+		default:
+			if err := copyFile(srcPath, dstPath, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(dstPath, info.ModTime(), info.ModTime())
+	})
+}
+
+// copyFile copies the contents of a regular file to a new file
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// saveLocked writes the trash to disk. The caller must hold the lock.
+func (fm *FileManager) saveLocked() error {
+	records := make([]*TrashRecord, 0, len(fm.trash))
+	for _, record := range fm.trash {
+		records = append(records, record)
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode trash: %w", err)
+	}
+
+	return writeFileAtomic(fm.file, data, 0600)
+}
+
+// fileRequest is the body of a file management request
+type fileRequest struct {
+	Path        string `json:"path"`
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+}
+
+// handleAPIFiles changes the media library with POST /api/files/<action>
+// and a JSON body: mkdir creates the folder name inside path, rename gives
+// path a new name, move moves path into the folder destination and delete
+// moves path to the trash. Every attempt is recorded in the audit log.
+func (s *MediaServer) handleAPIFiles(w http.ResponseWriter, r *http.Request) {
+	if s.files == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "file management is disabled")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isScriptRequest(r) {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "request body must be application/json")
+		return
+	}
+
+	var req fileRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	user := userFromContext(r.Context())
+	requested := path.Join("/", req.Path)
+	var destination, urlPath, fullPath string
+	var err error
+
+	action := strings.TrimPrefix(r.URL.Path, "/api/files/")
+	switch action {
+	case "mkdir":
+		requested = path.Join(requested, req.Name)
+		urlPath, fullPath, err = s.mkdirMedia(user, req.Path, req.Name)
+	case "rename":
+		destination = path.Join(path.Dir(requested), req.Name)
+		urlPath, fullPath, err = s.renameMedia(user, req.Path, req.Name)
+	case "move":
+		destination = path.Join("/", req.Destination)
+		urlPath, fullPath, err = s.moveMedia(user, req.Path, req.Destination)
+	case "delete":
+		var record TrashRecord
+		record, err = s.deleteMedia(user, req.Path)
+		s.auditFileChange(r, action, requested, "", err)
+		if err != nil {
+			s.writeFileError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, record)
+		return
+	default:
+		writeJSONError(w, http.StatusNotFound, "unknown action")
+		return
+	}
+
+	s.auditFileChange(r, action, requested, destination, err)
+	if err != nil {
+		s.writeFileError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if action == "mkdir" {
+		status = http.StatusCreated
+	}
+	s.writeFileInfo(w, status, urlPath, fullPath)
+}
+
+// mkdirMedia creates the folder name inside a folder and returns its path
+func (s *MediaServer) mkdirMedia(user, folder, name string) (string, string, error) {
+	if !validFileName(name) {
+		return "", "", errInvalidFileName
+	}
+	urlPath, fullPath, err := s.managedPath(user, path.Join(folder, name))
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.files.Mkdir(fullPath); err != nil {
+		return "", "", err
+	}
+	s.refreshCatalog(urlPath)
+	return urlPath, fullPath, nil
+}
+
+// renameMedia gives a file or folder a new name in the same folder and
+// returns its new path
+func (s *MediaServer) renameMedia(user, mediaPath, name string) (string, string, error) {
+	if !validFileName(name) {
+		return "", "", errInvalidFileName
+	}
+	oldPath, oldFull, err := s.managedPath(user, mediaPath)
+	if err != nil {
+		return "", "", err
+	}
+	if s.library.IsMount(oldPath) {
+		return "", "", errProtectedPath
+	}
+	newPath, newFull, err := s.managedPath(user, path.Join(path.Dir(oldPath), name))
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.files.Move(oldFull, newFull); err != nil {
+		return "", "", err
+	}
+	s.refreshCatalog(oldPath)
+	s.refreshCatalog(newPath)
+	return newPath, newFull, nil
+}
+
+// moveMedia moves a file or folder into another folder and returns its
+// new path
+func (s *MediaServer) moveMedia(user, mediaPath, destination string) (string, string, error) {
+	oldPath, oldFull, err := s.managedPath(user, mediaPath)
+	if err != nil {
+		return "", "", err
+	}
+	if s.library.IsMount(oldPath) {
+		return "", "", errProtectedPath
+	}
+	folder, folderFull, err := s.managedPath(user, destination)
+	if err != nil {
+		return "", "", err
+	}
+	if s.library.Root(folder) != s.library.Root(oldPath) {
+		return "", "", errCrossRoot
+	}
+	if folder == oldPath || strings.HasPrefix(folder, oldPath+"/") {
+		return "", "", errMoveIntoSelf
+	}
+	info, err := os.Stat(folderFull)
+	if err != nil {
+		return "", "", err
+	}
+	if !info.IsDir() {
+		return "", "", errNotFolder
+	}
+
+	newPath := path.Join(folder, path.Base(oldPath))
+	newFull := filepath.Join(folderFull, path.Base(oldPath))
+	if err := s.files.Move(oldFull, newFull); err != nil {
+		return "", "", err
+	}
+	s.refreshCatalog(oldPath)
+	s.refreshCatalog(newPath)
+	return newPath, newFull, nil
+}
+
+// deleteMedia moves a file or folder to the trash
+func (s *MediaServer) deleteMedia(user, mediaPath string) (TrashRecord, error) {
+	urlPath, fullPath, err := s.managedPath(user, mediaPath)
+	if err != nil {
+		return TrashRecord{}, err
+	}
+	if s.library.IsMount(urlPath) {
+		return TrashRecord{}, errProtectedPath
+	}
+	record, err := s.files.Trash(user, urlPath, fullPath)
+	if err != nil {
+		return TrashRecord{}, err
+	}
+	s.refreshCatalog(urlPath)
+	return record, nil
+}
+
+// handleAPITrash lists the trash with GET /api/trash, restores an item to
+// its original path with POST /api/trash/<id> and deletes it for good with
+// DELETE /api/trash/<id>. Changes need an X-Requested-With header.
+func (s *MediaServer) handleAPITrash(w http.ResponseWriter, r *http.Request) {
+	if s.files == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "file management is disabled")
+		return
+	}
+
+	user := userFromContext(r.Context())
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/trash"), "/")
+	if r.Method != http.MethodGet && !isScriptRequest(r) {
+		writeJSONError(w, http.StatusForbidden, "X-Requested-With header required")
+		return
+	}
+	if id != "" {
+		// Items of roots the user may not access are not found
+		if record, ok := s.files.Get(id); !ok || !s.library.Allows(user, record.Path) {
+			writeJSONError(w, http.StatusNotFound, errTrashNotFound.Error())
+			return
+		}
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"trash": s.files.List(user)})
+
+	case id != "" && r.Method == http.MethodPost:
+		record, ok := s.files.Get(id)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, errTrashNotFound.Error())
+			return
+		}
+		urlPath, fullPath, err := s.managedPath(user, record.Path)
+		if err == nil {
+			err = s.files.Restore(id, fullPath)
+		}
+		s.auditFileChange(r, "restore", record.Path, "", err)
+		if err != nil {
+			s.writeFileError(w, err)
+			return
+		}
+		s.refreshCatalog(urlPath)
+		s.writeFileInfo(w, http.StatusOK, urlPath, fullPath)
+
+	case id != "" && r.Method == http.MethodDelete:
+		record, err := s.files.Purge(id)
+		s.auditFileChange(r, "purge", record.Path, "", err)
+		if err != nil {
+			s.writeFileError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// managedPath resolves a path the file manager may change for a user. The
+// virtual top level and read-only roots are refused, as are hidden paths
+// by resolveUserPath.
+func (s *MediaServer) managedPath(user, mediaPath string) (string, string, error) {
+	cleanPath, fullPath, err := s.resolveUserPath(user, mediaPath)
+	if err != nil {
+		return "", "", err
+	}
+	root := s.library.Root(cleanPath)
+	if root == nil {
+		return "", "", errProtectedPath
+	}
+	if root.ReadOnly {
+		return "", "", errReadOnly
+	}
+	return cleanPath, fullPath, nil
+}
+
+// auditFileChange records an attempt to change the library in the audit log
+func (s *MediaServer) auditFileChange(r *http.Request, action, urlPath, destination string, err error) {
+	if s.audit == nil {
+		return
+	}
+	if auditErr := s.audit.Record(r, action, urlPath, destination, err); auditErr != nil {
+		log.Printf("Failed to write audit log: %v", auditErr)
+	}
+}
+
+// refreshCatalog updates the catalog entry of a changed path
+func (s *MediaServer) refreshCatalog(urlPath string) {
+	if s.catalog != nil {
+		s.catalog.Refresh(urlPath)
+	}
+}
+
+// writeFileInfo writes the listing record of a changed file
+func (s *MediaServer) writeFileInfo(w http.ResponseWriter, status int, urlPath, fullPath string) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		s.writeFileError(w, err)
+		return
+	}
+	writeJSON(w, status, newFileInfo(urlPath, fullPath, info, s.types))
+}
+
+// writeFileError writes the JSON error matching a file management failure
+func (s *MediaServer) writeFileError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidPath), errors.Is(err, errInvalidFileName),
+		errors.Is(err, errNotFolder), errors.Is(err, errMoveIntoSelf), errors.Is(err, errCrossRoot):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errForbiddenPath), errors.Is(err, errProtectedPath), errors.Is(err, errReadOnly):
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, errTrashNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, fs.ErrNotExist):
+		writeJSONError(w, http.StatusNotFound, "path not found")
+	case errors.Is(err, fs.ErrExist):
+		writeJSONError(w, http.StatusConflict, "a file with that name already exists")
+	default:
+		log.Printf("File management failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "operation failed")
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fileTestLibrary returns a library with a writable, a read-only and a
+// private root, and the roots' directories by name
+func fileTestLibrary(t *testing.T) (*Library, map[string]string) {
+	t.Helper()
+	dirs := map[string]string{"movies": t.TempDir(), "archive": t.TempDir(), "private": t.TempDir()}
+	writeTestFiles(t, dirs["movies"], "a.mp4", "b.mp4", "folder/c.mp4", "other/", ".hidden/x.mp4")
+	writeTestFiles(t, dirs["archive"], "old.mp4")
+	writeTestFiles(t, dirs["private"], "x.mp4")
+	library := NewLibrary(MediaConfig{Roots: []MediaRootConfig{
+		{Name: "movies", Directory: dirs["movies"]},
+		{Name: "archive", Directory: dirs["archive"], ReadOnly: true},
+		{Name: "private", Directory: dirs["private"], Users: []string{"bob"}},
+	}})
+	return library, dirs
+}
+
+func TestFileManagerTrash(t *testing.T) {
+	library, dirs := fileTestLibrary(t)
+	data := t.TempDir()
+	fm, err := NewFileManager(data, library, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := fm.Trash("alice", "/movies/a.mp4", filepath.Join(dirs["movies"], "a.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Path != "/movies/a.mp4" || file.IsDir || file.User != "alice" || len(file.ID) != 32 {
+		t.Errorf("Trash() = %+v", file)
+	}
+	if d := file.ExpiresAt.Sub(file.DeletedAt); d < time.Hour-time.Second || d > time.Hour {
+		t.Errorf("trash expires %s after deletion, want the retention", d)
+	}
+	trashed := filepath.Join(dirs["movies"], trashDirName, file.ID, "a.mp4")
+	if _, err := os.Stat(trashed); err != nil {
+		t.Errorf("trashed file: %v", err)
+	}
+
+	folder, err := fm.Trash("alice", "/movies/folder", filepath.Join(dirs["movies"], "folder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !folder.IsDir {
+		t.Errorf("Trash() of a folder = %+v, want IsDir", folder)
+	}
+	if _, err := fm.Trash("alice", "/movies/missing.mp4", filepath.Join(dirs["movies"], "missing.mp4")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Trash() of a missing file error = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := fm.Trash("alice", "/gone/a.mp4", filepath.Join(dirs["movies"], "b.mp4")); !errors.Is(err, errProtectedPath) {
+		t.Errorf("Trash() outside the roots error = %v, want errProtectedPath", err)
+	}
+
+	// Listings are filtered by access, most recent first
+	var paths []string
+	for _, record := range fm.List("alice") {
+		paths = append(paths, record.Path)
+	}
+	if want := []string{"/movies/folder", "/movies/a.mp4"}; !equalStrings(paths, want) {
+		t.Errorf("List() = %v, want %v", paths, want)
+	}
+
+	// The trash is saved and loaded again
+	reloaded, err := NewFileManager(data, library, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reloaded.Get(file.ID); !ok || got.Path != file.Path {
+		t.Errorf("reloaded Get() = %+v, %v, want %+v", got, ok, file)
+	}
+
+	// Restoring recreates parent folders deleted since
+	restored := filepath.Join(dirs["movies"], "new", "parent", "a.mp4")
+	if err := reloaded.Restore(file.ID, restored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(restored); err != nil {
+		t.Errorf("restored file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(trashed)); !os.IsNotExist(err) {
+		t.Errorf("trash item folder left behind: %v", err)
+	}
+	if err := reloaded.Restore(file.ID, restored); !errors.Is(err, errTrashNotFound) {
+		t.Errorf("second Restore() error = %v, want errTrashNotFound", err)
+	}
+	if err := reloaded.Restore(folder.ID, filepath.Join(dirs["movies"], "b.mp4")); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Restore() over a file error = %v, want fs.ErrExist", err)
+	}
+
+	if _, err := reloaded.Purge(folder.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dirs["movies"], trashDirName, folder.ID)); !os.IsNotExist(err) {
+		t.Errorf("purged item still exists: %v", err)
+	}
+	if _, err := reloaded.Purge(folder.ID); !errors.Is(err, errTrashNotFound) {
+		t.Errorf("second Purge() error = %v, want errTrashNotFound", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(data, "trash.json"), []byte("[{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileManager(data, library, time.Hour); err == nil {
+		t.Error("NewFileManager() with a broken trash succeeded")
+	}
+}
+
+func TestFileManagerPurgeReadOnly(t *testing.T) {
+	library, dirs := fileTestLibrary(t)
+	fm, err := NewFileManager(t.TempDir(), library, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := fm.Trash("", "/archive/old.mp4", filepath.Join(dirs["archive"], "old.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Items of read-only roots are kept until they expire
+	if _, err := fm.Purge(record.ID); !errors.Is(err, errReadOnly) {
+		t.Errorf("Purge() error = %v, want errReadOnly", err)
+	}
+	if _, ok := fm.Get(record.ID); !ok {
+		t.Error("item of a read-only root was purged")
+	}
+}
+
+func TestFileManagerRemoveExpired(t *testing.T) {
+	library, dirs := fileTestLibrary(t)
+	fm, err := NewFileManager(t.TempDir(), library, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := fm.Trash("", "/movies/a.mp4", filepath.Join(dirs["movies"], "a.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.Reconfigure(library, time.Hour)
+	kept, err := fm.Trash("", "/movies/b.mp4", filepath.Join(dirs["movies"], "b.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fm.removeExpired()
+	if _, ok := fm.Get(expired.ID); ok {
+		t.Error("expired item was kept")
+	}
+	if _, err := os.Stat(filepath.Join(dirs["movies"], trashDirName, expired.ID)); !os.IsNotExist(err) {
+		t.Errorf("expired item still exists: %v", err)
+	}
+	if _, ok := fm.Get(kept.ID); !ok {
+		t.Error("item within its retention was removed")
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	writeTestFiles(t, src, "a.mp4", "sub/b.mp4", "empty/")
+	if err := os.Chmod(filepath.Join(src, "a.mp4"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "sub", "b.mp4"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.mp4", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := copyTree(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		mode    fs.FileMode
+	}{
+		{"a.mp4", "a.mp4", 0600},
+		{"sub/b.mp4", "sub/b.mp4", 0644},
+		{"link", "a.mp4", 0600},
+	}
+	for _, tt := range tests {
+		full := filepath.Join(dst, filepath.FromSlash(tt.name))
+		data, err := os.ReadFile(full)
+		if err != nil {
+			t.Errorf("copy of %s: %v", tt.name, err)
+			continue
+		}
+		info, err := os.Stat(full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.content || info.Mode().Perm() != tt.mode {
+			t.Errorf("copy of %s = %q, %v, want %q, %v", tt.name, data, info.Mode().Perm(), tt.content, tt.mode)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "a.mp4" {
+		t.Errorf("copied symlink = %q, %v, want a.mp4", target, err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "sub", "b.mp4")); err != nil {
+		t.Error(err)
+	} else if !info.ModTime().Equal(modTime) {
+		t.Errorf("copied modification time = %v, want %v", info.ModTime(), modTime)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "empty")); err != nil || !info.IsDir() {
+		t.Errorf("copied empty folder: %v", err)
+	}
+
+	// Existing files are never overwritten
+	if err := copyTree(src, dst); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("copyTree() onto a copy error = %v, want fs.ErrExist", err)
+	}
+}
+
+// fileTestServer serves the file management API for fileTestLibrary,
+// recording changes in an audit log in the returned data directory
+func fileTestServer(t *testing.T) (*MediaServer, map[string]string, string) {
+	t.Helper()
+	library, dirs := fileTestLibrary(t)
+	data := t.TempDir()
+	files, err := NewFileManager(data, library, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := NewAuditLog(filepath.Join(data, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MediaServer{
+		config:  &Config{},
+		library: library,
+		types:   NewMediaTypes(defaultMediaTypes(), nil),
+		files:   files,
+		audit:   audit,
+	}, dirs, data
+}
+
+// fileRequestAs builds a file management request from user, sent by the
+// web interface's scripts
+func fileRequestAs(user, method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+// readAuditLog returns the entries of an audit log as "action path
+// destination error" lines
+func readAuditLog(t *testing.T, file string) []string {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		line := strings.Join([]string{entry.User, entry.Action, entry.Path, entry.Destination}, " ")
+		if entry.Error != "" {
+			line += " error"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestHandleAPIFiles(t *testing.T) {
+	s, dirs, data := fileTestServer(t)
+
+	// Steps run in order against the same library
+	steps := []struct {
+		name       string
+		user       string
+		action     string
+		body       string
+		wantStatus int
+		wantPath   string
+		wantFile   string
+		wantNoFile string
+	}{
+		{name: "mkdir", action: "mkdir", body: `{"path": "/movies", "name": "New"}`, wantStatus: http.StatusCreated, wantPath: "/movies/New", wantFile: "movies/New"},
+		{name: "mkdir existing", action: "mkdir", body: `{"path": "/movies", "name": "New"}`, wantStatus: http.StatusConflict},
+		{name: "mkdir hidden", action: "mkdir", body: `{"path": "/movies", "name": ".New"}`, wantStatus: http.StatusBadRequest, wantNoFile: "movies/.New"},
+		{name: "mkdir nested name", action: "mkdir", body: `{"path": "/movies", "name": "a/b"}`, wantStatus: http.StatusBadRequest},
+		{name: "mkdir backslash name", action: "mkdir", body: `{"path": "/movies", "name": "..\\b"}`, wantStatus: http.StatusBadRequest},
+		{name: "mkdir empty name", action: "mkdir", body: `{"path": "/movies", "name": ""}`, wantStatus: http.StatusBadRequest},
+		{name: "mkdir escaping", action: "mkdir", body: `{"path": "/movies/../../etc", "name": "x"}`, wantStatus: http.StatusNotFound},
+		{name: "mkdir in a read-only root", action: "mkdir", body: `{"path": "/archive", "name": "x"}`, wantStatus: http.StatusForbidden, wantNoFile: "archive/x"},
+		{name: "mkdir in a private root", action: "mkdir", body: `{"path": "/private", "name": "x"}`, wantStatus: http.StatusForbidden, wantNoFile: "private/x"},
+		{name: "mkdir at the top level", action: "mkdir", body: `{"path": "/", "name": "x"}`, wantStatus: http.StatusNotFound},
+		{name: "mkdir in a hidden folder", action: "mkdir", body: `{"path": "/movies/.hidden", "name": "x"}`, wantStatus: http.StatusNotFound, wantNoFile: "movies/.hidden/x"},
+		{name: "rename", action: "rename", body: `{"path": "/movies/a.mp4", "name": "renamed.mp4"}`, wantStatus: http.StatusOK, wantPath: "/movies/renamed.mp4", wantFile: "movies/renamed.mp4", wantNoFile: "movies/a.mp4"},
+		{name: "rename over a file", action: "rename", body: `{"path": "/movies/renamed.mp4", "name": "b.mp4"}`, wantStatus: http.StatusConflict, wantFile: "movies/renamed.mp4"},
+		{name: "rename to hidden", action: "rename", body: `{"path": "/movies/b.mp4", "name": ".b.mp4"}`, wantStatus: http.StatusBadRequest, wantFile: "movies/b.mp4"},
+		{name: "rename a root", action: "rename", body: `{"path": "/movies", "name": "films"}`, wantStatus: http.StatusForbidden},
+		{name: "rename missing", action: "rename", body: `{"path": "/movies/missing.mp4", "name": "x.mp4"}`, wantStatus: http.StatusNotFound},
+		{name: "rename in a read-only root", action: "rename", body: `{"path": "/archive/old.mp4", "name": "x.mp4"}`, wantStatus: http.StatusForbidden, wantFile: "archive/old.mp4"},
+		{name: "move", action: "move", body: `{"path": "/movies/b.mp4", "destination": "/movies/folder"}`, wantStatus: http.StatusOK, wantPath: "/movies/folder/b.mp4", wantFile: "movies/folder/b.mp4", wantNoFile: "movies/b.mp4"},
+		{name: "move a folder", action: "move", body: `{"path": "/movies/New", "destination": "/movies/other"}`, wantStatus: http.StatusOK, wantPath: "/movies/other/New", wantFile: "movies/other/New"},
+		{name: "move into itself", action: "move", body: `{"path": "/movies/other", "destination": "/movies/other/New"}`, wantStatus: http.StatusBadRequest, wantFile: "movies/other"},
+		{name: "move onto itself", action: "move", body: `{"path": "/movies/other", "destination": "/movies/other"}`, wantStatus: http.StatusBadRequest},
+		{name: "move into a file", action: "move", body: `{"path": "/movies/renamed.mp4", "destination": "/movies/folder/c.mp4"}`, wantStatus: http.StatusBadRequest},
+		{name: "move into a missing folder", action: "move", body: `{"path": "/movies/renamed.mp4", "destination": "/movies/missing"}`, wantStatus: http.StatusNotFound},
+		{name: "move to another root", action: "move", body: `{"path": "/movies/renamed.mp4", "destination": "/archive"}`, wantStatus: http.StatusForbidden, wantNoFile: "archive/renamed.mp4"},
+		{name: "move to a private root", user: "bob", action: "move", body: `{"path": "/movies/renamed.mp4", "destination": "/private"}`, wantStatus: http.StatusBadRequest, wantNoFile: "private/renamed.mp4"},
+		{name: "move a root", action: "move", body: `{"path": "/movies", "destination": "/movies/other"}`, wantStatus: http.StatusForbidden},
+		{name: "move to an unclean destination", action: "move", body: `{"path": "/movies/folder/b.mp4", "destination": "/movies/other/New/.."}`, wantStatus: http.StatusOK, wantFile: "movies/other/b.mp4"},
+		{name: "move with a name taken", action: "move", body: `{"path": "/movies/folder/c.mp4", "destination": "/movies/folder"}`, wantStatus: http.StatusConflict},
+		{name: "delete", action: "delete", body: `{"path": "/movies/renamed.mp4"}`, wantStatus: http.StatusOK, wantNoFile: "movies/renamed.mp4"},
+		{name: "delete missing", action: "delete", body: `{"path": "/movies/renamed.mp4"}`, wantStatus: http.StatusNotFound},
+		{name: "delete a root", action: "delete", body: `{"path": "/movies"}`, wantStatus: http.StatusForbidden},
+		{name: "delete the top level", action: "delete", body: `{"path": "/"}`, wantStatus: http.StatusForbidden},
+		{name: "delete the trash", action: "delete", body: `{"path": "/movies/.trash"}`, wantStatus: http.StatusNotFound},
+		{name: "delete in a read-only root", action: "delete", body: `{"path": "/archive/old.mp4"}`, wantStatus: http.StatusForbidden, wantFile: "archive/old.mp4"},
+		{name: "delete in a private root", action: "delete", body: `{"path": "/private/x.mp4"}`, wantStatus: http.StatusForbidden, wantFile: "private/x.mp4"},
+		{name: "unknown action", action: "copy", body: `{"path": "/movies/folder"}`, wantStatus: http.StatusNotFound},
+		{name: "invalid body", action: "mkdir", body: `path=/movies`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, step := range steps {
+		user := step.user
+		if user == "" {
+			user = "alice"
+		}
+		w := httptest.NewRecorder()
+		s.handleAPIFiles(w, fileRequestAs(user, "POST", "/api/files/"+step.action, step.body))
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body)
+		}
+		if step.wantPath != "" {
+			var info FileInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+				t.Fatal(err)
+			}
+			if info.Path != step.wantPath {
+				t.Errorf("%s: path = %q, want %q", step.name, info.Path, step.wantPath)
+			}
+		}
+		if step.wantFile != "" {
+			root, rel, _ := strings.Cut(step.wantFile, "/")
+			if _, err := os.Stat(filepath.Join(dirs[root], rel)); err != nil {
+				t.Errorf("%s: %v", step.name, err)
+			}
+		}
+		if step.wantNoFile != "" {
+			root, rel, _ := strings.Cut(step.wantNoFile, "/")
+			if _, err := os.Stat(filepath.Join(dirs[root], rel)); !os.IsNotExist(err) {
+				t.Errorf("%s: %s exists", step.name, step.wantNoFile)
+			}
+		}
+	}
+
+	// Every attempt is audited, the failed ones with their error
+	audit := readAuditLog(t, filepath.Join(data, "audit.log"))
+	want := []string{
+		"alice mkdir /movies/New ",
+		"alice mkdir /movies/New  error",
+		"alice mkdir /movies/.New  error",
+	}
+	if len(audit) < len(want) || !equalStrings(audit[:len(want)], want) {
+		t.Errorf("audit log starts with %q, want %q", audit, want)
+	}
+	for _, line := range []string{
+		"alice rename /movies/a.mp4 /movies/renamed.mp4",
+		"alice move /movies/b.mp4 /movies/folder",
+		"bob move /movies/renamed.mp4 /private error",
+		"alice delete /movies/renamed.mp4 ",
+		"alice delete /archive/old.mp4  error",
+	} {
+		found := false
+		for _, got := range audit {
+			found = found || got == line
+		}
+		if !found {
+			t.Errorf("audit log %q does not contain %q", audit, line)
+		}
+	}
+}
+
+func TestHandleAPIFilesRequests(t *testing.T) {
+	s, _, _ := fileTestServer(t)
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"get", "GET", "application/json", "", http.StatusMethodNotAllowed},
+		{"form post", "POST", "application/x-www-form-urlencoded", `{"path": "/movies", "name": "x"}`, http.StatusUnsupportedMediaType},
+		{"oversized body", "POST", "application/json", `{"path": "/movies", "name": "` + strings.Repeat("x", 1<<16) + `"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fileRequestAs("alice", tt.method, "/api/files/mkdir", tt.body)
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			s.handleAPIFiles(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	(&MediaServer{}).handleAPIFiles(w, fileRequestAs("alice", "POST", "/api/files/mkdir", `{}`))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status with file management disabled = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHandleAPITrash(t *testing.T) {
+	s, dirs, data := fileTestServer(t)
+	trash := func(user, urlPath, name string) TrashRecord {
+		t.Helper()
+		record, err := s.files.Trash(user, urlPath, filepath.Join(dirs[strings.Split(urlPath, "/")[1]], name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+	a := trash("alice", "/movies/a.mp4", "a.mp4")
+	folder := trash("alice", "/movies/folder", "folder")
+	private := trash("bob", "/private/x.mp4", "x.mp4")
+	old := trash("", "/archive/old.mp4", "old.mp4")
+	writeTestFiles(t, dirs["movies"], "folder/")
+
+	// Steps run in order against the same trash
+	steps := []struct {
+		name       string
+		user       string
+		method     string
+		id         string
+		script     bool
+		wantStatus int
+		wantPaths  []string
+		wantFile   string
+	}{
+		{name: "list", method: "GET", wantStatus: http.StatusOK, wantPaths: []string{"/archive/old.mp4", "/movies/folder", "/movies/a.mp4"}},
+		{name: "list of another user", user: "bob", method: "GET", wantStatus: http.StatusOK, wantPaths: []string{"/archive/old.mp4", "/private/x.mp4", "/movies/folder", "/movies/a.mp4"}},
+		{name: "restore without header", method: "POST", id: a.ID, wantStatus: http.StatusForbidden},
+		{name: "restore", method: "POST", id: a.ID, script: true, wantStatus: http.StatusOK, wantFile: "movies/a.mp4"},
+		{name: "restore again", method: "POST", id: a.ID, script: true, wantStatus: http.StatusNotFound},
+		{name: "restore over a folder", method: "POST", id: folder.ID, script: true, wantStatus: http.StatusConflict},
+		{name: "restore to a read-only root", method: "POST", id: old.ID, script: true, wantStatus: http.StatusForbidden},
+		{name: "restore from a private root", method: "POST", id: private.ID, script: true, wantStatus: http.StatusNotFound},
+		{name: "purge from a private root", method: "DELETE", id: private.ID, script: true, wantStatus: http.StatusNotFound},
+		{name: "purge from a read-only root", method: "DELETE", id: old.ID, script: true, wantStatus: http.StatusForbidden},
+		{name: "purge", method: "DELETE", id: folder.ID, script: true, wantStatus: http.StatusNoContent},
+		{name: "unknown item", method: "DELETE", id: "0123", script: true, wantStatus: http.StatusNotFound},
+		{name: "put", method: "PUT", id: private.ID, script: true, user: "bob", wantStatus: http.StatusMethodNotAllowed},
+		{name: "list after changes", method: "GET", wantStatus: http.StatusOK, wantPaths: []string{"/archive/old.mp4"}},
+	}
+
+	for _, step := range steps {
+		user := step.user
+		if user == "" {
+			user = "alice"
+		}
+		target := "/api/trash"
+		if step.id != "" {
+			target += "/" + step.id
+		}
+		r := httptest.NewRequest(step.method, target, nil)
+		if step.script {
+			r.Header.Set("X-Requested-With", "XMLHttpRequest")
+		}
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+		w := httptest.NewRecorder()
+		s.handleAPITrash(w, r)
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body)
+		}
+		if step.wantPaths != nil {
+			var resp struct {
+				Trash []TrashRecord `json:"trash"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, record := range resp.Trash {
+				paths = append(paths, record.Path)
+			}
+			if !equalStrings(paths, step.wantPaths) {
+				t.Errorf("%s: trash = %v, want %v", step.name, paths, step.wantPaths)
+			}
+		}
+		if step.wantFile != "" {
+			root, rel, _ := strings.Cut(step.wantFile, "/")
+			if _, err := os.Stat(filepath.Join(dirs[root], rel)); err != nil {
+				t.Errorf("%s: %v", step.name, err)
+			}
+		}
+	}
+
+	audit := readAuditLog(t, filepath.Join(data, "audit.log"))
+	want := []string{
+		"alice restore /movies/a.mp4 ",
+		"alice restore /movies/folder  error",
+		"alice restore /archive/old.mp4  error",
+		"alice purge /archive/old.mp4  error",
+		"alice purge /movies/folder ",
+	}
+	if !equalStrings(audit, want) {
+		t.Errorf("audit log = %q, want %q", audit, want)
+	}
+}
@@ -2,4 +2,13 @@ module http-media-svr-v2
 
 go 1.21
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	golang.org/x/crypto v0.21.0
+	golang.org/x/image v0.15.0
+	golang.org/x/net v0.21.0
+	golang.org/x/text v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.18.0 // indirect
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Track fragment flags used in generated segments
+const (
+	tfhdDefaultBaseIsMoof = 0x020000
+
+	trunDataOffset      = 0x000001
+	trunSampleDuration  = 0x000100
+	trunSampleSize      = 0x000200
+	trunSampleFlags     = 0x000400
+	trunSampleCTSOffset = 0x000800
+
+	sampleFlagsSync    = 0x02000000 // depends on no other sample
+	sampleFlagsNonSync = 0x01010000 // depends on others, not a sync sample
+)
+
+const (
+	// maxHLSSegmentSize bounds the sample data of one generated segment,
+	// which is held in memory
+	maxHLSSegmentSize = 256 << 20
+
+	// mp4SampleCost is the memory an mp4Sample takes, for cache accounting
+	mp4SampleCost = 40
+)
+
+// hlsExtensions lists the containers that can be packaged for HLS
+var hlsExtensions = map[string]bool{
+	".mp4": true,
+	".m4v": true,
+	".mov": true,
+}
+
+var errNoHLS = errors.New("HLS packaging is only supported for progressive MP4 files")
+
+// HLSPackager serves progressive MP4 files as HLS by remuxing their
+// samples into fragmented MP4 segments on request. Segment plans and
+// generated segments are kept in a memory cache.
+type HLSPackager struct {
+	segmentDuration time.Duration
+	cache           *lruCache
+}
+
+// hlsIndex is the segment plan for one source file
+type hlsIndex struct {
+	modTime  time.Time
+	size     int64
+	movie    *mp4Movie
+	tracks   []*mp4Track
+	segments []hlsSegment
+
+	// shifts holds the offset added to the decode times of each track, in
+	// its own timescale, so that the tracks line up as their edit lists
+	// place them. Segments carry no edit lists, as players differ in
+	// whether they apply them to fragments.
+	shifts []uint64
+}
+
+// hlsSegment is a segment's duration and its [first, last) sample range
+// in each packaged track
+type hlsSegment struct {
+	duration float64
+	ranges   [][2]int
+}
+
+// NewHLSPackager creates a packager that cuts segments of roughly
+// segmentDuration and caches up to cacheSize bytes
+func NewHLSPackager(segmentDuration time.Duration, cacheSize int64) *HLSPackager {
+	return &HLSPackager{
+		segmentDuration: segmentDuration,
+		cache:           newLRUCache(cacheSize),
+	}
+}
+
+// Index returns the segment plan for a file, reusing the cached plan while
+// the file is unchanged
+func (p *HLSPackager) Index(file io.ReaderAt, fullPath string, info fs.FileInfo) (*hlsIndex, error) {
+	key := "index\x00" + fullPath
+	if cached, ok := p.cache.Get(key); ok {
+		idx := cached.(*hlsIndex)
+		if idx.modTime.Equal(info.ModTime()) && idx.size == info.Size() {
+			return idx, nil
+		}
+	}
+
+	movie, err := parseMP4(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if movie.fragmented {
+		return nil, fmt.Errorf("%w: file is already fragmented", errNoHLS)
+	}
+
+	idx, err := planHLS(movie, p.segmentDuration)
+	if err != nil {
+		return nil, err
+	}
+	idx.modTime = info.ModTime()
+	idx.size = info.Size()
+
+	cost := int64(len(movie.mvhd))
+	for _, track := range movie.tracks {
+		cost += int64(len(track.samples))*mp4SampleCost + int64(len(track.stsd))
+	}
+	p.cache.Add(key, idx, cost)
+	return idx, nil
+}
+
+// cached returns the cached data for key, generating and caching it if
+// needed
+func (p *HLSPackager) cached(key string, generate func() ([]byte, error)) ([]byte, error) {
+	if cached, ok := p.cache.Get(key); ok {
+		return cached.([]byte), nil
+	}
+	data, err := generate()
+	if err != nil {
+		return nil, err
+	}
+	p.cache.Add(key, data, int64(len(data)))
+	return data, nil
+}
+
+// segmentKey identifies a generated segment of a particular file version.
+// The initialization segment is number -1.
+func segmentKey(fullPath string, idx *hlsIndex, n int) string {
+	return fmt.Sprintf("segment\x00%s\x00%d\x00%d\x00%d", fullPath, idx.modTime.UnixNano(), idx.size, n)
+}
+
+// planHLS chooses the tracks to package and cuts them into segments. Cuts
+// are made on sync samples of the video track, or on any sample for
+// audio-only files, once the target duration has been reached.
+func planHLS(movie *mp4Movie, target time.Duration) (*hlsIndex, error) {
+	var video, audio *mp4Track
+	for _, track := range movie.tracks {
+		if len(track.samples) == 0 {
+			continue
+		}
+		switch track.handler {
+		case "vide":
+			if video == nil {
+				video = track
+			}
+		case "soun":
+			if audio == nil {
+				audio = track
+			}
+		}
+	}
+
+	idx := &hlsIndex{movie: movie}
+	if video != nil {
+		idx.tracks = append(idx.tracks, video)
+	}
+	if audio != nil {
+		idx.tracks = append(idx.tracks, audio)
+	}
+	if len(idx.tracks) == 0 {
+		return nil, fmt.Errorf("%w: no audio or video tracks", errNoHLS)
+	}
+
+	idx.shifts = editShifts(idx.tracks, movie.timescale)
+
+	ref := idx.tracks[0]
+	step := uint64(target) * uint64(ref.timescale) / uint64(time.Second)
+	cuts := []uint64{ref.samples[0].dts}
+	for _, sample := range ref.samples[1:] {
+		if sample.sync && sample.dts-cuts[len(cuts)-1] >= step {
+			cuts = append(cuts, sample.dts)
+		}
+	}
+
+	// bounds[i][k] is the first sample of track i in segment k
+	bounds := make([][]int, len(idx.tracks))
+	for i, track := range idx.tracks {
+		bounds[i] = make([]int, len(cuts)+1)
+		for k := 1; k < len(cuts); k++ {
+			bounds[i][k] = firstSampleAt(track, idx.shifts[i], cuts[k]+idx.shifts[0], ref.timescale)
+		}
+		bounds[i][len(cuts)] = len(track.samples)
+	}
+
+	for k, start := range cuts {
+		end := ref.endTime()
+		if k+1 < len(cuts) {
+			end = cuts[k+1]
+		}
+		segment := hlsSegment{duration: float64(end-start) / float64(ref.timescale)}
+		for i := range idx.tracks {
+			segment.ranges = append(segment.ranges, [2]int{bounds[i][k], bounds[i][k+1]})
+		}
+		idx.segments = append(idx.segments, segment)
+	}
+	return idx, nil
+}
+
+// editShifts returns the offset to add to the decode times of each track,
+// in its own timescale, so that presentation starts where the edit lists
+// put it. The shifts are the smallest that keep every time positive.
+func editShifts(tracks []*mp4Track, movieTimescale uint32) []uint64 {
+	offsets := make([]float64, len(tracks))
+	latest := 0.0
+	for i, track := range tracks {
+		offsets[i] = float64(track.editStart) / float64(track.timescale)
+		if movieTimescale > 0 {
+			offsets[i] -= float64(track.editDelay) / float64(movieTimescale)
+		}
+		latest = math.Max(latest, offsets[i])
+	}
+
+	shifts := make([]uint64, len(tracks))
+	for i, track := range tracks {
+		shifts[i] = uint64(math.Round((latest - offsets[i]) * float64(track.timescale)))
+	}
+	return shifts
+}
+
+// firstSampleAt returns the index of the first sample of track decoded at
+// or after time t, given in the reference timescale. shift is added to the
+// track's decode times first.
+func firstSampleAt(track *mp4Track, shift, t uint64, timescale uint32) int {
+	return sort.Search(len(track.samples), func(i int) bool {
+		return (track.samples[i].dts+shift)*uint64(timescale) >= t*uint64(track.timescale)
+	})
+}
+
+// playlist renders the VOD media playlist
+func (idx *hlsIndex) playlist() []byte {
+	target := 1
+	for _, segment := range idx.segments {
+		if d := int(math.Ceil(segment.duration)); d > target {
+			target = d
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", target)
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+	for i, segment := range idx.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.6f,\nseg-%d.m4s\n", segment.duration, i)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.Bytes()
+}
+
+// initSegment builds the fragmented MP4 initialization segment: the
+// original track headers and sample descriptions with empty sample tables
+func (idx *hlsIndex) initSegment() []byte {
+	w := &mp4Writer{}
+
+	ftyp := w.open("ftyp")
+	w.write([]byte("iso6"))
+	w.u32(0)
+	w.write([]byte("iso6mp41"))
+	w.close(ftyp)
+
+	moov := w.open("moov")
+	w.write(idx.movie.mvhd)
+	for _, track := range idx.tracks {
+		trak := w.open("trak")
+		w.write(track.tkhd)
+
+		mdia := w.open("mdia")
+		w.write(track.mdhd)
+		w.write(track.hdlr)
+
+		minf := w.open("minf")
+		w.write(track.mediaHeader)
+		if track.dinf != nil {
+			w.write(track.dinf)
+		} else {
+			dinf := w.open("dinf")
+			dref := w.openFull("dref", 0, 0)
+			w.u32(1)
+			w.close(w.openFull("url ", 0, 1))
+			w.close(dref)
+			w.close(dinf)
+		}
+
+		stbl := w.open("stbl")
+		w.write(track.stsd)
+		for _, typ := range []string{"stts", "stsc", "stco"} {
+			box := w.openFull(typ, 0, 0)
+			w.u32(0)
+			w.close(box)
+		}
+		stsz := w.openFull("stsz", 0, 0)
+		w.u32(0)
+		w.u32(0)
+		w.close(stsz)
+		w.close(stbl)
+
+		w.close(minf)
+		w.close(mdia)
+		w.close(trak)
+	}
+
+	mvex := w.open("mvex")
+	for _, track := range idx.tracks {
+		trex := w.openFull("trex", 0, 0)
+		w.u32(track.id)
+		w.u32(1) // sample description index
+		w.u32(0) // default duration
+		w.u32(0) // default size
+		w.u32(0) // default flags
+		w.close(trex)
+	}
+	w.close(mvex)
+	w.close(moov)
+
+	return w.buf
+}
+
+// mediaSegment builds segment n as a moof box describing the samples of
+// each track, followed by an mdat box holding their data
+func (idx *hlsIndex) mediaSegment(file io.ReaderAt, n int) ([]byte, error) {
+	segment := idx.segments[n]
+	w := &mp4Writer{}
+
+	type dataOffset struct {
+		pos    int // position of the trun data offset field
+		offset int // offset of the track's data within mdat
+	}
+	var offsets []dataOffset
+	mdatSize := 0
+
+	moof := w.open("moof")
+	mfhd := w.openFull("mfhd", 0, 0)
+	w.u32(uint32(n + 1))
+	w.close(mfhd)
+
+	for i, track := range idx.tracks {
+		samples := track.samples[segment.ranges[i][0]:segment.ranges[i][1]]
+		if len(samples) == 0 {
+			continue
+		}
+
+		traf := w.open("traf")
+		tfhd := w.openFull("tfhd", 0, tfhdDefaultBaseIsMoof)
+		w.u32(track.id)
+		w.close(tfhd)
+
+		tfdt := w.openFull("tfdt", 1, 0)
+		w.u64(samples[0].dts + idx.shifts[i])
+		w.close(tfdt)
+
+		flags := uint32(trunDataOffset | trunSampleDuration | trunSampleSize | trunSampleFlags)
+		version := uint8(0)
+		if track.hasCTO {
+			flags |= trunSampleCTSOffset
+			version = 1
+		}
+		trun := w.openFull("trun", version, flags)
+		w.u32(uint32(len(samples)))
+		offsets = append(offsets, dataOffset{pos: len(w.buf), offset: mdatSize})
+		w.u32(0)
+		for _, sample := range samples {
+			w.u32(sample.duration)
+			w.u32(sample.size)
+			if sample.sync {
+				w.u32(sampleFlagsSync)
+			} else {
+				w.u32(sampleFlagsNonSync)
+			}
+			if track.hasCTO {
+				w.u32(uint32(sample.cto))
+			}
+			mdatSize += int(sample.size)
+		}
+		w.close(trun)
+		w.close(traf)
+	}
+	w.close(moof)
+
+	if mdatSize > maxHLSSegmentSize {
+		return nil, fmt.Errorf("%w: segment %d holds %d bytes of samples", errMalformedMP4, n, mdatSize)
+	}
+
+	moofSize := len(w.buf)
+	for _, o := range offsets {
+		binary.BigEndian.PutUint32(w.buf[o.pos:], uint32(moofSize+8+o.offset))
+	}
+
+	mdat := w.open("mdat")
+	start := len(w.buf)
+	w.buf = append(w.buf, make([]byte, mdatSize)...)
+	if err := readSamples(file, idx.tracks, segment, w.buf[start:]); err != nil {
+		return nil, err
+	}
+	w.close(mdat)
+
+	return w.buf, nil
+}
+
+// readSamples copies the segment's sample data into buf, reading runs of
+// adjacent samples with a single read
+func readSamples(file io.ReaderAt, tracks []*mp4Track, segment hlsSegment, buf []byte) error {
+	pos := 0
+	var runOffset int64
+	runLength := 0
+
+	flush := func() error {
+		if runLength == 0 {
+			return nil
+		}
+		if _, err := file.ReadAt(buf[pos:pos+runLength], runOffset); err != nil {
+			return fmt.Errorf("failed to read samples: %w", err)
+		}
+		pos += runLength
+		runLength = 0
+		return nil
+	}
+
+	for i, track := range tracks {
+		for _, sample := range track.samples[segment.ranges[i][0]:segment.ranges[i][1]] {
+			if runLength > 0 && sample.offset != runOffset+int64(runLength) {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if runLength == 0 {
+				runOffset = sample.offset
+			}
+			runLength += int(sample.size)
+		}
+	}
+	return flush()
+}
+
+// handleHLS serves /hls/<path>/index.m3u8 and the init.mp4 and
+// seg-<n>.m4s files it references
+func (s *MediaServer) handleHLS(w http.ResponseWriter, r *http.Request) {
+	if s.hls == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dir, name := path.Split(strings.TrimPrefix(r.URL.Path, "/hls"))
+	_, fullPath, err := s.resolvePath(r, strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+	if !hlsExtensions[strings.ToLower(filepath.Ext(fullPath))] {
+		http.Error(w, errNoHLS.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	idx, err := s.hls.Index(file, fullPath, info)
+	if err != nil {
+		if errors.Is(err, errNotMP4) || errors.Is(err, errNoHLS) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		log.Printf("HLS: failed to index %s: %v", fullPath, err)
+		http.Error(w, "Unable to package file", http.StatusUnprocessableEntity)
+		return
+	}
+
+	var data []byte
+	contentType := "video/mp4"
+	switch {
+	case name == "index.m3u8":
+		data = idx.playlist()
+		contentType = "application/vnd.apple.mpegurl"
+	case name == "init.mp4":
+		data, err = s.hls.cached(segmentKey(fullPath, idx, -1), func() ([]byte, error) {
+			return idx.initSegment(), nil
+		})
+	case strings.HasPrefix(name, "seg-") && strings.HasSuffix(name, ".m4s"):
+		n, convErr := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "seg-"), ".m4s"))
+		if convErr != nil || n < 0 || n >= len(idx.segments) {
+			http.NotFound(w, r)
+			return
+		}
+		data, err = s.hls.cached(segmentKey(fullPath, idx, n), func() ([]byte, error) {
+			return idx.mediaSegment(file, n)
+		})
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("HLS: failed to build %s for %s: %v", name, fullPath, err)
+		http.Error(w, "Unable to package file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", s.cacheControl(time.Hour))
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(data))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleHLS(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"clip.mp4":  testTrackFile([]uint32{10, 20, 30}, testBox("stco", u32s(0, 1, 24))),
+		"bad.mp4":   testTrackFile([]uint32{10, 20}, testBox("stco", u32s(0, 1, 0xfffffff0))),
+		"plain.mp4": []byte("not really an mp4 file"),
+		"notes.txt": []byte("text"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &MediaServer{
+		config:  &Config{},
+		library: NewLibrary(MediaConfig{Directory: dir}),
+		types:   NewMediaTypes(nil, nil),
+		hls:     NewHLSPackager(time.Second, 1<<20),
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		wantStatus  int
+		wantType    string
+		wantContain string
+	}{
+		{"playlist", "/hls/clip.mp4/index.m3u8", http.StatusOK, "application/vnd.apple.mpegurl", "seg-2.m4s\n#EXT-X-ENDLIST"},
+		{"init segment", "/hls/clip.mp4/init.mp4", http.StatusOK, "video/mp4", "mvex"},
+		{"media segment", "/hls/clip.mp4/seg-1.m4s", http.StatusOK, "video/mp4", strings.Repeat("\x02", 20)},
+		{"segment past the end", "/hls/clip.mp4/seg-3.m4s", http.StatusNotFound, "", ""},
+		{"negative segment", "/hls/clip.mp4/seg--1.m4s", http.StatusNotFound, "", ""},
+		{"huge segment number", "/hls/clip.mp4/seg-99999999999999999999.m4s", http.StatusNotFound, "", ""},
+		{"unknown file name", "/hls/clip.mp4/other.ts", http.StatusNotFound, "", ""},
+		{"samples outside the file", "/hls/bad.mp4/index.m3u8", http.StatusUnprocessableEntity, "", ""},
+		{"not an mp4 file", "/hls/plain.mp4/index.m3u8", http.StatusUnsupportedMediaType, "", ""},
+		{"other extension", "/hls/notes.txt/index.m3u8", http.StatusUnsupportedMediaType, "", ""},
+		{"missing file", "/hls/missing.mp4/index.m3u8", http.StatusNotFound, "", ""},
+		{"escaping path", "/hls/../../etc/passwd.mp4/index.m3u8", http.StatusNotFound, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleHLS(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if !bytes.Contains(w.Body.Bytes(), []byte(tt.wantContain)) {
+				t.Errorf("body does not contain %q:\n%q", tt.wantContain, w.Body)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	(&MediaServer{}).handleHLS(w, httptest.NewRequest("GET", "/hls/clip.mp4/index.m3u8", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status with HLS disabled = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -78,6 +78,7 @@ create_directories() {
     print_info "Creating directories..."
     mkdir -p $INSTALL_DIR
     mkdir -p $INSTALL_DIR/media
+    mkdir -p $INSTALL_DIR/data
     mkdir -p /var/log/$SERVICE_NAME
     print_success "Directories created"
 }
@@ -111,6 +112,7 @@ set_permissions() {
     chmod 755 $INSTALL_DIR
     chmod 644 $INSTALL_DIR/config.yaml
     chmod 755 $INSTALL_DIR/media
+    chmod 750 $INSTALL_DIR/data
     print_success "Permissions set"
 }
 
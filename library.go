@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errUnknownRoot is returned for paths below no media root
+var errUnknownRoot = fmt.Errorf("unknown media root: %w", fs.ErrNotExist)
+
+// MediaRoot is a directory of the media library, served below its mount
+// point. A library with a single directory mounts it at "/"; named roots
+// are mounted as top-level folders.
+type MediaRoot struct {
+	Name       string
+	Directory  string
+	Mount      string
+	ReadOnly   bool
+	ShowHidden bool
+	Symlinks   SymlinkPolicy
+
+	// users lists the users allowed to access the root; empty allows all
+	users map[string]bool
+}
+
+// Allows reports whether a user may access the root
+func (root *MediaRoot) Allows(user string) bool {
+	return len(root.users) == 0 || root.users[user]
+}
+
+// Hidden reports whether a file name is left out of the root. The trash is
+// hidden even when hidden files are shown.
+func (root *MediaRoot) Hidden(name string) bool {
+	return name == trashDirName || (!root.ShowHidden && isHidden(name))
+}
+
+// FullPath returns the filesystem path of a clean URL path below the root
+func (root *MediaRoot) FullPath(urlPath string) string {
+	rel := strings.TrimPrefix(urlPath, root.Mount)
+	return filepath.Join(root.Directory, filepath.FromSlash(rel))
+}
+
+// URLPath returns the URL path of a filesystem path below the root
+func (root *MediaRoot) URLPath(fullPath string) (string, bool) {
+	rel, err := filepath.Rel(root.Directory, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path.Join(root.Mount, filepath.ToSlash(rel)), true
+}
+
+// Library maps URL paths onto the roots of the media library
+type Library struct {
+	roots []*MediaRoot
+}
+
+// NewLibrary creates the library of a media configuration
+func NewLibrary(config MediaConfig) *Library {
+	if len(config.Roots) == 0 {
+		return &Library{roots: []*MediaRoot{{Directory: config.Directory, Mount: "/", Symlinks: config.Symlinks}}}
+	}
+
+	library := &Library{}
+	for _, rc := range config.Roots {
+		root := &MediaRoot{
+			Name:       rc.Name,
+			Directory:  rc.Directory,
+			Mount:      "/" + rc.Name,
+			ReadOnly:   rc.ReadOnly,
+			ShowHidden: rc.ShowHidden,
+			Symlinks:   defaultSymlinkPolicy(rc.Symlinks, config.Symlinks),
+			users:      make(map[string]bool),
+		}
+		for _, user := range rc.Users {
+			root.users[user] = true
+		}
+		library.roots = append(library.roots, root)
+	}
+	return library
+}
+
+// defaultSymlinkPolicy returns the policy of a root, falling back to the
+// policy of the library
+func defaultSymlinkPolicy(policy, library SymlinkPolicy) SymlinkPolicy {
+	if policy == "" {
+		return library
+	}
+	return policy
+}
+
+// Roots returns the roots of the library
+func (l *Library) Roots() []*MediaRoot {
+	return l.roots
+}
+
+// Virtual reports whether the top level of the library is a virtual folder
+// holding the roots rather than a directory
+func (l *Library) Virtual() bool {
+	return l.roots[0].Mount != "/"
+}
+
+// Root returns the root a clean URL path belongs to, or nil for the
+// virtual top level and for paths below no root
+func (l *Library) Root(urlPath string) *MediaRoot {
+	for _, root := range l.roots {
+		if root.Mount == "/" || urlPath == root.Mount || strings.HasPrefix(urlPath, root.Mount+"/") {
+			return root
+		}
+	}
+	return nil
+}
+
+// IsMount reports whether a clean URL path is the top level or the mount
+// point of a root, which cannot be renamed or deleted
+func (l *Library) IsMount(urlPath string) bool {
+	if urlPath == "/" {
+		return true
+	}
+	root := l.Root(urlPath)
+	return root != nil && root.Mount == urlPath
+}
+
+// Allows reports whether a user may access a clean URL path. The virtual
+// top level is open to everyone, listing only the roots they may access.
+func (l *Library) Allows(user, urlPath string) bool {
+	root := l.Root(urlPath)
+	return root == nil || root.Allows(user)
+}
+
+// Hidden reports whether any element of a clean URL path is hidden in its
+// root
+func (l *Library) Hidden(urlPath string) bool {
+	root := l.Root(urlPath)
+	if root == nil {
+		return false
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(urlPath, root.Mount), "/") {
+		if part != "" && root.Hidden(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the entries of the virtual top level: a folder for each
+// root the user may access
+func (l *Library) List(user string, types *MediaTypes) []FileInfo {
+	var files []FileInfo
+	for _, root := range l.roots {
+		if !root.Allows(user) {
+			continue
+		}
+		info, err := os.Stat(root.Directory)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		file := newFileInfo(root.Mount, root.Directory, info, types)
+		file.Name = root.Name
+		files = append(files, file)
+	}
+	sortByName(files)
+	return files
+}
+
+// virtualDirInfo describes the virtual top level of a library with several
+// roots
+type virtualDirInfo struct{}
+
+func (virtualDirInfo) Name() string       { return "/" }
+func (virtualDirInfo) Size() int64        { return 0 }
+func (virtualDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (virtualDirInfo) ModTime() time.Time { return time.Time{} }
+func (virtualDirInfo) IsDir() bool        { return true }
+func (virtualDirInfo) Sys() interface{}   { return nil }
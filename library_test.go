@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testLibrary returns a library of three roots below base: movies, music
+// with hidden files shown, and private for bob alone
+func testLibrary(base string) *Library {
+	return NewLibrary(MediaConfig{
+		Symlinks: SymlinksDeny,
+		Roots: []MediaRootConfig{
+			{Name: "movies", Directory: filepath.Join(base, "movies"), ReadOnly: true},
+			{Name: "music", Directory: filepath.Join(base, "music"), ShowHidden: true, Symlinks: SymlinksAllowAll},
+			{Name: "private", Directory: filepath.Join(base, "private"), Users: []string{"bob"}},
+		},
+	})
+}
+
+func TestNewLibrary(t *testing.T) {
+	single := NewLibrary(MediaConfig{Directory: "/srv/media", Symlinks: SymlinksWithinRoot})
+	if single.Virtual() || len(single.Roots()) != 1 {
+		t.Fatalf("library of a directory = %+v, want one root at the top level", single.Roots())
+	}
+	if root := single.Roots()[0]; root.Mount != "/" || root.Directory != "/srv/media" || root.Symlinks != SymlinksWithinRoot || !root.Allows("anyone") {
+		t.Errorf("root = %+v", root)
+	}
+
+	library := testLibrary("/srv")
+	if !library.Virtual() || len(library.Roots()) != 3 {
+		t.Fatalf("library of roots = %+v, want three roots below a virtual top level", library.Roots())
+	}
+	movies, music := library.Roots()[0], library.Roots()[1]
+	if movies.Mount != "/movies" || !movies.ReadOnly || movies.Symlinks != SymlinksDeny {
+		t.Errorf("movies root = %+v, want the library's symlink policy", movies)
+	}
+	if music.Mount != "/music" || !music.ShowHidden || music.Symlinks != SymlinksAllowAll {
+		t.Errorf("music root = %+v, want its own symlink policy", music)
+	}
+}
+
+func TestLibraryRoot(t *testing.T) {
+	library := testLibrary("/srv")
+
+	tests := []struct {
+		urlPath   string
+		wantRoot  string
+		wantMount bool
+	}{
+		{"/", "", true},
+		{"/movies", "movies", true},
+		{"/movies/a.mp4", "movies", false},
+		{"/movies/sub/a.mp4", "movies", false},
+		{"/music/a.mp3", "music", false},
+		{"/movies-extra/a.mp4", "", false},
+		{"/mov", "", false},
+		{"/other", "", false},
+	}
+
+	for _, tt := range tests {
+		var got string
+		if root := library.Root(tt.urlPath); root != nil {
+			got = root.Name
+		}
+		if got != tt.wantRoot {
+			t.Errorf("Root(%q) = %q, want %q", tt.urlPath, got, tt.wantRoot)
+		}
+		if mount := library.IsMount(tt.urlPath); mount != tt.wantMount {
+			t.Errorf("IsMount(%q) = %v, want %v", tt.urlPath, mount, tt.wantMount)
+		}
+	}
+
+	// A single directory holds every path
+	single := NewLibrary(MediaConfig{Directory: "/srv/media"})
+	if root := single.Root("/movies/a.mp4"); root == nil || root.Mount != "/" {
+		t.Errorf("Root() of a single directory = %+v, want the top level", root)
+	}
+	if !single.IsMount("/") || single.IsMount("/movies") {
+		t.Error("IsMount() of a single directory is true below the top level")
+	}
+}
+
+func TestLibraryAllows(t *testing.T) {
+	library := testLibrary("/srv")
+
+	tests := []struct {
+		user    string
+		urlPath string
+		want    bool
+	}{
+		{"alice", "/", true},
+		{"alice", "/movies/a.mp4", true},
+		{"", "/movies/a.mp4", true},
+		{"alice", "/private", false},
+		{"alice", "/private/x.mp4", false},
+		{"", "/private/x.mp4", false},
+		{"Bob", "/private/x.mp4", false},
+		{"bob", "/private/x.mp4", true},
+		{"alice", "/private-other/x.mp4", true},
+	}
+
+	for _, tt := range tests {
+		if got := library.Allows(tt.user, tt.urlPath); got != tt.want {
+			t.Errorf("Allows(%q, %q) = %v, want %v", tt.user, tt.urlPath, got, tt.want)
+		}
+	}
+}
+
+func TestLibraryHidden(t *testing.T) {
+	library := testLibrary("/srv")
+
+	tests := []struct {
+		urlPath string
+		want    bool
+	}{
+		{"/", false},
+		{"/movies", false},
+		{"/movies/a.mp4", false},
+		{"/movies/.a.mp4", true},
+		{"/movies/.sub/a.mp4", true},
+		{"/movies/sub/.a.mp4", true},
+		{"/movies/" + trashDirName, true},
+		{"/music/.a.mp3", false},
+		{"/music/.sub/a.mp3", false},
+		{"/music/" + trashDirName + "/id/a.mp3", true},
+		{"/.movies/a.mp4", false},
+	}
+
+	for _, tt := range tests {
+		if got := library.Hidden(tt.urlPath); got != tt.want {
+			t.Errorf("Hidden(%q) = %v, want %v", tt.urlPath, got, tt.want)
+		}
+	}
+}
+
+func TestMediaRootPaths(t *testing.T) {
+	movies := testLibrary("/srv").Roots()[0]
+	single := NewLibrary(MediaConfig{Directory: "/srv/media"}).Roots()[0]
+
+	tests := []struct {
+		root     *MediaRoot
+		urlPath  string
+		fullPath string
+	}{
+		{movies, "/movies", "/srv/movies"},
+		{movies, "/movies/a.mp4", "/srv/movies/a.mp4"},
+		{movies, "/movies/sub/..a.mp4", "/srv/movies/sub/..a.mp4"},
+		{single, "/", "/srv/media"},
+		{single, "/sub/a.mp4", "/srv/media/sub/a.mp4"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.root.FullPath(tt.urlPath); got != filepath.FromSlash(tt.fullPath) {
+			t.Errorf("FullPath(%q) = %q, want %q", tt.urlPath, got, tt.fullPath)
+		}
+		if got, ok := tt.root.URLPath(filepath.FromSlash(tt.fullPath)); !ok || got != tt.urlPath {
+			t.Errorf("URLPath(%q) = %q, %v, want %q", tt.fullPath, got, ok, tt.urlPath)
+		}
+	}
+
+	for _, outside := range []string{"/srv", "/srv/movies-extra/a.mp4", "/srv/music/a.mp3", "/etc/passwd"} {
+		if got, ok := movies.URLPath(filepath.FromSlash(outside)); ok {
+			t.Errorf("URLPath(%q) = %q, want it outside the root", outside, got)
+		}
+	}
+}
+
+func TestLibraryList(t *testing.T) {
+	base := t.TempDir()
+	writeTestFiles(t, base, "movies/", "music/", "private/")
+	library := testLibrary(base)
+	types := NewMediaTypes(nil, nil)
+
+	tests := []struct {
+		user string
+		want []string
+	}{
+		{"alice", []string{"movies", "music"}},
+		{"bob", []string{"movies", "music", "private"}},
+	}
+
+	for _, tt := range tests {
+		var names []string
+		for _, file := range library.List(tt.user, types) {
+			if !file.IsDir || file.Path != "/"+file.Name {
+				t.Errorf("root entry = %+v, want a folder at its mount point", file)
+			}
+			names = append(names, file.Name)
+		}
+		if !equalStrings(names, tt.want) {
+			t.Errorf("List(%q) = %v, want %v", tt.user, names, tt.want)
+		}
+	}
+
+	// Roots whose directory is missing are left out
+	missing := NewLibrary(MediaConfig{Roots: []MediaRootConfig{
+		{Name: "gone", Directory: filepath.Join(base, "gone")},
+		{Name: "file", Directory: filepath.Join(base, "movies", "a.mp4")},
+		{Name: "movies", Directory: filepath.Join(base, "movies")},
+	}})
+	writeTestFiles(t, base, "movies/a.mp4")
+	var names []string
+	for _, file := range missing.List("", types) {
+		names = append(names, file.Name)
+	}
+	if want := []string{"movies"}; !equalStrings(names, want) {
+		t.Errorf("List() = %v, want %v", names, want)
+	}
+}
+
+func TestHandleAPIListRoots(t *testing.T) {
+	base := t.TempDir()
+	writeTestFiles(t, base, "movies/a.mp4", "music/b.mp3", "music/.c.mp3", "private/x.mp4")
+	s := &MediaServer{library: testLibrary(base), types: NewMediaTypes(nil, nil)}
+
+	tests := []struct {
+		user       string
+		path       string
+		wantStatus int
+		wantPaths  []string
+	}{
+		{"alice", "/api/list/", http.StatusOK, []string{"/movies", "/music"}},
+		{"bob", "/api/list/", http.StatusOK, []string{"/movies", "/music", "/private"}},
+		{"alice", "/api/list/movies/", http.StatusOK, []string{"/movies/a.mp4"}},
+		{"alice", "/api/list/music/", http.StatusOK, []string{"/music/.c.mp3", "/music/b.mp3"}},
+		{"alice", "/api/list/private/", http.StatusForbidden, nil},
+		{"bob", "/api/list/private/", http.StatusOK, []string{"/private/x.mp4"}},
+		{"alice", "/api/list/movies-extra/", http.StatusNotFound, nil},
+		{"alice", "/api/list/movies/../private/", http.StatusForbidden, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user+" "+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, tt.user))
+			w := httptest.NewRecorder()
+			s.handleAPIList(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantPaths == nil {
+				return
+			}
+
+			var listing DirectoryListing
+			if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, file := range listing.Files {
+				paths = append(paths, file.Path)
+			}
+			if !equalStrings(paths, tt.wantPaths) {
+				t.Errorf("files = %v, want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestMediaRootsConfigValidation(t *testing.T) {
+	hash := testPasswordHash(t, "secret")
+	auth := "auth:\n  enabled: true\n  users: [{username: bob, password_hash: '" + hash + "'}]\n"
+
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"roots", "media:\n  roots: [{name: movies, directory: /a}, {name: music, directory: /b, read_only: true}]\n", ""},
+		{"root users", auth + "media:\n  roots: [{name: movies, directory: /a, users: [bob]}]\n", ""},
+		{"root symlink policy", "media:\n  roots: [{name: movies, directory: /a, symlinks: allow_all}]\n", ""},
+		{"directory and roots", "media:\n  directory: /a\n  roots: [{name: movies, directory: /b}]\n", "cannot both be configured"},
+		{"empty name", "media:\n  roots: [{name: '', directory: /a}]\n", "invalid name for media root 1"},
+		{"nested name", "media:\n  roots: [{name: movies/new, directory: /a}]\n", "invalid name"},
+		{"hidden name", "media:\n  roots: [{name: .movies, directory: /a}]\n", "invalid name"},
+		{"duplicate name", "media:\n  roots: [{name: movies, directory: /a}, {name: movies, directory: /b}]\n", "configured more than once"},
+		{"empty directory", "media:\n  roots: [{name: movies}]\n", "directory cannot be empty"},
+		{"invalid symlink policy", "media:\n  roots: [{name: movies, directory: /a, symlinks: sometimes}]\n", "invalid symlink policy for media root"},
+		{"users without authentication", "media:\n  roots: [{name: movies, directory: /a, users: [bob]}]\n", "authentication is disabled"},
+		{"unknown user", auth + "media:\n  roots: [{name: movies, directory: /a, users: [alice]}]\n", `unknown user "alice"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.config)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				if config.Media.Directory != "" {
+					t.Errorf("directory = %q, want none with roots", config.Media.Directory)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	config := &Config{Media: MediaConfig{Roots: []MediaRootConfig{{Name: "a", Directory: "/a"}, {Name: "b", Directory: "/b"}}}}
+	if got := config.MediaDirectories(); !equalStrings(got, []string{"/a", "/b"}) {
+		t.Errorf("MediaDirectories() = %v, want the roots' directories", got)
+	}
+	config = &Config{Media: MediaConfig{Directory: "/media"}}
+	if got := config.MediaDirectories(); !equalStrings(got, []string{"/media"}) {
+		t.Errorf("MediaDirectories() = %v, want the directory", got)
+	}
+}
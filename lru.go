@@ -0,0 +1,83 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache is a size-bounded least recently used cache. Each entry is
+// added with its approximate size in bytes, and the least recently used
+// entries are evicted once the total exceeds the limit.
+type lruCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	used     int64
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+// newLRUCache creates a cache holding at most maxBytes
+func newLRUCache(maxBytes int64) *lruCache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached value for key
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// Add stores a value, replacing any previous value for key. Values larger
+// than the whole cache are not stored.
+func (c *lruCache) Add(key string, value interface{}, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+	if size > c.maxBytes {
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, size: size})
+	c.used += size
+	for c.used > c.maxBytes {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// Remove deletes key from the cache
+func (c *lruCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// removeElement unlinks an entry; the caller must hold c.mu
+func (c *lruCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*lruEntry)
+	c.order.Remove(elem)
+	delete(c.items, entry.key)
+	c.used -= entry.size
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 )
 
 const (
@@ -19,6 +25,7 @@ func main() {
 		showVer    = flag.Bool("version", false, "Show version information")
 		help       = flag.Bool("help", false, "Show help information")
 		genConfig  = flag.Bool("gen-config", false, "Generate default configuration file")
+		hashPass   = flag.Bool("hash-password", false, "Read a password from stdin and print its bcrypt hash for config.yaml")
 	)
 
 	flag.Usage = func() {
@@ -30,6 +37,7 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  %s                    # Start server with default config\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -config /path/to/config.yaml\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -gen-config        # Generate default config file\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -hash-password     # Generate a password hash for an auth user\n", os.Args[0])
 	}
 
 	flag.Parse()
@@ -52,23 +60,76 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *hashPass {
+		if err := printPasswordHash(); err != nil {
+			log.Fatalf("Failed to hash password: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	// Load configuration
 	config, err := loadOrCreateConfig(*configFile)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Validate media directory
-	if err := validateMediaDirectory(config.Media.Directory); err != nil {
-		log.Fatalf("Media directory validation failed: %v", err)
+	// Validate media directories
+	for _, dir := range config.MediaDirectories() {
+		if err := validateMediaDirectory(dir); err != nil {
+			log.Fatalf("Media directory validation failed: %v", err)
+		}
 	}
 
 	// Create and start server
-	server := NewMediaServer(config)
+	server, err := NewMediaServer(config)
+	if err != nil {
+		log.Fatalf("Failed to initialize server: %v", err)
+	}
 	log.Printf("HTTP Media Server v%s starting...", version)
 
-	if err := server.Start(); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Start()
+	}()
+
+	// Handle signals: SIGINT/SIGTERM shut down gracefully, SIGHUP reloads
+	// the configuration file
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				log.Fatalf("Server failed to start: %v", err)
+			}
+			return
+
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloaded, err := reloadConfig(*configFile)
+				if err != nil {
+					log.Printf("Configuration reload failed, keeping current configuration: %v", err)
+					continue
+				}
+				if err := server.Reload(reloaded); err != nil {
+					log.Printf("Configuration reload failed, keeping current configuration: %v", err)
+					continue
+				}
+				config = reloaded
+				continue
+			}
+
+			log.Printf("Received %s, shutting down (drain timeout %v)...", sig, config.Server.ShutdownTimeout)
+			ctx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
+			if err := server.Stop(ctx); err != nil {
+				log.Printf("Shutdown did not complete cleanly: %v", err)
+			}
+			cancel()
+			<-errCh
+			log.Printf("Server stopped")
+			return
+		}
 	}
 }
 
@@ -91,6 +152,23 @@ func loadOrCreateConfig(configPath string) (*Config, error) {
 	return config, nil
 }
 
+// reloadConfig loads and validates the configuration file for a reload
+func reloadConfig(configPath string) (*Config, error) {
+	log.Printf("Reloading configuration from: %s", configPath)
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range config.MediaDirectories() {
+		if err := validateMediaDirectory(dir); err != nil {
+			return nil, fmt.Errorf("media directory validation failed: %w", err)
+		}
+	}
+
+	return config, nil
+}
+
 // generateConfig generates a default configuration file
 func generateConfig(configPath string) error {
 	// Create directory if it doesn't exist
@@ -104,6 +182,29 @@ func generateConfig(configPath string) error {
 	return CreateDefaultConfig(configPath)
 }
 
+// printPasswordHash reads a password from stdin and prints a bcrypt hash
+// suitable for the password_hash field of an auth user
+func printPasswordHash() error {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return fmt.Errorf("password cannot be empty")
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("password_hash: \"%s\"\n", hash)
+	return nil
+}
+
 // validateMediaDirectory validates that the media directory exists and is accessible
 func validateMediaDirectory(mediaDir string) error {
 	absPath, err := filepath.Abs(mediaDir)
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+)
+
+// Matroska element IDs, including their length marker bits
+const (
+	ebmlHeaderID        = 0x1a45dfa3
+	ebmlDocTypeID       = 0x4282
+	mkvSegmentID        = 0x18538067
+	mkvSeekHeadID       = 0x114d9b74
+	mkvSeekID           = 0x4dbb
+	mkvSeekElementID    = 0x53ab
+	mkvSeekPositionID   = 0x53ac
+	mkvInfoID           = 0x1549a966
+	mkvTimestampScaleID = 0x2ad7b1
+	mkvDurationID       = 0x4489
+	mkvTitleID          = 0x7ba9
+	mkvTracksID         = 0x1654ae6b
+	mkvTrackEntryID     = 0xae
+	mkvTrackTypeID      = 0x83
+	mkvCodecID          = 0x86
+	mkvVideoID          = 0xe0
+	mkvPixelWidthID     = 0xb0
+	mkvPixelHeightID    = 0xba
+	mkvAudioID          = 0xe1
+	mkvSamplingFreqID   = 0xb5
+	mkvChannelsID       = 0x9f
+	mkvTagsID           = 0x1254c367
+	mkvTagID            = 0x7373
+	mkvSimpleTagID      = 0x67c8
+	mkvTagNameID        = 0x45a3
+	mkvTagStringID      = 0x4487
+	mkvClusterID        = 0x1f43b675
+)
+
+const (
+	// maxEBMLElementSize bounds the size of the elements read into memory
+	maxEBMLElementSize = 16 << 20
+
+	// maxEBMLTopLevel bounds the number of segment children scanned
+	maxEBMLTopLevel = 1024
+)
+
+var errNotMatroska = errors.New("not a Matroska file")
+
+// matroskaCodecNames maps Matroska codec IDs to codec names
+var matroskaCodecNames = map[string]string{
+	"V_MPEG4/ISO/AVC":  "H.264",
+	"V_MPEGH/ISO/HEVC": "HEVC",
+	"V_AV1":            "AV1",
+	"V_VP8":            "VP8",
+	"V_VP9":            "VP9",
+	"V_MPEG4/ISO/ASP":  "MPEG-4",
+	"V_MPEG2":          "MPEG-2",
+	"V_THEORA":         "Theora",
+	"A_AAC":            "AAC",
+	"A_OPUS":           "Opus",
+	"A_VORBIS":         "Vorbis",
+	"A_FLAC":           "FLAC",
+	"A_AC3":            "AC-3",
+	"A_EAC3":           "E-AC-3",
+	"A_DTS":            "DTS",
+	"A_TRUEHD":         "TrueHD",
+	"A_MPEG/L3":        "MP3",
+}
+
+// matroskaTagNames maps Matroska tag names to tag names
+var matroskaTagNames = map[string]string{
+	"TITLE":         "title",
+	"ARTIST":        "artist",
+	"ALBUM":         "album",
+	"DATE_RELEASED": "date",
+	"DATE_RECORDED": "date",
+	"GENRE":         "genre",
+	"COMMENT":       "comment",
+	"DESCRIPTION":   "description",
+	"PART_NUMBER":   "track",
+}
+
+// ebmlElement is an element held in memory
+type ebmlElement struct {
+	id   uint32
+	data []byte
+}
+
+// ebmlVint decodes a variable length integer, returning its value with
+// the length marker removed, its length, and whether all value bits are
+// set, which marks an unknown size
+func ebmlVint(b []byte) (value uint64, length int, unknown bool, ok bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false, false
+	}
+	length = 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || len(b) < length {
+		return 0, 0, false, false
+	}
+	value = uint64(b[0] & (0xff >> length))
+	for _, c := range b[1:length] {
+		value = value<<8 | uint64(c)
+	}
+	return value, length, value == 1<<(7*length)-1, true
+}
+
+// ebmlHeader decodes an element ID and size. size is -1 for elements of
+// unknown size.
+func ebmlHeader(b []byte) (id uint32, size int64, headerLen int, ok bool) {
+	_, idLen, _, ok := ebmlVint(b)
+	if !ok || idLen > 4 {
+		return 0, 0, 0, false
+	}
+	for _, c := range b[:idLen] {
+		id = id<<8 | uint32(c)
+	}
+	value, sizeLen, unknown, ok := ebmlVint(b[idLen:])
+	if !ok || value > math.MaxInt64 {
+		return 0, 0, 0, false
+	}
+	size = int64(value)
+	if unknown {
+		size = -1
+	}
+	return id, size, idLen + sizeLen, true
+}
+
+// readEBMLHeader reads an element header from a file
+func readEBMLHeader(r io.ReaderAt, offset int64) (uint32, int64, int, error) {
+	var buf [12]byte
+	n, err := r.ReadAt(buf[:], offset)
+	if n == 0 {
+		if err == nil || err == io.EOF {
+			err = errNotMatroska
+		}
+		return 0, 0, 0, err
+	}
+	id, size, headerLen, ok := ebmlHeader(buf[:n])
+	if !ok {
+		return 0, 0, 0, errNotMatroska
+	}
+	return id, size, headerLen, nil
+}
+
+// readEBMLElement reads a whole element of known size into memory. The
+// element must end within the first end bytes of the file, so that a
+// corrupt size cannot make it allocate more than the file holds.
+func readEBMLElement(r io.ReaderAt, offset, end int64) (ebmlElement, error) {
+	id, size, headerLen, err := readEBMLHeader(r, offset)
+	if err != nil {
+		return ebmlElement{}, err
+	}
+	if size < 0 || size > maxEBMLElementSize || size > end-offset-int64(headerLen) {
+		return ebmlElement{}, errNotMatroska
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, offset+int64(headerLen)); err != nil {
+		return ebmlElement{}, err
+	}
+	return ebmlElement{id: id, data: data}, nil
+}
+
+// ebmlChildren splits element data into its children. Malformed trailing
+// data is ignored.
+func ebmlChildren(data []byte) []ebmlElement {
+	var children []ebmlElement
+	for len(data) > 0 {
+		id, size, headerLen, ok := ebmlHeader(data)
+		if !ok || size < 0 || size > int64(len(data)-headerLen) {
+			break
+		}
+		children = append(children, ebmlElement{id: id, data: data[headerLen : headerLen+int(size)]})
+		data = data[headerLen+int(size):]
+	}
+	return children
+}
+
+// ebmlUint decodes an unsigned integer element
+func ebmlUint(data []byte) uint64 {
+	var v uint64
+	for _, c := range data {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// ebmlFloat decodes a float element
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+// ebmlString decodes a string element
+func ebmlString(data []byte) string {
+	return strings.TrimRight(string(data), "\x00")
+}
+
+// probeMatroska reads Matroska and WebM files. The segment information,
+// tracks and tags are located through the seek head when they are not
+// found before the first cluster.
+func probeMatroska(r io.ReaderAt, size int64) (*MediaMetadata, error) {
+	header, err := readEBMLElement(r, 0, size)
+	if err != nil || header.id != ebmlHeaderID {
+		return nil, errNotMatroska
+	}
+	meta := &MediaMetadata{Format: "matroska"}
+	for _, child := range ebmlChildren(header.data) {
+		if child.id == ebmlDocTypeID {
+			meta.Format = ebmlString(child.data)
+		}
+	}
+
+	// The segment follows the EBML header
+	_, _, headerLen, _ := readEBMLHeader(r, 0)
+	segmentOffset := int64(headerLen) + int64(len(header.data))
+	id, segmentSize, headerLen, err := readEBMLHeader(r, segmentOffset)
+	if err != nil || id != mkvSegmentID {
+		return nil, errNotMatroska
+	}
+	start := segmentOffset + int64(headerLen)
+	end := size
+	if segmentSize >= 0 && segmentSize < end-start {
+		end = start + segmentSize
+	}
+
+	parsed := make(map[uint32]bool)
+	seek := make(map[uint32]int64)
+	timestampScale := uint64(1000000)
+	var duration float64
+
+	parse := func(element ebmlElement) {
+		parsed[element.id] = true
+		switch element.id {
+		case mkvSeekHeadID:
+			for _, entry := range ebmlChildren(element.data) {
+				if entry.id != mkvSeekID {
+					continue
+				}
+				var target uint32
+				var position int64 = -1
+				for _, field := range ebmlChildren(entry.data) {
+					switch field.id {
+					case mkvSeekElementID:
+						target = uint32(ebmlUint(field.data))
+					case mkvSeekPositionID:
+						position = int64(ebmlUint(field.data))
+					}
+				}
+				if _, ok := seek[target]; !ok && position >= 0 && position < end-start {
+					seek[target] = start + position
+				}
+			}
+		case mkvInfoID:
+			for _, field := range ebmlChildren(element.data) {
+				switch field.id {
+				case mkvTimestampScaleID:
+					if v := ebmlUint(field.data); v > 0 {
+						timestampScale = v
+					}
+				case mkvDurationID:
+					duration = ebmlFloat(field.data)
+				case mkvTitleID:
+					meta.setTag("title", ebmlString(field.data))
+				}
+			}
+		case mkvTracksID:
+			parseMatroskaTracks(element.data, meta)
+		case mkvTagsID:
+			parseMatroskaTags(element.data, meta)
+		}
+	}
+
+	// Scan the segment up to the first cluster, or the first element that
+	// does not fit in it
+	offset := start
+	for i := 0; i < maxEBMLTopLevel && offset < end; i++ {
+		id, elementSize, headerLen, err := readEBMLHeader(r, offset)
+		if err != nil || id == mkvClusterID || elementSize < 0 || elementSize > end-offset-int64(headerLen) {
+			break
+		}
+		switch id {
+		case mkvSeekHeadID, mkvInfoID, mkvTracksID, mkvTagsID:
+			if element, err := readEBMLElement(r, offset, end); err == nil {
+				parse(element)
+			}
+		}
+		offset += int64(headerLen) + elementSize
+	}
+
+	// Follow the seek head to elements stored after the clusters
+	for _, id := range []uint32{mkvInfoID, mkvTracksID, mkvTagsID} {
+		position, ok := seek[id]
+		if parsed[id] || !ok || position >= end {
+			continue
+		}
+		if element, err := readEBMLElement(r, position, end); err == nil && element.id == id {
+			parse(element)
+		}
+	}
+
+	if !parsed[mkvInfoID] && !parsed[mkvTracksID] {
+		return nil, errNotMatroska
+	}
+	meta.Duration = duration * float64(timestampScale) / 1e9
+	return meta, nil
+}
+
+// parseMatroskaTracks reads the first video and audio track of a Tracks
+// element
+func parseMatroskaTracks(data []byte, meta *MediaMetadata) {
+	for _, entry := range ebmlChildren(data) {
+		if entry.id != mkvTrackEntryID {
+			continue
+		}
+		var trackType uint64
+		var codec string
+		var video, audio []byte
+		for _, field := range ebmlChildren(entry.data) {
+			switch field.id {
+			case mkvTrackTypeID:
+				trackType = ebmlUint(field.data)
+			case mkvCodecID:
+				codec = ebmlString(field.data)
+			case mkvVideoID:
+				video = field.data
+			case mkvAudioID:
+				audio = field.data
+			}
+		}
+		if name, ok := matroskaCodecNames[codec]; ok {
+			codec = name
+		}
+
+		switch {
+		case trackType == 1 && meta.VideoCodec == "":
+			meta.VideoCodec = codec
+			for _, field := range ebmlChildren(video) {
+				switch field.id {
+				case mkvPixelWidthID:
+					meta.Width = int(ebmlUint(field.data))
+				case mkvPixelHeightID:
+					meta.Height = int(ebmlUint(field.data))
+				}
+			}
+		case trackType == 2 && meta.AudioCodec == "":
+			meta.AudioCodec = codec
+			meta.Channels = 1
+			for _, field := range ebmlChildren(audio) {
+				switch field.id {
+				case mkvSamplingFreqID:
+					meta.SampleRate = int(ebmlFloat(field.data))
+				case mkvChannelsID:
+					meta.Channels = int(ebmlUint(field.data))
+				}
+			}
+		}
+	}
+}
+
+// parseMatroskaTags reads the simple tags of a Tags element
+func parseMatroskaTags(data []byte, meta *MediaMetadata) {
+	for _, tag := range ebmlChildren(data) {
+		if tag.id != mkvTagID {
+			continue
+		}
+		for _, simple := range ebmlChildren(tag.data) {
+			if simple.id != mkvSimpleTagID {
+				continue
+			}
+			var name, value string
+			for _, field := range ebmlChildren(simple.data) {
+				switch field.id {
+				case mkvTagNameID:
+					name = ebmlString(field.data)
+				case mkvTagStringID:
+					value = ebmlString(field.data)
+				}
+			}
+			if key, ok := matroskaTagNames[strings.ToUpper(name)]; ok {
+				meta.setTag(key, value)
+			}
+		}
+	}
+}
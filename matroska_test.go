@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// testEBML builds an element of the given ID around the concatenated
+// parts, with an eight byte size
+func testEBML(id uint32, parts ...[]byte) []byte {
+	var b []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if c := byte(id >> shift); c != 0 || len(b) > 0 {
+			b = append(b, c)
+		}
+	}
+	payload := bytes.Join(parts, nil)
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(payload)))
+	size[0] = 0x01
+	b = append(b, size...)
+	return append(b, payload...)
+}
+
+// testEBMLSized builds an element header claiming size bytes, without
+// any data
+func testEBMLSized(id uint32, size uint64) []byte {
+	b := testEBML(id)
+	binary.BigEndian.PutUint64(b[len(b)-8:], size)
+	b[len(b)-8] = 0x01
+	return b
+}
+
+// testMatroskaFile builds a WebM file with the given segment children
+func testMatroskaFile(children ...[]byte) []byte {
+	header := testEBML(ebmlHeaderID, testEBML(ebmlDocTypeID, []byte("webm")))
+	return append(header, testEBML(mkvSegmentID, children...)...)
+}
+
+// limitedReaderAt fails reads larger than limit bytes, standing in for a
+// file whose probe must not allocate more than the file holds
+type limitedReaderAt struct {
+	t     *testing.T
+	data  []byte
+	limit int
+}
+
+func (r limitedReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if len(p) > r.limit {
+		r.t.Fatalf("read of %d bytes from a %d byte file", len(p), len(r.data))
+	}
+	return bytes.NewReader(r.data).ReadAt(p, offset)
+}
+
+func TestProbeMatroska(t *testing.T) {
+	duration := binary.BigEndian.AppendUint64(nil, math.Float64bits(90500))
+	info := testEBML(mkvInfoID,
+		testEBML(mkvTimestampScaleID, []byte{0x0f, 0x42, 0x40}),
+		testEBML(mkvDurationID, duration),
+		testEBML(mkvTitleID, []byte("Clip")),
+	)
+	tracks := testEBML(mkvTracksID,
+		testEBML(mkvTrackEntryID,
+			testEBML(mkvTrackTypeID, []byte{1}),
+			testEBML(mkvCodecID, []byte("V_VP9")),
+			testEBML(mkvVideoID, testEBML(mkvPixelWidthID, []byte{0x07, 0x80}), testEBML(mkvPixelHeightID, []byte{0x04, 0x38})),
+		),
+		testEBML(mkvTrackEntryID,
+			testEBML(mkvTrackTypeID, []byte{2}),
+			testEBML(mkvCodecID, []byte("A_OPUS")),
+			testEBML(mkvAudioID, testEBML(mkvChannelsID, []byte{2})),
+		),
+	)
+	cluster := testEBML(mkvClusterID, make([]byte, 32))
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantErr   bool
+		wantTitle string
+	}{
+		{"info and tracks", testMatroskaFile(info, tracks, cluster), false, "Clip"},
+		{"huge element skipped", testMatroskaFile(info, tracks, testEBMLSized(mkvTagsID, maxEBMLElementSize)), false, "Clip"},
+		{"huge element before info", testMatroskaFile(testEBMLSized(mkvTagsID, maxEBMLElementSize), info, tracks), true, ""},
+		{"element past the segment", testMatroskaFile(testEBMLSized(mkvTracksID, 1<<20)), true, ""},
+		{"overflowing element size", testMatroskaFile(info, testEBMLSized(mkvTracksID, math.MaxInt64-4)), false, "Clip"},
+		{"huge header", testEBMLSized(ebmlHeaderID, maxEBMLElementSize), true, ""},
+		{"truncated header", testMatroskaFile(info)[:10], true, ""},
+		{"not matroska", []byte("RIFF\x00\x00\x00\x00WAVE"), true, ""},
+		{"empty", nil, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := limitedReaderAt{t: t, data: tt.data, limit: max(len(tt.data), 12)}
+			meta, err := probeMatroska(r, int64(len(tt.data)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("probeMatroska() = %+v, want an error", meta)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeMatroska() error = %v", err)
+			}
+			if meta.Format != "webm" || meta.Tags["title"] != tt.wantTitle {
+				t.Errorf("probeMatroska() format %q, title %q, want webm, %q", meta.Format, meta.Tags["title"], tt.wantTitle)
+			}
+			if meta.Duration != 90.5 {
+				t.Errorf("probeMatroska() duration = %v, want 90.5", meta.Duration)
+			}
+		})
+	}
+
+	meta, err := probeMatroska(bytes.NewReader(testMatroskaFile(info, tracks)), int64(len(testMatroskaFile(info, tracks))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.VideoCodec != "VP9" || meta.Width != 1920 || meta.Height != 1080 || meta.AudioCodec != "Opus" || meta.Channels != 2 {
+		t.Errorf("probeMatroska() tracks = %+v", meta)
+	}
+}
+
+func TestEBMLVint(t *testing.T) {
+	tests := []struct {
+		data        []byte
+		wantValue   uint64
+		wantLength  int
+		wantUnknown bool
+		wantOK      bool
+	}{
+		{[]byte{0x81}, 1, 1, false, true},
+		{[]byte{0x40, 0x02}, 2, 2, false, true},
+		{[]byte{0xff}, 127, 1, true, true},
+		{[]byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1<<56 - 1, 8, true, true},
+		{[]byte{0x40}, 0, 0, false, false},
+		{[]byte{0x00, 0x81}, 0, 0, false, false},
+		{nil, 0, 0, false, false},
+	}
+
+	for _, tt := range tests {
+		value, length, unknown, ok := ebmlVint(tt.data)
+		if value != tt.wantValue || length != tt.wantLength || unknown != tt.wantUnknown || ok != tt.wantOK {
+			t.Errorf("ebmlVint(%x) = %d, %d, %v, %v, want %d, %d, %v, %v", tt.data, value, length, unknown, ok,
+				tt.wantValue, tt.wantLength, tt.wantUnknown, tt.wantOK)
+		}
+	}
+}
+
+func FuzzProbeMatroska(f *testing.F) {
+	info := testEBML(mkvInfoID, testEBML(mkvTitleID, []byte("Clip")))
+	f.Add(testMatroskaFile(info))
+	f.Add(testMatroskaFile(testEBML(mkvSeekHeadID, testEBML(mkvSeekID,
+		testEBML(mkvSeekElementID, []byte{0x15, 0x49, 0xa9, 0x66}),
+		testEBML(mkvSeekPositionID, []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}),
+	))))
+	f.Add(testMatroskaFile(testEBMLSized(mkvTracksID, maxEBMLElementSize)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := limitedReaderAt{t: t, data: data, limit: max(len(data), 12)}
+		probeMatroska(r, int64(len(data)))
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// MediaTypes is the media type registry. It groups files into the
+// configured categories, each with its extensions, MIME types, icon and
+// CSS class, and detects the MIME type of files.
+type MediaTypes struct {
+	categories []*MediaCategory
+	byName     map[string]*MediaCategory
+	byExt      map[string]*MediaCategory
+	extTypes   map[string]string
+	overrides  map[string]string
+	cache      *lruCache
+}
+
+// MediaCategory is one category of the media type registry
+type MediaCategory struct {
+	Name      string   `json:"name"`
+	Label     string   `json:"label"`
+	Icon      string   `json:"icon,omitempty"`
+	Class     string   `json:"class,omitempty"`
+	MimeTypes []string `json:"mime_types,omitempty"`
+}
+
+// defaultMediaTypes returns the built-in media categories. An empty MIME
+// type leaves the extension's type to the system MIME table.
+func defaultMediaTypes() []MediaTypeConfig {
+	return []MediaTypeConfig{
+		{
+			Name:      "video",
+			Label:     "Video",
+			Icon:      "🎬",
+			Class:     "video-file",
+			MimeTypes: []string{"video/*"},
+			Extensions: map[string]string{
+				".mp4":  "video/mp4",
+				".m4v":  "video/x-m4v",
+				".mkv":  "video/x-matroska",
+				".webm": "video/webm",
+				".mov":  "video/quicktime",
+				".avi":  "video/x-msvideo",
+				".wmv":  "video/x-ms-wmv",
+				".flv":  "video/x-flv",
+				".ts":   "video/mp2t",
+				".m2ts": "video/mp2t",
+				".mts":  "video/mp2t",
+				".mpg":  "video/mpeg",
+				".mpeg": "video/mpeg",
+				".3gp":  "video/3gpp",
+				".ogv":  "video/ogg",
+			},
+		},
+		{
+			Name:      "audio",
+			Label:     "Audio",
+			Icon:      "🎵",
+			Class:     "audio-file",
+			MimeTypes: []string{"audio/*"},
+			Extensions: map[string]string{
+				".mp3":  "audio/mpeg",
+				".m4a":  "audio/mp4",
+				".m4b":  "audio/mp4",
+				".aac":  "audio/aac",
+				".flac": "audio/flac",
+				".wav":  "audio/wav",
+				".ogg":  "audio/ogg",
+				".oga":  "audio/ogg",
+				".opus": "audio/ogg",
+				".wma":  "audio/x-ms-wma",
+				".mka":  "audio/x-matroska",
+				".aiff": "audio/aiff",
+			},
+		},
+		{
+			Name:      "image",
+			Label:     "Image",
+			Icon:      "🖼️",
+			Class:     "image-file",
+			MimeTypes: []string{"image/*"},
+			Extensions: map[string]string{
+				".jpg":  "image/jpeg",
+				".jpeg": "image/jpeg",
+				".png":  "image/png",
+				".gif":  "image/gif",
+				".bmp":  "image/bmp",
+				".webp": "image/webp",
+				".heic": "image/heic",
+				".heif": "image/heif",
+				".avif": "image/avif",
+				".tif":  "image/tiff",
+				".tiff": "image/tiff",
+				".svg":  "image/svg+xml",
+			},
+		},
+		{
+			Name:      "subtitle",
+			Label:     "Subtitle",
+			Icon:      "💬",
+			Class:     "subtitle-file",
+			MimeTypes: []string{"text/vtt", "application/x-subrip", "text/x-ssa"},
+			Extensions: map[string]string{
+				".srt": "application/x-subrip",
+				".vtt": "text/vtt",
+				".ass": "text/x-ssa",
+				".ssa": "text/x-ssa",
+			},
+		},
+	}
+}
+
+// NewMediaTypes creates the registry from category definitions and MIME
+// type overrides. Extensions are matched case-insensitively, with or
+// without the leading dot; when categories share an extension the first
+// one wins.
+func NewMediaTypes(categories []MediaTypeConfig, overrides map[string]string) *MediaTypes {
+	t := &MediaTypes{
+		byName:    make(map[string]*MediaCategory, len(categories)),
+		byExt:     make(map[string]*MediaCategory),
+		extTypes:  make(map[string]string),
+		overrides: make(map[string]string, len(overrides)),
+		cache:     newLRUCache(mimeCacheSize),
+	}
+
+	for _, config := range categories {
+		category := &MediaCategory{
+			Name:      config.Name,
+			Label:     config.Label,
+			Icon:      config.Icon,
+			Class:     config.Class,
+			MimeTypes: config.MimeTypes,
+		}
+		if category.Label == "" {
+			category.Label = config.Name
+		}
+		t.categories = append(t.categories, category)
+		t.byName[category.Name] = category
+
+		for ext, mimeType := range config.Extensions {
+			ext = normalizeExt(ext)
+			if _, ok := t.byExt[ext]; ok {
+				continue
+			}
+			t.byExt[ext] = category
+			if mimeType != "" {
+				t.extTypes[ext] = mimeType
+			}
+		}
+	}
+
+	for ext, mimeType := range overrides {
+		t.overrides[normalizeExt(ext)] = mimeType
+	}
+	return t
+}
+
+// normalizeExt lowercases an extension and gives it a leading dot
+func normalizeExt(ext string) string {
+	return "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+}
+
+// Categories returns the categories in their configured order
+func (t *MediaTypes) Categories() []*MediaCategory {
+	return t.categories
+}
+
+// Category returns the category with the given name, or nil
+func (t *MediaTypes) Category(name string) *MediaCategory {
+	return t.byName[name]
+}
+
+// Classify returns the category of a file from its MIME type, or from its
+// extension when the content type is unknown. It returns nil for files
+// that belong to no category.
+func (t *MediaTypes) Classify(name, mimeType string) *MediaCategory {
+	if mimeType != "" && mimeType != "application/octet-stream" {
+		if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+			mimeType = mediaType
+		}
+		for _, category := range t.categories {
+			if category.matches(mimeType) {
+				return category
+			}
+		}
+		return nil
+	}
+	return t.byExt[strings.ToLower(filepath.Ext(name))]
+}
+
+// typeByExtension returns the MIME type registered for an extension,
+// falling back to the system MIME table
+func (t *MediaTypes) typeByExtension(ext string) string {
+	if mimeType, ok := t.extTypes[ext]; ok {
+		return mimeType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// matches reports whether a MIME type belongs to the category. Patterns
+// ending in "/*" match every subtype.
+func (c *MediaCategory) matches(mimeType string) bool {
+	for _, pattern := range c.MimeTypes {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(mimeType, prefix) {
+				return true
+			}
+		} else if mimeType == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewMediaTypes(t *testing.T) {
+	types := NewMediaTypes([]MediaTypeConfig{
+		{Name: "video", Icon: "🎬", MimeTypes: []string{"video/*"}, Extensions: map[string]string{"MKV": "video/x-matroska", ".PNG": ""}},
+		{Name: "recording", Label: "Recordings", Extensions: map[string]string{"mkv": "video/x-recording", ".rec": "video/x-recording"}},
+	}, nil)
+
+	if got := types.Categories(); len(got) != 2 || got[0].Name != "video" || got[1].Name != "recording" {
+		t.Fatalf("Categories() = %+v, want video then recording", got)
+	}
+
+	tests := []struct {
+		ext          string
+		wantCategory string
+		wantType     string
+	}{
+		{".mkv", "video", "video/x-matroska"},
+		{".png", "video", "image/png"},
+		{".rec", "recording", "video/x-recording"},
+		{".xyz123", "", ""},
+	}
+
+	for _, tt := range tests {
+		category := ""
+		if c := types.byExt[tt.ext]; c != nil {
+			category = c.Name
+		}
+		if category != tt.wantCategory {
+			t.Errorf("category of %s = %q, want %q", tt.ext, category, tt.wantCategory)
+		}
+		if got := types.typeByExtension(tt.ext); got != tt.wantType {
+			t.Errorf("typeByExtension(%q) = %q, want %q", tt.ext, got, tt.wantType)
+		}
+	}
+
+	if c := types.Category("video"); c == nil || c.Label != "video" || c.Icon != "🎬" {
+		t.Errorf("Category(video) = %+v, want the name as its label", c)
+	}
+	if c := types.Category("recording"); c == nil || c.Label != "Recordings" {
+		t.Errorf("Category(recording) = %+v, want label Recordings", c)
+	}
+	if c := types.Category("missing"); c != nil {
+		t.Errorf("Category(missing) = %+v, want nil", c)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	types := NewMediaTypes(defaultMediaTypes(), nil)
+
+	tests := []struct {
+		name     string
+		fileName string
+		mimeType string
+		want     string
+	}{
+		{"video type", "clip", "video/mp4", "video"},
+		{"type parameters", "clip", "video/mp4; codecs=avc1", "video"},
+		{"audio type", "song.bin", "audio/flac", "audio"},
+		{"exact subtitle type", "subs", "text/vtt", "subtitle"},
+		{"image type", "photo", "image/heic", "image"},
+		{"known type outside every category", "movie.mp4", "text/plain; charset=utf-8", ""},
+		{"unknown type uses the extension", "Movie.MKV", "application/octet-stream", "video"},
+		{"no type uses the extension", "subs.SRT", "", "subtitle"},
+		{"unknown extension", "archive.zip", "", ""},
+		{"no extension", "README", "application/octet-stream", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if category := types.Classify(tt.fileName, tt.mimeType); category != nil {
+				got = category.Name
+			}
+			if got != tt.want {
+				t.Errorf("Classify(%q, %q) = %q, want %q", tt.fileName, tt.mimeType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFileInfo(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "movie.m4v", "song.opus", "photo.heic", "subs.srt", "notes.txt", "folder/")
+	types := NewMediaTypes(defaultMediaTypes(), nil)
+
+	tests := []struct {
+		name         string
+		wantCategory string
+		wantIcon     string
+		wantClass    string
+	}{
+		{"movie.m4v", "video", "🎬", "video-file"},
+		{"song.opus", "audio", "🎵", "audio-file"},
+		{"photo.heic", "image", "🖼️", "image-file"},
+		{"subs.srt", "subtitle", "💬", "subtitle-file"},
+		{"notes.txt", "", "📄", ""},
+		{"folder", "", "📁", "directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fullPath := filepath.Join(dir, tt.name)
+			info, err := os.Stat(fullPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := newFileInfo("/"+tt.name, fullPath, info, types)
+			if file.Category != tt.wantCategory || file.GetFileIcon() != tt.wantIcon || file.GetFileClass() != tt.wantClass {
+				t.Errorf("category %q, icon %q, class %q, want %q, %q, %q",
+					file.Category, file.GetFileIcon(), file.GetFileClass(), tt.wantCategory, tt.wantIcon, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestMediaTypesConfigValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		media   string
+		wantErr string
+	}{
+		{"defaults", "directory: ./media", ""},
+		{"custom category", "types: [{name: comics, mime_types: [application/vnd.comicbook+zip], extensions: {cbz: '', .cbr: application/vnd.comicbook-rar}}]", ""},
+		{"empty name", "types: [{name: ''}]", "name cannot be empty"},
+		{"reserved name", "types: [{name: directory}]", "reserved for search filters"},
+		{"duplicate name", "types: [{name: video}, {name: video}]", "configured more than once"},
+		{"invalid pattern", "types: [{name: video, mime_types: ['video//*']}]", "invalid MIME type pattern"},
+		{"empty extension", "types: [{name: video, extensions: {'.': video/mp4}}]", "empty extension"},
+		{"invalid extension type", "types: [{name: video, extensions: {.mp4: 'not a type'}}]", "invalid MIME type for .mp4"},
+		{"valid override", "mime_types: {.mkv: video/webm}", ""},
+		{"invalid override", "mime_types: {.mkv: 'video/'}", "invalid MIME type for .mkv"},
+		{"empty override extension", "mime_types: {'': video/webm}", "empty extension"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, "media:\n  "+tt.media+"\n")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				if len(config.Media.Types) == 0 {
+					t.Error("no media types are configured")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeExt(t *testing.T) {
+	tests := map[string]string{
+		"mp4":    ".mp4",
+		".MKV":   ".mkv",
+		"Tar.GZ": ".tar.gz",
+	}
+
+	for ext, want := range tests {
+		if got := normalizeExt(ext); got != want {
+			t.Errorf("normalizeExt(%q) = %q, want %q", ext, got, want)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxEXIFSize bounds the APP1 segment read from JPEG files
+const maxEXIFSize = 64 << 10
+
+var errNoMetadata = errors.New("metadata is not supported for this file type")
+
+// MediaMetadata describes the contents of a media file as read from its
+// container headers
+type MediaMetadata struct {
+	Format     string            `json:"format"`
+	Duration   float64           `json:"duration,omitempty"`
+	Width      int               `json:"width,omitempty"`
+	Height     int               `json:"height,omitempty"`
+	VideoCodec string            `json:"video_codec,omitempty"`
+	AudioCodec string            `json:"audio_codec,omitempty"`
+	SampleRate int               `json:"sample_rate,omitempty"`
+	Channels   int               `json:"channels,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// metadataProber reads the metadata of one file format
+type metadataProber func(r io.ReaderAt, size int64) (*MediaMetadata, error)
+
+// metadataProbers maps file extensions to the prober for their format
+var metadataProbers = map[string]metadataProber{
+	".mp4":  probeMP4,
+	".m4v":  probeMP4,
+	".m4a":  probeMP4,
+	".mov":  probeMP4,
+	".mkv":  probeMatroska,
+	".mka":  probeMatroska,
+	".webm": probeMatroska,
+	".mp3":  probeMP3,
+	".flac": probeFLAC,
+	".jpg":  probeJPEG,
+	".jpeg": probeJPEG,
+	".png":  probeImage,
+	".gif":  probeImage,
+	".webp": probeImage,
+}
+
+// hasMetadataProber reports whether metadata can be read from a file
+func hasMetadataProber(name string) bool {
+	_, ok := metadataProbers[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// ProbeFile reads the metadata of a media file. Only the headers of the
+// file are read, never the media data itself. A prober that fails on a
+// malformed file reports an error rather than taking down the server.
+func ProbeFile(fullPath string) (meta *MediaMetadata, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			meta, err = nil, fmt.Errorf("failed to read metadata of %s: %v", fullPath, p)
+		}
+	}()
+
+	probe, ok := metadataProbers[strings.ToLower(filepath.Ext(fullPath))]
+	if !ok {
+		return nil, errNoMetadata
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return probe(file, info.Size())
+}
+
+// Summary returns a short description such as "1:42:05 • 1920×1080 •
+// H.264/AAC" for the listing page
+func (m *MediaMetadata) Summary() string {
+	var parts []string
+	if m.Duration > 0 {
+		parts = append(parts, formatDuration(m.Duration))
+	}
+	if m.Width > 0 && m.Height > 0 {
+		parts = append(parts, fmt.Sprintf("%d×%d", m.Width, m.Height))
+	}
+	var codecs []string
+	for _, codec := range []string{m.VideoCodec, m.AudioCodec} {
+		if codec != "" {
+			codecs = append(codecs, codec)
+		}
+	}
+	if len(codecs) > 0 {
+		parts = append(parts, strings.Join(codecs, "/"))
+	}
+	if title := m.Tags["title"]; title != "" {
+		if artist := m.Tags["artist"]; artist != "" {
+			title = artist + " - " + title
+		}
+		parts = append(parts, title)
+	}
+	return strings.Join(parts, " • ")
+}
+
+// formatDuration formats seconds as h:mm:ss, or m:ss under an hour
+func formatDuration(seconds float64) string {
+	total := int(seconds + 0.5)
+	h, m, s := total/3600, total/60%60, total%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+// setTag stores a trimmed, non-empty tag value, keeping the first value
+// seen for each key
+func (m *MediaMetadata) setTag(key, value string) {
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	if value == "" {
+		return
+	}
+	if m.Tags == nil {
+		m.Tags = make(map[string]string)
+	}
+	if _, ok := m.Tags[key]; !ok {
+		m.Tags[key] = value
+	}
+}
+
+// mp4CodecNames maps MP4 sample entry types to codec names
+var mp4CodecNames = map[string]string{
+	"avc1": "H.264",
+	"avc3": "H.264",
+	"hvc1": "HEVC",
+	"hev1": "HEVC",
+	"av01": "AV1",
+	"vp09": "VP9",
+	"mp4v": "MPEG-4",
+	"jpeg": "MJPEG",
+	"apch": "ProRes",
+	"apcn": "ProRes",
+	"apcs": "ProRes",
+	"apco": "ProRes",
+	"ap4h": "ProRes",
+	"mp4a": "AAC",
+	".mp3": "MP3",
+	"ac-3": "AC-3",
+	"ec-3": "E-AC-3",
+	"Opus": "Opus",
+	"fLaC": "FLAC",
+	"alac": "ALAC",
+}
+
+// mp4TagNames maps iTunes-style metadata items to tag names
+var mp4TagNames = map[string]string{
+	"\xa9nam": "title",
+	"\xa9ART": "artist",
+	"aART":    "album_artist",
+	"\xa9alb": "album",
+	"\xa9day": "date",
+	"\xa9gen": "genre",
+	"\xa9cmt": "comment",
+	"desc":    "description",
+}
+
+// probeMP4 reads MP4 and QuickTime files
+func probeMP4(r io.ReaderAt, size int64) (*MediaMetadata, error) {
+	movie, err := parseMP4Header(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &MediaMetadata{Format: "mp4"}
+	if movie.timescale > 0 {
+		meta.Duration = float64(movie.duration) / float64(movie.timescale)
+	}
+
+	for _, track := range movie.tracks {
+		entry, ok := track.sampleEntry()
+		if !ok {
+			continue
+		}
+		name := mp4CodecNames[entry.typ]
+		if name == "" {
+			name = strings.TrimSpace(entry.typ)
+		}
+
+		switch track.handler {
+		case "vide":
+			if meta.VideoCodec != "" {
+				continue
+			}
+			meta.VideoCodec = name
+			meta.Width, meta.Height = int(track.width), int(track.height)
+		case "soun":
+			if meta.AudioCodec != "" {
+				continue
+			}
+			if codec := track.codec(); codec == "mp4a.6b" || codec == "mp4a.69" {
+				name = "MP3"
+			}
+			meta.AudioCodec = name
+			// Audio sample entries hold the channel count at 16 and the
+			// 16.16 fixed point sample rate at 24
+			if len(entry.payload) >= 28 {
+				meta.Channels = int(binary.BigEndian.Uint16(entry.payload[16:]))
+				meta.SampleRate = int(binary.BigEndian.Uint32(entry.payload[24:]) >> 16)
+			}
+		}
+		if meta.Duration == 0 && track.timescale > 0 {
+			meta.Duration = float64(track.duration) / float64(track.timescale)
+		}
+	}
+
+	parseMP4Tags(movie.udta, meta)
+	return meta, nil
+}
+
+// parseMP4Tags reads the iTunes-style item list in a udta payload
+func parseMP4Tags(udta []byte, meta *MediaMetadata) {
+	children, err := childBoxes(udta)
+	if err != nil {
+		return
+	}
+	metaBox, ok := children["meta"]
+	if !ok || len(metaBox.payload) < 8 {
+		return
+	}
+	// meta is a full box in MP4 files but a plain container in QuickTime
+	payload := metaBox.payload
+	if string(payload[4:8]) != "hdlr" {
+		payload = payload[4:]
+	}
+	boxes, err := childBoxes(payload)
+	if err != nil {
+		return
+	}
+	items, err := parseBoxes(boxes["ilst"].payload)
+	if err != nil {
+		return
+	}
+
+	for _, item := range items {
+		data, err := childBoxes(item.payload)
+		if err != nil || len(data["data"].payload) < 8 {
+			continue
+		}
+		value := data["data"].payload[8:]
+		switch {
+		case item.typ == "trkn":
+			if len(value) >= 4 {
+				if n := binary.BigEndian.Uint16(value[2:]); n > 0 {
+					meta.setTag("track", strconv.Itoa(int(n)))
+				}
+			}
+		case mp4TagNames[item.typ] != "":
+			meta.setTag(mp4TagNames[item.typ], string(value))
+		}
+	}
+}
+
+// probeImage reads the dimensions of PNG, GIF and WebP images
+func probeImage(r io.ReaderAt, size int64) (*MediaMetadata, error) {
+	config, format, err := image.DecodeConfig(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	return &MediaMetadata{Format: format, Width: config.Width, Height: config.Height}, nil
+}
+
+// probeJPEG reads the dimensions and EXIF tags of a JPEG image
+func probeJPEG(r io.ReaderAt, size int64) (*MediaMetadata, error) {
+	var header [9]byte
+	if _, err := r.ReadAt(header[:2], 0); err != nil || header[0] != 0xff || header[1] != 0xd8 {
+		return nil, errors.New("not a JPEG file")
+	}
+
+	meta := &MediaMetadata{Format: "jpeg"}
+	for offset := int64(2); offset+4 <= size; {
+		if _, err := r.ReadAt(header[:4], offset); err != nil {
+			return nil, err
+		}
+		if header[0] != 0xff {
+			return nil, errors.New("malformed JPEG file")
+		}
+		marker := header[1]
+		if marker == 0xff {
+			// Fill byte before a marker
+			offset++
+			continue
+		}
+		if marker == 0xd9 || marker == 0xda {
+			// End of image or start of scan data
+			break
+		}
+		length := int64(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return nil, errors.New("malformed JPEG file")
+		}
+
+		switch {
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// Start of frame: precision, height and width
+			if _, err := r.ReadAt(header[4:9], offset+4); err != nil {
+				return nil, err
+			}
+			meta.Height = int(binary.BigEndian.Uint16(header[5:]))
+			meta.Width = int(binary.BigEndian.Uint16(header[7:]))
+			return meta, nil
+		case marker == 0xe1 && length > 8 && length <= maxEXIFSize:
+			segment := make([]byte, length-2)
+			if _, err := r.ReadAt(segment, offset+4); err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(string(segment), "Exif\x00\x00") {
+				parseEXIF(segment[6:], meta)
+			}
+		}
+		offset += 2 + length
+	}
+	return meta, nil
+}
+
+// EXIF tags read from JPEG files
+const (
+	exifMake             = 0x010f
+	exifModel            = 0x0110
+	exifOrientation      = 0x0112
+	exifDateTime         = 0x0132
+	exifIFDPointer       = 0x8769
+	exifDateTimeOriginal = 0x9003
+)
+
+// parseEXIF reads camera tags from a TIFF structured EXIF block
+func parseEXIF(tiff []byte, meta *MediaMetadata) {
+	if len(tiff) < 8 {
+		return
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	meta.setTag("camera_make", string(ifd0[exifMake]))
+	meta.setTag("camera_model", string(ifd0[exifModel]))
+	if value := ifd0[exifOrientation]; len(value) >= 2 {
+		meta.setTag("orientation", strconv.Itoa(int(order.Uint16(value))))
+	}
+	if value := ifd0[exifIFDPointer]; len(value) >= 4 {
+		exif := readIFD(tiff, order, order.Uint32(value))
+		meta.setTag("date_taken", string(exif[exifDateTimeOriginal]))
+	}
+	meta.setTag("date_taken", string(ifd0[exifDateTime]))
+}
+
+// readIFD returns the raw values of the entries in the image file
+// directory at offset
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16][]byte {
+	// Sizes of the TIFF field types, indexed by type
+	typeSizes := [...]uint32{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+	entries := make(map[uint16][]byte)
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return entries
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		pos := int(offset) + 2 + i*12
+		if pos+12 > len(tiff) {
+			break
+		}
+		tag := order.Uint16(tiff[pos:])
+		typ := order.Uint16(tiff[pos+2:])
+		n := order.Uint32(tiff[pos+4:])
+		if int(typ) >= len(typeSizes) || typ == 0 {
+			continue
+		}
+		size := uint64(typeSizes[typ]) * uint64(n)
+		if size <= 4 {
+			entries[tag] = tiff[pos+8 : pos+8+int(size)]
+			continue
+		}
+		valueOffset := uint64(order.Uint32(tiff[pos+8:]))
+		if valueOffset+size <= uint64(len(tiff)) {
+			entries[tag] = tiff[valueOffset : valueOffset+size]
+		}
+	}
+	return entries
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testID3Tag builds an ID3v2 tag of the given version around frames
+func testID3Tag(version byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	size := len(body)
+	tag := []byte{'I', 'D', '3', version, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(tag, body...)
+}
+
+// testID3Frame builds an ID3v2.3 frame
+func testID3Frame(id string, payload ...byte) []byte {
+	frame := append([]byte(id), u32s(uint32(len(payload)))...)
+	return append(append(frame, 0, 0), payload...)
+}
+
+// testMP3Frame builds an MPEG-1 layer III frame header at 128 kbit/s and
+// 44.1 kHz, followed by a Xing header when frames is not zero
+func testMP3Frame(frames uint32) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+	if frames > 0 {
+		copy(frame[36:], "Xing")
+		binary.BigEndian.PutUint32(frame[40:], 1)
+		binary.BigEndian.PutUint32(frame[44:], frames)
+	}
+	return frame
+}
+
+// testFLACFile builds a FLAC file with a stream info block and a Vorbis
+// comment block
+func testFLACFile(sampleRate, channels int, samples uint64, comments ...string) []byte {
+	info := make([]byte, 34)
+	info[10] = byte(sampleRate >> 12)
+	info[11] = byte(sampleRate >> 4)
+	info[12] = byte(sampleRate&0x0f)<<4 | byte(channels-1)<<1
+	info[13] = 0xf0 | byte(samples>>32&0x0f)
+	binary.BigEndian.PutUint32(info[14:], uint32(samples))
+
+	vendor := "test"
+	block := binary.LittleEndian.AppendUint32(nil, uint32(len(vendor)))
+	block = append(block, vendor...)
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(comments)))
+	for _, comment := range comments {
+		block = binary.LittleEndian.AppendUint32(block, uint32(len(comment)))
+		block = append(block, comment...)
+	}
+
+	file := []byte("fLaC")
+	file = append(file, 0x00, 0, 0, byte(len(info)))
+	file = append(file, info...)
+	file = append(file, 0x84, byte(len(block)>>16), byte(len(block)>>8), byte(len(block)))
+	return append(file, block...)
+}
+
+func TestProbeMP3(t *testing.T) {
+	utf16Artist := []byte{1, 0xff, 0xfe, 'A', 0, 'B', 0, 0xe9, 0, 0, 0}
+
+	tests := []struct {
+		name         string
+		data         []byte
+		wantErr      bool
+		wantDuration float64
+		wantTags     map[string]string
+	}{
+		{
+			name: "tags and xing header",
+			data: append(testID3Tag(3,
+				testID3Frame("TIT2", append([]byte{0}, "Song"...)...),
+				testID3Frame("TPE1", utf16Artist...),
+				testID3Frame("TRCK", append([]byte{3}, "3/12"...)...),
+				testID3Frame("APIC", 0, 1, 2, 3),
+			), testMP3Frame(441)...),
+			wantDuration: 441 * 1152 / 44100.0,
+			wantTags:     map[string]string{"title": "Song", "artist": "ABé", "track": "3"},
+		},
+		{
+			name:         "constant bitrate estimate",
+			data:         bytes.Repeat(testMP3Frame(0), 10),
+			wantDuration: 4170 * 8 / 128000.0,
+		},
+		{
+			name:     "tags without frames",
+			data:     testID3Tag(3, testID3Frame("TALB", append([]byte{0}, "Album"...)...)),
+			wantTags: map[string]string{"album": "Album"},
+		},
+		{
+			name:    "tag larger than the file",
+			data:    append([]byte{'I', 'D', '3', 3, 0, 0, 0x07, 0x7f, 0x7f, 0x7f}, testMP3Frame(441)...),
+			wantErr: true,
+		},
+		{name: "not an mp3 file", data: []byte("RIFF\x00\x00\x00\x00WAVEfmt "), wantErr: true},
+		{name: "empty", data: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := limitedReaderAt{t: t, data: tt.data, limit: max(len(tt.data), mp3SyncWindow)}
+			meta, err := probeMP3(r, int64(len(tt.data)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("probeMP3() = %+v, want an error", meta)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeMP3() error = %v", err)
+			}
+			if meta.Duration != tt.wantDuration {
+				t.Errorf("duration = %v, want %v", meta.Duration, tt.wantDuration)
+			}
+			if tt.wantDuration > 0 && (meta.SampleRate != 44100 || meta.Channels != 2) {
+				t.Errorf("sample rate %d, channels %d, want 44100, 2", meta.SampleRate, meta.Channels)
+			}
+			if !equalTags(meta.Tags, tt.wantTags) {
+				t.Errorf("tags = %v, want %v", meta.Tags, tt.wantTags)
+			}
+		})
+	}
+}
+
+// equalTags compares tag maps, treating nil and empty as equal
+func equalTags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseID3(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		flags   byte
+		body    []byte
+		want    map[string]string
+	}{
+		{
+			name:    "version 2.2",
+			version: 2,
+			body:    append([]byte("TT2\x00\x00\x05\x00Clip"), "TP1\x00\x00\x03\x00Me"...),
+			want:    map[string]string{"title": "Clip", "artist": "Me"},
+		},
+		{
+			name:    "version 2.4 syncsafe sizes",
+			version: 4,
+			body:    append([]byte("TIT2\x00\x00\x01\x00\x00\x00\x03"), bytes.Repeat([]byte("x"), 128)...),
+			want:    map[string]string{"title": string(bytes.Repeat([]byte("x"), 127))},
+		},
+		{
+			name:    "extended header",
+			version: 3,
+			flags:   0x40,
+			body:    append([]byte{0, 0, 0, 6, 0, 0, 0, 0, 0, 0}, testID3Frame("TCON", append([]byte{0}, "Jazz"...)...)...),
+			want:    map[string]string{"genre": "Jazz"},
+		},
+		{
+			name:    "extended header past the end",
+			version: 3,
+			flags:   0x40,
+			body:    []byte{0x7f, 0xff, 0xff, 0xff},
+		},
+		{
+			name:    "frame past the end",
+			version: 3,
+			body:    append(testID3Frame("TIT2", append([]byte{0}, "Song"...)...), "TALB\x7f\xff\xff\xff\x00\x00"...),
+			want:    map[string]string{"title": "Song"},
+		},
+		{
+			name:    "padding",
+			version: 3,
+			body:    append(testID3Frame("TYER", append([]byte{0}, "1999"...)...), make([]byte, 32)...),
+			want:    map[string]string{"date": "1999"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := &MediaMetadata{}
+			parseID3(tt.body, tt.version, tt.flags, meta)
+			if !equalTags(meta.Tags, tt.want) {
+				t.Errorf("parseID3() tags = %v, want %v", meta.Tags, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeID3Text(t *testing.T) {
+	tests := []struct {
+		encoding byte
+		data     []byte
+		want     string
+	}{
+		{0, []byte("Caf\xe9\x00rest"), "Café"},
+		{1, []byte{0xff, 0xfe, 'h', 0, 'i', 0}, "hi"},
+		{1, []byte{0xfe, 0xff, 0, 'h', 0, 'i'}, "hi"},
+		{2, []byte{0x4e, 0x2d, 0x65, 0x87}, "中文"},
+		{1, []byte{0xff, 0xfe, 0x3d, 0xd8, 0x0a, 0xde}, "😊"},
+		{3, []byte("naïve\x00second"), "naïve"},
+		{1, []byte{0xff}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := decodeID3Text(tt.encoding, tt.data); got != tt.want {
+			t.Errorf("decodeID3Text(%d, %x) = %q, want %q", tt.encoding, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestProbeFLAC(t *testing.T) {
+	valid := testFLACFile(44100, 2, 441000, "TITLE=Song", "artist=Band", "TRACKNUMBER=7/10", "IGNORED", "ENCODER=x")
+	hugeComments := append(testFLACFile(48000, 1, 48000)[:42], 0x84, 0xff, 0xff, 0xff)
+
+	tests := []struct {
+		name         string
+		data         []byte
+		wantErr      bool
+		wantDuration float64
+		wantRate     int
+		wantChannels int
+		wantTags     map[string]string
+	}{
+		{"stream info and comments", valid, false, 10, 44100, 2, map[string]string{"title": "Song", "artist": "Band", "track": "7"}},
+		{"comment block past the end", hugeComments, false, 1, 48000, 1, nil},
+		{"not flac", []byte("OggS\x00\x02"), true, 0, 0, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := limitedReaderAt{t: t, data: tt.data, limit: max(len(tt.data), 18)}
+			meta, err := probeFLAC(r, int64(len(tt.data)))
+			if tt.wantErr {
+				if !errors.Is(err, errNotFLAC) {
+					t.Fatalf("probeFLAC() error = %v, want %v", err, errNotFLAC)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeFLAC() error = %v", err)
+			}
+			if meta.Duration != tt.wantDuration || meta.SampleRate != tt.wantRate || meta.Channels != tt.wantChannels {
+				t.Errorf("probeFLAC() = %v s, %d Hz, %d channels, want %v, %d, %d",
+					meta.Duration, meta.SampleRate, meta.Channels, tt.wantDuration, tt.wantRate, tt.wantChannels)
+			}
+			if !equalTags(meta.Tags, tt.wantTags) {
+				t.Errorf("tags = %v, want %v", meta.Tags, tt.wantTags)
+			}
+		})
+	}
+}
+
+// testJPEG builds a JPEG header with an EXIF block and a start of frame
+// segment for a width by height image
+func testJPEG(width, height uint16) []byte {
+	// Little-endian TIFF structure: IFD0 at 8 holding Make, Orientation
+	// and the EXIF IFD pointer, the EXIF IFD at 50 holding the original
+	// date, and the string values after it
+	tiff := make([]byte, 120)
+	copy(tiff, "II*\x00")
+	le := binary.LittleEndian
+	le.PutUint32(tiff[4:], 8)
+	le.PutUint16(tiff[8:], 3)
+	entry := func(pos int, tag, typ uint16, count, value uint32) {
+		le.PutUint16(tiff[pos:], tag)
+		le.PutUint16(tiff[pos+2:], typ)
+		le.PutUint32(tiff[pos+4:], count)
+		le.PutUint32(tiff[pos+8:], value)
+	}
+	entry(10, exifMake, 2, 6, 68)
+	entry(22, exifOrientation, 3, 1, 6)
+	entry(34, exifIFDPointer, 4, 1, 50)
+	le.PutUint16(tiff[50:], 1)
+	entry(52, exifDateTimeOriginal, 2, 20, 74)
+	copy(tiff[68:], "Canon\x00")
+	copy(tiff[74:], "2024:05:01 12:00:00\x00")
+
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe1}
+	jpeg = binary.BigEndian.AppendUint16(jpeg, uint16(len(app1)+2))
+	jpeg = append(jpeg, app1...)
+	jpeg = append(jpeg, 0xff, 0xc0, 0, 17, 8)
+	jpeg = binary.BigEndian.AppendUint16(jpeg, height)
+	jpeg = binary.BigEndian.AppendUint16(jpeg, width)
+	return append(jpeg, make([]byte, 10)...)
+}
+
+func TestProbeJPEG(t *testing.T) {
+	valid := testJPEG(4000, 3000)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantErr    bool
+		wantWidth  int
+		wantHeight int
+		wantTags   map[string]string
+	}{
+		{
+			name:       "exif and frame",
+			data:       valid,
+			wantWidth:  4000,
+			wantHeight: 3000,
+			wantTags:   map[string]string{"camera_make": "Canon", "orientation": "6", "date_taken": "2024:05:01 12:00:00"},
+		},
+		{
+			name:       "broken exif offsets",
+			data:       append(append(append([]byte{0xff, 0xd8, 0xff, 0xe1, 0, 22}, "Exif\x00\x00II*\x00\xff\xff\xff\xff"...), 0, 0, 0, 0, 0, 0), valid[len(valid)-19:]...),
+			wantWidth:  4000,
+			wantHeight: 3000,
+		},
+		{name: "not a jpeg", data: []byte("GIF89a"), wantErr: true},
+		{name: "broken marker", data: []byte{0xff, 0xd8, 0x00, 0xe1, 0, 4}, wantErr: true},
+		{name: "short segment length", data: []byte{0xff, 0xd8, 0xff, 0xe1, 0, 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := probeJPEG(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("probeJPEG() = %+v, want an error", meta)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeJPEG() error = %v", err)
+			}
+			if meta.Width != tt.wantWidth || meta.Height != tt.wantHeight {
+				t.Errorf("size = %dx%d, want %dx%d", meta.Width, meta.Height, tt.wantWidth, tt.wantHeight)
+			}
+			if !equalTags(meta.Tags, tt.wantTags) {
+				t.Errorf("tags = %v, want %v", meta.Tags, tt.wantTags)
+			}
+		})
+	}
+}
+
+func TestProbeFile(t *testing.T) {
+	dir := t.TempDir()
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 64, 48))); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"image.PNG":  img.Bytes(),
+		"clip.mp4":   testTrackFile([]uint32{10, 20, 30}, testBox("stco", u32s(0, 1, 24))),
+		"song.flac":  testFLACFile(44100, 2, 441000),
+		"notes.txt":  []byte("text"),
+		"broken.mp4": []byte("garbage"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		want       MediaMetadata
+		wantErr    error
+		wantAnyErr bool
+	}{
+		{name: "image.PNG", want: MediaMetadata{Format: "png", Width: 64, Height: 48}},
+		{name: "clip.mp4", want: MediaMetadata{Format: "mp4", Duration: 3}},
+		{name: "song.flac", want: MediaMetadata{Format: "flac", AudioCodec: "FLAC", Duration: 10, SampleRate: 44100, Channels: 2}},
+		{name: "notes.txt", wantErr: errNoMetadata},
+		{name: "missing.mp4", wantErr: fs.ErrNotExist},
+		{name: "broken.mp4", wantAnyErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := ProbeFile(filepath.Join(dir, tt.name))
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("ProbeFile() error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantAnyErr:
+				if err == nil {
+					t.Errorf("ProbeFile() = %+v, want an error", meta)
+				}
+			case err != nil:
+				t.Errorf("ProbeFile() error = %v", err)
+			case meta.Format != tt.want.Format || meta.Duration != tt.want.Duration || meta.Width != tt.want.Width ||
+				meta.Height != tt.want.Height || meta.AudioCodec != tt.want.AudioCodec ||
+				meta.SampleRate != tt.want.SampleRate || meta.Channels != tt.want.Channels:
+				t.Errorf("ProbeFile() = %+v, want %+v", meta, tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaMetadataSummary(t *testing.T) {
+	tests := []struct {
+		meta MediaMetadata
+		want string
+	}{
+		{MediaMetadata{Duration: 6125.4, Width: 1920, Height: 1080, VideoCodec: "H.264", AudioCodec: "AAC"}, "1:42:05 • 1920×1080 • H.264/AAC"},
+		{MediaMetadata{Duration: 59.6, AudioCodec: "MP3", Tags: map[string]string{"title": "Song", "artist": "Band"}}, "1:00 • MP3 • Band - Song"},
+		{MediaMetadata{Width: 640, Tags: map[string]string{"title": "Untitled"}}, "Untitled"},
+		{MediaMetadata{}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.meta.Summary(); got != tt.want {
+			t.Errorf("Summary() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestSetTag(t *testing.T) {
+	meta := &MediaMetadata{}
+	meta.setTag("title", "  First\x00\x00")
+	meta.setTag("title", "Second")
+	meta.setTag("artist", " \x00")
+	if !equalTags(meta.Tags, map[string]string{"title": "First"}) {
+		t.Errorf("tags = %v, want only the first trimmed title", meta.Tags)
+	}
+}
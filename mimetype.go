@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// sniffLength is how much of a file is read to detect its type
+	sniffLength = 512
+
+	// mimeCacheSize bounds the memory used to cache detected types
+	mimeCacheSize = 32 << 20
+)
+
+// mimeEntry is the detected type of one version of a file
+type mimeEntry struct {
+	modTime  time.Time
+	size     int64
+	mimeType string
+}
+
+// activeContentTypes are the types browsers render as documents that can
+// run scripts. Content is never sniffed as one of them.
+var activeContentTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+	"image/svg+xml":         true,
+	"text/xml":              true,
+	"application/xml":       true,
+}
+
+// TypeOf returns the MIME type of a file, or "" for directories.
+// Configured MIME type overrides take precedence, then the type registered
+// for the file's extension. Only files without a known extension are
+// identified from their content, with the results cached until the file
+// changes, so listings and scans do not open every file.
+func (t *MediaTypes) TypeOf(fullPath string, info fs.FileInfo) string {
+	if info.IsDir() {
+		return ""
+	}
+
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	if mimeType, ok := t.overrides[ext]; ok {
+		return mimeType
+	}
+	if mimeType := t.typeByExtension(ext); mimeType != "" {
+		return mimeType
+	}
+
+	if cached, ok := t.cache.Get(fullPath); ok {
+		entry := cached.(mimeEntry)
+		if entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+			return entry.mimeType
+		}
+	}
+
+	mimeType := t.detect(fullPath)
+	t.cache.Add(fullPath, mimeEntry{modTime: info.ModTime(), size: info.Size(), mimeType: mimeType}, int64(len(fullPath)+len(mimeType)+64))
+	return mimeType
+}
+
+// detect reads the start of a file and identifies its type. Active
+// content is reported as a download rather than a document.
+func (t *MediaTypes) detect(fullPath string) string {
+	var header []byte
+	if file, err := os.Open(fullPath); err == nil {
+		buf := make([]byte, sniffLength)
+		n, _ := file.Read(buf)
+		file.Close()
+		header = buf[:n]
+	}
+
+	if sniffed := sniffMediaType(header); sniffed != "" {
+		return sniffed
+	}
+	if len(header) == 0 {
+		return "application/octet-stream"
+	}
+	if detected := http.DetectContentType(header); !isActiveContentType(detected) {
+		return detected
+	}
+	return "application/octet-stream"
+}
+
+// isActiveContentType reports whether browsers would render a MIME type
+// as a document that can run scripts
+func isActiveContentType(mimeType string) bool {
+	mediaType, _, _ := strings.Cut(mimeType, ";")
+	return activeContentTypes[strings.ToLower(strings.TrimSpace(mediaType))]
+}
+
+// sniffMediaType identifies common media containers and subtitle formats
+// from their leading bytes. It returns "" if the format is not recognized.
+func sniffMediaType(b []byte) string {
+	has := func(offset int, magic string) bool {
+		return len(b) >= offset+len(magic) && string(b[offset:offset+len(magic)]) == magic
+	}
+
+	switch {
+	// ISO base media: the major brand tells MP4, QuickTime, 3GP and the
+	// still image formats apart
+	case has(4, "ftyp") && len(b) >= 12:
+		brand := string(b[8:12])
+		switch {
+		case brand == "qt  ":
+			return "video/quicktime"
+		case brand == "M4A " || brand == "M4B ":
+			return "audio/mp4"
+		case strings.HasPrefix(brand, "3gp"):
+			return "video/3gpp"
+		case brand == "avif" || brand == "avis":
+			return "image/avif"
+		case brand == "heic" || brand == "heix" || brand == "mif1" || brand == "msf1":
+			return "image/heic"
+		}
+		return "video/mp4"
+	case has(4, "moov") || has(4, "mdat") || has(4, "wide"):
+		return "video/quicktime"
+	case has(0, "\x1a\x45\xdf\xa3"):
+		if bytes.Contains(b[:min(len(b), 64)], []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case has(0, "RIFF") && has(8, "AVI "):
+		return "video/x-msvideo"
+	case has(0, "RIFF") && has(8, "WAVE"):
+		return "audio/wav"
+	case has(0, "RIFF") && has(8, "WEBP"):
+		return "image/webp"
+	case has(0, "FLV\x01"):
+		return "video/x-flv"
+	case has(0, "\x30\x26\xb2\x75\x8e\x66\xcf\x11"):
+		return "video/x-ms-asf"
+	case has(0, "\x00\x00\x01\xba"):
+		return "video/mpeg"
+	case len(b) > 376 && b[0] == 0x47 && b[188] == 0x47 && b[376] == 0x47:
+		return "video/mp2t"
+	case has(0, "OggS"):
+		switch {
+		case bytes.Contains(b, []byte("\x80theora")):
+			return "video/ogg"
+		case bytes.Contains(b, []byte("OpusHead")):
+			return "audio/ogg"
+		case bytes.Contains(b, []byte("\x01vorbis")):
+			return "audio/ogg"
+		}
+		return "application/ogg"
+	case has(0, "fLaC"):
+		return "audio/flac"
+	case has(0, "ID3"):
+		return "audio/mpeg"
+	case len(b) >= 2 && b[0] == 0xff && b[1]&0xf6 == 0xf0:
+		// ADTS sync word with layer bits 00
+		return "audio/aac"
+	case len(b) >= 2 && b[0] == 0xff && b[1]&0xe0 == 0xe0 && b[1]&0x06 != 0:
+		return "audio/mpeg"
+	case has(0, "\xff\xd8\xff"):
+		return "image/jpeg"
+	case has(0, "\x89PNG\r\n\x1a\n"):
+		return "image/png"
+	case has(0, "GIF87a") || has(0, "GIF89a"):
+		return "image/gif"
+	case has(0, "BM") && len(b) >= 14:
+		return "image/bmp"
+	case has(0, "II*\x00") || has(0, "MM\x00*"):
+		return "image/tiff"
+	}
+	return sniffSubtitleType(b)
+}
+
+// sniffSubtitleType identifies WebVTT, SubRip and SubStation Alpha text
+func sniffSubtitleType(b []byte) string {
+	text := strings.TrimPrefix(string(b), "\ufeff")
+	switch {
+	case strings.HasPrefix(text, "WEBVTT"):
+		return "text/vtt"
+	case strings.HasPrefix(text, "[Script Info]"):
+		return "text/x-ssa"
+	}
+
+	// SubRip starts with a cue number followed by a timing line
+	lines := strings.SplitN(strings.TrimLeft(text, "\r\n"), "\n", 3)
+	if len(lines) >= 2 && isDigits(strings.TrimSpace(lines[0])) && strings.Contains(lines[1], "-->") {
+		return "application/x-subrip"
+	}
+	return ""
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
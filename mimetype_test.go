@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSniffMediaType(t *testing.T) {
+	ts := make([]byte, 400)
+	ts[0], ts[188], ts[376] = 0x47, 0x47, 0x47
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"mp4", "\x00\x00\x00\x18ftypisom", "video/mp4"},
+		{"quicktime brand", "\x00\x00\x00\x14ftypqt  ", "video/quicktime"},
+		{"m4a", "\x00\x00\x00\x18ftypM4A ", "audio/mp4"},
+		{"3gp", "\x00\x00\x00\x18ftyp3gp5", "video/3gpp"},
+		{"heic", "\x00\x00\x00\x18ftypheic", "image/heic"},
+		{"avif", "\x00\x00\x00\x18ftypavif", "image/avif"},
+		{"short ftyp", "\x00\x00\x00\x18ftyp", ""},
+		{"quicktime atoms", "\x00\x00\x00\x08wide", "video/quicktime"},
+		{"webm", "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm", "video/webm"},
+		{"matroska", "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska", "video/x-matroska"},
+		{"avi", "RIFF\x00\x00\x00\x00AVI LIST", "video/x-msvideo"},
+		{"wav", "RIFF\x00\x00\x00\x00WAVEfmt ", "audio/wav"},
+		{"webp", "RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"flv", "FLV\x01\x05", "video/x-flv"},
+		{"asf", "\x30\x26\xb2\x75\x8e\x66\xcf\x11\xa6\xd9", "video/x-ms-asf"},
+		{"mpeg program stream", "\x00\x00\x01\xba\x44", "video/mpeg"},
+		{"transport stream", string(ts), "video/mp2t"},
+		{"ogg theora", "OggS\x00\x02\x00\x00\x80theora", "video/ogg"},
+		{"ogg opus", "OggS\x00\x02\x00\x00OpusHead", "audio/ogg"},
+		{"ogg vorbis", "OggS\x00\x02\x00\x00\x01vorbis", "audio/ogg"},
+		{"ogg other", "OggS\x00\x02\x00\x00", "application/ogg"},
+		{"flac", "fLaC\x00\x00\x00\x22", "audio/flac"},
+		{"id3", "ID3\x03\x00", "audio/mpeg"},
+		{"adts", "\xff\xf1\x50\x80", "audio/aac"},
+		{"mp3 frame", "\xff\xfb\x90\x00", "audio/mpeg"},
+		{"jpeg", "\xff\xd8\xff\xe0", "image/jpeg"},
+		{"png", "\x89PNG\r\n\x1a\n", "image/png"},
+		{"gif", "GIF89a", "image/gif"},
+		{"bmp", "BM\x36\x00\x0c\x00\x00\x00\x00\x00\x36\x00\x00\x00", "image/bmp"},
+		{"short bmp", "BM", ""},
+		{"tiff", "MM\x00*\x00\x00\x00\x08", "image/tiff"},
+		{"webvtt with bom", "\ufeffWEBVTT\n\n", "text/vtt"},
+		{"ssa", "[Script Info]\nTitle: x", "text/x-ssa"},
+		{"subrip", "\r\n1\r\n00:00:01,000 --> 00:00:02,000\r\nHello", "application/x-subrip"},
+		{"numbered text", "1\nnot a timing line\n", ""},
+		{"html", "<!DOCTYPE html><script>", ""},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffMediaType([]byte(tt.data)); got != tt.want {
+				t.Errorf("sniffMediaType(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsActiveContentType(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     bool
+	}{
+		{"text/html", true},
+		{"text/html; charset=utf-8", true},
+		{" Image/SVG+XML ", true},
+		{"application/xhtml+xml", true},
+		{"text/xml; charset=utf-8", true},
+		{"text/plain; charset=utf-8", false},
+		{"video/mp4", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := isActiveContentType(tt.mimeType); got != tt.want {
+			t.Errorf("isActiveContentType(%q) = %v, want %v", tt.mimeType, got, tt.want)
+		}
+	}
+}
+
+func TestTypeOf(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"movie.MP4":   "plain text, named as a video",
+		"clip":        "\x00\x00\x00\x18ftypisom",
+		"song.xyz123": "ID3\x03\x00",
+		"page":        "<!DOCTYPE html><html><script>alert(1)</script>",
+		"drawing":     "<?xml version=\"1.0\"?><svg xmlns=\"http://www.w3.org/2000/svg\"/>",
+		"readme":      "just some text",
+		"empty":       "",
+		"subs.custom": "anything",
+		"logo.svg":    "<svg/>",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	types := NewMediaTypes(defaultMediaTypes(), map[string]string{"CUSTOM": "text/vtt", ".mp4": "video/x-custom"})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"movie.MP4", "video/x-custom"},
+		{"clip", "video/mp4"},
+		{"song.xyz123", "audio/mpeg"},
+		{"page", "application/octet-stream"},
+		{"drawing", "application/octet-stream"},
+		{"readme", "text/plain; charset=utf-8"},
+		{"empty", "application/octet-stream"},
+		{"subs.custom", "text/vtt"},
+		{"logo.svg", "image/svg+xml"},
+		{"missing", "application/octet-stream"},
+		{".", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fullPath := filepath.Join(dir, tt.name)
+			var info os.FileInfo = fakeFileInfo{name: tt.name}
+			if fi, err := os.Stat(fullPath); err == nil {
+				info = fi
+			}
+			if got := types.TypeOf(fullPath, info); got != tt.want {
+				t.Errorf("TypeOf(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeFileInfo describes a regular file that does not exist on disk
+type fakeFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi fakeFileInfo) Name() string       { return fi.name }
+func (fi fakeFileInfo) Size() int64        { return 0 }
+func (fi fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fakeFileInfo) IsDir() bool        { return false }
+
+func TestTypeOfCache(t *testing.T) {
+	fullPath := filepath.Join(t.TempDir(), "clip")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	types := NewMediaTypes(nil, nil)
+
+	typeOf := func(data string, modTime time.Time) string {
+		t.Helper()
+		if err := os.WriteFile(fullPath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fullPath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return types.TypeOf(fullPath, info)
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		modTime time.Time
+		want    string
+	}{
+		{"first detection", "\x00\x00\x00\x18ftypisom", modTime, "video/mp4"},
+		{"unchanged file is cached", "\x00\x00\x00\x18ftypM4A ", modTime, "video/mp4"},
+		{"new modification time", "\x00\x00\x00\x18ftypM4A ", modTime.Add(time.Second), "audio/mp4"},
+		{"new size", "\x00\x00\x00\x18ftypqt  \x00\x00", modTime.Add(time.Second), "video/quicktime"},
+	}
+
+	for _, tt := range tests {
+		if got := typeOf(tt.data, tt.modTime); got != tt.want {
+			t.Errorf("%s: TypeOf() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServeFileContentHeaders(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"movie.mp4":  "\x00\x00\x00\x18ftypisom",
+		"logo.svg":   "<svg xmlns=\"http://www.w3.org/2000/svg\"><script>alert(1)</script></svg>",
+		"index.html": "<script>alert(1)</script>",
+		"page":       "<!DOCTYPE html><script>alert(1)</script>",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &MediaServer{config: &Config{}, types: NewMediaTypes(defaultMediaTypes(), nil)}
+
+	tests := []struct {
+		name            string
+		wantType        string
+		wantDisposition string
+		wantCSP         string
+	}{
+		{"movie.mp4", "video/mp4", `inline; filename="movie.mp4"`, ""},
+		{"logo.svg", "image/svg+xml", `attachment; filename="logo.svg"`, "sandbox"},
+		{"index.html", "text/html; charset=utf-8", `attachment; filename="index.html"`, "sandbox"},
+		{"page", "application/octet-stream", `inline; filename="page"`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fullPath := filepath.Join(dir, tt.name)
+			info, err := os.Stat(fullPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			s.serveFile(w, httptest.NewRequest("GET", "/"+tt.name, nil), fullPath, info)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			h := w.Header()
+			if h.Get("Content-Type") != tt.wantType || h.Get("Content-Disposition") != tt.wantDisposition ||
+				h.Get("Content-Security-Policy") != tt.wantCSP || h.Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("headers = %v, want type %q, disposition %q, CSP %q and nosniff",
+					h, tt.wantType, tt.wantDisposition, tt.wantCSP)
+			}
+			if !bytes.Equal(w.Body.Bytes(), []byte(files[tt.name])) {
+				t.Errorf("body = %q, want the file contents", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,983 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// maxMoovSize bounds how much of a file is read to parse its metadata
+	maxMoovSize = 64 << 20
+
+	// maxTrackSamples bounds the sample tables built for a single track
+	maxTrackSamples = 1 << 22
+)
+
+var (
+	errNotMP4       = errors.New("not an MP4 file")
+	errMalformedMP4 = errors.New("malformed MP4 file")
+)
+
+// mp4TopLevelTypes are the box types that may start an MP4 file
+var mp4TopLevelTypes = map[string]bool{
+	"ftyp": true, "styp": true, "moov": true, "mdat": true, "free": true,
+	"skip": true, "wide": true, "pdin": true, "sidx": true, "moof": true,
+	"uuid": true, "meta": true,
+}
+
+// mp4BoxHeader locates a box within a file without holding its payload
+type mp4BoxHeader struct {
+	typ        string
+	offset     int64
+	size       int64
+	headerSize int64
+}
+
+// mp4Box is a box held in memory
+type mp4Box struct {
+	typ     string
+	raw     []byte // the whole box including its header
+	payload []byte
+}
+
+// mp4Movie is the parsed structure of an MP4 file
+type mp4Movie struct {
+	timescale  uint32
+	duration   uint64
+	mvhd       []byte
+	tracks     []*mp4Track
+	boxes      []mp4BoxHeader
+	fragmented bool
+	udta       []byte
+
+	// trexDurations holds the default sample duration of each track in a
+	// fragmented file, keyed by track ID
+	trexDurations map[uint32]uint32
+}
+
+// mp4Track is a track and its expanded sample table
+type mp4Track struct {
+	id          uint32
+	handler     string
+	timescale   uint32
+	duration    uint64
+	width       uint32
+	height      uint32
+	tkhd        []byte
+	mdhd        []byte
+	hdlr        []byte
+	mediaHeader []byte
+	dinf        []byte
+	stsd        []byte
+	samples     []mp4Sample
+	hasCTO      bool
+
+	// The edit list delays the track by editDelay, in the movie timescale,
+	// and starts its presentation at media time editStart
+	editDelay uint64
+	editStart int64
+}
+
+// mp4Sample locates a single sample (frame) in the file
+type mp4Sample struct {
+	offset   int64
+	size     uint32
+	dts      uint64
+	duration uint32
+	cto      int32
+	sync     bool
+}
+
+// readBoxHeaders lists the top-level boxes of a file
+func readBoxHeaders(r io.ReaderAt, fileSize int64) ([]mp4BoxHeader, error) {
+	var boxes []mp4BoxHeader
+	var buf [16]byte
+
+	for offset := int64(0); offset < fileSize; {
+		n, err := r.ReadAt(buf[:], offset)
+		if n < 8 {
+			if err == nil || err == io.EOF {
+				err = errMalformedMP4
+			}
+			return nil, err
+		}
+
+		box := mp4BoxHeader{
+			typ:        string(buf[4:8]),
+			offset:     offset,
+			size:       int64(binary.BigEndian.Uint32(buf[:4])),
+			headerSize: 8,
+		}
+		switch box.size {
+		case 0:
+			box.size = fileSize - offset
+		case 1:
+			if n < 16 {
+				return nil, errMalformedMP4
+			}
+			box.size = int64(binary.BigEndian.Uint64(buf[8:]))
+			box.headerSize = 16
+		}
+
+		if len(boxes) == 0 && !mp4TopLevelTypes[box.typ] {
+			return nil, errNotMP4
+		}
+		if box.size < box.headerSize || box.size > fileSize-offset {
+			return nil, fmt.Errorf("%w: invalid %q box size", errMalformedMP4, box.typ)
+		}
+
+		boxes = append(boxes, box)
+		offset += box.size
+	}
+	return boxes, nil
+}
+
+// parseBoxes splits data into consecutive boxes
+func parseBoxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errMalformedMP4
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errMalformedMP4
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: invalid %q box size", errMalformedMP4, typ)
+		}
+		boxes = append(boxes, mp4Box{typ: typ, raw: data[:size], payload: data[header:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// childBoxes parses the children of a container box into a map by type,
+// keeping the first box of each type
+func childBoxes(payload []byte) (map[string]mp4Box, error) {
+	boxes, err := parseBoxes(payload)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[string]mp4Box, len(boxes))
+	for _, box := range boxes {
+		if _, ok := children[box.typ]; !ok {
+			children[box.typ] = box
+		}
+	}
+	return children, nil
+}
+
+// parseMP4 reads the box structure and sample tables of an MP4 file
+func parseMP4(r io.ReaderAt, fileSize int64) (*mp4Movie, error) {
+	return readMP4(r, fileSize, true)
+}
+
+// parseMP4Header reads the box structure of an MP4 file without
+// expanding the sample tables of its tracks
+func parseMP4Header(r io.ReaderAt, fileSize int64) (*mp4Movie, error) {
+	return readMP4(r, fileSize, false)
+}
+
+// readMP4 parses the moov box of an MP4 file, optionally expanding the
+// sample tables of each track
+func readMP4(r io.ReaderAt, fileSize int64, samples bool) (*mp4Movie, error) {
+	boxes, err := readBoxHeaders(r, fileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	movie := &mp4Movie{boxes: boxes}
+	var moov *mp4BoxHeader
+	for i := range boxes {
+		switch boxes[i].typ {
+		case "moov":
+			if moov == nil {
+				moov = &boxes[i]
+			}
+		case "moof":
+			movie.fragmented = true
+		}
+	}
+	if moov == nil {
+		return nil, fmt.Errorf("%w: no moov box", errNotMP4)
+	}
+	if moov.size > maxMoovSize {
+		return nil, fmt.Errorf("%w: moov box too large", errMalformedMP4)
+	}
+
+	data := make([]byte, moov.size)
+	if _, err := r.ReadAt(data, moov.offset); err != nil {
+		return nil, err
+	}
+
+	children, err := parseBoxes(data[moov.headerSize:])
+	if err != nil {
+		return nil, err
+	}
+	for _, box := range children {
+		switch box.typ {
+		case "mvhd":
+			movie.mvhd = box.raw
+			movie.timescale, movie.duration, err = parseMediaHeader(box.payload)
+			if err != nil {
+				return nil, err
+			}
+		case "mvex":
+			movie.fragmented = true
+			movie.trexDurations, err = parseTrackExtends(box.payload)
+			if err != nil {
+				return nil, err
+			}
+		case "udta":
+			movie.udta = box.payload
+		case "trak":
+			track, err := parseTrack(box.payload, fileSize, samples)
+			if err != nil {
+				return nil, err
+			}
+			movie.tracks = append(movie.tracks, track)
+		}
+	}
+	if movie.mvhd == nil {
+		return nil, fmt.Errorf("%w: no mvhd box", errMalformedMP4)
+	}
+	return movie, nil
+}
+
+// parseTrackExtends reads the default sample durations from an mvex
+// payload
+func parseTrackExtends(payload []byte) (map[uint32]uint32, error) {
+	boxes, err := parseBoxes(payload)
+	if err != nil {
+		return nil, err
+	}
+	durations := make(map[uint32]uint32)
+	for _, box := range boxes {
+		if box.typ != "trex" {
+			continue
+		}
+		if len(box.payload) < 24 {
+			return nil, fmt.Errorf("%w: invalid trex", errMalformedMP4)
+		}
+		durations[binary.BigEndian.Uint32(box.payload[4:])] = binary.BigEndian.Uint32(box.payload[12:])
+	}
+	return durations, nil
+}
+
+// parseMediaHeader reads the timescale and duration from an mvhd or mdhd
+// payload
+func parseMediaHeader(payload []byte) (timescale uint32, duration uint64, err error) {
+	if len(payload) >= 32 && payload[0] == 1 {
+		return binary.BigEndian.Uint32(payload[20:]), binary.BigEndian.Uint64(payload[24:]), nil
+	}
+	if len(payload) >= 20 && payload[0] == 0 {
+		return binary.BigEndian.Uint32(payload[12:]), uint64(binary.BigEndian.Uint32(payload[16:])), nil
+	}
+	return 0, 0, fmt.Errorf("%w: invalid media header", errMalformedMP4)
+}
+
+// parseTrack reads a trak box payload of a file of fileSize bytes
+func parseTrack(payload []byte, fileSize int64, samples bool) (*mp4Track, error) {
+	trak, err := childBoxes(payload)
+	if err != nil {
+		return nil, err
+	}
+	tkhd, ok := trak["tkhd"]
+	if !ok {
+		return nil, fmt.Errorf("%w: track without tkhd", errMalformedMP4)
+	}
+	mdia, ok := trak["mdia"]
+	if !ok {
+		return nil, fmt.Errorf("%w: track without mdia", errMalformedMP4)
+	}
+
+	track := &mp4Track{tkhd: tkhd.raw}
+	p := tkhd.payload
+	switch {
+	case len(p) >= 92 && p[0] == 1:
+		track.id = binary.BigEndian.Uint32(p[20:])
+	case len(p) >= 80 && p[0] == 0:
+		track.id = binary.BigEndian.Uint32(p[12:])
+	default:
+		return nil, fmt.Errorf("%w: invalid tkhd", errMalformedMP4)
+	}
+	track.width = binary.BigEndian.Uint32(p[len(p)-8:]) >> 16
+	track.height = binary.BigEndian.Uint32(p[len(p)-4:]) >> 16
+
+	if edts, ok := trak["edts"]; ok {
+		if track.editDelay, track.editStart, err = parseEditList(edts.payload); err != nil {
+			return nil, err
+		}
+	}
+
+	media, err := childBoxes(mdia.payload)
+	if err != nil {
+		return nil, err
+	}
+	mdhd, ok := media["mdhd"]
+	if !ok {
+		return nil, fmt.Errorf("%w: track without mdhd", errMalformedMP4)
+	}
+	track.mdhd = mdhd.raw
+	track.timescale, track.duration, err = parseMediaHeader(mdhd.payload)
+	if err != nil {
+		return nil, err
+	}
+	if track.timescale == 0 {
+		return nil, fmt.Errorf("%w: zero track timescale", errMalformedMP4)
+	}
+
+	hdlr, ok := media["hdlr"]
+	if !ok || len(hdlr.payload) < 12 {
+		return nil, fmt.Errorf("%w: track without hdlr", errMalformedMP4)
+	}
+	track.hdlr = hdlr.raw
+	track.handler = string(hdlr.payload[8:12])
+
+	minf, ok := media["minf"]
+	if !ok {
+		return nil, fmt.Errorf("%w: track without minf", errMalformedMP4)
+	}
+	info, err := childBoxes(minf.payload)
+	if err != nil {
+		return nil, err
+	}
+	for _, typ := range []string{"vmhd", "smhd", "sthd", "nmhd"} {
+		if box, ok := info[typ]; ok {
+			track.mediaHeader = box.raw
+			break
+		}
+	}
+	track.dinf = info["dinf"].raw
+
+	stbl, ok := info["stbl"]
+	if !ok {
+		return nil, fmt.Errorf("%w: track without stbl", errMalformedMP4)
+	}
+	tables, err := childBoxes(stbl.payload)
+	if err != nil {
+		return nil, err
+	}
+	stsd, ok := tables["stsd"]
+	if !ok {
+		return nil, fmt.Errorf("%w: track without stsd", errMalformedMP4)
+	}
+	track.stsd = stsd.raw
+
+	if !samples {
+		return track, nil
+	}
+	if err := track.buildSamples(tables, fileSize); err != nil {
+		return nil, fmt.Errorf("track %d: %w", track.id, err)
+	}
+	return track, nil
+}
+
+// parseEditList reads the start of a track's presentation from an edts
+// payload: the duration of the empty edits before it, in the movie
+// timescale, and the media time of the first edit that shows media
+func parseEditList(payload []byte) (delay uint64, start int64, err error) {
+	edts, err := childBoxes(payload)
+	if err != nil {
+		return 0, 0, err
+	}
+	elst, ok := edts["elst"]
+	if !ok {
+		return 0, 0, nil
+	}
+
+	entrySize := 12
+	if len(elst.payload) > 0 && elst.payload[0] == 1 {
+		entrySize = 20
+	}
+	count, entries, err := tableEntries(elst.payload, 0, entrySize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid elst", errMalformedMP4)
+	}
+	for i := 0; i < count; i++ {
+		e := entries[i*entrySize:]
+		var duration uint64
+		var mediaTime int64
+		if entrySize == 20 {
+			duration, mediaTime = binary.BigEndian.Uint64(e), int64(binary.BigEndian.Uint64(e[8:]))
+		} else {
+			duration, mediaTime = uint64(binary.BigEndian.Uint32(e)), int64(int32(binary.BigEndian.Uint32(e[4:])))
+		}
+		if mediaTime >= 0 {
+			return delay, mediaTime, nil
+		}
+		delay += duration
+	}
+	return delay, 0, nil
+}
+
+// tableEntries validates a full box holding a counted table and returns
+// the entry count and table bytes. extra is the number of bytes between
+// the version/flags and the entry count.
+func tableEntries(payload []byte, extra, entrySize int) (int, []byte, error) {
+	start := 4 + extra + 4
+	if len(payload) < start {
+		return 0, nil, errMalformedMP4
+	}
+	count := uint64(binary.BigEndian.Uint32(payload[start-4:]))
+	if count*uint64(entrySize) > uint64(len(payload)-start) {
+		return 0, nil, errMalformedMP4
+	}
+	return int(count), payload[start:], nil
+}
+
+// buildSamples expands the sample tables into a list of samples, each of
+// which must lie within the fileSize bytes of the file
+func (t *mp4Track) buildSamples(tables map[string]mp4Box, fileSize int64) error {
+	sizes, err := sampleSizes(tables)
+	if err != nil {
+		return err
+	}
+	count := len(sizes)
+	if count == 0 {
+		return nil
+	}
+	t.samples = make([]mp4Sample, count)
+	for i, size := range sizes {
+		t.samples[i].size = size
+		t.samples[i].sync = true
+	}
+
+	// Chunk offsets
+	var chunks []int64
+	if box, ok := tables["stco"]; ok {
+		n, entries, err := tableEntries(box.payload, 0, 4)
+		if err != nil {
+			return err
+		}
+		chunks = make([]int64, n)
+		for i := range chunks {
+			chunks[i] = int64(binary.BigEndian.Uint32(entries[i*4:]))
+		}
+	} else if box, ok := tables["co64"]; ok {
+		n, entries, err := tableEntries(box.payload, 0, 8)
+		if err != nil {
+			return err
+		}
+		chunks = make([]int64, n)
+		for i := range chunks {
+			chunks[i] = int64(binary.BigEndian.Uint64(entries[i*8:]))
+		}
+	} else {
+		return fmt.Errorf("%w: missing chunk offsets", errMalformedMP4)
+	}
+
+	// Sample to chunk mapping
+	stsc, ok := tables["stsc"]
+	if !ok {
+		return fmt.Errorf("%w: missing stsc", errMalformedMP4)
+	}
+	n, entries, err := tableEntries(stsc.payload, 0, 12)
+	if err != nil {
+		return err
+	}
+	sample := 0
+	for i := 0; i < n && sample < count; i++ {
+		first := int(binary.BigEndian.Uint32(entries[i*12:]))
+		perChunk := int(binary.BigEndian.Uint32(entries[i*12+4:]))
+		last := len(chunks) + 1
+		if i+1 < n {
+			last = int(binary.BigEndian.Uint32(entries[(i+1)*12:]))
+		}
+		if first < 1 || last > len(chunks)+1 {
+			return fmt.Errorf("%w: invalid stsc", errMalformedMP4)
+		}
+		for chunk := first; chunk < last && sample < count; chunk++ {
+			offset := chunks[chunk-1]
+			for j := 0; j < perChunk && sample < count; j++ {
+				size := int64(t.samples[sample].size)
+				if offset < 0 || size > fileSize-offset {
+					return fmt.Errorf("%w: sample %d lies outside the file", errMalformedMP4, sample+1)
+				}
+				t.samples[sample].offset = offset
+				offset += size
+				sample++
+			}
+		}
+	}
+	if sample != count {
+		return fmt.Errorf("%w: stsc covers %d of %d samples", errMalformedMP4, sample, count)
+	}
+
+	// Decoding times
+	stts, ok := tables["stts"]
+	if !ok {
+		return fmt.Errorf("%w: missing stts", errMalformedMP4)
+	}
+	n, entries, err = tableEntries(stts.payload, 0, 8)
+	if err != nil {
+		return err
+	}
+	sample = 0
+	var dts uint64
+	for i := 0; i < n && sample < count; i++ {
+		runLength := binary.BigEndian.Uint32(entries[i*8:])
+		delta := binary.BigEndian.Uint32(entries[i*8+4:])
+		for j := uint32(0); j < runLength && sample < count; j++ {
+			t.samples[sample].dts = dts
+			t.samples[sample].duration = delta
+			dts += uint64(delta)
+			sample++
+		}
+	}
+	if sample != count {
+		return fmt.Errorf("%w: stts covers %d of %d samples", errMalformedMP4, sample, count)
+	}
+
+	// Composition offsets, treated as signed in either version
+	if box, ok := tables["ctts"]; ok {
+		n, entries, err := tableEntries(box.payload, 0, 8)
+		if err != nil {
+			return err
+		}
+		sample = 0
+		for i := 0; i < n && sample < count; i++ {
+			runLength := binary.BigEndian.Uint32(entries[i*8:])
+			offset := int32(binary.BigEndian.Uint32(entries[i*8+4:]))
+			for j := uint32(0); j < runLength && sample < count; j++ {
+				t.samples[sample].cto = offset
+				sample++
+			}
+		}
+		t.hasCTO = true
+	}
+
+	// Sync samples; without stss every sample is a sync sample
+	if box, ok := tables["stss"]; ok {
+		n, entries, err := tableEntries(box.payload, 0, 4)
+		if err != nil {
+			return err
+		}
+		for i := range t.samples {
+			t.samples[i].sync = false
+		}
+		for i := 0; i < n; i++ {
+			if index := int(binary.BigEndian.Uint32(entries[i*4:])); index >= 1 && index <= count {
+				t.samples[index-1].sync = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// sampleSizes reads the stsz or stz2 sample size table
+func sampleSizes(tables map[string]mp4Box) ([]uint32, error) {
+	if box, ok := tables["stsz"]; ok {
+		if len(box.payload) < 12 {
+			return nil, errMalformedMP4
+		}
+		fixed := binary.BigEndian.Uint32(box.payload[4:])
+		entrySize := 4
+		if fixed != 0 {
+			entrySize = 0
+		}
+		n, entries, err := tableEntries(box.payload, 4, entrySize)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxTrackSamples {
+			return nil, fmt.Errorf("%w: too many samples", errMalformedMP4)
+		}
+		sizes := make([]uint32, n)
+		for i := range sizes {
+			if fixed != 0 {
+				sizes[i] = fixed
+			} else {
+				sizes[i] = binary.BigEndian.Uint32(entries[i*4:])
+			}
+		}
+		return sizes, nil
+	}
+
+	if box, ok := tables["stz2"]; ok {
+		if len(box.payload) < 12 {
+			return nil, errMalformedMP4
+		}
+		fieldSize := int(box.payload[7])
+		n, entries, err := tableEntries(box.payload, 4, 0)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxTrackSamples || (n*fieldSize+7)/8 > len(entries) {
+			return nil, errMalformedMP4
+		}
+		sizes := make([]uint32, n)
+		for i := range sizes {
+			switch fieldSize {
+			case 4:
+				b := entries[i/2]
+				if i%2 == 0 {
+					sizes[i] = uint32(b >> 4)
+				} else {
+					sizes[i] = uint32(b & 0x0f)
+				}
+			case 8:
+				sizes[i] = uint32(entries[i])
+			case 16:
+				sizes[i] = uint32(binary.BigEndian.Uint16(entries[i*2:]))
+			default:
+				return nil, fmt.Errorf("%w: invalid stz2 field size", errMalformedMP4)
+			}
+		}
+		return sizes, nil
+	}
+
+	return nil, fmt.Errorf("%w: missing sample sizes", errMalformedMP4)
+}
+
+// mp4Fragment is a movie fragment of a fragmented MP4 file: a moof box,
+// an optional styp before it and the mdat holding its samples
+type mp4Fragment struct {
+	offset   int64
+	size     int64
+	start    uint64
+	duration uint64
+}
+
+// readFragments lists the movie fragments of a fragmented file, timed in
+// the timescale of the given track. Fragments without samples of that
+// track are merged into the previous fragment.
+func readFragments(r io.ReaderAt, movie *mp4Movie, track *mp4Track) ([]mp4Fragment, error) {
+	var fragments []mp4Fragment
+	var next uint64
+	segmentStart := int64(-1)
+
+	for i, box := range movie.boxes {
+		switch box.typ {
+		case "styp":
+			segmentStart = box.offset
+		case "moof":
+			if box.size > maxMoovSize {
+				return nil, fmt.Errorf("%w: moof box too large", errMalformedMP4)
+			}
+			data := make([]byte, box.size)
+			if _, err := r.ReadAt(data, box.offset); err != nil {
+				return nil, err
+			}
+			start, duration, found, err := fragmentTiming(data[box.headerSize:], track.id, movie.trexDurations[track.id])
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				start = next
+			}
+			next = start + duration
+
+			offset := box.offset
+			if segmentStart >= 0 && i > 0 && movie.boxes[i-1].offset == segmentStart {
+				offset = segmentStart
+			}
+			segmentStart = -1
+
+			if duration == 0 && len(fragments) > 0 {
+				continue
+			}
+			fragments = append(fragments, mp4Fragment{offset: offset, size: box.offset + box.size - offset, start: start, duration: duration})
+		case "mdat":
+			if len(fragments) > 0 {
+				last := &fragments[len(fragments)-1]
+				last.size = box.offset + box.size - last.offset
+			}
+		}
+	}
+	if len(fragments) == 0 {
+		return nil, fmt.Errorf("%w: no movie fragments", errMalformedMP4)
+	}
+	return fragments, nil
+}
+
+// fragmentTiming returns the base decode time and total sample duration
+// of a track within a moof payload. found reports whether the fragment
+// carried a decode time for the track.
+func fragmentTiming(payload []byte, trackID, defaultDuration uint32) (start, duration uint64, found bool, err error) {
+	boxes, err := parseBoxes(payload)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	for _, traf := range boxes {
+		if traf.typ != "traf" {
+			continue
+		}
+		children, err := parseBoxes(traf.payload)
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		sampleDuration := defaultDuration
+		matched := false
+		for _, box := range children {
+			p := box.payload
+			switch box.typ {
+			case "tfhd":
+				if len(p) < 8 {
+					return 0, 0, false, fmt.Errorf("%w: invalid tfhd", errMalformedMP4)
+				}
+				if binary.BigEndian.Uint32(p[4:]) != trackID {
+					break
+				}
+				matched = true
+				flags := binary.BigEndian.Uint32(p) & 0xffffff
+				pos := 8
+				if flags&0x01 != 0 {
+					pos += 8 // base data offset
+				}
+				if flags&0x02 != 0 {
+					pos += 4 // sample description index
+				}
+				if flags&0x08 != 0 {
+					if len(p) < pos+4 {
+						return 0, 0, false, fmt.Errorf("%w: invalid tfhd", errMalformedMP4)
+					}
+					sampleDuration = binary.BigEndian.Uint32(p[pos:])
+				}
+			case "tfdt":
+				if !matched {
+					break
+				}
+				switch {
+				case len(p) >= 12 && p[0] == 1:
+					start = binary.BigEndian.Uint64(p[4:])
+				case len(p) >= 8 && p[0] == 0:
+					start = uint64(binary.BigEndian.Uint32(p[4:]))
+				default:
+					return 0, 0, false, fmt.Errorf("%w: invalid tfdt", errMalformedMP4)
+				}
+				found = true
+			case "trun":
+				if !matched {
+					break
+				}
+				d, err := runDuration(p, sampleDuration)
+				if err != nil {
+					return 0, 0, false, err
+				}
+				duration += d
+			}
+		}
+		if matched {
+			return start, duration, found, nil
+		}
+	}
+	return 0, 0, false, nil
+}
+
+// runDuration returns the total sample duration of a trun payload
+func runDuration(p []byte, defaultDuration uint32) (uint64, error) {
+	if len(p) < 8 {
+		return 0, fmt.Errorf("%w: invalid trun", errMalformedMP4)
+	}
+	flags := binary.BigEndian.Uint32(p) & 0xffffff
+	count := int(binary.BigEndian.Uint32(p[4:]))
+	pos := 8
+	if flags&trunDataOffset != 0 {
+		pos += 4
+	}
+	if flags&0x04 != 0 {
+		pos += 4 // first sample flags
+	}
+	if len(p) < pos {
+		return 0, fmt.Errorf("%w: invalid trun", errMalformedMP4)
+	}
+
+	if flags&trunSampleDuration == 0 {
+		return uint64(count) * uint64(defaultDuration), nil
+	}
+
+	entrySize := 0
+	for _, flag := range []uint32{trunSampleDuration, trunSampleSize, trunSampleFlags, trunSampleCTSOffset} {
+		if flags&flag != 0 {
+			entrySize += 4
+		}
+	}
+	if uint64(count)*uint64(entrySize) > uint64(len(p)-pos) {
+		return 0, fmt.Errorf("%w: invalid trun", errMalformedMP4)
+	}
+
+	var total uint64
+	for i := 0; i < count; i++ {
+		total += uint64(binary.BigEndian.Uint32(p[pos+i*entrySize:]))
+	}
+	return total, nil
+}
+
+// codec returns the RFC 6381 codecs parameter for the track, such as
+// "avc1.64001f" or "mp4a.40.2". Unknown sample entries are reported by
+// their four character code.
+func (t *mp4Track) codec() string {
+	entry, ok := t.sampleEntry()
+	if !ok {
+		return ""
+	}
+
+	switch entry.typ {
+	case "avc1", "avc3":
+		// Visual sample entries have 78 bytes of fields before their boxes
+		if len(entry.payload) < 78 {
+			return entry.typ
+		}
+		children, err := childBoxes(entry.payload[78:])
+		if err != nil {
+			return entry.typ
+		}
+		if avcC, ok := children["avcC"]; ok && len(avcC.payload) >= 4 {
+			return fmt.Sprintf("%s.%02x%02x%02x", entry.typ, avcC.payload[1], avcC.payload[2], avcC.payload[3])
+		}
+	case "mp4a":
+		// Audio sample entries have 28 bytes of fields before their boxes
+		if len(entry.payload) < 28 {
+			return entry.typ
+		}
+		children, err := childBoxes(entry.payload[28:])
+		if err != nil {
+			return entry.typ
+		}
+		if esds, ok := children["esds"]; ok && len(esds.payload) > 4 {
+			if codec := esdsCodec(esds.payload[4:]); codec != "" {
+				return codec
+			}
+		}
+	}
+	return entry.typ
+}
+
+// sampleEntry returns the first sample description of the track
+func (t *mp4Track) sampleEntry() (mp4Box, bool) {
+	// stsd: full box header, entry count, then the sample entries
+	if len(t.stsd) < 24 {
+		return mp4Box{}, false
+	}
+	entries, err := parseBoxes(t.stsd[16:])
+	if err != nil || len(entries) == 0 {
+		return mp4Box{}, false
+	}
+	return entries[0], true
+}
+
+// esdsCodec reads the object type and, for MPEG-4 audio, the audio object
+// type from an elementary stream descriptor
+func esdsCodec(p []byte) string {
+	// readDescriptor returns the tag and body of the descriptor at p
+	readDescriptor := func(p []byte) (byte, []byte) {
+		if len(p) < 2 {
+			return 0, nil
+		}
+		tag := p[0]
+		size, i := 0, 1
+		for ; i < len(p) && i < 5; i++ {
+			size = size<<7 | int(p[i]&0x7f)
+			if p[i]&0x80 == 0 {
+				i++
+				break
+			}
+		}
+		if size > len(p)-i {
+			return 0, nil
+		}
+		return tag, p[i : i+size]
+	}
+
+	tag, es := readDescriptor(p)
+	if tag != 0x03 || len(es) < 3 {
+		return ""
+	}
+	flags := es[2]
+	pos := 3
+	if flags&0x80 != 0 {
+		pos += 2 // depends on ES ID
+	}
+	if flags&0x40 != 0 {
+		if pos >= len(es) {
+			return ""
+		}
+		pos += 1 + int(es[pos]) // URL
+	}
+	if flags&0x20 != 0 {
+		pos += 2 // OCR ES ID
+	}
+	if pos >= len(es) {
+		return ""
+	}
+
+	tag, config := readDescriptor(es[pos:])
+	if tag != 0x04 || len(config) < 13 {
+		return ""
+	}
+	objectType := config[0]
+	if objectType != 0x40 {
+		return fmt.Sprintf("mp4a.%02x", objectType)
+	}
+
+	tag, specific := readDescriptor(config[13:])
+	if tag != 0x05 || len(specific) == 0 {
+		return "mp4a.40"
+	}
+	audioType := specific[0] >> 3
+	if audioType == 31 && len(specific) >= 2 {
+		audioType = 32 + (specific[0]&0x07)<<3 | specific[1]>>5
+	}
+	return fmt.Sprintf("mp4a.40.%d", audioType)
+}
+
+// endTime returns the decode time at which the track ends
+func (t *mp4Track) endTime() uint64 {
+	if len(t.samples) == 0 {
+		return 0
+	}
+	last := t.samples[len(t.samples)-1]
+	return last.dts + uint64(last.duration)
+}
+
+// mp4Writer builds boxes in memory
+type mp4Writer struct {
+	buf []byte
+}
+
+// open starts a box and returns its position for close
+func (w *mp4Writer) open(typ string) int {
+	pos := len(w.buf)
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	w.buf = append(w.buf, typ...)
+	return pos
+}
+
+// openFull starts a full box with the given version and flags
+func (w *mp4Writer) openFull(typ string, version uint8, flags uint32) int {
+	pos := w.open(typ)
+	w.u32(uint32(version)<<24 | flags)
+	return pos
+}
+
+// close writes the size of the box started at pos
+func (w *mp4Writer) close(pos int) {
+	binary.BigEndian.PutUint32(w.buf[pos:], uint32(len(w.buf)-pos))
+}
+
+func (w *mp4Writer) u32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *mp4Writer) u64(v uint64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+}
+
+func (w *mp4Writer) write(b []byte) {
+	w.buf = append(w.buf, b...)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testBox builds a box of the given type around the concatenated parts
+func testBox(typ string, parts ...[]byte) []byte {
+	payload := bytes.Join(parts, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	box = append(box, typ...)
+	return append(box, payload...)
+}
+
+// u32s encodes big-endian 32-bit values
+func u32s(values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func TestParseBoxes(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []string
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"two boxes", append(testBox("free"), testBox("skip", []byte{1, 2})...), []string{"free", "skip"}, false},
+		{"size zero runs to the end", append(u32s(0), "mdat\x01\x02"...), []string{"mdat"}, false},
+		{"truncated header", []byte{0, 0, 0, 8, 'f'}, nil, true},
+		{"size below header", append(u32s(4), "free"...), nil, true},
+		{"size past the end", append(u32s(16), "free\x00"...), nil, true},
+		{"truncated large size", append(u32s(1), "mdat\x00\x00"...), nil, true},
+		{"large size past the end", append(append(u32s(1), "mdat"...), u32s(0, 1<<20)...), nil, true},
+		{"large size overflowing", append(append(u32s(1), "mdat"...), u32s(0xffffffff, 0xffffffff)...), nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			boxes, err := parseBoxes(tt.data)
+			if tt.wantErr {
+				if !errors.Is(err, errMalformedMP4) {
+					t.Fatalf("parseBoxes() error = %v, want %v", err, errMalformedMP4)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseBoxes() error = %v", err)
+			}
+			var types []string
+			for _, box := range boxes {
+				types = append(types, box.typ)
+			}
+			if len(types) != len(tt.want) {
+				t.Fatalf("parseBoxes() = %v, want %v", types, tt.want)
+			}
+			for i := range types {
+				if types[i] != tt.want[i] {
+					t.Errorf("parseBoxes() = %v, want %v", types, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadBoxHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr error
+	}{
+		{"valid", append(testBox("ftyp", []byte("isom")), testBox("mdat", []byte{1})...), 2, nil},
+		{"not mp4", testBox("abcd"), 0, errNotMP4},
+		{"truncated header", append(testBox("ftyp"), 0, 0, 0), 0, errMalformedMP4},
+		{"box past the end", append(testBox("ftyp"), append(u32s(100), "mdat"...)...), 0, errMalformedMP4},
+		{"truncated large size", append(testBox("ftyp"), append(u32s(1), "mdat"...)...), 0, errMalformedMP4},
+		{"large size past the end", append(testBox("ftyp"), append(append(u32s(1), "mdat"...), u32s(0x80000000, 0)...)...), 0, errMalformedMP4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			boxes, err := readBoxHeaders(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readBoxHeaders() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(boxes) != tt.want {
+				t.Errorf("readBoxHeaders() = %d boxes, want %d", len(boxes), tt.want)
+			}
+		})
+	}
+}
+
+func TestRunDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    uint64
+		wantErr bool
+	}{
+		{"default durations", u32s(0, 3), 3 * 1000, false},
+		{"sample durations", u32s(trunSampleDuration, 2, 10, 20), 30, false},
+		{"sample durations and sizes", u32s(trunSampleDuration|trunSampleSize, 2, 10, 99, 20, 99), 30, false},
+		{"data offset and first sample flags", u32s(trunSampleDuration|trunDataOffset|0x04, 1, 0, 0, 40), 40, false},
+		{"short payload", []byte{0, 0, 1}, 0, true},
+		{"header past the end", []byte{0, 0, 1, 5, 0, 0, 0, 1}, 0, true},
+		{"data offset past the end", u32s(trunSampleDuration|trunDataOffset, 0), 0, true},
+		{"entries past the end", u32s(trunSampleDuration, 3, 10, 20), 0, true},
+		{"huge count", u32s(trunSampleDuration|trunSampleSize, 0xffffffff, 1, 2), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runDuration(tt.payload, 1000)
+			if tt.wantErr {
+				if !errors.Is(err, errMalformedMP4) {
+					t.Fatalf("runDuration() error = %v, want %v", err, errMalformedMP4)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("runDuration() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("runDuration() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFragmentTiming(t *testing.T) {
+	tfhd := testBox("tfhd", u32s(0, 1))
+	tfdt := testBox("tfdt", u32s(0, 5000))
+
+	tests := []struct {
+		name      string
+		moof      []byte
+		wantStart uint64
+		wantDur   uint64
+		wantFound bool
+		wantErr   bool
+	}{
+		{"complete", testBox("traf", tfhd, tfdt, testBox("trun", u32s(0, 2))), 5000, 2000, true, false},
+		{"other track", testBox("traf", testBox("tfhd", u32s(0, 2)), tfdt), 0, 0, false, false},
+		{"default duration from tfhd", testBox("traf", testBox("tfhd", u32s(0x08, 1, 40)), testBox("trun", u32s(0, 3))), 0, 120, false, false},
+		{"truncated tfhd", testBox("traf", testBox("tfhd", u32s(0))), 0, 0, false, true},
+		{"truncated tfhd duration", testBox("traf", testBox("tfhd", u32s(0x08, 1))), 0, 0, false, true},
+		{"truncated tfdt", testBox("traf", tfhd, testBox("tfdt", u32s(0))), 0, 0, false, true},
+		{"truncated trun", testBox("traf", tfhd, testBox("trun", []byte{0, 0, 1, 5, 0, 0, 0, 1})), 0, 0, false, true},
+		{"truncated traf", testBox("traf", tfhd[:6]), 0, 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, duration, found, err := fragmentTiming(tt.moof, 1, 1000)
+			if tt.wantErr {
+				if !errors.Is(err, errMalformedMP4) {
+					t.Fatalf("fragmentTiming() error = %v, want %v", err, errMalformedMP4)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fragmentTiming() error = %v", err)
+			}
+			if start != tt.wantStart || duration != tt.wantDur || found != tt.wantFound {
+				t.Errorf("fragmentTiming() = %d, %d, %v, want %d, %d, %v", start, duration, found, tt.wantStart, tt.wantDur, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestReadFragmentsTruncatedTrun(t *testing.T) {
+	moof := testBox("moof", testBox("traf", testBox("tfhd", u32s(0, 1)), testBox("trun", []byte{0, 0, 1, 5, 0, 0, 0, 1})))
+	data := append(testBox("ftyp", []byte("iso6")), moof...)
+	data = append(data, testBox("mdat", []byte{0})...)
+
+	boxes, err := readBoxHeaders(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	movie := &mp4Movie{boxes: boxes, fragmented: true}
+	_, err = readFragments(bytes.NewReader(data), movie, &mp4Track{id: 1})
+	if !errors.Is(err, errMalformedMP4) {
+		t.Errorf("readFragments() error = %v, want %v", err, errMalformedMP4)
+	}
+}
+
+// testTrackFile builds a progressive MP4 file with one video track of
+// one-second samples of the given sizes stored in a single chunk, whose
+// offset box (stco or co64) is given. The samples' data starts at byte 24.
+func testTrackFile(sizes []uint32, chunkOffsets []byte) []byte {
+	data := make([]byte, 0, 64)
+	for i, size := range sizes {
+		for j := uint32(0); j < size && len(data) < 1<<16; j++ {
+			data = append(data, byte(i+1))
+		}
+	}
+
+	stsz := u32s(0, 0, uint32(len(sizes)))
+	for _, size := range sizes {
+		stsz = append(stsz, u32s(size)...)
+	}
+	stbl := testBox("stbl",
+		testBox("stsd", u32s(0, 0)),
+		testBox("stts", u32s(0, 1, uint32(len(sizes)), 1000)),
+		testBox("stsc", u32s(0, 1, 1, uint32(len(sizes)), 1)),
+		testBox("stsz", stsz),
+		chunkOffsets,
+	)
+	tkhd := make([]byte, 80)
+	binary.BigEndian.PutUint32(tkhd[12:], 1)
+	trak := testBox("trak",
+		testBox("tkhd", tkhd),
+		testBox("mdia",
+			testBox("mdhd", u32s(0, 0, 0, 1000, uint32(len(sizes))*1000)),
+			testBox("hdlr", u32s(0, 0), []byte("vide"), make([]byte, 12)),
+			testBox("minf", testBox("vmhd", u32s(0, 0, 0)), stbl),
+		),
+	)
+	moov := testBox("moov", testBox("mvhd", u32s(0, 0, 0, 1000, uint32(len(sizes))*1000), make([]byte, 80)), trak)
+
+	file := testBox("ftyp", []byte("isom"), u32s(0))
+	file = append(file, testBox("mdat", data)...)
+	return append(file, moov...)
+}
+
+func TestParseMP4SampleBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		sizes   []uint32
+		chunks  []byte
+		wantErr bool
+	}{
+		{"valid", []uint32{10, 10, 10}, testBox("stco", u32s(0, 1, 24)), false},
+		{"valid co64", []uint32{10, 10, 10}, testBox("co64", u32s(0, 1, 0, 24)), false},
+		{"chunk past the end", []uint32{10, 10, 10}, testBox("stco", u32s(0, 1, 0xfffffff0)), true},
+		{"negative co64 offset", []uint32{10}, testBox("co64", u32s(0, 1, 0x80000000, 0)), true},
+		{"huge co64 offset", []uint32{10}, testBox("co64", u32s(0, 1, 0x7fffffff, 0xffffffff)), true},
+		{"huge sample", []uint32{10, 0xffffffff}, testBox("stco", u32s(0, 1, 24)), true},
+		{"truncated stco", []uint32{10}, testBox("stco", u32s(0, 2, 24)), true},
+		{"missing chunk offsets", []uint32{10}, testBox("free"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testTrackFile(tt.sizes, tt.chunks)
+			movie, err := parseMP4(bytes.NewReader(data), int64(len(data)))
+			if tt.wantErr {
+				if !errors.Is(err, errMalformedMP4) {
+					t.Fatalf("parseMP4() error = %v, want %v", err, errMalformedMP4)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMP4() error = %v", err)
+			}
+			samples := movie.tracks[0].samples
+			if len(samples) != len(tt.sizes) {
+				t.Fatalf("parseMP4() found %d samples, want %d", len(samples), len(tt.sizes))
+			}
+			for i, sample := range samples {
+				if want := int64(24 + 10*i); sample.offset != want || sample.dts != uint64(1000*i) {
+					t.Errorf("sample %d at %d, dts %d, want %d, %d", i, sample.offset, sample.dts, want, 1000*i)
+				}
+			}
+		})
+	}
+}
+
+func TestHLSMediaSegment(t *testing.T) {
+	data := testTrackFile([]uint32{10, 20, 30}, testBox("stco", u32s(0, 1, 24)))
+	movie, err := parseMP4(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := planHLS(movie, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.segments) != 3 {
+		t.Fatalf("planHLS() cut %d segments, want 3", len(idx.segments))
+	}
+
+	segment, err := idx.mediaSegment(bytes.NewReader(data), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boxes, err := parseBoxes(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(boxes) != 2 || boxes[0].typ != "moof" || boxes[1].typ != "mdat" {
+		t.Fatalf("segment boxes = %v, want moof and mdat", boxes)
+	}
+	if !bytes.Equal(boxes[1].payload, bytes.Repeat([]byte{2}, 20)) {
+		t.Errorf("segment samples = %v, want the second sample", boxes[1].payload)
+	}
+	start, duration, found, err := fragmentTiming(boxes[0].payload, 1, 0)
+	if err != nil || start != 1000 || duration != 1000 || !found {
+		t.Errorf("segment timing = %d, %d, %v, %v, want 1000, 1000, true", start, duration, found, err)
+	}
+}
+
+func TestHLSMediaSegmentTooLarge(t *testing.T) {
+	track := &mp4Track{id: 1, timescale: 1000, samples: []mp4Sample{
+		{offset: 0, size: maxHLSSegmentSize / 2, duration: 1000, sync: true},
+		{offset: 0, size: maxHLSSegmentSize/2 + 1, duration: 1000},
+	}}
+	idx := &hlsIndex{
+		movie:    &mp4Movie{},
+		tracks:   []*mp4Track{track},
+		shifts:   []uint64{0},
+		segments: []hlsSegment{{duration: 2, ranges: [][2]int{{0, 2}}}},
+	}
+	if _, err := idx.mediaSegment(bytes.NewReader(nil), 0); !errors.Is(err, errMalformedMP4) {
+		t.Errorf("mediaSegment() error = %v, want %v", err, errMalformedMP4)
+	}
+}
+
+func TestParseEditList(t *testing.T) {
+	elst := func(version byte, entries ...[]byte) []byte {
+		return testBox("elst", []byte{version, 0, 0, 0}, u32s(uint32(len(entries))), bytes.Join(entries, nil))
+	}
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		wantDelay uint64
+		wantStart int64
+		wantErr   bool
+	}{
+		{"no elst", testBox("free"), 0, 0, false},
+		{"media start", elst(0, u32s(5000, 1024, 0x10000)), 0, 1024, false},
+		{"empty edit first", elst(0, u32s(600, 0xffffffff, 0x10000), u32s(5000, 0, 0x10000)), 600, 0, false},
+		{"version 1", elst(1, u32s(0, 700, 0xffffffff, 0xffffffff, 0x10000), u32s(0, 5000, 0, 2048, 0x10000)), 700, 2048, false},
+		{"only empty edits", elst(0, u32s(600, 0xffffffff, 0x10000)), 600, 0, false},
+		{"truncated entries", testBox("elst", u32s(0, 2), u32s(5000, 0, 0x10000)), 0, 0, true},
+		{"truncated box", []byte{0, 0, 0, 20, 'e', 'l', 's', 't'}, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, start, err := parseEditList(tt.payload)
+			if tt.wantErr {
+				if !errors.Is(err, errMalformedMP4) {
+					t.Fatalf("parseEditList() error = %v, want %v", err, errMalformedMP4)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEditList() error = %v", err)
+			}
+			if delay != tt.wantDelay || start != tt.wantStart {
+				t.Errorf("parseEditList() = %d, %d, want %d, %d", delay, start, tt.wantDelay, tt.wantStart)
+			}
+		})
+	}
+}
+
+func TestEditShifts(t *testing.T) {
+	tests := []struct {
+		name   string
+		tracks []*mp4Track
+		want   []uint64
+	}{
+		{"no edits", []*mp4Track{{timescale: 1000}, {timescale: 48000}}, []uint64{0, 0}},
+		{"audio priming skipped", []*mp4Track{{timescale: 1000}, {timescale: 48000, editStart: 1024}}, []uint64{21, 0}},
+		{"video delayed by composition offset", []*mp4Track{{timescale: 90000, editStart: 3000}, {timescale: 48000}}, []uint64{0, 1600}},
+		{"empty edit delays a track", []*mp4Track{{timescale: 1000}, {timescale: 48000, editDelay: 500}}, []uint64{0, 24000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := editShifts(tt.tracks, 1000)
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("editShifts() = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
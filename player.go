@@ -0,0 +1,406 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// subtitleExtensions are the sidecar subtitle formats offered as tracks.
+// They are converted to WebVTT when served to the player.
+var subtitleExtensions = map[string]bool{
+	".vtt": true,
+	".srt": true,
+	".ass": true,
+	".ssa": true,
+}
+
+// subtitleLanguage matches subtitle name suffixes that are language tags,
+// such as "en", "chi" or "zh-CN"
+var subtitleLanguage = regexp.MustCompile(`^[a-zA-Z]{2,3}([-_][a-zA-Z]{2,4})?$`)
+
+// PlayerData holds data for the player page template
+type PlayerData struct {
+	ServerName string
+	File       FileInfo
+	Kind       string
+	FileURL    string
+	FolderURL  string
+	// PrefetchURL is the next image, loaded ahead of navigation
+	PrefetchURL string
+	Previous    *FileInfo
+	Next        *FileInfo
+	Position    int
+	Count       int
+	Subtitles   []SubtitleTrack
+	// Progress enables saving the playback position, resuming at Resume
+	Progress bool
+	Resume   float64
+}
+
+// SubtitleTrack is a sidecar subtitle file offered to the media element
+type SubtitleTrack struct {
+	Label    string
+	Language string
+	URL      string
+}
+
+// playerKind returns the media element that plays a MIME type: "video",
+// "audio" or "image", or "" if it cannot be shown in the browser
+func playerKind(mimeType string) string {
+	for _, kind := range []string{"video", "audio", "image"} {
+		if strings.HasPrefix(mimeType, kind+"/") {
+			return kind
+		}
+	}
+	return ""
+}
+
+// IsPlayable reports whether the file can be opened in the player
+func (f FileInfo) IsPlayable() bool {
+	return !f.IsDir && playerKind(f.MimeType) != ""
+}
+
+// GetPlayPath returns the URL of the file's player page
+func (f FileInfo) GetPlayPath() string {
+	return "/play" + escapeURLPath(f.Path)
+}
+
+// handlePlay serves /play/<path>, a page that plays a video or audio file
+// or shows an image, with navigation to the neighbouring files of the
+// same kind in its folder
+func (s *MediaServer) handlePlay(w http.ResponseWriter, r *http.Request) {
+	if s.player == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cleanPath, fullPath, err := s.resolvePath(r, strings.TrimPrefix(r.URL.Path, "/play"))
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	file := newFileInfo(cleanPath, fullPath, info, s.types)
+	kind := playerKind(file.MimeType)
+	if kind == "" {
+		http.Error(w, "File cannot be played in the browser", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	folder := path.Dir(cleanPath)
+	siblings, err := s.listDirectory(userFromContext(r.Context()), filepath.Dir(fullPath), folder)
+	if err != nil {
+		log.Printf("Error reading directory %s: %v", filepath.Dir(fullPath), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := PlayerData{
+		ServerName: "HTTP Media Server",
+		File:       file,
+		Kind:       kind,
+		FileURL:    escapeURLPath(cleanPath),
+		FolderURL:  escapeURLPath(folder),
+	}
+
+	var playlist []FileInfo
+	for _, sibling := range siblings {
+		if !sibling.IsDir && playerKind(sibling.MimeType) == kind {
+			playlist = append(playlist, sibling)
+		}
+	}
+	for i := range playlist {
+		if playlist[i].Path != cleanPath {
+			continue
+		}
+		data.Position, data.Count = i+1, len(playlist)
+		if i > 0 {
+			data.Previous = &playlist[i-1]
+		}
+		if i+1 < len(playlist) {
+			data.Next = &playlist[i+1]
+			if kind == "image" {
+				data.PrefetchURL = escapeURLPath(data.Next.Path)
+			}
+		}
+	}
+
+	if kind == "video" {
+		data.Subtitles = findSubtitles(file, siblings)
+	}
+	if s.progress != nil && kind != "image" {
+		data.Progress = true
+		if entry, ok := s.progress.Get(userFromContext(r.Context()), cleanPath); ok && !entry.Finished {
+			data.Resume = entry.Position
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.player.Execute(w, data); err != nil {
+		log.Printf("Template execution error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// findSubtitles returns the subtitle files next to a media file that share
+// its base name, such as "movie.srt" or "movie.en.vtt" for "movie.mp4"
+func findSubtitles(file FileInfo, siblings []FileInfo) []SubtitleTrack {
+	base := strings.TrimSuffix(file.Name, filepath.Ext(file.Name))
+
+	var tracks []SubtitleTrack
+	for _, sibling := range siblings {
+		ext := filepath.Ext(sibling.Name)
+		if sibling.IsDir || !subtitleExtensions[strings.ToLower(ext)] {
+			continue
+		}
+		name := strings.TrimSuffix(sibling.Name, ext)
+		if name != base && !strings.HasPrefix(name, base+".") {
+			continue
+		}
+
+		track := SubtitleTrack{
+			Label: strings.TrimPrefix(strings.TrimPrefix(name, base), "."),
+			URL:   escapeURLPath(sibling.Path) + "?format=vtt",
+		}
+		if subtitleLanguage.MatchString(track.Label) {
+			track.Language = strings.ReplaceAll(track.Label, "_", "-")
+		}
+		if track.Label == "" {
+			track.Label = strings.ToUpper(strings.TrimPrefix(ext, "."))
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+// newPlayerTemplate parses the player page template
+func newPlayerTemplate() *template.Template {
+	return template.Must(template.New("player").Parse(playerTemplate))
+}
+
+const playerTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.File.Name}} - {{.ServerName}}</title>
+    {{with .PrefetchURL}}<link rel="prefetch" href="{{.}}">{{end}}
+    <style>
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            margin: 0;
+            background-color: #111;
+            color: #eee;
+            display: flex;
+            flex-direction: column;
+            height: 100vh;
+        }
+        .header {
+            display: flex;
+            align-items: center;
+            gap: 15px;
+            padding: 10px 20px;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+        }
+        .header a {
+            color: white;
+            text-decoration: none;
+        }
+        .header .title {
+            flex: 1;
+            overflow: hidden;
+            text-overflow: ellipsis;
+            white-space: nowrap;
+        }
+        .header .position {
+            font-size: 14px;
+            opacity: 0.8;
+        }
+        .stage {
+            flex: 1;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            min-height: 0;
+            position: relative;
+        }
+        .stage video, .stage img {
+            max-width: 100%;
+            max-height: 100%;
+        }
+        .stage audio {
+            width: 80%;
+        }
+        .stage img.zoomed {
+            max-width: none;
+            max-height: none;
+        }
+        .stage.zoomed {
+            overflow: auto;
+            align-items: flex-start;
+            justify-content: flex-start;
+        }
+        .nav {
+            position: absolute;
+            top: 50%;
+            transform: translateY(-50%);
+            padding: 20px 12px;
+            font-size: 28px;
+            color: white;
+            text-decoration: none;
+            background-color: rgba(0,0,0,0.4);
+            border-radius: 6px;
+        }
+        .nav.previous {
+            left: 10px;
+        }
+        .nav.next {
+            right: 10px;
+        }
+        .info {
+            padding: 10px 20px;
+            font-size: 13px;
+            color: #aaa;
+        }
+    </style>
+</head>
+<body>
+    <div class="header">
+        <a href="{{.FolderURL}}" title="Back to folder (Esc)">↰</a>
+        <div class="title">{{.File.GetFileIcon}} {{.File.Name}}</div>
+        {{if gt .Count 1}}<div class="position">{{.Position}} / {{.Count}}</div>{{end}}
+        <a href="{{.FileURL}}" download>⬇</a>
+    </div>
+
+    <div class="stage" id="stage">
+        {{if eq .Kind "video"}}
+        <video id="media" src="{{.FileURL}}" controls autoplay preload="metadata">
+            {{range $i, $track := .Subtitles}}
+            <track kind="subtitles" src="{{$track.URL}}" label="{{$track.Label}}"{{with $track.Language}} srclang="{{.}}"{{end}}{{if eq $i 0}} default{{end}}>
+            {{end}}
+        </video>
+        {{else if eq .Kind "audio"}}
+        <audio id="media" src="{{.FileURL}}" controls autoplay preload="metadata"></audio>
+        {{else}}
+        <img id="media" src="{{.FileURL}}" alt="{{.File.Name}}">
+        {{end}}
+
+        {{with .Previous}}<a class="nav previous" id="previous" href="{{.GetPlayPath}}" title="{{.Name}}">‹</a>{{end}}
+        {{with .Next}}<a class="nav next" id="next" href="{{.GetPlayPath}}" title="{{.Name}}">›</a>{{end}}
+    </div>
+
+    <div class="info">
+        {{if .File.MimeType}}{{.File.MimeType}} • {{end}}{{with .File.Metadata}}{{with .Summary}}{{.}} • {{end}}{{end}}{{.File.GetFormattedSize}} MB
+    </div>
+
+    <script>
+    (function() {
+        var kind = "{{.Kind}}";
+        var media = document.getElementById("media");
+        var stage = document.getElementById("stage");
+
+        function go(id) {
+            var link = document.getElementById(id);
+            if (link) {
+                window.location.href = link.href;
+            }
+        }
+
+        document.addEventListener("keydown", function(e) {
+            if (e.altKey || e.ctrlKey || e.metaKey) {
+                return;
+            }
+            switch (e.key) {
+            case "Escape":
+                window.location.href = "{{.FolderURL}}";
+                break;
+            case "ArrowLeft":
+                if (kind === "image") go("previous");
+                break;
+            case "ArrowRight":
+                if (kind === "image") go("next");
+                break;
+            case "PageUp":
+            case "p":
+                go("previous");
+                break;
+            case "PageDown":
+            case "n":
+                go("next");
+                break;
+            }
+        });
+
+        if (kind === "image") {
+            // Click toggles between fitting the window and the full size
+            media.addEventListener("click", function() {
+                media.classList.toggle("zoomed");
+                stage.classList.toggle("zoomed");
+            });
+        } else if (kind === "audio") {
+            // Continue with the next track of the folder
+            media.addEventListener("ended", function() {
+                go("next");
+            });
+        }
+        {{if .Progress}}
+
+        // Resume where the user left off and save the position while
+        // playing, when pausing and when leaving the page
+        var progressURL = "/api/progress{{.FileURL}}";
+        var resume = {{.Resume}};
+        var saved = 0;
+
+        function save(leaving) {
+            if (!isFinite(media.duration)) {
+                return;
+            }
+            var body = JSON.stringify({position: media.currentTime, duration: media.duration});
+            if (leaving && navigator.sendBeacon) {
+                navigator.sendBeacon(progressURL, new Blob([body], {type: "application/json"}));
+                return;
+            }
+            fetch(progressURL, {method: "PUT", headers: {"Content-Type": "application/json"}, body: body});
+        }
+
+        media.addEventListener("loadedmetadata", function() {
+            if (resume > 0 && resume < media.duration - 5) {
+                media.currentTime = resume;
+            }
+        });
+        media.addEventListener("timeupdate", function() {
+            if (Math.abs(media.currentTime - saved) >= 10) {
+                saved = media.currentTime;
+                save(false);
+            }
+        });
+        media.addEventListener("pause", function() {
+            save(false);
+        });
+        media.addEventListener("ended", function() {
+            save(true);
+        });
+        window.addEventListener("pagehide", function() {
+            save(true);
+        });
+        {{end}}
+    })();
+    </script>
+</body>
+</html>`
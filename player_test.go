@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPlayerKind(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     string
+	}{
+		{"video/mp4", "video"},
+		{"video/x-matroska", "video"},
+		{"audio/mpeg", "audio"},
+		{"image/jpeg", "image"},
+		{"application/x-subrip", ""},
+		{"text/plain; charset=utf-8", ""},
+		{"videos/mp4", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := playerKind(tt.mimeType); got != tt.want {
+			t.Errorf("playerKind(%q) = %q, want %q", tt.mimeType, got, tt.want)
+		}
+	}
+}
+
+func TestFindSubtitles(t *testing.T) {
+	file := FileInfo{Name: "movie.mp4", Path: "/films/movie.mp4"}
+	sibling := func(name string, isDir bool) FileInfo {
+		return FileInfo{Name: name, Path: "/films/" + name, IsDir: isDir}
+	}
+	siblings := []FileInfo{
+		sibling("movie.mp4", false),
+		sibling("movie.srt", false),
+		sibling("movie.en.vtt", false),
+		sibling("movie.zh_CN.ASS", false),
+		sibling("movie.Director's cut.ssa", false),
+		sibling("movie.vtt", true),
+		sibling("movie2.srt", false),
+		sibling("other.srt", false),
+		sibling("movie.txt", false),
+	}
+
+	want := []SubtitleTrack{
+		{Label: "SRT", URL: "/films/movie.srt?format=vtt"},
+		{Label: "en", Language: "en", URL: "/films/movie.en.vtt?format=vtt"},
+		{Label: "zh_CN", Language: "zh-CN", URL: "/films/movie.zh_CN.ASS?format=vtt"},
+		{Label: "Director's cut", URL: "/films/movie.Director%27s%20cut.ssa?format=vtt"},
+	}
+	got := findSubtitles(file, siblings)
+	if len(got) != len(want) {
+		t.Fatalf("findSubtitles() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("track %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHandlePlay(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "a.mp4", "b.mp4", "c.mp4", "a.en.srt", "song.mp3", "pic1.jpg", "pic2.jpg", "notes.txt", "sub/")
+
+	progress, err := NewProgressStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress.Update("", "/song.mp3", 42, 100)
+	s := &MediaServer{
+		config:   &Config{},
+		library:  NewLibrary(MediaConfig{Directory: dir}),
+		types:    NewMediaTypes(defaultMediaTypes(), nil),
+		player:   newPlayerTemplate(),
+		progress: progress,
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		wantStatus   int
+		wantContains []string
+		wantMissing  []string
+	}{
+		{
+			name:         "middle of the playlist",
+			path:         "/play/b.mp4",
+			wantStatus:   http.StatusOK,
+			wantContains: []string{`<video id="media" src="/b.mp4"`, "2 / 3", `href="/play/a.mp4"`, `href="/play/c.mp4"`, "var resume =  0 ;"},
+			wantMissing:  []string{"<track"},
+		},
+		{
+			name:         "subtitles",
+			path:         "/play/a.mp4",
+			wantStatus:   http.StatusOK,
+			wantContains: []string{`src="/a.en.srt?format=vtt" label="en" srclang="en" default`},
+			wantMissing:  []string{`id="previous"`},
+		},
+		{
+			name:         "audio resumes",
+			path:         "/play/song.mp3",
+			wantStatus:   http.StatusOK,
+			wantContains: []string{`<audio id="media" src="/song.mp3"`, "var resume =  42 ;"},
+			wantMissing:  []string{"1 / 1"},
+		},
+		{
+			name:         "image prefetches the next one",
+			path:         "/play/pic1.jpg",
+			wantStatus:   http.StatusOK,
+			wantContains: []string{`<link rel="prefetch" href="/pic2.jpg">`, `<img id="media" src="/pic1.jpg"`},
+			wantMissing:  []string{"var resume"},
+		},
+		{name: "not playable", path: "/play/notes.txt", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "subtitle file", path: "/play/a.en.srt", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "directory", path: "/play/sub", wantStatus: http.StatusNotFound},
+		{name: "missing file", path: "/play/missing.mp4", wantStatus: http.StatusNotFound},
+		{name: "escaping path", path: "/play/../../etc/passwd", wantStatus: http.StatusNotFound},
+		{name: "post", method: "POST", path: "/play/a.mp4", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			w := httptest.NewRecorder()
+			s.handlePlay(w, httptest.NewRequest(method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			body := w.Body.String()
+			for _, want := range tt.wantContains {
+				if !strings.Contains(body, want) {
+					t.Errorf("page does not contain %q", want)
+				}
+			}
+			for _, missing := range tt.wantMissing {
+				if strings.Contains(body, missing) {
+					t.Errorf("page contains %q", missing)
+				}
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	(&MediaServer{}).handlePlay(w, httptest.NewRequest("GET", "/play/a.mp4", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status with the player disabled = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// maxPlaylistEntries bounds the files listed in one playlist
+	maxPlaylistEntries = 10000
+
+	// playlistLinkExpiry is how long the signed links of a playlist stay
+	// valid, long enough to play through it but short enough that a leaked
+	// playlist soon stops working
+	playlistLinkExpiry = 6 * time.Hour
+
+	// maxPlaylistDuration bounds the durations written to playlists, in
+	// seconds; longer ones come from broken metadata and are left out
+	maxPlaylistDuration = 1 << 31
+)
+
+// playlistFormat writes a playlist in one file format
+type playlistFormat struct {
+	contentType string
+	write       func(w io.Writer, title string, entries []playlistEntry) error
+}
+
+// playlistFormats maps playlist URL extensions to their formats
+var playlistFormats = map[string]playlistFormat{
+	".m3u8": {"audio/x-mpegurl; charset=utf-8", writeM3U8},
+	".pls":  {"audio/x-scpls; charset=utf-8", writePLS},
+	".xspf": {"application/xspf+xml; charset=utf-8", writeXSPF},
+}
+
+// playlistEntry is one media file of a playlist
+type playlistEntry struct {
+	URL      string
+	Title    string
+	Creator  string
+	Album    string
+	Duration float64
+}
+
+// handlePlaylist serves /playlist/<dir>.m3u8, .pls and .xspf, listing the
+// audio and video files of a folder in listing order with absolute URLs.
+// ?recursive=true includes subfolders. When authentication is enabled the
+// URLs are signed share links, so players need no credentials.
+func (s *MediaServer) handlePlaylist(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Playlists.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ext := path.Ext(r.URL.Path)
+	format, ok := playlistFormats[strings.ToLower(ext)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	cleanPath, fullPath, err := s.resolvePath(r, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/playlist"), ext))
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+	if info, err := s.statMedia(fullPath); err != nil || !info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Each file gets a signed link of its own, so the playlist grants
+	// access to nothing but the files it lists
+	base := baseURL(r)
+	fileURL := func(urlPath string) (string, error) {
+		return base + escapeURLPath(urlPath), nil
+	}
+	if s.auth != nil && s.shares != nil {
+		fileURL = func(urlPath string) (string, error) {
+			token, err := s.shares.Sign(urlPath, playlistLinkExpiry)
+			if err != nil {
+				return "", err
+			}
+			return base + "/s/" + token, nil
+		}
+	}
+
+	var entries []playlistEntry
+	var signErr error
+	err = s.walkPlaylist(userFromContext(r.Context()), fullPath, cleanPath, r.URL.Query().Get("recursive") == "true", func(file FileInfo) {
+		url, err := fileURL(file.Path)
+		if err != nil {
+			signErr = err
+			return
+		}
+		entries = append(entries, newPlaylistEntry(file, url))
+	})
+	if err != nil {
+		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
+		return
+	}
+	if signErr != nil {
+		log.Printf("Failed to sign playlist URLs: %v", signErr)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	title := path.Base(cleanPath)
+	if cleanPath == "/" {
+		title = "Media"
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", title+ext))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := format.write(w, title, entries); err != nil {
+		log.Printf("Error writing playlist: %v", err)
+	}
+}
+
+// walkPlaylist visits the audio and video files of a directory in the
+// order serveDirectory lists them, descending into subdirectories where
+// they appear when recursive is set
+func (s *MediaServer) walkPlaylist(user, fullPath, urlPath string, recursive bool, visit func(FileInfo)) error {
+	count := 0
+	var walk func(fullPath, urlPath string) error
+	walk = func(fullPath, urlPath string) error {
+		files, err := s.listDirectory(user, fullPath, urlPath)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if count >= maxPlaylistEntries {
+				return nil
+			}
+			switch {
+			case file.IsDir && recursive:
+				_, dirPath, err := s.resolveUserPath(user, file.Path)
+				if err == nil {
+					err = walk(dirPath, file.Path)
+				}
+				if err != nil {
+					log.Printf("Skipping %s in playlist: %v", file.Path, err)
+				}
+			case !file.IsDir && (playerKind(file.MimeType) == "video" || playerKind(file.MimeType) == "audio"):
+				visit(file)
+				count++
+			}
+		}
+		return nil
+	}
+	return walk(fullPath, urlPath)
+}
+
+// newPlaylistEntry describes a file, taking its title from the media tags
+// when available
+func newPlaylistEntry(file FileInfo, url string) playlistEntry {
+	entry := playlistEntry{
+		URL:   url,
+		Title: strings.TrimSuffix(file.Name, filepath.Ext(file.Name)),
+	}
+	if meta := file.Metadata; meta != nil {
+		entry.Duration = meta.Duration
+		if title := meta.Tags["title"]; title != "" {
+			entry.Title = title
+		}
+		entry.Creator = meta.Tags["artist"]
+		entry.Album = meta.Tags["album"]
+	}
+	return entry
+}
+
+// displayTitle returns "Artist - Title", or the title alone
+func (e playlistEntry) displayTitle() string {
+	if e.Creator != "" {
+		return e.Creator + " - " + e.Title
+	}
+	return e.Title
+}
+
+// seconds returns the duration rounded to whole seconds, or -1 if unknown
+func (e playlistEntry) seconds() int {
+	if !(e.Duration > 0 && e.Duration <= maxPlaylistDuration) {
+		return -1
+	}
+	return int(math.Round(e.Duration))
+}
+
+// writeM3U8 writes an extended M3U playlist
+func writeM3U8(w io.Writer, title string, entries []playlistEntry) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", playlistLine(title))
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", entry.seconds(), playlistLine(entry.displayTitle()), entry.URL)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writePLS writes a PLS playlist
+func writePLS(w io.Writer, title string, entries []playlistEntry) error {
+	var b strings.Builder
+	b.WriteString("[playlist]\n")
+	for i, entry := range entries {
+		fmt.Fprintf(&b, "File%d=%s\n", i+1, entry.URL)
+		fmt.Fprintf(&b, "Title%d=%s\n", i+1, playlistLine(entry.displayTitle()))
+		fmt.Fprintf(&b, "Length%d=%d\n", i+1, entry.seconds())
+	}
+	fmt.Fprintf(&b, "NumberOfEntries=%d\nVersion=2\n", len(entries))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// xspfPlaylist is the XML Shareable Playlist Format document
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+// xspfTrack is one track of an XSPF playlist
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int64  `xml:"duration,omitempty"`
+}
+
+// writeXSPF writes an XSPF playlist
+func writeXSPF(w io.Writer, title string, entries []playlistEntry) error {
+	playlist := xspfPlaylist{Version: 1, Title: title, Tracks: []xspfTrack{}}
+	for _, entry := range entries {
+		track := xspfTrack{
+			Location: entry.URL,
+			Title:    entry.Title,
+			Creator:  entry.Creator,
+			Album:    entry.Album,
+		}
+		if entry.seconds() >= 0 {
+			track.Duration = int64(entry.Duration * 1000)
+		}
+		playlist.Tracks = append(playlist.Tracks, track)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(playlist); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// playlistLine removes line breaks, which would end a playlist entry
+func playlistLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
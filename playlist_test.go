@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewPlaylistEntry(t *testing.T) {
+	tests := []struct {
+		name string
+		file FileInfo
+		want playlistEntry
+	}{
+		{
+			name: "file name",
+			file: FileInfo{Name: "01 Intro.mp3"},
+			want: playlistEntry{URL: "u", Title: "01 Intro"},
+		},
+		{
+			name: "tags",
+			file: FileInfo{Name: "01.flac", Metadata: &MediaMetadata{Duration: 61.6, Tags: map[string]string{"title": "Song", "artist": "Band", "album": "Album"}}},
+			want: playlistEntry{URL: "u", Title: "Song", Creator: "Band", Album: "Album", Duration: 61.6},
+		},
+		{
+			name: "artist without title",
+			file: FileInfo{Name: "clip.mp4", Metadata: &MediaMetadata{Tags: map[string]string{"artist": "Band"}}},
+			want: playlistEntry{URL: "u", Title: "clip", Creator: "Band"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newPlaylistEntry(tt.file, "u"); got != tt.want {
+				t.Errorf("newPlaylistEntry() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaylistWriters(t *testing.T) {
+	entries := []playlistEntry{
+		{URL: "http://host/a.mp3", Title: "Song", Creator: "Band", Album: "Album", Duration: 61.6},
+		{URL: "http://host/b.mp4", Title: "Line\r\nbreak"},
+		{URL: "http://host/c.mp3", Title: "Broken", Duration: 1e300},
+	}
+
+	tests := []struct {
+		name  string
+		write func(w *bytes.Buffer) error
+		want  string
+	}{
+		{
+			name:  "m3u8",
+			write: func(w *bytes.Buffer) error { return writeM3U8(w, "My\nList", entries) },
+			want: "#EXTM3U\n#PLAYLIST:My List\n" +
+				"#EXTINF:62,Band - Song\nhttp://host/a.mp3\n" +
+				"#EXTINF:-1,Line  break\nhttp://host/b.mp4\n" +
+				"#EXTINF:-1,Broken\nhttp://host/c.mp3\n",
+		},
+		{
+			name:  "pls",
+			write: func(w *bytes.Buffer) error { return writePLS(w, "List", entries) },
+			want: "[playlist]\n" +
+				"File1=http://host/a.mp3\nTitle1=Band - Song\nLength1=62\n" +
+				"File2=http://host/b.mp4\nTitle2=Line  break\nLength2=-1\n" +
+				"File3=http://host/c.mp3\nTitle3=Broken\nLength3=-1\n" +
+				"NumberOfEntries=3\nVersion=2\n",
+		},
+		{
+			name:  "empty pls",
+			write: func(w *bytes.Buffer) error { return writePLS(w, "List", nil) },
+			want:  "[playlist]\nNumberOfEntries=0\nVersion=2\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tt.write(&b); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("playlist = %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteXSPF(t *testing.T) {
+	entries := []playlistEntry{
+		{URL: "http://host/a.mp3?x=1&y=2", Title: "Song <1>", Creator: "Band", Album: "Album", Duration: 61.6},
+		{URL: "http://host/c.mp3", Title: "Broken", Duration: 1e300},
+	}
+	var b bytes.Buffer
+	if err := writeXSPF(&b, "List", entries); err != nil {
+		t.Fatal(err)
+	}
+
+	var playlist xspfPlaylist
+	if err := xml.Unmarshal(b.Bytes(), &playlist); err != nil {
+		t.Fatalf("invalid XSPF: %v\n%s", err, b.String())
+	}
+	want := []xspfTrack{
+		{Location: "http://host/a.mp3?x=1&y=2", Title: "Song <1>", Creator: "Band", Album: "Album", Duration: 61600},
+		{Location: "http://host/c.mp3", Title: "Broken"},
+	}
+	if playlist.Title != "List" || playlist.Version != 1 || len(playlist.Tracks) != len(want) {
+		t.Fatalf("playlist = %+v, want %d tracks titled List", playlist, len(want))
+	}
+	for i := range want {
+		if playlist.Tracks[i] != want[i] {
+			t.Errorf("track %d = %+v, want %+v", i, playlist.Tracks[i], want[i])
+		}
+	}
+}
+
+func TestHandlePlaylist(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "album/01 intro.mp3", "album/02 song.flac", "album/cover.jpg", "album/notes.txt",
+		"album/clip.mp4", "album/extra/bonus.mp3", "album/extra/.hidden.mp3", "album/.private/secret.mp3")
+	s := &MediaServer{
+		config:  &Config{Playlists: PlaylistConfig{Enabled: true}},
+		library: NewLibrary(MediaConfig{Directory: dir}),
+		types:   NewMediaTypes(defaultMediaTypes(), nil),
+	}
+
+	tests := []struct {
+		name            string
+		method          string
+		path            string
+		wantStatus      int
+		wantType        string
+		wantDisposition string
+		wantBody        string
+	}{
+		{
+			name:            "m3u8",
+			path:            "/playlist/album.m3u8",
+			wantStatus:      http.StatusOK,
+			wantType:        "audio/x-mpegurl; charset=utf-8",
+			wantDisposition: `attachment; filename="album.m3u8"`,
+			wantBody: "#EXTM3U\n#PLAYLIST:album\n" +
+				"#EXTINF:-1,01 intro\nhttp://example.com/album/01%20intro.mp3\n" +
+				"#EXTINF:-1,02 song\nhttp://example.com/album/02%20song.flac\n" +
+				"#EXTINF:-1,clip\nhttp://example.com/album/clip.mp4\n",
+		},
+		{
+			name:       "recursive pls",
+			path:       "/playlist/album.PLS?recursive=true",
+			wantStatus: http.StatusOK,
+			wantType:   "audio/x-scpls; charset=utf-8",
+			wantBody: "[playlist]\n" +
+				"File1=http://example.com/album/extra/bonus.mp3\nTitle1=bonus\nLength1=-1\n" +
+				"File2=http://example.com/album/01%20intro.mp3\nTitle2=01 intro\nLength2=-1\n" +
+				"File3=http://example.com/album/02%20song.flac\nTitle3=02 song\nLength3=-1\n" +
+				"File4=http://example.com/album/clip.mp4\nTitle4=clip\nLength4=-1\n" +
+				"NumberOfEntries=4\nVersion=2\n",
+		},
+		{
+			name:            "whole library",
+			path:            "/playlist/.xspf",
+			wantStatus:      http.StatusOK,
+			wantType:        "application/xspf+xml; charset=utf-8",
+			wantDisposition: `attachment; filename="Media.xspf"`,
+		},
+		{name: "head", method: "HEAD", path: "/playlist/album.m3u8", wantStatus: http.StatusOK, wantType: "audio/x-mpegurl; charset=utf-8"},
+		{name: "unknown format", path: "/playlist/album.txt", wantStatus: http.StatusNotFound},
+		{name: "file", path: "/playlist/album/clip.mp4.m3u8", wantStatus: http.StatusNotFound},
+		{name: "missing folder", path: "/playlist/missing.m3u8", wantStatus: http.StatusNotFound},
+		{name: "hidden folder", path: "/playlist/album/.private.m3u8", wantStatus: http.StatusNotFound},
+		{name: "post", method: "POST", path: "/playlist/album.m3u8", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			w := httptest.NewRecorder()
+			s.handlePlaylist(w, httptest.NewRequest(method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if got := w.Header().Get("Content-Disposition"); tt.wantDisposition != "" && got != tt.wantDisposition {
+				t.Errorf("Content-Disposition = %q, want %q", got, tt.wantDisposition)
+			}
+			if method == "HEAD" && w.Body.Len() > 0 {
+				t.Errorf("HEAD body = %q, want none", w.Body)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+
+	s.config.Playlists.Enabled = false
+	w := httptest.NewRecorder()
+	s.handlePlaylist(w, httptest.NewRequest("GET", "/playlist/album.m3u8", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status with playlists disabled = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandlePlaylistSignedLinks(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "a.mp3", "b.mp3")
+	shares, err := NewShareStore("test signing key", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &MediaServer{
+		config:  &Config{Playlists: PlaylistConfig{Enabled: true}},
+		library: NewLibrary(MediaConfig{Directory: dir}),
+		types:   NewMediaTypes(defaultMediaTypes(), nil),
+		auth:    NewAuthenticator(AuthConfig{}),
+		shares:  shares,
+	}
+
+	w := httptest.NewRecorder()
+	s.handlePlaylist(w, httptest.NewRequest("GET", "/playlist/.m3u8", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		token, ok := strings.CutPrefix(line, "http://example.com/s/")
+		if !ok {
+			t.Fatalf("playlist URL %q is not a signed link", line)
+		}
+		claims, err := shares.Verify(token)
+		if err != nil {
+			t.Fatalf("Verify(%q) error = %v", token, err)
+		}
+		if !claims.File || time.Until(time.Unix(claims.Expires, 0)) > playlistLinkExpiry {
+			t.Errorf("claims = %+v, want a file link expiring within %s", claims, playlistLinkExpiry)
+		}
+		paths = append(paths, claims.Path)
+	}
+	if want := []string{"/a.mp3", "/b.mp3"}; !equalStrings(paths, want) {
+		t.Errorf("signed paths = %v, want %v", paths, want)
+	}
+}
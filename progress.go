@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// finishedThreshold is the fraction of a file after which it counts
+	// as watched to the end
+	finishedThreshold = 0.95
+
+	// maxProgressEntries bounds the positions kept per user; the least
+	// recently updated are dropped first
+	maxProgressEntries = 1000
+
+	// continueWatchingLimit is how many unfinished files the listing shows
+	continueWatchingLimit = 8
+
+	// progressSaveDelay is how long position updates wait before the store
+	// is written, so that players reporting every few seconds cause few
+	// writes
+	progressSaveDelay = 30 * time.Second
+)
+
+// WatchProgress is a user's playback position in a file
+type WatchProgress struct {
+	Path      string    `json:"path"`
+	Position  float64   `json:"position"`
+	Duration  float64   `json:"duration,omitempty"`
+	Finished  bool      `json:"finished"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Percent returns the position as a percentage of the duration
+func (p WatchProgress) Percent() int {
+	if p.Finished {
+		return 100
+	}
+	if p.Duration <= 0 {
+		return 0
+	}
+	return int(math.Min(p.Position/p.Duration, 1) * 100)
+}
+
+// Name returns the file name of the progress entry
+func (p WatchProgress) Name() string {
+	return path.Base(p.Path)
+}
+
+// GetPlayPath returns the URL of the file's player page
+func (p WatchProgress) GetPlayPath() string {
+	return "/play" + escapeURLPath(p.Path)
+}
+
+// ProgressStore persists playback positions per user as a JSON file in
+// the data directory. Without authentication all clients share the
+// anonymous user "". Position updates are written after a delay, and
+// Flush writes any that are pending.
+type ProgressStore struct {
+	file string
+
+	mu        sync.Mutex
+	users     map[string]map[string]*WatchProgress
+	saveTimer *time.Timer
+}
+
+// NewProgressStore loads the progress store from the data directory
+func NewProgressStore(dataDir string) (*ProgressStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	store := &ProgressStore{
+		file:  filepath.Join(dataDir, "progress.json"),
+		users: make(map[string]map[string]*WatchProgress),
+	}
+
+	data, err := os.ReadFile(store.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("failed to read progress store: %w", err)
+	}
+
+	var users map[string][]*WatchProgress
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("failed to parse progress store: %w", err)
+	}
+	for user, entries := range users {
+		store.users[user] = make(map[string]*WatchProgress, len(entries))
+		for _, entry := range entries {
+			store.users[user][entry.Path] = entry
+		}
+	}
+
+	return store, nil
+}
+
+// Get returns a user's position in a file
+func (st *ProgressStore) Get(user, urlPath string) (WatchProgress, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	entry, ok := st.users[user][urlPath]
+	if !ok {
+		return WatchProgress{}, false
+	}
+	return *entry, true
+}
+
+// Update records a user's position in a file. The file counts as finished
+// once the position passes finishedThreshold of its duration. The store
+// is written within progressSaveDelay.
+func (st *ProgressStore) Update(user, urlPath string, position, duration float64) WatchProgress {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	entries, ok := st.users[user]
+	if !ok {
+		entries = make(map[string]*WatchProgress)
+		st.users[user] = entries
+	}
+
+	entry := &WatchProgress{
+		Path:      urlPath,
+		Position:  position,
+		Duration:  duration,
+		Finished:  duration > 0 && position >= duration*finishedThreshold,
+		UpdatedAt: time.Now(),
+	}
+	entries[urlPath] = entry
+	st.scheduleSaveLocked()
+	return *entry
+}
+
+// Remove forgets a user's position in a file
+func (st *ProgressStore) Remove(user, urlPath string) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.users[user][urlPath]; !ok {
+		return false, nil
+	}
+	delete(st.users[user], urlPath)
+	return true, st.saveLocked()
+}
+
+// List returns up to limit of a user's positions in files that present
+// reports as still in place, most recently updated first
+func (st *ProgressStore) List(user string, limit int, present func(WatchProgress) bool) []WatchProgress {
+	entries := []WatchProgress{}
+	for _, entry := range st.all(user) {
+		if !present(entry) {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) == limit {
+			break
+		}
+	}
+	return entries
+}
+
+// Unfinished returns up to limit of a user's files below root that were
+// started but not finished and that present reports as still in place,
+// most recently watched first
+func (st *ProgressStore) Unfinished(user, root string, limit int, present func(WatchProgress) bool) []WatchProgress {
+	entries := []WatchProgress{}
+	for _, entry := range st.all(user) {
+		if entry.Finished || entry.Position <= 0 {
+			continue
+		}
+		if root != "/" && !strings.HasPrefix(entry.Path, root+"/") {
+			continue
+		}
+		if !present(entry) {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) == limit {
+			break
+		}
+	}
+	return entries
+}
+
+// all returns a user's positions, most recently updated first
+func (st *ProgressStore) all(user string) []WatchProgress {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	entries := make([]WatchProgress, 0, len(st.users[user]))
+	for _, entry := range st.users[user] {
+		entries = append(entries, *entry)
+	}
+	sortByUpdated(entries)
+	return entries
+}
+
+// Flush writes pending position updates to disk
+func (st *ProgressStore) Flush() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.saveTimer == nil {
+		return nil
+	}
+	st.saveTimer.Stop()
+	st.saveTimer = nil
+	return st.saveLocked()
+}
+
+// scheduleSaveLocked flushes the store after progressSaveDelay unless a
+// flush is already pending. The caller must hold the lock.
+func (st *ProgressStore) scheduleSaveLocked() {
+	if st.saveTimer != nil {
+		return
+	}
+	st.saveTimer = time.AfterFunc(progressSaveDelay, func() {
+		if err := st.Flush(); err != nil {
+			log.Printf("Failed to save watch progress: %v", err)
+		}
+	})
+}
+
+// saveLocked trims each user to maxProgressEntries and writes the store
+// to disk. The caller must hold the lock.
+func (st *ProgressStore) saveLocked() error {
+	users := make(map[string][]*WatchProgress, len(st.users))
+	for user, entries := range st.users {
+		list := make([]*WatchProgress, 0, len(entries))
+		for _, entry := range entries {
+			list = append(list, entry)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].UpdatedAt.After(list[j].UpdatedAt)
+		})
+		for _, entry := range list[min(len(list), maxProgressEntries):] {
+			delete(entries, entry.Path)
+		}
+		users[user] = list[:min(len(list), maxProgressEntries)]
+	}
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode progress store: %w", err)
+	}
+
+	return writeFileAtomic(st.file, data, 0600)
+}
+
+// sortByUpdated sorts progress entries, most recently updated first
+func sortByUpdated(entries []WatchProgress) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].UpdatedAt.After(entries[j].UpdatedAt)
+	})
+}
+
+// updateProgressRequest is the body of PUT /api/progress/<path>
+type updateProgressRequest struct {
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration"`
+}
+
+// handleAPIProgress serves the authenticated user's playback positions.
+// GET /api/progress lists them; GET, PUT (or POST) and DELETE on
+// /api/progress/<path> fetch, record and clear the position in one file.
+func (s *MediaServer) handleAPIProgress(w http.ResponseWriter, r *http.Request) {
+	if s.progress == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "watch progress is disabled")
+		return
+	}
+
+	user := userFromContext(r.Context())
+	urlPath := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/progress"), "/")
+	if urlPath == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit, err := parsePositiveInt(r.URL.Query().Get("limit"), maxProgressEntries)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		var entries []WatchProgress
+		if r.URL.Query().Get("unfinished") == "true" {
+			entries = s.progress.Unfinished(user, "/", limit, s.progressPresent(user))
+		} else {
+			entries = s.progress.List(user, limit, s.progressPresent(user))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"progress": entries})
+		return
+	}
+
+	cleanPath, fullPath, err := s.resolvePath(r, urlPath)
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, ok := s.progress.Get(user, cleanPath)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no progress recorded")
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+
+	case http.MethodPut, http.MethodPost:
+		var req updateProgressRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Position < 0 || req.Duration < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid position or duration")
+			return
+		}
+		if info, err := os.Stat(fullPath); err != nil || info.IsDir() {
+			writeJSONError(w, http.StatusNotFound, "file not found")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, s.progress.Update(user, cleanPath, req.Position, req.Duration))
+
+	case http.MethodDelete:
+		ok, err := s.progress.Remove(user, cleanPath)
+		if err != nil {
+			log.Printf("Failed to save watch progress: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to save progress")
+			return
+		}
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no progress recorded")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"path": cleanPath, "status": "removed"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// progressPresent returns a filter accepting the progress entries of
+// files that still exist and that a user may still access
+func (s *MediaServer) progressPresent(user string) func(WatchProgress) bool {
+	return func(entry WatchProgress) bool {
+		_, fullPath, err := s.resolveUserPath(user, entry.Path)
+		if err != nil {
+			return false
+		}
+		info, err := os.Stat(fullPath)
+		return err == nil && !info.IsDir()
+	}
+}
+
+// attachProgress sets the requesting user's position on each file
+func (s *MediaServer) attachProgress(r *http.Request, files []FileInfo) {
+	if s.progress == nil {
+		return
+	}
+	user := userFromContext(r.Context())
+	for i := range files {
+		if files[i].IsDir {
+			continue
+		}
+		if entry, ok := s.progress.Get(user, files[i].Path); ok {
+			files[i].Progress = &entry
+		}
+	}
+}
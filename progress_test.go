@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWatchProgressPercent(t *testing.T) {
+	tests := []struct {
+		progress WatchProgress
+		want     int
+	}{
+		{WatchProgress{Position: 30, Duration: 120}, 25},
+		{WatchProgress{Position: 30}, 0},
+		{WatchProgress{Position: 200, Duration: 100}, 100},
+		{WatchProgress{Position: 10, Duration: 100, Finished: true}, 100},
+		{WatchProgress{Position: 0, Duration: 100}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := tt.progress.Percent(); got != tt.want {
+			t.Errorf("Percent() of %+v = %d, want %d", tt.progress, got, tt.want)
+		}
+	}
+}
+
+func TestProgressStoreUpdate(t *testing.T) {
+	store, err := NewProgressStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Flush() })
+
+	tests := []struct {
+		position     float64
+		duration     float64
+		wantFinished bool
+	}{
+		{10, 100, false},
+		{94.9, 100, false},
+		{95, 100, true},
+		{150, 100, true},
+		{5000, 0, false},
+	}
+
+	for _, tt := range tests {
+		entry := store.Update("alice", "/a.mp4", tt.position, tt.duration)
+		if entry.Finished != tt.wantFinished || entry.Position != tt.position || entry.Path != "/a.mp4" {
+			t.Errorf("Update(%v, %v) = %+v, want finished %v", tt.position, tt.duration, entry, tt.wantFinished)
+		}
+		if got, ok := store.Get("alice", "/a.mp4"); !ok || got != entry {
+			t.Errorf("Get() = %+v, %v, want %+v", got, ok, entry)
+		}
+	}
+	if _, ok := store.Get("bob", "/a.mp4"); ok {
+		t.Error("Get() found the position of another user")
+	}
+}
+
+func TestProgressStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewProgressStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxProgressEntries+5; i++ {
+		store.Update("alice", fmt.Sprintf("/%d.mp4", i), 1, 10)
+	}
+	store.Update("bob", "/b.mp4", 2, 10)
+
+	// Updates are written after a delay, not one by one
+	file := filepath.Join(dir, "progress.json")
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("store was written before the save delay: %v", err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("store mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	reloaded, err := NewProgressStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(reloaded.all("alice")); got != maxProgressEntries {
+		t.Errorf("reloaded %d entries, want %d", got, maxProgressEntries)
+	}
+	if got, ok := reloaded.Get("bob", "/b.mp4"); !ok || got.Position != 2 {
+		t.Errorf("reloaded Get() = %+v, %v, want position 2", got, ok)
+	}
+
+	// Removals are written at once
+	if removed, err := reloaded.Remove("bob", "/b.mp4"); !removed || err != nil {
+		t.Fatalf("Remove() = %v, %v", removed, err)
+	}
+	if removed, err := reloaded.Remove("bob", "/b.mp4"); removed || err != nil {
+		t.Errorf("second Remove() = %v, %v, want false", removed, err)
+	}
+	again, err := NewProgressStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := again.Get("bob", "/b.mp4"); ok {
+		t.Error("removed position was loaded again")
+	}
+
+	if err := os.WriteFile(file, []byte("{broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewProgressStore(dir); err == nil {
+		t.Error("NewProgressStore() of a broken store succeeded")
+	}
+}
+
+func TestProgressStoreUnfinished(t *testing.T) {
+	store, err := NewProgressStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Flush() })
+	store.Update("", "/movies/finished.mp4", 99, 100)
+	store.Update("", "/movies/unstarted.mp4", 0, 100)
+	store.Update("", "/movies/gone.mp4", 10, 100)
+	store.Update("", "/movies-extra/other.mp4", 10, 100)
+	store.Update("", "/movies/a.mp4", 10, 100)
+	store.Update("", "/movies/sub/b.mp4", 20, 100)
+	present := func(entry WatchProgress) bool { return entry.Path != "/movies/gone.mp4" }
+
+	tests := []struct {
+		root  string
+		limit int
+		want  []string
+	}{
+		{"/", 10, []string{"/movies/sub/b.mp4", "/movies/a.mp4", "/movies-extra/other.mp4"}},
+		{"/movies", 10, []string{"/movies/sub/b.mp4", "/movies/a.mp4"}},
+		{"/movies", 1, []string{"/movies/sub/b.mp4"}},
+		{"/music", 10, nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, entry := range store.Unfinished("", tt.root, tt.limit, present) {
+			got = append(got, entry.Path)
+		}
+		if !equalStrings(got, tt.want) {
+			t.Errorf("Unfinished(%q, %d) = %v, want %v", tt.root, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestHandleAPIProgress(t *testing.T) {
+	movies, private := t.TempDir(), t.TempDir()
+	writeTestFiles(t, movies, "a.mp4", "b.mp4", "gone.mp4", "sub/")
+	writeTestFiles(t, private, "x.mp4")
+	progress, err := NewProgressStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { progress.Flush() })
+	s := &MediaServer{
+		config: &Config{},
+		library: NewLibrary(MediaConfig{Roots: []MediaRootConfig{
+			{Name: "movies", Directory: movies},
+			{Name: "private", Directory: private, Users: []string{"bob"}},
+		}}),
+		types:    NewMediaTypes(nil, nil),
+		progress: progress,
+	}
+
+	// Steps run in order against the same store
+	steps := []struct {
+		name       string
+		user       string
+		method     string
+		path       string
+		body       string
+		remove     string
+		wantStatus int
+		wantPaths  []string
+	}{
+		{"record", "alice", "PUT", "/api/progress/movies/a.mp4", `{"position": 30, "duration": 100}`, "", http.StatusOK, nil},
+		{"record with post", "alice", "POST", "/api/progress/movies/gone.mp4", `{"position": 5, "duration": 100}`, "", http.StatusOK, nil},
+		{"record escaped path", "alice", "PUT", "/api/progress/movies/b%2Emp4", `{"position": 99, "duration": 100}`, "", http.StatusOK, nil},
+		{"negative position", "alice", "PUT", "/api/progress/movies/a.mp4", `{"position": -1}`, "", http.StatusBadRequest, nil},
+		{"invalid body", "alice", "PUT", "/api/progress/movies/a.mp4", `position=1`, "", http.StatusBadRequest, nil},
+		{"oversized body", "alice", "PUT", "/api/progress/movies/a.mp4", `{"position": 1` + strings.Repeat(" ", 1<<12) + `}`, "", http.StatusBadRequest, nil},
+		{"missing file", "alice", "PUT", "/api/progress/movies/missing.mp4", `{"position": 1}`, "", http.StatusNotFound, nil},
+		{"directory", "alice", "PUT", "/api/progress/movies/sub", `{"position": 1}`, "", http.StatusNotFound, nil},
+		{"root without access", "alice", "PUT", "/api/progress/private/x.mp4", `{"position": 1}`, "", http.StatusForbidden, nil},
+		{"root with access", "bob", "PUT", "/api/progress/private/x.mp4", `{"position": 1, "duration": 100}`, "", http.StatusOK, nil},
+		{"get", "alice", "GET", "/api/progress/movies/a.mp4", "", "", http.StatusOK, []string{"/movies/a.mp4"}},
+		{"get of another user", "bob", "GET", "/api/progress/movies/a.mp4", "", "", http.StatusNotFound, nil},
+		{"list skips removed files", "alice", "GET", "/api/progress", "", "gone.mp4", http.StatusOK, []string{"/movies/b.mp4", "/movies/a.mp4"}},
+		{"list with limit", "alice", "GET", "/api/progress?limit=1", "", "", http.StatusOK, []string{"/movies/b.mp4"}},
+		{"unfinished", "alice", "GET", "/api/progress?unfinished=true", "", "", http.StatusOK, []string{"/movies/a.mp4"}},
+		{"invalid limit", "alice", "GET", "/api/progress?limit=-1", "", "", http.StatusBadRequest, nil},
+		{"list of another user", "bob", "GET", "/api/progress", "", "", http.StatusOK, []string{"/private/x.mp4"}},
+		{"delete", "alice", "DELETE", "/api/progress/movies/a.mp4", "", "", http.StatusOK, nil},
+		{"delete again", "alice", "DELETE", "/api/progress/movies/a.mp4", "", "", http.StatusNotFound, nil},
+		{"post to the list", "alice", "POST", "/api/progress", "", "", http.StatusMethodNotAllowed, nil},
+		{"patch", "alice", "PATCH", "/api/progress/movies/a.mp4", "", "", http.StatusMethodNotAllowed, nil},
+	}
+
+	for _, step := range steps {
+		if step.remove != "" {
+			if err := os.Remove(filepath.Join(movies, step.remove)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(step.method, step.path, strings.NewReader(step.body))
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey, step.user))
+		s.handleAPIProgress(w, r)
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body)
+		}
+		if step.wantPaths == nil {
+			continue
+		}
+
+		var got []string
+		if strings.HasPrefix(step.path, "/api/progress/") {
+			var entry WatchProgress
+			if err := json.Unmarshal(w.Body.Bytes(), &entry); err != nil {
+				t.Fatal(err)
+			}
+			got = []string{entry.Path}
+		} else {
+			var resp struct {
+				Progress []WatchProgress `json:"progress"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range resp.Progress {
+				got = append(got, entry.Path)
+			}
+		}
+		if !equalStrings(got, step.wantPaths) {
+			t.Errorf("%s: paths = %v, want %v", step.name, got, step.wantPaths)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	(&MediaServer{}).handleAPIProgress(w, httptest.NewRequest("GET", "/api/progress", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status with progress disabled = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
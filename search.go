@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// SearchOptions controls a search over the media library
+type SearchOptions struct {
+	Query string
+	Types []string
+	Root  string
+	Limit int
+
+	// User limits the search to the media roots they may access
+	User string
+}
+
+// SearchResults is the JSON representation of a search
+type SearchResults struct {
+	Query   string     `json:"query"`
+	Types   []string   `json:"types,omitempty"`
+	Root    string     `json:"root"`
+	Total   int        `json:"total"`
+	Limit   int        `json:"limit"`
+	Results []FileInfo `json:"results"`
+}
+
+// searchHit is a matching file with its relevance score
+type searchHit struct {
+	file  FileInfo
+	score int
+}
+
+// handleAPISearch serves /api/search?q=&type=&path=&limit=
+func (s *MediaServer) handleAPISearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, err := s.parseSearchOptions(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results, total, err := s.search(opts)
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+	s.attachProgress(r, results)
+
+	writeSearchResults(w, opts, results, total)
+}
+
+// parseSearchOptions reads search parameters from the request query. Type
+// filters name media type categories, or "directory" and "other".
+func (s *MediaServer) parseSearchOptions(r *http.Request) (SearchOptions, error) {
+	query := r.URL.Query()
+
+	opts := SearchOptions{
+		Query: strings.TrimSpace(query.Get("q")),
+		Root:  path.Clean("/" + query.Get("path")),
+		User:  userFromContext(r.Context()),
+	}
+	if opts.Query == "" {
+		return opts, errors.New("missing search query")
+	}
+
+	for _, value := range query["type"] {
+		for _, t := range strings.Split(value, ",") {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if t == "" {
+				continue
+			}
+			if t != "directory" && t != "other" && s.types.Category(t) == nil {
+				return opts, fmt.Errorf("invalid type: must be one of %s", strings.Join(s.searchTypes(), ", "))
+			}
+			opts.Types = append(opts.Types, t)
+		}
+	}
+
+	limit, err := parsePositiveInt(query.Get("limit"), defaultSearchLimit)
+	if err != nil {
+		return opts, errors.New("invalid limit")
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	opts.Limit = limit
+
+	return opts, nil
+}
+
+// search finds files below opts.Root whose names and paths match every
+// query token. It returns up to opts.Limit results, best matches first,
+// along with the total number of matches.
+func (s *MediaServer) search(opts SearchOptions) ([]FileInfo, int, error) {
+	root, fullRoot, err := s.resolveUserPath(opts.User, opts.Root)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	terms := tokenize(opts.Query)
+	if len(terms) == 0 {
+		return []FileInfo{}, 0, nil
+	}
+
+	types := make(map[string]bool)
+	for _, t := range opts.Types {
+		types[t] = true
+	}
+
+	var hits []searchHit
+	visit := func(file FileInfo) {
+		if root != "/" && !strings.HasPrefix(file.Path, root+"/") {
+			return
+		}
+		if !s.library.Allows(opts.User, file.Path) {
+			return
+		}
+		if len(types) > 0 && !types[searchType(file)] {
+			return
+		}
+		if score, ok := matchScore(terms, file); ok {
+			hits = append(hits, searchHit{file: file, score: score})
+		}
+	}
+
+	if s.catalog != nil && s.catalog.Ready() {
+		s.catalog.Walk(visit)
+	} else {
+		s.walkMedia(fullRoot, root, visit)
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return strings.ToLower(hits[i].file.Path) < strings.ToLower(hits[j].file.Path)
+	})
+
+	total := len(hits)
+	if len(hits) > opts.Limit {
+		hits = hits[:opts.Limit]
+	}
+
+	results := make([]FileInfo, len(hits))
+	for i, hit := range hits {
+		results[i] = hit.file
+	}
+	return results, total, nil
+}
+
+// searchTypes returns the valid search type filters
+func (s *MediaServer) searchTypes() []string {
+	var names []string
+	for _, category := range s.types.Categories() {
+		names = append(names, category.Name)
+	}
+	return append(names, "directory", "other")
+}
+
+// searchType returns the type filter a file matches
+func searchType(file FileInfo) string {
+	switch {
+	case file.IsDir:
+		return "directory"
+	case file.Category == "":
+		return "other"
+	}
+	return file.Category
+}
+
+// serveSearch renders search results below urlPath with the listing
+// template, or as JSON when the client asks for it
+func (s *MediaServer) serveSearch(w http.ResponseWriter, r *http.Request, urlPath string) {
+	opts, err := s.parseSearchOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Root = urlPath
+
+	results, total, err := s.search(opts)
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+	s.attachProgress(r, results)
+
+	if wantsJSON(r) {
+		writeSearchResults(w, opts, results, total)
+		return
+	}
+
+	data := DirectoryData{
+		Path:        urlPath,
+		Files:       results,
+		ServerName:  "HTTP Media Server",
+		Query:       opts.Query,
+		SearchType:  strings.Join(opts.Types, ","),
+		Categories:  s.types.Categories(),
+		Player:      s.player != nil,
+		ResultCount: total,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.template.Execute(w, data); err != nil {
+		log.Printf("Template execution error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// writeSearchResults writes search results as JSON
+func writeSearchResults(w http.ResponseWriter, opts SearchOptions, results []FileInfo, total int) {
+	writeJSON(w, http.StatusOK, SearchResults{
+		Query:   opts.Query,
+		Types:   opts.Types,
+		Root:    opts.Root,
+		Total:   total,
+		Limit:   opts.Limit,
+		Results: results,
+	})
+}
+
+// walkMedia visits every visible file below fullRoot without the catalog.
+// The virtual top level of a library with several roots walks every root.
+func (s *MediaServer) walkMedia(fullRoot, urlRoot string, visit func(FileInfo)) {
+	if fullRoot == "" {
+		for _, root := range s.library.Roots() {
+			s.walkMedia(root.Directory, root.Mount, visit)
+		}
+		return
+	}
+
+	root := s.library.Root(urlRoot)
+	filepath.WalkDir(fullRoot, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil || fullPath == fullRoot {
+			return nil
+		}
+		if root.Hidden(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(fullRoot, fullPath)
+		if err != nil {
+			return nil
+		}
+		visit(newFileInfo(path.Join(urlRoot, filepath.ToSlash(rel)), fullPath, info, s.types))
+		return nil
+	})
+}
+
+// matchScore reports whether every term matches the file's path and scores
+// the match. Terms found in the file name score higher than terms found
+// only in parent directory names, and whole-word matches beat prefixes.
+func matchScore(terms []string, file FileInfo) (int, bool) {
+	nameTokens := tokenize(file.Name)
+	dirTokens := tokenize(path.Dir(file.Path))
+
+	score := 0
+	for _, term := range terms {
+		if s := termScore(term, nameTokens); s > 0 {
+			score += 2 * s
+		} else if s := termScore(term, dirTokens); s > 0 {
+			score += s
+		} else {
+			return 0, false
+		}
+	}
+	return score, true
+}
+
+// termScore scores a query term against a token list: 2 for an exact
+// token, 1 for a prefix (or a substring of a CJK token), 0 for no match
+func termScore(term string, tokens []string) int {
+	best := 0
+	for _, token := range tokens {
+		switch {
+		case token == term:
+			return 2
+		case strings.HasPrefix(token, term):
+			best = 1
+		case isCJKToken(token) && strings.Contains(token, term):
+			best = 1
+		}
+	}
+	return best
+}
+
+// tokenize lowercases s and splits it into words. Runs of CJK characters,
+// which are not separated by spaces, are kept together as single tokens
+// and matched by substring.
+func tokenize(s string) []string {
+	var tokens []string
+	var current []rune
+	currentCJK := false
+
+	flush := func() {
+		if len(current) > 0 {
+			tokens = append(tokens, string(current))
+			current = current[:0]
+		}
+	}
+
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case isCJK(r):
+			if !currentCJK {
+				flush()
+			}
+			currentCJK = true
+			current = append(current, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r):
+			if currentCJK {
+				flush()
+			}
+			currentCJK = false
+			current = append(current, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// isCJK reports whether r is a Chinese, Japanese or Korean character,
+// including the katakana prolonged sound mark
+func isCJK(r rune) bool {
+	return r == 'ー' || unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// isCJKToken reports whether a token produced by tokenize is a CJK run
+func isCJKToken(token string) bool {
+	for _, r := range token {
+		return isCJK(r)
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"The Matrix (1999).mp4", []string{"the", "matrix", "1999", "mp4"}},
+		{"snake_case-and.dots", []string{"snake", "case", "and", "dots"}},
+		{"進撃の巨人 第1話.mp4", []string{"進撃の巨人", "第", "1", "話", "mp4"}},
+		{"Café Noël", []string{"café", "noël"}},
+		{"ラーメン", []string{"ラーメン"}},
+		{"  -- ", nil},
+	}
+
+	for _, tt := range tests {
+		if got := tokenize(tt.in); !equalStrings(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	file := FileInfo{Name: "The Matrix (1999).mp4", Path: "/Movies/Sci-Fi/The Matrix (1999).mp4"}
+
+	tests := []struct {
+		query     string
+		wantScore int
+		wantOK    bool
+	}{
+		{"matrix", 4, true},
+		{"mat", 2, true},
+		{"movies", 2, true},
+		{"sci matrix", 6, true},
+		{"MATRIX 1999", 8, true},
+		{"matrix reloaded", 0, false},
+		{"atrix", 0, false},
+	}
+
+	for _, tt := range tests {
+		score, ok := matchScore(tokenize(tt.query), file)
+		if score != tt.wantScore || ok != tt.wantOK {
+			t.Errorf("matchScore(%q) = %d, %v, want %d, %v", tt.query, score, ok, tt.wantScore, tt.wantOK)
+		}
+	}
+}
+
+func TestHandleAPISearch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir,
+		"Movies/The Matrix (1999).mp4",
+		"Movies/Matrix Reloaded.mkv",
+		"Music/matrix theme.mp3",
+		"Docs/notes.txt",
+		"アニメ/進撃の巨人 第1話.mp4",
+		".hidden/matrix.mp4",
+	)
+	library := NewLibrary(MediaConfig{Directory: dir})
+	types := NewMediaTypes(defaultMediaTypes(), nil)
+	catalog := NewCatalog(library, types, false)
+	if err := catalog.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	servers := map[string]*MediaServer{
+		"catalog": {library: library, types: types, catalog: catalog},
+		"walk":    {library: library, types: types},
+	}
+
+	tests := []struct {
+		name       string
+		query      url.Values
+		wantStatus int
+		wantPaths  []string
+		wantTotal  int
+	}{
+		{
+			name:       "name match",
+			query:      url.Values{"q": {"matrix"}},
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/Movies/Matrix Reloaded.mkv", "/Movies/The Matrix (1999).mp4", "/Music/matrix theme.mp3"},
+			wantTotal:  3,
+		},
+		{
+			name:       "directory terms rank lower",
+			query:      url.Values{"q": {"movies"}},
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/Movies", "/Movies/Matrix Reloaded.mkv", "/Movies/The Matrix (1999).mp4"},
+			wantTotal:  3,
+		},
+		{
+			name:       "every term must match",
+			query:      url.Values{"q": {"matrix 1999"}},
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/Movies/The Matrix (1999).mp4"},
+			wantTotal:  1,
+		},
+		{
+			name:       "cjk substring",
+			query:      url.Values{"q": {"巨人"}},
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/アニメ/進撃の巨人 第1話.mp4"},
+			wantTotal:  1,
+		},
+		{
+			name:       "type filter",
+			query:      url.Values{"q": {"matrix"}, "type": {"audio"}},
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/Music/matrix theme.mp3"},
+			wantTotal:  1,
+		},
+		{
+			name:       "directory filter",
+			query:      url.Values{"q": {"movies"}, "type": {"directory"}},
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/Movies"},
+			wantTotal:  1,
+		},
+		{
+			name:       "below a path",
+			query:      url.Values{"q": {"matrix"}, "path": {"/Music"}},
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/Music/matrix theme.mp3"},
+			wantTotal:  1,
+		},
+		{
+			name:       "limit",
+			query:      url.Values{"q": {"matrix"}, "limit": {"1"}},
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/Movies/Matrix Reloaded.mkv"},
+			wantTotal:  3,
+		},
+		{
+			name:       "huge limit",
+			query:      url.Values{"q": {"notes"}, "limit": {"9223372036854775807"}},
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/Docs/notes.txt"},
+			wantTotal:  1,
+		},
+		{
+			name:       "no match",
+			query:      url.Values{"q": {"nothing"}},
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{},
+		},
+		{name: "missing query", query: url.Values{"q": {"  "}}, wantStatus: http.StatusBadRequest},
+		{name: "invalid type", query: url.Values{"q": {"matrix"}, "type": {"font"}}, wantStatus: http.StatusBadRequest},
+		{name: "invalid limit", query: url.Values{"q": {"matrix"}, "limit": {"0"}}, wantStatus: http.StatusBadRequest},
+		{name: "hidden path", query: url.Values{"q": {"matrix"}, "path": {"/.hidden"}}, wantStatus: http.StatusNotFound},
+	}
+
+	for server, s := range servers {
+		for _, tt := range tests {
+			t.Run(server+"/"+tt.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				s.handleAPISearch(w, httptest.NewRequest("GET", "/api/search?"+tt.query.Encode(), nil))
+				if w.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+				}
+				if tt.wantStatus != http.StatusOK {
+					return
+				}
+
+				var results SearchResults
+				if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+					t.Fatal(err)
+				}
+				paths := []string{}
+				for _, file := range results.Results {
+					paths = append(paths, file.Path)
+				}
+				if !equalStrings(paths, tt.wantPaths) || results.Total != tt.wantTotal {
+					t.Errorf("results = %q (total %d), want %q (total %d)", paths, results.Total, tt.wantPaths, tt.wantTotal)
+				}
+				if results.Limit > maxSearchLimit {
+					t.Errorf("limit = %d, want at most %d", results.Limit, maxSearchLimit)
+				}
+			})
+		}
+	}
+}
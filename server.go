@@ -1,31 +1,45 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
 	"log"
-	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/webdav"
 )
 
 // FileInfo represents file information for directory listing
 type FileInfo struct {
-	Name        string
-	Path        string
-	Size        int64
-	ModTime     time.Time
-	IsDir       bool
-	MimeType    string
-	EncodedPath string
+	Name        string         `json:"name"`
+	Path        string         `json:"path"`
+	Size        int64          `json:"size"`
+	ModTime     time.Time      `json:"mod_time"`
+	IsDir       bool           `json:"is_dir"`
+	MimeType    string         `json:"mime_type,omitempty"`
+	EncodedPath string         `json:"encoded_path"`
+	Category    string         `json:"category,omitempty"`
+	Metadata    *MediaMetadata `json:"metadata,omitempty"`
+	Progress    *WatchProgress `json:"progress,omitempty"`
+
+	// icon and class come from the file's media category
+	icon  string
+	class string
 }
 
 // GetFileIcon returns the appropriate icon for the file type
@@ -33,23 +47,9 @@ func (f FileInfo) GetFileIcon() string {
 	if f.IsDir {
 		return "📁"
 	}
-
-	ext := strings.ToLower(filepath.Ext(f.Name))
-	if strings.HasPrefix(f.MimeType, "video/") || ext == ".mp4" || ext == ".avi" ||
-		ext == ".mkv" || ext == ".mov" || ext == ".wmv" || ext == ".flv" || ext == ".webm" {
-		return "🎬"
-	}
-
-	if strings.HasPrefix(f.MimeType, "audio/") || ext == ".mp3" || ext == ".wav" ||
-		ext == ".flac" || ext == ".aac" || ext == ".ogg" || ext == ".m4a" {
-		return "🎵"
-	}
-
-	if strings.HasPrefix(f.MimeType, "image/") || ext == ".jpg" || ext == ".jpeg" ||
-		ext == ".png" || ext == ".gif" || ext == ".bmp" || ext == ".webp" {
-		return "🖼️"
+	if f.icon != "" {
+		return f.icon
 	}
-
 	return "📄"
 }
 
@@ -58,24 +58,7 @@ func (f FileInfo) GetFileClass() string {
 	if f.IsDir {
 		return "directory"
 	}
-
-	ext := strings.ToLower(filepath.Ext(f.Name))
-	if strings.HasPrefix(f.MimeType, "video/") || ext == ".mp4" || ext == ".avi" ||
-		ext == ".mkv" || ext == ".mov" || ext == ".wmv" || ext == ".flv" || ext == ".webm" {
-		return "video-file"
-	}
-
-	if strings.HasPrefix(f.MimeType, "audio/") || ext == ".mp3" || ext == ".wav" ||
-		ext == ".flac" || ext == ".aac" || ext == ".ogg" || ext == ".m4a" {
-		return "audio-file"
-	}
-
-	if strings.HasPrefix(f.MimeType, "image/") || ext == ".jpg" || ext == ".jpeg" ||
-		ext == ".png" || ext == ".gif" || ext == ".bmp" || ext == ".webp" {
-		return "image-file"
-	}
-
-	return ""
+	return f.class
 }
 
 // GetFormattedSize returns the file size formatted in MB
@@ -84,61 +67,529 @@ func (f FileInfo) GetFormattedSize() string {
 	return fmt.Sprintf("%.2f", sizeInMB)
 }
 
+// HasThumbnail reports whether a thumbnail can be generated for the file
+func (f FileInfo) HasThumbnail() bool {
+	return !f.IsDir && thumbnailExtensions[strings.ToLower(filepath.Ext(f.Name))]
+}
+
+// GetThumbnailPath returns the URL of the file's thumbnail
+func (f FileInfo) GetThumbnailPath() string {
+	return "/thumb" + escapeURLPath(f.Path)
+}
+
 // DirectoryData holds data for directory listing template
 type DirectoryData struct {
-	Path       string
-	ParentPath string
-	Files      []FileInfo
-	ServerName string
+	Path        string
+	ParentPath  string
+	Files       []FileInfo
+	ServerName  string
+	Query       string
+	SearchType  string
+	Categories  []*MediaCategory
+	ResultCount int
+	Shared      bool
+	View        string
+	Thumbnails  bool
+	Player      bool
+	// ContinueWatching lists the user's unfinished files below Path
+	ContinueWatching []WatchProgress
+	// PlaylistURL is the M3U8 playlist of the folder
+	PlaylistURL string
+	// Uploads shows the upload area for the folder
+	Uploads bool
+	// Manage shows the file management actions
+	Manage bool
 }
 
 // MediaServer represents the HTTP media server
 type MediaServer struct {
-	config   *Config
-	template *template.Template
+	config     *Config
+	template   *template.Template
+	library    *Library
+	catalog    *Catalog
+	auth       *Authenticator
+	shares     *ShareStore
+	thumbnails *Thumbnailer
+	types      *MediaTypes
+	hls        *HLSPackager
+	dash       *DASHPackager
+	player     *template.Template
+	progress   *ProgressStore
+	dlna       *DLNAServer
+	dav        *webdav.Handler
+	uploads    *UploadStore
+	files      *FileManager
+	audit      *AuditLog
+
+	// ctx is cancelled when this server's background tasks must stop,
+	// either on shutdown or when a reload replaces it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Listener state, owned by the instance that Start was called on.
+	// Reloads swap the active instance serving requests.
+	mu            sync.Mutex
+	handler       atomic.Value
+	active        *MediaServer
+	httpServer    *http.Server
+	redirect      *http.Server
+	stopListeners context.CancelFunc
 }
 
 // NewMediaServer creates a new media server instance
-func NewMediaServer(config *Config) *MediaServer {
+func NewMediaServer(config *Config) (*MediaServer, error) {
+	return newMediaServer(config, nil)
+}
+
+// newMediaServer creates a server instance for config. On a reload it
+// takes over the stores of the previous instance that persist to the same
+// data directory, so that each file is written by a single store, and its
+// library and catalog while the media settings are unchanged, so that the
+// library is not scanned again.
+func newMediaServer(config *Config, previous *MediaServer) (*MediaServer, error) {
+	kept := &MediaServer{}
+	if previous != nil {
+		if reflect.DeepEqual(previous.config.Media, config.Media) {
+			kept.library, kept.types = previous.library, previous.types
+			if previous.config.Index.Metadata == config.Index.Metadata {
+				kept.catalog = previous.catalog
+			}
+		}
+		if previous.config.Data.Directory == config.Data.Directory {
+			kept.shares, kept.progress, kept.uploads, kept.files = previous.shares, previous.progress, previous.uploads, previous.files
+		}
+		if previous.config.Files.AuditLog == config.Files.AuditLog {
+			kept.audit = previous.audit
+		}
+	}
+
 	tmpl := template.Must(template.New("directory").Parse(directoryTemplate))
-	return &MediaServer{
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &MediaServer{
 		config:   config,
 		template: tmpl,
+		library:  kept.library,
+		types:    kept.types,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	if s.library == nil {
+		s.library = NewLibrary(config.Media)
+		s.types = NewMediaTypes(config.Media.Types, config.Media.MimeTypes)
+	}
+	if config.Index.Enabled {
+		s.catalog = kept.catalog
+		if s.catalog == nil {
+			s.catalog = NewCatalog(s.library, s.types, config.Index.Metadata)
+		}
+	}
+	if config.Auth.Enabled {
+		s.auth = NewAuthenticator(config.Auth)
+	}
+	if config.Share.Enabled {
+		if kept.shares != nil {
+			kept.shares.SetSigningKey(config.Share.SigningKey)
+			s.shares = kept.shares
+		} else {
+			shares, err := NewShareStore(config.Share.SigningKey, config.Data.Directory)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			s.shares = shares
+		}
+	}
+	if config.Thumbnails.Enabled {
+		thumbnails, err := NewThumbnailer(config.Thumbnails.CacheDirectory, int64(config.Thumbnails.CacheSize)<<20, config.Thumbnails.Quality)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		s.thumbnails = thumbnails
+	}
+	if config.HLS.Enabled {
+		s.hls = NewHLSPackager(config.HLS.SegmentDuration, int64(config.HLS.CacheSize)<<20)
+	}
+	if config.DASH.Enabled {
+		s.dash = NewDASHPackager()
+	}
+	if config.Player.Enabled {
+		s.player = newPlayerTemplate()
+	}
+	if config.Progress.Enabled {
+		s.progress = kept.progress
+		if s.progress == nil {
+			progress, err := NewProgressStore(config.Data.Directory)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			s.progress = progress
+		}
+	}
+	if config.DLNA.Enabled {
+		s.dlna = NewDLNAServer(config)
+	}
+	if config.WebDAV.Enabled {
+		s.dav = newDAVHandler(s)
+	}
+	if config.Uploads.Enabled || config.Files.Enabled {
+		s.audit = kept.audit
+		if s.audit == nil {
+			audit, err := NewAuditLog(config.Files.AuditLog)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			s.audit = audit
+		}
+	}
+	if config.Uploads.Enabled {
+		if kept.uploads != nil {
+			if previous.config.Uploads.StagingDirectory != config.Uploads.StagingDirectory {
+				log.Printf("Upload staging directory changed; restart the server to apply it")
+			}
+			s.uploads = kept.uploads
+		} else {
+			uploads, err := NewUploadStore(config.Data.Directory, config.Uploads.StagingDirectory)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			s.uploads = uploads
+		}
+	}
+	if config.Files.Enabled {
+		if kept.files != nil {
+			kept.files.Reconfigure(s.library, config.Files.TrashRetention)
+			s.files = kept.files
+		} else {
+			files, err := NewFileManager(config.Data.Directory, s.library, config.Files.TrashRetention)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			s.files = files
+		}
 	}
+	return s, nil
 }
 
-// Start starts the HTTP server
-func (s *MediaServer) Start() error {
+// routes builds the request handler for this server's configuration
+func (s *MediaServer) routes() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleRequest)
 	mux.HandleFunc("/health", s.handleHealth)
 	mux.HandleFunc("/api/info", s.handleAPIInfo)
+	mux.HandleFunc("/api/list", s.handleAPIList)
+	mux.HandleFunc("/api/list/", s.handleAPIList)
+	mux.HandleFunc("/api/events", s.handleAPIEvents)
+	mux.HandleFunc("/api/search", s.handleAPISearch)
+	mux.HandleFunc("/api/shares", s.handleAPIShares)
+	mux.HandleFunc("/api/shares/", s.handleAPIShare)
+	mux.HandleFunc("/api/progress", s.handleAPIProgress)
+	mux.HandleFunc("/api/progress/", s.handleAPIProgress)
+	mux.HandleFunc("/s/", s.handleShare)
+	mux.HandleFunc("/thumb/", s.handleThumbnail)
+	mux.HandleFunc("/hls/", s.handleHLS)
+	mux.HandleFunc("/dash/", s.handleDASH)
+	mux.HandleFunc("/play/", s.handlePlay)
+	mux.HandleFunc("/playlist/", s.handlePlaylist)
+	mux.HandleFunc("/dlna/", s.handleDLNA)
+	mux.HandleFunc("/dav/", s.handleDAV)
+	mux.HandleFunc("/api/uploads", s.handleUploads)
+	mux.HandleFunc("/api/uploads/", s.handleUploads)
+	mux.HandleFunc("/api/files/", s.handleAPIFiles)
+	mux.HandleFunc("/api/trash", s.handleAPITrash)
+	mux.HandleFunc("/api/trash/", s.handleAPITrash)
+
+	return s.corsMiddleware(s.loggingMiddleware(s.authMiddleware(s.optionsMiddleware(mux))))
+}
+
+// startBackground starts the indexer, watcher, SSDP announcements and
+// upload and trash cleanup until s.ctx is cancelled
+func (s *MediaServer) startBackground() {
+	if s.catalog != nil {
+		go s.catalog.Run(s.ctx, s.config.Index.RescanInterval)
+		if s.config.Index.Watch {
+			for _, root := range s.library.Roots() {
+				watcher := NewWatcher(s.catalog, root, s.config.Index.PollInterval)
+				go watcher.Run(s.ctx)
+			}
+		}
+	}
+	if s.dlna != nil {
+		go s.dlna.Run(s.ctx, s.catalog)
+	}
+	if s.thumbnails != nil {
+		go s.thumbnails.Run(s.ctx)
+	}
+	if s.uploads != nil {
+		go s.uploads.Run(s.ctx)
+	}
+	if s.files != nil {
+		go s.files.Run(s.ctx)
+	}
+}
+
+// Start starts the HTTP server and blocks until it fails or Stop is called
+func (s *MediaServer) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	scheme := "http"
+	if s.config.Server.TLS.Enabled {
+		scheme = "https"
+	}
 
 	addr := fmt.Sprintf("%s:%d", s.config.Server.Host, s.config.Server.Port)
 	log.Printf("Starting media server on %s", addr)
-	log.Printf("Serving directory: %s", s.config.Media.Directory)
-	log.Printf("Health check available at: http://%s/health", addr)
-	log.Printf("API info available at: http://%s/api/info", addr)
+	for _, root := range s.library.Roots() {
+		log.Printf("Serving directory: %s at %s", root.Directory, root.Mount)
+	}
+	if s.auth != nil {
+		log.Printf("Authentication enabled for %d user(s)", len(s.config.Auth.Users))
+	}
+	if s.dav != nil && !s.config.WebDAV.ReadOnly && s.auth == nil {
+		log.Printf("Warning: WebDAV allows changes to the media directory without authentication")
+	}
+	if s.uploads != nil && s.auth == nil {
+		log.Printf("Warning: uploads are enabled without authentication")
+	}
+	log.Printf("Health check available at: %s://%s/health", scheme, addr)
+	log.Printf("API info available at: %s://%s/api/info", scheme, addr)
+	log.Printf("Directory listing API available at: %s://%s/api/list/", scheme, addr)
 
 	server := &http.Server{
-		Addr:         addr,
-		Handler:      s.corsMiddleware(s.loggingMiddleware(mux)),
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.handler.Load().(http.Handler).ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: s.config.Server.Timeouts.ReadHeader,
+		ReadTimeout:       s.config.Server.Timeouts.Read,
+		WriteTimeout:      s.config.Server.Timeouts.Write,
+		IdleTimeout:       s.config.Server.Timeouts.Idle,
+	}
+
+	// Long-lived event streams end when shutdown begins rather than
+	// holding up the drain of in-flight downloads
+	server.RegisterOnShutdown(func() {
+		s.mu.Lock()
+		active := s.active
+		s.mu.Unlock()
+		active.cancel()
+	})
+
+	s.mu.Lock()
+	if s.httpServer != nil {
+		s.mu.Unlock()
+		return errors.New("server already started")
+	}
+	s.handler.Store(s.routes())
+	s.active = s
+	s.httpServer = server
+	s.stopListeners = cancel
+	s.mu.Unlock()
+
+	s.startBackground()
+
+	if !s.config.Server.TLS.Enabled {
+		return ignoreServerClosed(server.ListenAndServe())
+	}
+
+	// Configure HTTPS with a certificate that is reloaded on change
+	if err := ensureCertificate(s.config); err != nil {
+		return err
+	}
+	certs, err := NewCertReloader(s.config.Server.TLS.CertFile, s.config.Server.TLS.KeyFile)
+	if err != nil {
+		return err
+	}
+	go certs.Watch(ctx)
+
+	server.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
 	}
 
-	return server.ListenAndServe()
+	if port := s.config.Server.TLS.RedirectPort; port != 0 {
+		redirect := &http.Server{
+			Addr:         fmt.Sprintf("%s:%d", s.config.Server.Host, port),
+			Handler:      s.redirectHandler(),
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		defer redirect.Close()
+
+		s.mu.Lock()
+		s.redirect = redirect
+		s.mu.Unlock()
+
+		log.Printf("Redirecting HTTP requests on port %d to HTTPS", port)
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("HTTP redirect listener failed: %v", err)
+			}
+		}()
+	}
+
+	return ignoreServerClosed(server.ListenAndServeTLS("", ""))
+}
+
+// Stop gracefully shuts the server down. New connections are refused and
+// in-flight requests, such as video streams, are allowed to finish until
+// ctx expires, after which remaining connections are closed.
+func (s *MediaServer) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	server, redirect, active, stopListening := s.httpServer, s.redirect, s.active, s.stopListeners
+	s.mu.Unlock()
+
+	if server == nil {
+		s.cancel()
+		return nil
+	}
+
+	if redirect != nil {
+		redirect.Close()
+	}
+
+	if active.dlna != nil {
+		active.dlna.ssdp.ByeBye()
+	}
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Drain timeout exceeded, closing remaining connections")
+		server.Close()
+	}
+
+	if active.progress != nil {
+		if err := active.progress.Flush(); err != nil {
+			log.Printf("Failed to save watch progress: %v", err)
+		}
+	}
+
+	active.cancel()
+	stopListening()
+	return err
+}
+
+// Reload replaces the running configuration without dropping connections.
+// Requests already in progress finish with the previous configuration.
+// Stores and the catalog carry over wherever the change allows. Listener
+// settings (host, port and TLS) only take effect after a restart.
+func (s *MediaServer) Reload(config *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.httpServer == nil {
+		return errors.New("server is not running")
+	}
+
+	next, err := newMediaServer(config, s.active)
+	if err != nil {
+		return err
+	}
+
+	if !listenerConfigEqual(s.config.Server, config.Server) {
+		log.Printf("Listener settings changed; restart the server to apply them")
+	}
+
+	next.startBackground()
+	s.handler.Store(next.routes())
+
+	previous := s.active
+	s.active = next
+	if previous.dlna != nil && (next.dlna == nil || next.dlna.udn != previous.dlna.udn) {
+		previous.dlna.ssdp.ByeBye()
+	}
+	previous.cancel()
+
+	log.Printf("Configuration reloaded (serving directories: %s)", strings.Join(config.MediaDirectories(), ", "))
+	return nil
+}
+
+// listenerConfigEqual reports whether two server configurations bind the
+// same listeners
+func listenerConfigEqual(a, b ServerConfig) bool {
+	return a.Host == b.Host &&
+		a.Port == b.Port &&
+		a.TLS.Enabled == b.TLS.Enabled &&
+		a.TLS.CertFile == b.TLS.CertFile &&
+		a.TLS.KeyFile == b.TLS.KeyFile &&
+		a.TLS.RedirectPort == b.TLS.RedirectPort
 }
 
-// corsMiddleware adds CORS headers for better compatibility
+// ignoreServerClosed maps the error returned after a graceful shutdown to nil
+func ignoreServerClosed(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// corsMiddleware adds CORS headers for the origins allowed to call the
+// server from a browser. Their preflight requests are answered here, as
+// browsers send them without credentials; other origins get no CORS
+// headers, so browsers keep their pages from reading the responses.
 func (s *MediaServer) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range")
+		if len(s.config.Server.CORSOrigins) > 0 {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if origin := s.corsOrigin(r.Header.Get("Origin")); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if origin != "*" && s.auth != nil {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Range, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, X-Requested-With")
+			w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Upload-Offset, Upload-Length, Upload-Expires")
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, or "" if the origin may not call the server
+func (s *MediaServer) corsOrigin(origin string) string {
+	allowed := s.config.Server.CORSOrigins
+	if len(allowed) == 0 {
+		if s.auth == nil {
+			return "*"
+		}
+		return ""
+	}
+	if origin == "" {
+		return ""
+	}
+	for _, o := range allowed {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
 
-		if r.Method == "OPTIONS" {
+// optionsMiddleware answers OPTIONS requests that are not CORS preflights,
+// advertising the tus protocol on the upload endpoints. WebDAV clients
+// use OPTIONS to discover the DAV capabilities, so those are passed on.
+func (s *MediaServer) optionsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions && !strings.HasPrefix(r.URL.Path, "/dav/") {
+			if s.uploads != nil && strings.HasPrefix(r.URL.Path, "/api/uploads") {
+				s.setTusOptions(w)
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -179,6 +630,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // handleHealth provides a health check endpoint
 func (s *MediaServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -186,19 +642,21 @@ func (s *MediaServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if media directory is accessible
-	_, err := os.Stat(s.config.Media.Directory)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusServiceUnavailable)
-		fmt.Fprintf(w, `{"status":"unhealthy","error":"media directory not accessible: %s"}`, err.Error())
-		return
+	// Check if media directories are accessible
+	dirs := s.config.MediaDirectories()
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, `{"status":"unhealthy","error":"media directory not accessible: %s"}`, err.Error())
+			return
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, `{"status":"healthy","timestamp":"%s","media_directory":"%s"}`,
-		time.Now().Format(time.RFC3339), s.config.Media.Directory)
+		time.Now().Format(time.RFC3339), strings.Join(dirs, ", "))
 }
 
 // handleAPIInfo provides server information
@@ -213,13 +671,54 @@ func (s *MediaServer) handleAPIInfo(w http.ResponseWriter, r *http.Request) {
 		"version":         "2.0.0",
 		"media_directory": s.config.Media.Directory,
 		"server_time":     time.Now().Format(time.RFC3339),
+		"index_enabled":   s.catalog != nil,
+		"auth_enabled":    s.auth != nil,
+		"thumbnails":      s.thumbnails != nil,
+		"hls_enabled":     s.hls != nil,
+		"dash_enabled":    s.dash != nil,
+		"player_enabled":  s.player != nil,
+		"progress":        s.progress != nil,
+		"playlists":       s.config.Playlists.Enabled,
+		"dlna_enabled":    s.dlna != nil,
+		"webdav":          s.dav != nil,
+		"uploads":         s.uploads != nil,
+		"file_management": s.files != nil,
+		"media_types":     s.types.Categories(),
 		"endpoints": map[string]string{
-			"health":   "/health",
-			"api_info": "/api/info",
-			"browse":   "/",
+			"health":       "/health",
+			"api_info":     "/api/info",
+			"api_list":     "/api/list/",
+			"api_events":   "/api/events",
+			"api_search":   "/api/search",
+			"api_shares":   "/api/shares",
+			"api_progress": "/api/progress/{path}",
+			"thumbnails":   "/thumb/",
+			"hls":          "/hls/{path}/index.m3u8",
+			"dash":         "/dash/{path}/manifest.mpd",
+			"play":         "/play/{path}",
+			"playlist":     "/playlist/{path}.m3u8",
+			"dlna":         "/dlna/device.xml",
+			"webdav":       "/dav/",
+			"api_uploads":  "/api/uploads",
+			"api_files":    "/api/files/{mkdir,rename,move,delete}",
+			"api_trash":    "/api/trash",
+			"browse":       "/",
 		},
 	}
 
+	if s.library.Virtual() {
+		var roots []string
+		for _, root := range s.library.Roots() {
+			if root.Allows(userFromContext(r.Context())) {
+				roots = append(roots, root.Name)
+			}
+		}
+		info["media_roots"] = roots
+	}
+	if s.catalog != nil {
+		info["catalog"] = s.catalog.Stats()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(info); err != nil {
 		log.Printf("Error encoding API info: %v", err)
@@ -229,42 +728,14 @@ func (s *MediaServer) handleAPIInfo(w http.ResponseWriter, r *http.Request) {
 
 // handleRequest handles all HTTP requests
 func (s *MediaServer) handleRequest(w http.ResponseWriter, r *http.Request) {
-
-	// Decode URL path
-	decodedPath, err := url.QueryUnescape(r.URL.Path)
-	if err != nil {
-		http.Error(w, "Invalid URL path", http.StatusBadRequest)
-		return
-	}
-
-	// Clean and join with media directory
-	cleanPath := path.Clean(decodedPath)
-	if cleanPath == "." {
-		cleanPath = "/"
-	}
-
-	fullPath := filepath.Join(s.config.Media.Directory, cleanPath)
-
-	// Security check: ensure path is within media directory
-	absMediaDir, err := filepath.Abs(s.config.Media.Directory)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	absFullPath, err := filepath.Abs(fullPath)
+	cleanPath, fullPath, err := s.resolvePath(r, r.URL.Path)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	if !strings.HasPrefix(absFullPath, absMediaDir) {
-		http.Error(w, "Forbidden", http.StatusForbidden)
+		s.writePathError(w, err)
 		return
 	}
 
 	// Check if file/directory exists
-	fileInfo, err := os.Stat(fullPath)
+	fileInfo, err := s.statMedia(fullPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Printf("File not found: %s (requested: %s)", fullPath, r.URL.Path)
@@ -283,15 +754,114 @@ func (s *MediaServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// serveDirectory serves directory listing
-func (s *MediaServer) serveDirectory(w http.ResponseWriter, r *http.Request, fullPath, urlPath string) {
+// errInvalidPath, errForbiddenPath and errHiddenPath are returned by
+// resolvePath. Hidden paths are reported as missing.
+var (
+	errInvalidPath   = errors.New("invalid URL path")
+	errForbiddenPath = errors.New("path outside media directory")
+	errHiddenPath    = fmt.Errorf("hidden path: %w", fs.ErrNotExist)
+)
+
+// resolvePath decodes a URL path and maps it onto the media library for
+// the requesting user. It returns the cleaned URL path and the
+// corresponding filesystem path.
+func (s *MediaServer) resolvePath(r *http.Request, urlPath string) (string, string, error) {
+	// Decode URL path
+	decodedPath, err := url.QueryUnescape(urlPath)
+	if err != nil {
+		return "", "", errInvalidPath
+	}
+
+	return s.resolveUserPath(userFromContext(r.Context()), decodedPath)
+}
+
+// resolveUserPath maps an already decoded media path onto the media
+// library, refusing roots the user may not access
+func (s *MediaServer) resolveUserPath(user, mediaPath string) (string, string, error) {
+	cleanPath, fullPath, err := s.resolveMediaPath(mediaPath)
+	if err != nil {
+		return "", "", err
+	}
+	if !s.library.Allows(user, cleanPath) {
+		return "", "", errForbiddenPath
+	}
+	return cleanPath, fullPath, nil
+}
+
+// resolveMediaPath maps an already decoded media path onto its media root,
+// rejecting paths that escape it directly or through symlinks and paths
+// hidden in the root, such as the trash. The virtual top level of a
+// library with several roots has no filesystem path.
+func (s *MediaServer) resolveMediaPath(mediaPath string) (string, string, error) {
+	// Clean and join with the root's directory
+	cleanPath := path.Clean("/" + mediaPath)
+
+	root := s.library.Root(cleanPath)
+	if root == nil {
+		if cleanPath == "/" {
+			return cleanPath, "", nil
+		}
+		return "", "", errUnknownRoot
+	}
+	if s.library.Hidden(cleanPath) {
+		return "", "", errHiddenPath
+	}
+	fullPath := root.FullPath(cleanPath)
+
+	// Security check: ensure path is within media directory, including
+	// where its symlinks lead
+	if err := root.Contain(fullPath); err != nil {
+		return "", "", err
+	}
+
+	return cleanPath, fullPath, nil
+}
+
+// writePathError writes the HTTP error matching a resolvePath failure
+func (s *MediaServer) writePathError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidPath):
+		http.Error(w, "Invalid URL path", http.StatusBadRequest)
+	case errors.Is(err, errForbiddenPath):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "Not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// statMedia returns the info of a resolved path. The virtual top level of
+// a library with several roots is a directory.
+func (s *MediaServer) statMedia(fullPath string) (fs.FileInfo, error) {
+	if fullPath == "" {
+		return virtualDirInfo{}, nil
+	}
+	return os.Stat(fullPath)
+}
+
+// listDirectory returns the visible entries of a directory, directories
+// first and then sorted by name. Listings are served from the catalog when
+// it has indexed the directory, otherwise the directory is read from disk.
+// The virtual top level lists the roots the user may access.
+func (s *MediaServer) listDirectory(user, fullPath, urlPath string) ([]FileInfo, error) {
+	if fullPath == "" {
+		return s.library.List(user, s.types), nil
+	}
+
+	if s.catalog != nil {
+		if files, ok := s.catalog.List(urlPath); ok {
+			return files, nil
+		}
+	}
+
 	entries, err := os.ReadDir(fullPath)
 	if err != nil {
-		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	var files []FileInfo
+	root := s.library.Root(urlPath)
 
 	for _, entry := range entries {
 		info, err := entry.Info()
@@ -300,52 +870,113 @@ func (s *MediaServer) serveDirectory(w http.ResponseWriter, r *http.Request, ful
 		}
 
 		// Skip hidden files
-		if strings.HasPrefix(info.Name(), ".") {
+		if root.Hidden(info.Name()) {
 			continue
 		}
 
-		filePath := path.Join(urlPath, info.Name())
-		mimeType := ""
+		files = append(files, newFileInfo(path.Join(urlPath, info.Name()), filepath.Join(fullPath, info.Name()), info, s.types))
+	}
 
-		if !info.IsDir() {
-			mimeType = mime.TypeByExtension(filepath.Ext(info.Name()))
-			if mimeType == "" {
-				mimeType = "application/octet-stream"
-			}
-		}
+	sortByName(files)
+	return files, nil
+}
 
-		files = append(files, FileInfo{
-			Name:        info.Name(),
-			Path:        filePath,
-			Size:        info.Size(),
-			ModTime:     info.ModTime(),
-			IsDir:       info.IsDir(),
-			MimeType:    mimeType,
-			EncodedPath: url.PathEscape(filePath),
-		})
+// newFileInfo builds the listing record for a file at the given URL path,
+// detecting its type and category with the media type registry
+func newFileInfo(urlPath, fullPath string, info fs.FileInfo, types *MediaTypes) FileInfo {
+	file := FileInfo{
+		Name:        info.Name(),
+		Path:        urlPath,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		IsDir:       info.IsDir(),
+		MimeType:    types.TypeOf(fullPath, info),
+		EncodedPath: url.PathEscape(urlPath),
+	}
+	if category := types.Classify(file.Name, file.MimeType); category != nil && !file.IsDir {
+		file.Category = category.Name
+		file.icon = category.Icon
+		file.class = category.Class
 	}
+	return file
+}
 
-	// Sort files: directories first, then by name
+// isHidden reports whether a file name should be hidden from listings
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// validFileName reports whether name can be given to a new file or folder:
+// a single path element that is not hidden
+func validFileName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\") && !isHidden(name)
+}
+
+// sortByName sorts files with directories first, then by name
+func sortByName(files []FileInfo) {
 	sort.Slice(files, func(i, j int) bool {
 		if files[i].IsDir != files[j].IsDir {
 			return files[i].IsDir
 		}
 		return strings.ToLower(files[i].Name) < strings.ToLower(files[j].Name)
 	})
+}
+
+// parentPath returns the parent of a URL path, or "" at the root
+func parentPath(urlPath string) string {
+	if urlPath == "/" {
+		return ""
+	}
+	parent := path.Dir(urlPath)
+	if parent == "." {
+		parent = "/"
+	}
+	return parent
+}
+
+// serveDirectory serves directory listing
+func (s *MediaServer) serveDirectory(w http.ResponseWriter, r *http.Request, fullPath, urlPath string) {
+	// Listings and search results are JSON or HTML depending on Accept
+	w.Header().Add("Vary", "Accept")
+
+	if r.URL.Query().Get("q") != "" {
+		s.serveSearch(w, r, urlPath)
+		return
+	}
+
+	if wantsJSON(r) {
+		s.serveDirectoryJSON(w, r, fullPath, urlPath)
+		return
+	}
+
+	files, err := s.listDirectory(userFromContext(r.Context()), fullPath, urlPath)
+	if err != nil {
+		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
+		return
+	}
+	s.attachProgress(r, files)
 
 	// Prepare template data
 	data := DirectoryData{
 		Path:       urlPath,
+		ParentPath: parentPath(urlPath),
 		Files:      files,
 		ServerName: "HTTP Media Server",
+		Categories: s.types.Categories(),
+		View:       viewMode(w, r),
+		Thumbnails: s.thumbnails != nil,
+		Player:     s.player != nil,
 	}
-
-	// Add parent directory link if not at root
-	if urlPath != "/" {
-		data.ParentPath = path.Dir(urlPath)
-		if data.ParentPath == "." {
-			data.ParentPath = "/"
-		}
+	if s.progress != nil {
+		user := userFromContext(r.Context())
+		data.ContinueWatching = s.progress.Unfinished(user, urlPath, continueWatchingLimit, s.progressPresent(user))
+	}
+	if s.config.Playlists.Enabled {
+		data.PlaylistURL = "/playlist" + escapeURLPath(urlPath) + ".m3u8"
+	}
+	if root := s.library.Root(urlPath); root != nil && !root.ReadOnly {
+		data.Uploads = s.uploads != nil
+		data.Manage = s.files != nil
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -355,8 +986,32 @@ func (s *MediaServer) serveDirectory(w http.ResponseWriter, r *http.Request, ful
 	}
 }
 
+// viewMode returns the listing layout, "list" or "grid". An explicit
+// ?view= choice is remembered in a cookie for later listings.
+func viewMode(w http.ResponseWriter, r *http.Request) string {
+	if view := r.URL.Query().Get("view"); view == "list" || view == "grid" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "view",
+			Value:    view,
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return view
+	}
+	if cookie, err := r.Cookie("view"); err == nil && cookie.Value == "grid" {
+		return "grid"
+	}
+	return "list"
+}
+
 // serveFile serves individual files with proper headers for media streaming
 func (s *MediaServer) serveFile(w http.ResponseWriter, r *http.Request, fullPath string, fileInfo fs.FileInfo) {
+	if r.URL.Query().Get("format") == "vtt" {
+		s.serveSubtitle(w, r, fullPath, fileInfo)
+		return
+	}
+
 	file, err := os.Open(fullPath)
 	if err != nil {
 		http.Error(w, "Unable to open file", http.StatusInternalServerError)
@@ -364,24 +1019,41 @@ func (s *MediaServer) serveFile(w http.ResponseWriter, r *http.Request, fullPath
 	}
 	defer file.Close()
 
-	// Set content type
-	contentType := mime.TypeByExtension(filepath.Ext(fullPath))
-	if contentType == "" {
-		contentType = "application/octet-stream"
-	}
+	// Set content type, and keep browsers from second-guessing it
+	contentType := s.types.TypeOf(fullPath, fileInfo)
 	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
 	// Set headers for better media player compatibility
 	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Cache-Control", s.cacheControl(time.Hour))
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
 
-	// Set filename for download
+	// Set filename for download. Documents that can run scripts, such as
+	// uploaded HTML or SVG, are downloaded rather than rendered on the
+	// server's origin.
 	filename := filepath.Base(fullPath)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", filename))
+	disposition := "inline"
+	if isActiveContentType(contentType) {
+		disposition = "attachment"
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"", disposition, filename))
+
+	// Serve file with range support for media streaming. Streams may
+	// outlast the server write timeout as long as the client keeps reading.
+	http.ServeContent(s.streamWriter(w), r, filename, fileInfo.ModTime(), file)
+}
 
-	// Serve file with range support for media streaming
-	http.ServeContent(w, r, filename, fileInfo.ModTime(), file)
+// cacheControl returns the Cache-Control value for responses that clients
+// may reuse for maxAge. Shared caches may only keep them when the server
+// requires no credentials.
+func (s *MediaServer) cacheControl(maxAge time.Duration) string {
+	scope := "public"
+	if s.auth != nil {
+		scope = "private"
+	}
+	return fmt.Sprintf("%s, max-age=%d", scope, int(maxAge.Seconds()))
 }
 
 // HTML template for directory listing
@@ -415,6 +1087,40 @@ const directoryTemplate = `<!DOCTYPE html>
             font-size: 14px;
             opacity: 0.9;
         }
+        .search {
+            display: flex;
+            gap: 8px;
+            margin-top: 15px;
+        }
+        .search input {
+            flex: 1;
+            padding: 8px 12px;
+            border: none;
+            border-radius: 6px;
+            font-size: 14px;
+        }
+        .search select, .search button {
+            padding: 8px 12px;
+            border: none;
+            border-radius: 6px;
+            font-size: 14px;
+        }
+        .search button {
+            background-color: rgba(255,255,255,0.2);
+            color: white;
+            cursor: pointer;
+        }
+        .search-summary {
+            padding: 15px 20px;
+            background-color: #e3f2fd;
+            border-bottom: 1px solid #eee;
+            font-size: 14px;
+        }
+        .file-path {
+            font-size: 12px;
+            color: #999;
+            margin-top: 3px;
+        }
         .file-list {
             background: white;
             border-radius: 10px;
@@ -465,15 +1171,194 @@ const directoryTemplate = `<!DOCTYPE html>
         .image-file {
             color: #f57c00;
         }
+        .subtitle-file {
+            color: #00897b;
+        }
+        .view-toggle {
+            margin-top: 10px;
+            font-size: 14px;
+        }
+        .view-toggle a {
+            color: white;
+            opacity: 0.7;
+            margin-right: 10px;
+        }
+        .view-toggle a.active {
+            opacity: 1;
+            font-weight: bold;
+        }
+        .file-grid {
+            display: grid;
+            grid-template-columns: repeat(auto-fill, minmax(160px, 1fr));
+            gap: 1px;
+            background-color: #eee;
+        }
+        .file-grid .file-item {
+            background: white;
+            border-bottom: none;
+            text-align: center;
+            overflow: hidden;
+        }
+        .file-grid .parent-link {
+            background-color: #e3f2fd;
+        }
+        .thumb {
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            height: 120px;
+            font-size: 48px;
+            margin-bottom: 8px;
+        }
+        .thumb img {
+            max-width: 100%;
+            max-height: 120px;
+            border-radius: 4px;
+        }
+        .file-grid .file-name {
+            font-size: 13px;
+            word-break: break-word;
+        }
+        .progress {
+            height: 4px;
+            margin-top: 6px;
+            background-color: #e0e0e0;
+            border-radius: 2px;
+            overflow: hidden;
+        }
+        .progress div {
+            height: 100%;
+            background-color: #667eea;
+        }
+        .continue-watching {
+            background: white;
+            border-radius: 10px;
+            padding: 15px 20px;
+            margin-bottom: 20px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        .continue-watching h2 {
+            margin: 0 0 10px 0;
+            font-size: 16px;
+        }
+        .continue-watching a {
+            display: block;
+            padding: 8px 0;
+            text-decoration: none;
+            color: #333;
+        }
+        .upload {
+            border: 2px dashed #bbb;
+            border-radius: 10px;
+            padding: 15px 20px;
+            margin-bottom: 20px;
+            text-align: center;
+            color: #666;
+            background: white;
+        }
+        .upload.dragover {
+            border-color: #667eea;
+            background-color: #f0f2ff;
+        }
+        .upload label {
+            color: #667eea;
+            cursor: pointer;
+            text-decoration: underline;
+        }
+        .upload-item {
+            text-align: left;
+            margin-top: 10px;
+        }
+        .upload-item.failed .file-name {
+            color: #d32f2f;
+        }
+        .file-actions {
+            float: right;
+        }
+        .file-actions button {
+            padding: 4px 8px;
+            margin-left: 4px;
+            border: 1px solid #ddd;
+            border-radius: 4px;
+            background: white;
+            color: #333;
+            font-size: 12px;
+            cursor: pointer;
+        }
     </style>
 </head>
 <body>
     <div class="header">
         <h1>{{.ServerName}}</h1>
         <div class="path">{{.Path}}</div>
+        {{if not .Shared}}
+        <form class="search" action="{{.Path}}" method="get">
+            <input type="search" name="q" value="{{.Query}}" placeholder="Search files...">
+            <select name="type">
+                <option value="">All types</option>
+                {{range .Categories}}
+                <option value="{{.Name}}"{{if eq $.SearchType .Name}} selected{{end}}>{{.Label}}</option>
+                {{end}}
+                <option value="directory"{{if eq .SearchType "directory"}} selected{{end}}>Folder</option>
+            </select>
+            <button type="submit">Search</button>
+        </form>
+        {{if not .Query}}
+        <div class="view-toggle">
+            <a href="?view=list"{{if ne .View "grid"}} class="active"{{end}}>☰ List</a>
+            <a href="?view=grid"{{if eq .View "grid"}} class="active"{{end}}>▦ Grid</a>
+            {{with .PlaylistURL}}<a href="{{.}}">▶ Playlist</a>{{end}}
+            {{if .Manage}}<a href="#" id="new-folder">＋ New folder</a>{{end}}
+        </div>
+        {{end}}
+        {{end}}
+    </div>
+
+    {{if and .ContinueWatching (not .Query)}}
+    <div class="continue-watching">
+        <h2>Continue watching</h2>
+        {{range .ContinueWatching}}
+        <a href="{{if $.Player}}{{.GetPlayPath}}{{else}}{{.Path}}{{end}}">
+            <div class="file-name">{{.Name}}</div>
+            <div class="progress"><div style="width: {{.Percent}}%"></div></div>
+        </a>
+        {{end}}
     </div>
+    {{end}}
+
+    {{if .Uploads}}
+    <div class="upload" id="upload">
+        Drop files here to upload, or <label>choose files<input type="file" id="upload-input" multiple hidden></label>
+        <div id="upload-list"></div>
+    </div>
+    {{end}}
+
+    {{if eq .View "grid"}}
+    <div class="file-list file-grid">
+        {{if .ParentPath}}
+        <a href="{{.ParentPath}}" class="file-item parent-link">
+            <div class="thumb">↰</div>
+            <div class="file-name">..</div>
+        </a>
+        {{end}}
 
+        {{range .Files}}
+        <a href="{{if and $.Player .IsPlayable}}{{.GetPlayPath}}{{else}}{{.EncodedPath}}{{end}}" class="file-item {{if .IsDir}}directory{{else}}{{.GetFileClass}}{{end}}" title="{{.Name}}">
+            <div class="thumb">
+                {{if and $.Thumbnails .HasThumbnail}}<img src="{{.GetThumbnailPath}}" alt="" loading="lazy">{{else}}{{.GetFileIcon}}{{end}}
+            </div>
+            <div class="file-name">{{.Name}}</div>
+            {{with .Progress}}<div class="progress"><div style="width: {{.Percent}}%"></div></div>{{end}}
+        </a>
+        {{end}}
+    </div>
+    {{else}}
     <div class="file-list">
+        {{if .Query}}
+        <div class="search-summary">
+            {{.ResultCount}} result(s) for "{{.Query}}" • <a href="{{.Path}}">Back to listing</a>
+        </div>
+        {{end}}
         {{if .ParentPath}}
         <a href="{{.ParentPath}}" class="file-item parent-link">
             <span class="file-icon">↰</span>
@@ -482,18 +1367,242 @@ const directoryTemplate = `<!DOCTYPE html>
         {{end}}
 
         {{range .Files}}
-        <a href="{{.EncodedPath}}" class="file-item {{if .IsDir}}directory{{else}}{{.GetFileClass}}{{end}}">
+        <a href="{{if and $.Player .IsPlayable}}{{.GetPlayPath}}{{else}}{{.EncodedPath}}{{end}}" class="file-item {{if .IsDir}}directory{{else}}{{.GetFileClass}}{{end}}">
+            {{if $.Manage}}
+            <span class="file-actions" data-path="{{.Path}}" data-name="{{.Name}}">
+                <button type="button" data-action="rename">Rename</button>
+                <button type="button" data-action="move">Move</button>
+                <button type="button" data-action="delete">Delete</button>
+            </span>
+            {{end}}
             <span class="file-icon">
                 {{.GetFileIcon}}
             </span>
             <div class="file-name">{{.Name}}</div>
+            {{if $.Query}}<div class="file-path">{{.Path}}</div>{{end}}
             {{if not .IsDir}}
             <div class="file-info">
-                {{if .MimeType}}{{.MimeType}} • {{end}}{{.GetFormattedSize}} MB • {{.ModTime.Format "2006-01-02 15:04:05"}}
+                {{if .MimeType}}{{.MimeType}} • {{end}}{{with .Metadata}}{{with .Summary}}{{.}} • {{end}}{{end}}{{.GetFormattedSize}} MB • {{.ModTime.Format "2006-01-02 15:04:05"}}
             </div>
+            {{with .Progress}}<div class="progress"><div style="width: {{.Percent}}%"></div></div>{{end}}
             {{end}}
         </a>
         {{end}}
     </div>
+    {{end}}
+    {{if .Uploads}}
+
+    <script>
+    (function() {
+        // Uploads use the tus protocol in chunks, so an interrupted upload
+        // resumes where it stopped, even after reloading the page
+        var folder = "{{.Path}}";
+        var chunkSize = 8 * 1024 * 1024;
+        var zone = document.getElementById("upload");
+        var input = document.getElementById("upload-input");
+        var list = document.getElementById("upload-list");
+        var pending = 0;
+
+        function tus(method, url, headers, body) {
+            headers["Tus-Resumable"] = "1.0.0";
+            return fetch(url, {method: method, headers: headers, body: body});
+        }
+
+        function encode(value) {
+            return btoa(unescape(encodeURIComponent(value)));
+        }
+
+        function upload(file) {
+            var key = "upload:" + folder + ":" + file.name + ":" + file.size + ":" + file.lastModified;
+            var row = document.createElement("div");
+            row.className = "upload-item";
+            row.innerHTML = '<div class="file-name"></div><div class="progress"><div></div></div>';
+            var label = row.querySelector(".file-name");
+            var bar = row.querySelector(".progress div");
+            label.textContent = file.name;
+            list.appendChild(row);
+            pending++;
+
+            function finish(error) {
+                if (error) {
+                    label.textContent = file.name + " - " + error;
+                    row.classList.add("failed");
+                }
+                if (--pending === 0 && !list.querySelector(".failed")) {
+                    window.location.reload();
+                }
+            }
+
+            function failure(res) {
+                return res.json().catch(function() {
+                    return {};
+                }).then(function(body) {
+                    var error = new Error(body.error || res.statusText);
+                    error.status = res.status;
+                    throw error;
+                });
+            }
+
+            function send(url, offset, retries) {
+                bar.style.width = (file.size ? offset / file.size * 100 : 100) + "%";
+                if (offset >= file.size) {
+                    localStorage.removeItem(key);
+                    finish();
+                    return;
+                }
+                tus("PATCH", url, {"Upload-Offset": String(offset), "Content-Type": "application/offset+octet-stream"},
+                    file.slice(offset, offset + chunkSize)).then(function(res) {
+                    if (res.status !== 204) {
+                        return failure(res);
+                    }
+                    send(url, parseInt(res.headers.get("Upload-Offset"), 10), 5);
+                }).catch(function(error) {
+                    retry(url, error, retries);
+                });
+            }
+
+            // Network and server errors resume from the offset the server
+            // has; other errors end the upload
+            function retry(url, error, retries) {
+                if (retries === 0 || error.status < 500) {
+                    localStorage.removeItem(key);
+                    finish(error.message);
+                    return;
+                }
+                setTimeout(function() {
+                    resume(url, retries - 1);
+                }, 2000);
+            }
+
+            function resume(url, retries) {
+                tus("HEAD", url, {}).then(function(res) {
+                    if (res.status !== 200) {
+                        localStorage.removeItem(key);
+                        create();
+                        return;
+                    }
+                    send(url, parseInt(res.headers.get("Upload-Offset"), 10), retries);
+                }, function(error) {
+                    retry(url, error, retries);
+                });
+            }
+
+            function create() {
+                tus("POST", "/api/uploads", {
+                    "Upload-Length": String(file.size),
+                    "Upload-Metadata": "filename " + encode(file.name) + ",folder " + encode(folder)
+                }).then(function(res) {
+                    if (res.status !== 201) {
+                        return failure(res);
+                    }
+                    var url = res.headers.get("Location");
+                    localStorage.setItem(key, url);
+                    send(url, parseInt(res.headers.get("Upload-Offset"), 10), 5);
+                }).catch(function(error) {
+                    finish(error.message);
+                });
+            }
+
+            var saved = localStorage.getItem(key);
+            if (saved) {
+                resume(saved, 5);
+            } else {
+                create();
+            }
+        }
+
+        function uploadAll(files) {
+            for (var i = 0; i < files.length; i++) {
+                upload(files[i]);
+            }
+        }
+
+        input.addEventListener("change", function() {
+            uploadAll(input.files);
+            input.value = "";
+        });
+        document.addEventListener("dragover", function(e) {
+            e.preventDefault();
+            zone.classList.add("dragover");
+        });
+        document.addEventListener("dragleave", function(e) {
+            if (!e.relatedTarget) {
+                zone.classList.remove("dragover");
+            }
+        });
+        document.addEventListener("drop", function(e) {
+            e.preventDefault();
+            zone.classList.remove("dragover");
+            uploadAll(e.dataTransfer.files);
+        });
+    })();
+    </script>
+    {{end}}
+    {{if .Manage}}
+
+    <script>
+    (function() {
+        var folder = "{{.Path}}";
+
+        function change(action, body) {
+            return fetch("/api/files/" + action, {
+                method: "POST",
+                headers: {"Content-Type": "application/json"},
+                body: JSON.stringify(body)
+            }).then(function(res) {
+                if (res.ok) {
+                    window.location.reload();
+                    return;
+                }
+                return res.json().catch(function() {
+                    return {};
+                }).then(function(body) {
+                    alert(body.error || res.statusText);
+                });
+            });
+        }
+
+        var newFolder = document.getElementById("new-folder");
+        if (newFolder) {
+            newFolder.addEventListener("click", function(e) {
+                e.preventDefault();
+                var name = prompt("New folder name:");
+                if (name) {
+                    change("mkdir", {path: folder, name: name});
+                }
+            });
+        }
+
+        document.addEventListener("click", function(e) {
+            var button = e.target.closest(".file-actions button");
+            if (!button) {
+                return;
+            }
+            e.preventDefault();
+            e.stopPropagation();
+            var item = button.parentNode.dataset;
+            switch (button.dataset.action) {
+            case "rename":
+                var name = prompt("Rename \"" + item.name + "\" to:", item.name);
+                if (name && name !== item.name) {
+                    change("rename", {path: item.path, name: name});
+                }
+                break;
+            case "move":
+                var destination = prompt("Move \"" + item.name + "\" to folder:", folder);
+                if (destination && destination !== folder) {
+                    change("move", {path: item.path, destination: destination});
+                }
+                break;
+            case "delete":
+                if (confirm("Move \"" + item.name + "\" to the trash?")) {
+                    change("delete", {path: item.path});
+                }
+                break;
+            }
+        }, true);
+    })();
+    </script>
+    {{end}}
 </body>
 </html>`
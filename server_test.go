@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serverTestConfig loads a configuration serving mediaDir with its data
+// kept in dataDir
+func serverTestConfig(t *testing.T, port int, mediaDir, dataDir string) *Config {
+	t.Helper()
+	config, err := loadTestConfig(t, fmt.Sprintf(`
+server:
+  host: 127.0.0.1
+  port: %d
+media:
+  directory: %q
+data:
+  directory: %q
+index:
+  enabled: true
+share:
+  enabled: true
+  signing_key: 0123456789abcdef0123456789abcdef
+progress:
+  enabled: true
+`, port, mediaDir, dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// freePort returns a local TCP port that is not in use
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestNewMediaServerReload(t *testing.T) {
+	media, otherMedia, data := t.TempDir(), t.TempDir(), t.TempDir()
+	previous, err := NewMediaServer(serverTestConfig(t, 8080, media, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer previous.cancel()
+
+	tests := []struct {
+		name        string
+		change      func(c *Config)
+		wantLibrary bool
+		wantCatalog bool
+		wantStores  bool
+	}{
+		{"unchanged", func(c *Config) {}, true, true, true},
+		{"other listener settings", func(c *Config) { c.Server.Port = 9090 }, true, true, true},
+		{"media directory", func(c *Config) { c.Media.Directory = otherMedia }, false, false, true},
+		{"metadata probing", func(c *Config) { c.Index.Metadata = !c.Index.Metadata }, true, false, true},
+		{"data directory", func(c *Config) { c.Data.Directory = t.TempDir() }, true, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := serverTestConfig(t, 8080, media, data)
+			tt.change(config)
+			next, err := newMediaServer(config, previous)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer next.cancel()
+
+			if got := next.catalog == previous.catalog; got != tt.wantCatalog {
+				t.Errorf("catalog kept = %v, want %v", got, tt.wantCatalog)
+			}
+			if got := next.library == previous.library; got != tt.wantLibrary {
+				t.Errorf("library kept = %v, want %v", got, tt.wantLibrary)
+			}
+			if got := next.shares == previous.shares && next.progress == previous.progress; got != tt.wantStores {
+				t.Errorf("stores kept = %v, want %v", got, tt.wantStores)
+			}
+		})
+	}
+}
+
+func TestListenerConfigEqual(t *testing.T) {
+	base := ServerConfig{Host: "0.0.0.0", Port: 8080, TLS: TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}}
+
+	tests := []struct {
+		name   string
+		change func(c *ServerConfig)
+		want   bool
+	}{
+		{"same", func(c *ServerConfig) {}, true},
+		{"timeouts", func(c *ServerConfig) { c.Timeouts.Write = time.Minute }, true},
+		{"cors origins", func(c *ServerConfig) { c.CORSOrigins = []string{"https://a.example"} }, true},
+		{"host", func(c *ServerConfig) { c.Host = "127.0.0.1" }, false},
+		{"port", func(c *ServerConfig) { c.Port = 8081 }, false},
+		{"tls", func(c *ServerConfig) { c.TLS.Enabled = true }, false},
+		{"certificate", func(c *ServerConfig) { c.TLS.CertFile = "other.pem" }, false},
+		{"redirect port", func(c *ServerConfig) { c.TLS.RedirectPort = 80 }, false},
+	}
+
+	for _, tt := range tests {
+		changed := base
+		tt.change(&changed)
+		if got := listenerConfigEqual(base, changed); got != tt.want {
+			t.Errorf("%s: listenerConfigEqual() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMediaServerStartReloadStop(t *testing.T) {
+	media, otherMedia, data := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTestFiles(t, media, "first.mp4")
+	writeTestFiles(t, otherMedia, "second.mp4")
+	port := freePort(t)
+
+	s, err := NewMediaServer(serverTestConfig(t, port, media, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(serverTestConfig(t, port, otherMedia, data)); err == nil {
+		t.Fatal("Reload() of a stopped server succeeded")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+
+	base := fmt.Sprintf("http://127.0.0.1:%d", port)
+	listing := func() []string {
+		t.Helper()
+		resp, err := http.Get(base + "/api/list/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var listing DirectoryListing
+		if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, file := range listing.Files {
+			names = append(names, file.Name)
+		}
+		return names
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(base + "/health")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := s.Start(); err == nil {
+		t.Error("second Start() succeeded")
+	}
+	if got := listing(); !equalStrings(got, []string{"first.mp4"}) {
+		t.Errorf("listing = %v, want [first.mp4]", got)
+	}
+
+	if err := s.Reload(serverTestConfig(t, port, otherMedia, data)); err != nil {
+		t.Fatal(err)
+	}
+	if got := listing(); !equalStrings(got, []string{"second.mp4"}) {
+		t.Errorf("listing after reload = %v, want [second.mp4]", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start() error = %v after Stop", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start() did not return after Stop")
+	}
+	if _, err := http.Get(base + "/health"); err == nil {
+		t.Error("server still accepts connections after Stop")
+	}
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSignedLinkExpiry bounds the lifetime of the unrecorded links
+	// minted by Sign, which cannot be revoked
+	maxSignedLinkExpiry = 12 * time.Hour
+
+	// shareSessionCookie names the cookie that ties the requests of one
+	// download of a limited share link together
+	shareSessionCookie = "share_session"
+
+	// shareSessionIdle is how long a download session lasts without
+	// requests before the next request counts as a new download
+	shareSessionIdle = 6 * time.Hour
+)
+
+// Share link errors
+var (
+	errShareInvalid   = errors.New("invalid share link")
+	errShareExpired   = errors.New("share link has expired")
+	errShareRevoked   = errors.New("share link has been revoked")
+	errShareExhausted = errors.New("share link download limit reached")
+)
+
+// ShareRecord describes a minted share link
+type ShareRecord struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	IsDir        bool      `json:"is_dir"`
+	CreatedBy    string    `json:"created_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	Revoked      bool      `json:"revoked"`
+	URL          string    `json:"url,omitempty"`
+}
+
+// shareClaims is the signed payload of a share token
+type shareClaims struct {
+	ID           string `json:"i"`
+	Path         string `json:"p"`
+	Expires      int64  `json:"e"`
+	MaxDownloads int    `json:"n,omitempty"`
+	File         bool   `json:"f,omitempty"`
+}
+
+// ShareStore persists share records, including revocations and download
+// counts, as a JSON file in the data directory
+type ShareStore struct {
+	key  []byte
+	file string
+
+	mu      sync.Mutex
+	records map[string]*ShareRecord
+
+	// sessions holds when each download of a limited link was last
+	// requested, so that the range requests of a player seeking through a
+	// file count as one download
+	sessions map[shareSession]time.Time
+}
+
+// shareSession identifies the download of one file of a share link by one
+// client
+type shareSession struct {
+	id      string
+	session string
+	file    string
+}
+
+// NewShareStore loads the share store from the data directory
+func NewShareStore(signingKey, dataDir string) (*ShareStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	store := &ShareStore{
+		key:      []byte(signingKey),
+		file:     filepath.Join(dataDir, "shares.json"),
+		records:  make(map[string]*ShareRecord),
+		sessions: make(map[shareSession]time.Time),
+	}
+
+	data, err := os.ReadFile(store.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("failed to read share store: %w", err)
+	}
+
+	var records []*ShareRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse share store: %w", err)
+	}
+	for _, record := range records {
+		store.records[record.ID] = record
+	}
+
+	return store, nil
+}
+
+// Create mints a new share link for a media path and returns its record
+// and signed token
+func (st *ShareStore) Create(urlPath string, isDir bool, expiry time.Duration, maxDownloads int, createdBy string) (*ShareRecord, string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	record := &ShareRecord{
+		ID:           hex.EncodeToString(id),
+		Path:         urlPath,
+		IsDir:        isDir,
+		CreatedBy:    createdBy,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(expiry).Truncate(time.Second),
+		MaxDownloads: maxDownloads,
+	}
+
+	token, err := st.sign(shareClaims{
+		ID:           record.ID,
+		Path:         record.Path,
+		Expires:      record.ExpiresAt.Unix(),
+		MaxDownloads: record.MaxDownloads,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.records[record.ID] = record
+	if err := st.saveLocked(); err != nil {
+		return nil, "", err
+	}
+
+	copied := *record
+	return &copied, token, nil
+}
+
+// SetSigningKey replaces the key that tokens are signed and verified
+// with, for configuration reloads
+func (st *ShareStore) SetSigningKey(signingKey string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.key = []byte(signingKey)
+}
+
+// Sign mints a short-lived token for a single media file without
+// recording a share link, for links the server hands out itself such as
+// playlist entries. Such tokens do not appear in the share list and cannot
+// be revoked, so they never reach a folder and expire within
+// maxSignedLinkExpiry.
+func (st *ShareStore) Sign(urlPath string, expiry time.Duration) (string, error) {
+	if expiry > maxSignedLinkExpiry {
+		return "", fmt.Errorf("signed link expiry %s exceeds %s", expiry, maxSignedLinkExpiry)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return st.sign(shareClaims{
+		ID:      hex.EncodeToString(id),
+		Path:    urlPath,
+		Expires: time.Now().Add(expiry).Unix(),
+		File:    true,
+	})
+}
+
+// Verify checks a share token's signature, expiry and revocation status
+// and returns its claims
+func (st *ShareStore) Verify(token string) (shareClaims, error) {
+	var claims shareClaims
+
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, errShareInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, errShareInvalid
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, st.mac(data)) {
+		return claims, errShareInvalid
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return claims, errShareInvalid
+	}
+
+	if time.Now().After(time.Unix(claims.Expires, 0)) {
+		return claims, errShareExpired
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if record, ok := st.records[claims.ID]; ok && record.Revoked {
+		return claims, errShareRevoked
+	}
+
+	return claims, nil
+}
+
+// CheckDownload fails once a share's download limit has been reached,
+// unless session continues a download of file, without counting a
+// download
+func (st *ShareStore) CheckDownload(claims shareClaims, file, session string) error {
+	if claims.MaxDownloads <= 0 {
+		return nil
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.activeSessionLocked(shareSession{id: claims.ID, session: session, file: file}) {
+		return nil
+	}
+	if record, ok := st.records[claims.ID]; ok && record.Downloads >= claims.MaxDownloads {
+		return errShareExhausted
+	}
+	return nil
+}
+
+// RecordDownload counts a request for a file of a share link against the
+// link's download limit and returns the download session it belongs to.
+// Requests in a session the client has already been given continue that
+// download, so a player may seek with any number of range requests,
+// while every request without one counts as a new download and fails once
+// the limit has been reached. Links without a limit have no sessions.
+func (st *ShareStore) RecordDownload(claims shareClaims, file, session string) (string, error) {
+	if claims.MaxDownloads <= 0 {
+		return "", nil
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key := shareSession{id: claims.ID, session: session, file: file}
+	if st.activeSessionLocked(key) {
+		st.sessions[key] = time.Now()
+		return session, nil
+	}
+
+	record, ok := st.records[claims.ID]
+	if !ok {
+		// The store was lost; track the link again from its claims
+		record = &ShareRecord{
+			ID:           claims.ID,
+			Path:         claims.Path,
+			ExpiresAt:    time.Unix(claims.Expires, 0),
+			MaxDownloads: claims.MaxDownloads,
+		}
+		st.records[claims.ID] = record
+	}
+	if record.Downloads >= claims.MaxDownloads {
+		return "", errShareExhausted
+	}
+
+	// Clients keep their session across the files of a folder; a new
+	// client gets a random one
+	if !validShareSession(session) {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		session = hex.EncodeToString(id)
+	}
+	now := time.Now()
+	for other, lastSeen := range st.sessions {
+		if now.Sub(lastSeen) >= shareSessionIdle {
+			delete(st.sessions, other)
+		}
+	}
+	st.sessions[shareSession{id: claims.ID, session: session, file: file}] = now
+
+	record.Downloads++
+	return session, st.saveLocked()
+}
+
+// activeSessionLocked reports whether a download session has seen a
+// request within shareSessionIdle. The caller must hold the lock.
+func (st *ShareStore) activeSessionLocked(key shareSession) bool {
+	lastSeen, ok := st.sessions[key]
+	return ok && time.Since(lastSeen) < shareSessionIdle
+}
+
+// validShareSession reports whether a session cookie value has the form
+// of the sessions RecordDownload hands out
+func validShareSession(session string) bool {
+	if len(session) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(session)
+	return err == nil
+}
+
+// Revoke invalidates a share link. It reports false if the ID is unknown
+// or allowed refuses the link.
+func (st *ShareStore) Revoke(id string, allowed func(ShareRecord) bool) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	record, ok := st.records[id]
+	if !ok || !allowed(*record) {
+		return false, nil
+	}
+	record.Revoked = true
+	return true, st.saveLocked()
+}
+
+// List returns the unexpired share records that allowed accepts, newest
+// first
+func (st *ShareStore) List(allowed func(ShareRecord) bool) []ShareRecord {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	records := make([]ShareRecord, 0, len(st.records))
+	for _, record := range st.records {
+		if now.Before(record.ExpiresAt) && allowed(*record) {
+			records = append(records, *record)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.After(records[j].CreatedAt)
+	})
+	return records
+}
+
+// saveLocked prunes expired records and writes the store to disk. The
+// caller must hold the lock.
+func (st *ShareStore) saveLocked() error {
+	now := time.Now()
+	records := make([]*ShareRecord, 0, len(st.records))
+	for id, record := range st.records {
+		if now.After(record.ExpiresAt) {
+			delete(st.records, id)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode share store: %w", err)
+	}
+
+	return writeFileAtomic(st.file, data, 0600)
+}
+
+// sign encodes claims as a token of the form payload.signature
+func (st *ShareStore) sign(claims shareClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data) + "." +
+		base64.RawURLEncoding.EncodeToString(st.mac(data)), nil
+}
+
+// mac returns the HMAC-SHA256 of data under the signing key
+func (st *ShareStore) mac(data []byte) []byte {
+	st.mu.Lock()
+	key := st.key
+	st.mu.Unlock()
+
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// createShareRequest is the body of POST /api/shares
+type createShareRequest struct {
+	Path         string `json:"path"`
+	ExpiresIn    string `json:"expires_in"`
+	MaxDownloads int    `json:"max_downloads"`
+}
+
+// handleAPIShares lists share links (GET) or mints a new one (POST)
+func (s *MediaServer) handleAPIShares(w http.ResponseWriter, r *http.Request) {
+	if s.shares == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "share links are disabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		records := s.shares.List(s.shareAllowed(userFromContext(r.Context())))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"shares": records})
+
+	case http.MethodPost:
+		var req createShareRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		expiry := s.config.Share.DefaultExpiry
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid expires_in")
+				return
+			}
+			expiry = d
+		}
+		if expiry > s.config.Share.MaxExpiry {
+			writeJSONError(w, http.StatusBadRequest,
+				fmt.Sprintf("expires_in exceeds the maximum of %s", s.config.Share.MaxExpiry))
+			return
+		}
+		if req.MaxDownloads < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid max_downloads")
+			return
+		}
+
+		cleanPath, fullPath, err := s.resolveUserPath(userFromContext(r.Context()), req.Path)
+		if err != nil {
+			s.writePathError(w, err)
+			return
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "path not found")
+			return
+		}
+
+		record, token, err := s.shares.Create(cleanPath, info.IsDir(), expiry, req.MaxDownloads, userFromContext(r.Context()))
+		if err != nil {
+			log.Printf("Failed to create share link: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to create share link")
+			return
+		}
+
+		record.URL = baseURL(r) + "/s/" + token
+		if record.IsDir {
+			record.URL += "/"
+		}
+		log.Printf("Share link %s created for %s (expires %s)", record.ID, record.Path, record.ExpiresAt.Format(time.RFC3339))
+		writeJSON(w, http.StatusCreated, record)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAPIShare revokes a share link with DELETE /api/shares/<id>
+func (s *MediaServer) handleAPIShare(w http.ResponseWriter, r *http.Request) {
+	if s.shares == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "share links are disabled")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/shares/")
+	ok, err := s.shares.Revoke(id, s.shareAllowed(userFromContext(r.Context())))
+	if err != nil {
+		log.Printf("Failed to revoke share link %s: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to revoke share link")
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "share link not found")
+		return
+	}
+
+	log.Printf("Share link %s revoked", id)
+	writeJSON(w, http.StatusOK, map[string]string{"id": id, "status": "revoked"})
+}
+
+// shareAllowed returns a filter accepting the share links a user may see
+// and revoke: those they created, and those of paths they may access
+func (s *MediaServer) shareAllowed(user string) func(ShareRecord) bool {
+	return func(record ShareRecord) bool {
+		return (user != "" && record.CreatedBy == user) || s.library.Allows(user, record.Path)
+	}
+}
+
+// handleShare serves shared files and folders under /s/<token>/<path>.
+// Share links bypass authentication; access is limited to the shared path.
+func (s *MediaServer) handleShare(w http.ResponseWriter, r *http.Request) {
+	if s.shares == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, subPath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+	claims, err := s.shares.Verify(token)
+	if err != nil {
+		if errors.Is(err, errShareInvalid) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusGone)
+		}
+		return
+	}
+
+	// Resolve the request relative to the shared path
+	subPath = path.Clean("/" + subPath)
+	cleanPath, fullPath, err := s.resolveMediaPath(path.Join(claims.Path, subPath))
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+	if cleanPath != claims.Path && !strings.HasPrefix(cleanPath, strings.TrimSuffix(claims.Path, "/")+"/") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if claims.File && (cleanPath != claims.Path || info.IsDir()) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	prefix := "/s/" + token
+	if info.IsDir() {
+		s.serveSharedDirectory(w, fullPath, cleanPath, claims.Path, prefix)
+		return
+	}
+
+	// Every response checks the download limit, and each request outside
+	// a download session starts a download that counts against it
+	var session string
+	if cookie, err := r.Cookie(shareSessionCookie); err == nil {
+		session = cookie.Value
+	}
+	if r.Method == http.MethodHead {
+		err = s.shares.CheckDownload(claims, cleanPath, session)
+	} else {
+		session, err = s.shares.RecordDownload(claims, cleanPath, session)
+		if session != "" {
+			http.SetCookie(w, &http.Cookie{
+				Name:     shareSessionCookie,
+				Value:    session,
+				Path:     prefix,
+				MaxAge:   int(shareSessionIdle.Seconds()),
+				Secure:   r.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	}
+	if err != nil {
+		if errors.Is(err, errShareExhausted) {
+			http.Error(w, err.Error(), http.StatusGone)
+		} else {
+			log.Printf("Failed to record share download: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.serveFile(w, r, fullPath, info)
+}
+
+// serveSharedDirectory renders a directory inside a shared folder, with
+// links rewritten to stay under the share prefix
+func (s *MediaServer) serveSharedDirectory(w http.ResponseWriter, fullPath, urlPath, shareRoot, prefix string) {
+	files, err := s.listDirectory("", fullPath, urlPath)
+	if err != nil {
+		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
+		return
+	}
+
+	rel := func(p string) string {
+		return path.Clean("/" + strings.TrimPrefix(p, shareRoot))
+	}
+
+	for i := range files {
+		files[i].Path = rel(files[i].Path)
+		files[i].EncodedPath = prefix + escapeURLPath(files[i].Path)
+	}
+
+	data := DirectoryData{
+		Path:       path.Join(path.Base(shareRoot), rel(urlPath)),
+		Files:      files,
+		ServerName: "HTTP Media Server",
+		Shared:     true,
+	}
+	if urlPath != shareRoot {
+		data.ParentPath = prefix + escapeURLPath(path.Dir(rel(urlPath)))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.template.Execute(w, data); err != nil {
+		log.Printf("Template execution error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// escapeURLPath escapes each segment of a URL path
+func escapeURLPath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// baseURL returns the scheme and host the client used to reach the server
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareStoreVerify(t *testing.T) {
+	store, err := NewShareStore("secret", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, token, err := store.Create("/a.mp4", false, time.Hour, 0, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedToken, err := store.Create("/b.mp4", false, time.Hour, 0, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.Revoke(revoked.ID, func(ShareRecord) bool { return true }); !ok || err != nil {
+		t.Fatalf("Revoke() = %v, %v", ok, err)
+	}
+	expired, err := store.sign(shareClaims{ID: "old", Path: "/a.mp4", Expires: time.Now().Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewShareStore("other", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, foreign, err := other.Create("/a.mp4", false, time.Hour, 0, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _, _ := strings.Cut(token, ".")
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", token, nil},
+		{"revoked", revokedToken, errShareRevoked},
+		{"expired", expired, errShareExpired},
+		{"other key", foreign, errShareInvalid},
+		{"missing signature", payload, errShareInvalid},
+		{"tampered payload", "x" + token, errShareInvalid},
+		{"empty", "", errShareInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := store.Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (claims.ID != record.ID || claims.Path != "/a.mp4") {
+				t.Errorf("Verify() = %+v, want the claims of %s", claims, record.ID)
+			}
+		})
+	}
+}
+
+func TestShareStoreSign(t *testing.T) {
+	store, err := NewShareStore("secret", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Sign("/a.mp4", maxSignedLinkExpiry+time.Second); err == nil {
+		t.Error("Sign() accepted an expiry beyond maxSignedLinkExpiry")
+	}
+	token, err := store.Sign("/a.mp4", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := store.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claims.File || claims.Path != "/a.mp4" {
+		t.Errorf("Sign() claims = %+v, want a file link to /a.mp4", claims)
+	}
+	if len(store.List(func(ShareRecord) bool { return true })) != 0 {
+		t.Error("Sign() recorded a share link")
+	}
+}
+
+func TestShareStoreRecordDownload(t *testing.T) {
+	// Each step is a request for a file by a client holding a session
+	// cookie from an earlier step, or none
+	type step struct {
+		file    string
+		session int // index of the step whose session is sent, or -1
+		head    bool
+		wantErr error
+	}
+	tests := []struct {
+		name          string
+		maxDownloads  int
+		steps         []step
+		wantDownloads int
+	}{
+		{"unlimited", 0, []step{{"/a", -1, false, nil}, {"/a", -1, false, nil}}, 0},
+		{"seeking within one download", 1, []step{
+			{"/a", -1, false, nil},
+			{"/a", 0, false, nil},
+			{"/a", 0, false, nil},
+			{"/a", 0, true, nil},
+		}, 1},
+		{"second client after the limit", 1, []step{
+			{"/a", -1, false, nil},
+			{"/a", -1, false, errShareExhausted},
+			{"/a", -1, true, errShareExhausted},
+			{"/a", 0, false, nil},
+		}, 1},
+		{"requests without a session each count", 2, []step{
+			{"/a", -1, false, nil},
+			{"/a", -1, false, nil},
+			{"/a", -1, false, errShareExhausted},
+		}, 2},
+		{"each file of a folder counts", 2, []step{
+			{"/dir/a", -1, false, nil},
+			{"/dir/b", 0, false, nil},
+			{"/dir/a", 0, false, nil},
+			{"/dir/c", 0, false, errShareExhausted},
+			{"/dir/b", 0, true, nil},
+		}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewShareStore("secret", t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			record, _, err := store.Create("/", true, time.Hour, tt.maxDownloads, "bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims := shareClaims{ID: record.ID, Path: record.Path, Expires: record.ExpiresAt.Unix(), MaxDownloads: tt.maxDownloads}
+
+			sessions := make([]string, len(tt.steps))
+			for i, step := range tt.steps {
+				var session string
+				if step.session >= 0 {
+					session = sessions[step.session]
+				}
+				if step.head {
+					err = store.CheckDownload(claims, step.file, session)
+				} else {
+					sessions[i], err = store.RecordDownload(claims, step.file, session)
+				}
+				if !errors.Is(err, step.wantErr) {
+					t.Fatalf("step %d: error = %v, want %v", i, err, step.wantErr)
+				}
+			}
+
+			got := store.List(func(ShareRecord) bool { return true })
+			if len(got) != 1 || got[0].Downloads != tt.wantDownloads {
+				t.Errorf("downloads = %+v, want %d", got, tt.wantDownloads)
+			}
+		})
+	}
+}
+
+func TestShareStoreSessionExpiry(t *testing.T) {
+	store, err := NewShareStore("secret", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, _, err := store.Create("/a", false, time.Hour, 2, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := shareClaims{ID: record.ID, Path: record.Path, Expires: record.ExpiresAt.Unix(), MaxDownloads: 2}
+
+	session, err := store.RecordDownload(claims, "/a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.sessions[shareSession{id: claims.ID, session: session, file: "/a"}] = time.Now().Add(-shareSessionIdle)
+	if _, err := store.RecordDownload(claims, "/a", session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RecordDownload(claims, "/a", "forged"); !errors.Is(err, errShareExhausted) {
+		t.Errorf("request after an idle session and a forged one error = %v, want %v", err, errShareExhausted)
+	}
+}
+
+func TestHandleShareDownloadLimit(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.mp4"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	shares, err := NewShareStore("secret", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &MediaServer{
+		config:  &Config{},
+		library: NewLibrary(MediaConfig{Directory: dir}),
+		types:   NewMediaTypes(nil, nil),
+		shares:  shares,
+	}
+	_, token, err := shares.Create("/a.mp4", false, time.Hour, 1, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method, rangeHeader string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/s/"+token, nil)
+		if rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		s.handleShare(w, r)
+		return w
+	}
+
+	// A player starts in the middle, then seeks around with its cookie
+	first := request("GET", "bytes=500-", nil)
+	if first.Code != http.StatusPartialContent {
+		t.Fatalf("first request status = %d, want %d", first.Code, http.StatusPartialContent)
+	}
+	cookies := first.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != shareSessionCookie || cookies[0].Path != "/s/"+token || !cookies[0].HttpOnly {
+		t.Fatalf("first request cookies = %v, want an HttpOnly session cookie for the link", cookies)
+	}
+	for _, rangeHeader := range []string{"bytes=0-", "bytes=900-", "bytes=100-199", ""} {
+		if w := request("GET", rangeHeader, cookies[0]); w.Code >= 400 {
+			t.Errorf("seek %q status = %d, want success", rangeHeader, w.Code)
+		}
+	}
+	if w := request("HEAD", "", cookies[0]); w.Code != http.StatusOK {
+		t.Errorf("HEAD with the session status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Other clients, whatever range they ask for, are over the limit
+	for _, rangeHeader := range []string{"", "bytes=0-", "bytes=500-"} {
+		if w := request("GET", rangeHeader, nil); w.Code != http.StatusGone {
+			t.Errorf("new client %q status = %d, want %d", rangeHeader, w.Code, http.StatusGone)
+		}
+	}
+	if w := request("HEAD", "", nil); w.Code != http.StatusGone {
+		t.Errorf("HEAD without a session status = %d, want %d", w.Code, http.StatusGone)
+	}
+}
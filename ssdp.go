@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// ssdpAddress is the SSDP multicast group and port
+	ssdpAddress = "239.255.255.250:1900"
+
+	// ssdpMaxAge is how long control points may cache an announcement
+	ssdpMaxAge = 1800
+
+	// ssdpNotifyInterval is how often the server re-announces itself,
+	// well within ssdpMaxAge
+	ssdpNotifyInterval = 15 * time.Minute
+
+	// ssdpServer identifies the server in SSDP messages
+	ssdpServer = "Linux/1.0 UPnP/1.0 HTTP-Media-Server/2.0"
+)
+
+// SSDPAnnouncer advertises the DLNA media server on the local network. It
+// answers M-SEARCH discovery requests and multicasts ssdp:alive
+// notifications on every interface, pointing control points at the
+// device description on each interface's address.
+type SSDPAnnouncer struct {
+	udn          string
+	scheme       string
+	port         int
+	locationPath string
+
+	// allows limits the requesters that get search responses, so that
+	// spoofed requests cannot direct them at hosts elsewhere; nil answers
+	// every requester
+	allows func(net.IP) bool
+}
+
+// ssdpTargets are the notification types the server advertises
+var ssdpTargets = []string{
+	"upnp:rootdevice",
+	"", // the device UUID
+	dlnaDeviceType,
+	dlnaContentDirectoryType,
+	dlnaConnectionManagerType,
+}
+
+// NewSSDPAnnouncer creates an announcer for the device with the given UDN,
+// whose description is served at locationPath on the HTTP port
+func NewSSDPAnnouncer(udn, scheme string, port int, locationPath string) *SSDPAnnouncer {
+	return &SSDPAnnouncer{
+		udn:          udn,
+		scheme:       scheme,
+		port:         port,
+		locationPath: locationPath,
+	}
+}
+
+// Run announces the server and answers discovery requests until ctx is
+// cancelled
+func (a *SSDPAnnouncer) Run(ctx context.Context) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		log.Printf("SSDP disabled: %v", err)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Printf("SSDP disabled: %v", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go a.listen(ctx, conn)
+
+	a.notify("ssdp:alive")
+	ticker := time.NewTicker(ssdpNotifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.notify("ssdp:alive")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ByeBye tells control points that the server is going away
+func (a *SSDPAnnouncer) ByeBye() {
+	a.notify("ssdp:byebye")
+}
+
+// listen answers M-SEARCH requests received on the multicast group
+func (a *SSDPAnnouncer) listen(ctx context.Context, conn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("SSDP read error: %v", err)
+			}
+			return
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		if a.allows != nil && !a.allows(remote.IP) {
+			continue
+		}
+		targets := a.matchTargets(req.Header.Get("St"))
+		if len(targets) == 0 {
+			continue
+		}
+
+		// Responses are spread at random over the MX window, which is at
+		// least a second; using only the first second keeps control
+		// points from waiting on slow discovery
+		delay := time.Duration(rand.Int63n(int64(time.Second)))
+		go a.respond(remote, targets, delay)
+	}
+}
+
+// matchTargets returns the advertised targets matching a search target
+func (a *SSDPAnnouncer) matchTargets(st string) []string {
+	var targets []string
+	for _, target := range ssdpTargets {
+		if target == "" {
+			target = a.udn
+		}
+		if st == "ssdp:all" || st == target {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// respond sends unicast search responses from the address the requester
+// can reach us on
+func (a *SSDPAnnouncer) respond(remote *net.UDPAddr, targets []string, delay time.Duration) {
+	time.Sleep(delay)
+
+	conn, err := net.DialUDP("udp4", nil, remote)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+
+	for _, target := range targets {
+		msg := fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+			"CACHE-CONTROL: max-age=%d\r\n"+
+			"DATE: %s\r\n"+
+			"EXT:\r\n"+
+			"LOCATION: %s\r\n"+
+			"SERVER: %s\r\n"+
+			"ST: %s\r\n"+
+			"USN: %s\r\n\r\n",
+			ssdpMaxAge, time.Now().UTC().Format(http.TimeFormat), a.location(local), ssdpServer, target, a.usn(target))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return
+		}
+	}
+}
+
+// notify multicasts a notification of every target on each interface
+func (a *SSDPAnnouncer) notify(nts string) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return
+	}
+
+	for _, ip := range multicastAddrs() {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+		if err != nil {
+			continue
+		}
+		for _, target := range ssdpTargets {
+			if target == "" {
+				target = a.udn
+			}
+			msg := fmt.Sprintf("NOTIFY * HTTP/1.1\r\n"+
+				"HOST: %s\r\n"+
+				"CACHE-CONTROL: max-age=%d\r\n"+
+				"LOCATION: %s\r\n"+
+				"NT: %s\r\n"+
+				"NTS: %s\r\n"+
+				"SERVER: %s\r\n"+
+				"USN: %s\r\n\r\n",
+				ssdpAddress, ssdpMaxAge, a.location(ip), target, nts, ssdpServer, a.usn(target))
+			conn.WriteToUDP([]byte(msg), group)
+		}
+		conn.Close()
+	}
+}
+
+// location returns the device description URL on a local address
+func (a *SSDPAnnouncer) location(ip net.IP) string {
+	return fmt.Sprintf("%s://%s%s", a.scheme, net.JoinHostPort(ip.String(), strconv.Itoa(a.port)), a.locationPath)
+}
+
+// usn returns the unique service name of a notification target
+func (a *SSDPAnnouncer) usn(target string) string {
+	if target == a.udn {
+		return a.udn
+	}
+	return a.udn + "::" + target
+}
+
+// multicastAddrs returns the IPv4 addresses of the interfaces that are up
+// and support multicast
+func multicastAddrs() []net.IP {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+// localNetworks returns the subnets of the interfaces that are up,
+// including loopback
+func localNetworks() []*net.IPNet {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var networks []*net.IPNet
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				networks = append(networks, ipNet)
+			}
+		}
+	}
+	return networks
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSSDPMatchTargets(t *testing.T) {
+	a := NewSSDPAnnouncer("uuid:device", "http", 8080, "/dlna/device.xml")
+
+	tests := []struct {
+		st   string
+		want []string
+	}{
+		{"ssdp:all", []string{"upnp:rootdevice", "uuid:device", dlnaDeviceType, dlnaContentDirectoryType, dlnaConnectionManagerType}},
+		{"upnp:rootdevice", []string{"upnp:rootdevice"}},
+		{"uuid:device", []string{"uuid:device"}},
+		{dlnaContentDirectoryType, []string{dlnaContentDirectoryType}},
+		{"urn:schemas-upnp-org:device:MediaRenderer:1", nil},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		if got := a.matchTargets(tt.st); !equalStrings(got, tt.want) {
+			t.Errorf("matchTargets(%q) = %v, want %v", tt.st, got, tt.want)
+		}
+	}
+}
+
+func TestSSDPNames(t *testing.T) {
+	a := NewSSDPAnnouncer("uuid:device", "http", 8080, "/dlna/device.xml")
+
+	if got, want := a.usn("uuid:device"), "uuid:device"; got != want {
+		t.Errorf("usn() of the device = %q, want %q", got, want)
+	}
+	if got, want := a.usn("upnp:rootdevice"), "uuid:device::upnp:rootdevice"; got != want {
+		t.Errorf("usn() of the root device = %q, want %q", got, want)
+	}
+	if got, want := a.location(net.IPv4(192, 168, 1, 2)), "http://192.168.1.2:8080/dlna/device.xml"; got != want {
+		t.Errorf("location() = %q, want %q", got, want)
+	}
+	if got, want := a.location(net.ParseIP("fe80::1")), "http://[fe80::1]:8080/dlna/device.xml"; got != want {
+		t.Errorf("location() of an IPv6 address = %q, want %q", got, want)
+	}
+}
+
+func TestSSDPListen(t *testing.T) {
+	search := func(man, st string) string {
+		return "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: " + man + "\r\nMX: 1\r\nST: " + st + "\r\n\r\n"
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		allows  func(net.IP) bool
+		want    []string
+	}{
+		{"root device", search(`"ssdp:discover"`, "upnp:rootdevice"), nil, []string{"upnp:rootdevice"}},
+		{"all targets", search(`"ssdp:discover"`, "ssdp:all"), func(ip net.IP) bool { return ip.IsLoopback() }, []string{"upnp:rootdevice", "uuid:device", dlnaDeviceType, dlnaContentDirectoryType, dlnaConnectionManagerType}},
+		{"requester on another network", search(`"ssdp:discover"`, "ssdp:all"), func(net.IP) bool { return false }, nil},
+		{"unknown target", search(`"ssdp:discover"`, "urn:schemas-upnp-org:device:MediaRenderer:1"), nil, nil},
+		{"missing man header", search(`ssdp:discover`, "ssdp:all"), nil, nil},
+		{"notification", "NOTIFY * HTTP/1.1\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\n\r\n", nil, nil},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			a := NewSSDPAnnouncer("uuid:device", "http", 8080, "/dlna/device.xml")
+			a.allows = tt.allows
+
+			server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Skipf("UDP unavailable: %v", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(func() {
+				cancel()
+				server.Close()
+			})
+			go a.listen(ctx, server)
+
+			// Responses come from another port than the search went to, as
+			// they do for searches sent to the multicast group
+			client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.WriteToUDP([]byte(tt.request), server.LocalAddr().(*net.UDPAddr)); err != nil {
+				t.Fatal(err)
+			}
+
+			// Responses come within a second of the request
+			var got []string
+			buf := make([]byte, 2048)
+			client.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+			for len(got) < 5 {
+				n, _, err := client.ReadFromUDP(buf)
+				if err != nil {
+					break
+				}
+				resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+				if err != nil {
+					t.Fatalf("invalid response %q: %v", buf[:n], err)
+				}
+				st := resp.Header.Get("St")
+				if want := "http://127.0.0.1:8080/dlna/device.xml"; resp.Header.Get("Location") != want {
+					t.Errorf("LOCATION = %q, want %q", resp.Header.Get("Location"), want)
+				}
+				if resp.Header.Get("Usn") != a.usn(st) {
+					t.Errorf("USN = %q, want %q", resp.Header.Get("Usn"), a.usn(st))
+				}
+				got = append(got, st)
+			}
+			if !equalStrings(got, tt.want) {
+				t.Errorf("responses = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// deadlineRefreshInterval limits how often a stream's write deadline is
+// pushed forward
+const deadlineRefreshInterval = time.Second
+
+// refreshInterval returns how often the deadlines of a stream are pushed
+// forward. Short idle timeouts refresh at half their length, so that the
+// deadline cannot pass while data is still flowing.
+func refreshInterval(idle time.Duration) time.Duration {
+	return min(deadlineRefreshInterval, idle/2)
+}
+
+// streamWriter replaces the server's fixed write timeout with a deadline
+// that moves forward as data is written, so long downloads and slow
+// clients are only cut off when they stop making progress
+type streamWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	idle     time.Duration
+	extended time.Time
+}
+
+// streamWriter wraps w with a progress-based write deadline. If the
+// stream idle timeout is zero or the deadline cannot be controlled, w is
+// returned unchanged.
+func (s *MediaServer) streamWriter(w http.ResponseWriter) http.ResponseWriter {
+	idle := s.config.Server.Timeouts.StreamIdle
+	if idle <= 0 {
+		return w
+	}
+
+	sw := &streamWriter{
+		ResponseWriter: w,
+		rc:             http.NewResponseController(w),
+		idle:           idle,
+	}
+	if err := sw.extend(time.Now()); err != nil {
+		log.Printf("Unable to set stream write deadline: %v", err)
+		return w
+	}
+	return sw
+}
+
+// Write writes data and pushes the write deadline forward
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if now := time.Now(); now.Sub(sw.extended) >= refreshInterval(sw.idle) {
+		if err := sw.extend(now); err != nil {
+			return 0, err
+		}
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// extend sets the write deadline to idle from now
+func (sw *streamWriter) extend(now time.Time) error {
+	sw.extended = now
+	return sw.rc.SetWriteDeadline(now.Add(sw.idle))
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (sw *streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// streamReader applies the same progress-based deadlines to a request
+// body, so large uploads are only cut off when the client stops sending.
+// The write deadline moves too, since the server's write timeout runs
+// while the body is being read.
+type streamReader struct {
+	io.ReadCloser
+	rc       *http.ResponseController
+	idle     time.Duration
+	extended time.Time
+}
+
+// streamBody replaces r.Body with a reader that pushes the read and write
+// deadlines forward as the body arrives. If the stream idle timeout is
+// zero or the deadlines cannot be controlled, r is left unchanged.
+func (s *MediaServer) streamBody(w http.ResponseWriter, r *http.Request) {
+	idle := s.config.Server.Timeouts.StreamIdle
+	if idle <= 0 {
+		return
+	}
+
+	sr := &streamReader{
+		ReadCloser: r.Body,
+		rc:         http.NewResponseController(w),
+		idle:       idle,
+	}
+	if err := sr.extend(time.Now()); err != nil {
+		log.Printf("Unable to set upload read deadline: %v", err)
+		return
+	}
+	r.Body = sr
+}
+
+// Read reads body data and pushes the deadlines forward
+func (sr *streamReader) Read(p []byte) (int, error) {
+	if now := time.Now(); now.Sub(sr.extended) >= refreshInterval(sr.idle) {
+		if err := sr.extend(now); err != nil {
+			return 0, err
+		}
+	}
+	return sr.ReadCloser.Read(p)
+}
+
+// extend sets the read and write deadlines to idle from now
+func (sr *streamReader) extend(now time.Time) error {
+	sr.extended = now
+	if err := sr.rc.SetReadDeadline(now.Add(sr.idle)); err != nil {
+		return err
+	}
+	return sr.rc.SetWriteDeadline(now.Add(sr.idle))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// streamTestServer starts a server with short read and write timeouts
+// whose handler gets a MediaServer with the given stream idle timeout
+func streamTestServer(t *testing.T, idle time.Duration, handler func(s *MediaServer, w http.ResponseWriter, r *http.Request)) *httptest.Server {
+	t.Helper()
+	s := &MediaServer{config: &Config{Server: ServerConfig{Timeouts: TimeoutConfig{StreamIdle: idle}}}}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(s, w, r)
+	}))
+	ts.Config.ReadTimeout = 100 * time.Millisecond
+	ts.Config.WriteTimeout = 100 * time.Millisecond
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestStreamWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		idle     time.Duration
+		pauses   []time.Duration
+		wantFull bool
+	}{
+		{"steady stream outlasts the write timeout", 200 * time.Millisecond, []time.Duration{60, 60, 60, 60, 60, 60, 60, 60}, true},
+		{"disabled stream idle keeps the write timeout", 0, []time.Duration{60, 60, 60}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunk := bytes.Repeat([]byte("x"), 1024)
+			ts := streamTestServer(t, tt.idle, func(s *MediaServer, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(chunk)*len(tt.pauses)))
+				sw := s.streamWriter(w)
+				rc := http.NewResponseController(sw)
+				for _, pause := range tt.pauses {
+					time.Sleep(pause * time.Millisecond)
+					if _, err := sw.Write(chunk); err != nil {
+						return
+					}
+					if err := rc.Flush(); err != nil {
+						return
+					}
+				}
+			})
+
+			resp, err := http.Get(ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			full := err == nil && len(body) == len(chunk)*len(tt.pauses)
+			if full != tt.wantFull {
+				t.Errorf("received %d of %d bytes (%v), want full body %v", len(body), len(chunk)*len(tt.pauses), err, tt.wantFull)
+			}
+		})
+	}
+}
+
+func TestRefreshInterval(t *testing.T) {
+	tests := []struct {
+		idle time.Duration
+		want time.Duration
+	}{
+		{60 * time.Second, deadlineRefreshInterval},
+		{2 * time.Second, deadlineRefreshInterval},
+		{time.Second, 500 * time.Millisecond},
+		{200 * time.Millisecond, 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		if got := refreshInterval(tt.idle); got != tt.want {
+			t.Errorf("refreshInterval(%v) = %v, want %v", tt.idle, got, tt.want)
+		}
+	}
+}
+
+// slowReader returns one chunk per read, pausing before each
+type slowReader struct {
+	chunks int
+	pause  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.chunks == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.pause)
+	r.chunks--
+	return copy(p, bytes.Repeat([]byte("x"), min(len(p), 512))), nil
+}
+
+func TestStreamBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		idle     time.Duration
+		wantFull bool
+	}{
+		{"slow upload outlasts the read timeout", 200 * time.Millisecond, true},
+		{"disabled stream idle keeps the read timeout", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := streamTestServer(t, tt.idle, func(s *MediaServer, w http.ResponseWriter, r *http.Request) {
+				s.streamBody(w, r)
+				n, err := io.Copy(io.Discard, r.Body)
+				if err != nil {
+					return
+				}
+				io.WriteString(w, strconv.FormatInt(n, 10))
+			})
+
+			body := &slowReader{chunks: 8, pause: 50 * time.Millisecond}
+			resp, err := http.Post(ts.URL, "application/octet-stream", body)
+			full := false
+			if err == nil {
+				got, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				full = string(got) == "4096"
+			}
+			if full != tt.wantFull {
+				t.Errorf("upload received in full = %v (%v), want %v", full, err, tt.wantFull)
+			}
+		})
+	}
+}
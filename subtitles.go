@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const (
+	// maxSubtitleSize bounds the subtitle files converted in memory
+	maxSubtitleSize = 10 << 20
+
+	// maxSubtitleOffset bounds the timing offset, well inside the range
+	// of cue times
+	maxSubtitleOffset = 24 * time.Hour
+
+	// maxCueTime bounds cue timestamps, in seconds, so that they cannot
+	// overflow when converted to a duration and shifted
+	maxCueTime = 1000 * 60 * 60
+)
+
+var (
+	errNoSubtitle       = errors.New("file is not a supported subtitle format")
+	errSubtitleTooLarge = errors.New("subtitle file is too large to convert")
+	errSubtitleOffset   = errors.New("subtitle offset out of range")
+)
+
+// subtitleCharsets are the encodings that may be requested with ?charset=
+var subtitleCharsets = map[string]encoding.Encoding{
+	"utf-8":   encoding.Nop,
+	"utf8":    encoding.Nop,
+	"utf-16":  unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+	"gbk":     simplifiedchinese.GBK,
+	"gb2312":  simplifiedchinese.GBK,
+	"gb18030": simplifiedchinese.GB18030,
+	"big5":    traditionalchinese.Big5,
+}
+
+// commonHanzi are frequent Chinese characters in both simplified and
+// traditional forms. Legacy encodings are told apart by how many of them
+// a decoding produces; decoding with the wrong one yields rare characters.
+const commonHanzi = "的一是不了在人有我他这這个個们們中来來上大为為和国國地到以说說时時要就出会會可也你对對生能而子那得于着著下自之年过過发發后後作里裡用道行所然家种種事成方多经經么麼去法学學如都同现現当當没沒动動面起看定天分还還进進好小部其些主样樣理心她本前开開但因只从從想实實吗嗎呢吧啊"
+
+// cueTiming matches a cue timing line of SubRip or WebVTT. Hours are
+// optional in WebVTT; SubRip separates milliseconds with a comma.
+var cueTiming = regexp.MustCompile(`^\s*((?:\d+:)?\d{1,2}:\d{1,2}[,.]\d{1,3})\s*-->\s*((?:\d+:)?\d{1,2}:\d{1,2}[,.]\d{1,3})(.*)$`)
+
+// subtitleCue is one timed block of subtitle text
+type subtitleCue struct {
+	start time.Duration
+	end   time.Duration
+	text  string
+}
+
+// serveSubtitle serves a subtitle file converted to WebVTT, for
+// ?format=vtt. The optional offset parameter shifts every cue, in seconds
+// or as a duration such as "-1.5s", and charset overrides the detected
+// text encoding.
+func (s *MediaServer) serveSubtitle(w http.ResponseWriter, r *http.Request, fullPath string, info fs.FileInfo) {
+	query := r.URL.Query()
+
+	offset, err := parseSubtitleOffset(query.Get("offset"))
+	if err != nil {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	var charset encoding.Encoding
+	if name := query.Get("charset"); name != "" {
+		var ok bool
+		if charset, ok = subtitleCharsets[strings.ToLower(name)]; !ok {
+			http.Error(w, "Unsupported charset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := s.convertSubtitle(fullPath, info, charset, offset)
+	if err != nil {
+		switch {
+		case errors.Is(err, errNoSubtitle):
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		case errors.Is(err, errSubtitleTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		default:
+			log.Printf("Subtitle conversion failed for %s: %v", fullPath, err)
+			http.Error(w, "Unable to convert subtitles", http.StatusUnprocessableEntity)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(data))
+}
+
+// convertSubtitle reads a SubRip, SubStation Alpha or WebVTT file and
+// returns it as UTF-8 WebVTT. A nil charset detects the encoding.
+func (s *MediaServer) convertSubtitle(fullPath string, info fs.FileInfo, charset encoding.Encoding, offset time.Duration) ([]byte, error) {
+	if info.Size() > maxSubtitleSize {
+		return nil, errSubtitleTooLarge
+	}
+
+	var parse func(string) ([]subtitleCue, error)
+	switch s.types.TypeOf(fullPath, info) {
+	case "application/x-subrip":
+		parse = parseSRT
+	case "text/x-ssa":
+		parse = parseSSA
+	case "text/vtt":
+	default:
+		return nil, errNoSubtitle
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(file, maxSubtitleSize))
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeSubtitleText(raw, charset)
+	if err != nil {
+		return nil, err
+	}
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+
+	if parse == nil {
+		return []byte(shiftVTT(text, offset)), nil
+	}
+	cues, err := parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return writeVTT(cues, offset), nil
+}
+
+// parseSubtitleOffset parses a timing offset given in seconds, such as
+// "2.5", or as a duration, such as "-500ms". Offsets beyond
+// maxSubtitleOffset, including infinite and NaN ones, are refused.
+func parseSubtitleOffset(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if math.IsNaN(seconds) || math.Abs(seconds) > maxSubtitleOffset.Seconds() {
+			return 0, errSubtitleOffset
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	offset, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if offset > maxSubtitleOffset || offset < -maxSubtitleOffset {
+		return 0, errSubtitleOffset
+	}
+	return offset, nil
+}
+
+// decodeSubtitleText converts subtitle bytes to a string. Without an
+// explicit charset, a byte order mark or valid UTF-8 is taken as Unicode;
+// otherwise the text is decoded as GBK or Big5, whichever yields more
+// common Chinese characters.
+func decodeSubtitleText(raw []byte, charset encoding.Encoding) (string, error) {
+	if charset == nil {
+		switch {
+		case bytes.HasPrefix(raw, []byte{0xff, 0xfe}), bytes.HasPrefix(raw, []byte{0xfe, 0xff}):
+			charset = subtitleCharsets["utf-16"]
+		case utf8.Valid(raw):
+			charset = encoding.Nop
+		default:
+			charset = detectLegacyCharset(raw)
+		}
+	}
+
+	decoded, err := charset.NewDecoder().Bytes(raw)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(string(decoded), "\ufeff"), nil
+}
+
+// detectLegacyCharset chooses between the GB18030 and Big5 encodings
+func detectLegacyCharset(raw []byte) encoding.Encoding {
+	best, bestScore := encoding.Encoding(simplifiedchinese.GB18030), -1
+	for _, candidate := range []encoding.Encoding{simplifiedchinese.GB18030, traditionalchinese.Big5} {
+		decoded, err := candidate.NewDecoder().Bytes(raw)
+		if err != nil {
+			continue
+		}
+		score := 0
+		for _, r := range string(decoded) {
+			switch {
+			case r == utf8.RuneError:
+				score -= 10
+			case strings.ContainsRune(commonHanzi, r):
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best
+}
+
+// parseSRT reads SubRip cues. Cue numbers are optional and extra text
+// after the timing, such as SubRip position coordinates, is ignored.
+func parseSRT(text string) ([]subtitleCue, error) {
+	var cues []subtitleCue
+	var cue *subtitleCue
+	var lines []string
+
+	flush := func() {
+		if cue != nil {
+			// Drop the number of the next cue, which follows a blank line
+			if n := len(lines); n > 1 && isDigits(strings.TrimSpace(lines[n-1])) && strings.TrimSpace(lines[n-2]) == "" {
+				lines = lines[:n-1]
+			}
+			// A blank line would end the cue early in WebVTT
+			var text []string
+			for _, line := range lines {
+				if strings.TrimSpace(line) != "" {
+					text = append(text, line)
+				}
+			}
+			cue.text = convertSRTMarkup(strings.Join(text, "\n"))
+			if cue.text != "" {
+				cues = append(cues, *cue)
+			}
+		}
+		cue, lines = nil, nil
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		if m := cueTiming.FindStringSubmatch(line); m != nil {
+			flush()
+			start, err := parseCueTime(m[1])
+			if err != nil {
+				return nil, err
+			}
+			end, err := parseCueTime(m[2])
+			if err != nil {
+				return nil, err
+			}
+			cue = &subtitleCue{start: start, end: end}
+			continue
+		}
+		if cue != nil && (strings.TrimSpace(line) != "" || len(lines) > 0) {
+			lines = append(lines, line)
+		}
+	}
+	flush()
+
+	if len(cues) == 0 {
+		return nil, errors.New("no SubRip cues found")
+	}
+	return cues, nil
+}
+
+// parseCueTime parses a SubRip or WebVTT timestamp
+func parseCueTime(value string) (time.Duration, error) {
+	value = strings.Replace(value, ",", ".", 1)
+	clock, fraction, _ := strings.Cut(value, ".")
+	parts := strings.Split(clock, ":")
+
+	var total time.Duration
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || total > maxCueTime/60 || n > maxCueTime {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+		total = total*60 + time.Duration(n)
+	}
+	if total > maxCueTime {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+	total *= time.Second
+
+	if fraction != "" {
+		ms, err := strconv.Atoi((fraction + "00")[:3])
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+		total += time.Duration(ms) * time.Millisecond
+	}
+	return total, nil
+}
+
+// srtTag matches HTML-like tags and SubStation override blocks in SubRip
+// text
+var srtTag = regexp.MustCompile(`</?([a-zA-Z]+)[^>]*>|\{\\[^}]*\}`)
+
+// convertSRTMarkup keeps the italic, bold and underline tags WebVTT
+// understands and removes other markup such as <font> and {\an8}
+func convertSRTMarkup(text string) string {
+	return escapeVTTText(text, func(tag string) string {
+		m := srtTag.FindStringSubmatch(tag)
+		switch name := strings.ToLower(m[1]); name {
+		case "i", "b", "u":
+			if strings.HasPrefix(tag, "</") {
+				return "</" + name + ">"
+			}
+			return "<" + name + ">"
+		}
+		return ""
+	})
+}
+
+// escapeVTTText escapes the characters WebVTT reserves, passing every
+// markup tag through convert
+func escapeVTTText(text string, convert func(tag string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range srtTag.FindAllStringIndex(text, -1) {
+		b.WriteString(escapeVTT(text[last:loc[0]]))
+		b.WriteString(convert(text[loc[0]:loc[1]]))
+		last = loc[1]
+	}
+	b.WriteString(escapeVTT(text[last:]))
+	return b.String()
+}
+
+// escapeVTT escapes text for a WebVTT cue payload
+func escapeVTT(text string) string {
+	text = strings.ReplaceAll(text, "&", "&amp;")
+	text = strings.ReplaceAll(text, "<", "&lt;")
+	text = strings.ReplaceAll(text, ">", "&gt;")
+	return strings.ReplaceAll(text, "-->", "--&gt;")
+}
+
+// parseSSA reads the Dialogue events of a SubStation Alpha or Advanced
+// SubStation Alpha script. Styles and positioning are dropped; italic,
+// bold and underline overrides are kept.
+func parseSSA(text string) ([]subtitleCue, error) {
+	var cues []subtitleCue
+	inEvents := false
+	fields := []string{"marked", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "format":
+			fields = strings.Split(strings.ToLower(strings.ReplaceAll(value, " ", "")), ",")
+		case "dialogue":
+			// Text is the last field and may itself contain commas
+			values := strings.SplitN(strings.TrimSpace(value), ",", len(fields))
+			if len(values) != len(fields) {
+				continue
+			}
+			var cue subtitleCue
+			var err error
+			for i, field := range fields {
+				switch field {
+				case "start":
+					cue.start, err = parseCueTime(strings.TrimSpace(values[i]))
+				case "end":
+					cue.end, err = parseCueTime(strings.TrimSpace(values[i]))
+				case "text":
+					cue.text = convertSSAText(values[i])
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			if cue.text != "" && cue.end > cue.start {
+				cues = append(cues, cue)
+			}
+		}
+	}
+
+	if len(cues) == 0 {
+		return nil, errors.New("no SubStation Alpha dialogue found")
+	}
+	sort.SliceStable(cues, func(i, j int) bool {
+		return cues[i].start < cues[j].start
+	})
+	return cues, nil
+}
+
+// ssaOverride matches one override tag inside a SubStation override block
+var ssaOverride = regexp.MustCompile(`\\([ibu])([01])\b`)
+
+// convertSSAText converts SubStation dialogue text to a WebVTT payload
+func convertSSAText(text string) string {
+	text = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(text)
+
+	// Drawing commands ({\p1}...{\p0}) are vector shapes, not text
+	if strings.Contains(text, `\p1`) {
+		return ""
+	}
+
+	open := make(map[string]bool)
+	converted := escapeVTTText(text, func(tag string) string {
+		if !strings.HasPrefix(tag, "{") {
+			return escapeVTT(tag)
+		}
+		var b strings.Builder
+		for _, m := range ssaOverride.FindAllStringSubmatch(tag, -1) {
+			name, on := m[1], m[2] == "1"
+			if on && !open[name] {
+				b.WriteString("<" + name + ">")
+			} else if !on && open[name] {
+				b.WriteString("</" + name + ">")
+			}
+			open[name] = on
+		}
+		return b.String()
+	})
+	for _, name := range []string{"u", "b", "i"} {
+		if open[name] {
+			converted += "</" + name + ">"
+		}
+	}
+	return strings.TrimSpace(converted)
+}
+
+// writeVTT formats cues as a WebVTT file, shifting them by offset. Cues
+// shifted before the start of the media are dropped or truncated.
+func writeVTT(cues []subtitleCue, offset time.Duration) []byte {
+	var b bytes.Buffer
+	b.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		start, end := cue.start+offset, cue.end+offset
+		if end <= 0 {
+			continue
+		}
+		start = max(start, 0)
+		fmt.Fprintf(&b, "\n%s --> %s\n%s\n", formatCueTime(start), formatCueTime(end), cue.text)
+	}
+	return b.Bytes()
+}
+
+// shiftVTT shifts the cue timings of a WebVTT file by offset
+func shiftVTT(text string, offset time.Duration) string {
+	if offset == 0 {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		m := cueTiming.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		start, err1 := parseCueTime(m[1])
+		end, err2 := parseCueTime(m[2])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		lines[i] = formatCueTime(max(start+offset, 0)) + " --> " + formatCueTime(max(end+offset, 0)) + m[3]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatCueTime formats a WebVTT timestamp
+func formatCueTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+func TestParseSubtitleOffset(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"2.5", 2500 * time.Millisecond, false},
+		{"-1", -time.Second, false},
+		{"-500ms", -500 * time.Millisecond, false},
+		{"1m30s", 90 * time.Second, false},
+		{"86400", 24 * time.Hour, false},
+		{"86401", 0, true},
+		{"-25h", 0, true},
+		{"1e300", 0, true},
+		{"Inf", 0, true},
+		{"-Inf", 0, true},
+		{"NaN", 0, true},
+		{"soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSubtitleOffset(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSubtitleOffset(%q) = %v, %v, want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCueTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"00:00:01,000", time.Second, false},
+		{"01:02:03.456", time.Hour + 2*time.Minute + 3456*time.Millisecond, false},
+		{"02:03.4", 2*time.Minute + 3400*time.Millisecond, false},
+		{"0:00:01.50", 1500 * time.Millisecond, false},
+		{"1000:00:00.000", 1000 * time.Hour, false},
+		{"1000:00:01.000", 0, true},
+		{"99999999999999999:00:00.000", 0, true},
+		{"00:xx:01.000", 0, true},
+		{"00:00:01.x", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseCueTime(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseCueTime(%q) = %v, %v, want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseSRT(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []subtitleCue
+		wantErr bool
+	}{
+		{
+			name: "numbered cues",
+			text: "1\n00:00:01,000 --> 00:00:02,500\nHello\nworld\n\n2\n00:00:03,000 --> 00:00:04,000\nBye\n",
+			want: []subtitleCue{
+				{time.Second, 2500 * time.Millisecond, "Hello\nworld"},
+				{3 * time.Second, 4 * time.Second, "Bye"},
+			},
+		},
+		{
+			name: "no numbers, coordinates and blank lines in a cue",
+			text: "00:00:01,000 --> 00:00:02,000 X1:10 X2:20\nFirst\n\nstill first\n00:00:03,000 --> 00:00:04,000\nSecond",
+			want: []subtitleCue{
+				{time.Second, 2 * time.Second, "First\nstill first"},
+				{3 * time.Second, 4 * time.Second, "Second"},
+			},
+		},
+		{
+			name: "markup",
+			text: "1\n00:00:01,000 --> 00:00:02,000\n{\\an8}<i>Italic</I> <font color=\"red\">red</font> a < b && c --> d\n",
+			want: []subtitleCue{{time.Second, 2 * time.Second, "<i>Italic</i> red a &lt; b &amp;&amp; c --&gt; d"}},
+		},
+		{
+			name: "empty cue is dropped",
+			text: "1\n00:00:01,000 --> 00:00:02,000\n<font></font>\n\n2\n00:00:03,000 --> 00:00:04,000\nText\n",
+			want: []subtitleCue{{3 * time.Second, 4 * time.Second, "Text"}},
+		},
+		{name: "no cues", text: "just some text\n", wantErr: true},
+		{name: "timestamp out of range", text: "1\n5000:00:00,000 --> 5000:00:01,000\nText\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSRT(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSRT() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSRT() error = %v", err)
+			}
+			if !equalCues(got, tt.want) {
+				t.Errorf("parseSRT() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// equalCues compares two lists of cues
+func equalCues(a, b []subtitleCue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseSSA(t *testing.T) {
+	header := "[Script Info]\nTitle: Test\n\n[V4+ Styles]\nFormat: Name, Fontname\nStyle: Default,Arial\n\n[Events]\n"
+
+	tests := []struct {
+		name    string
+		text    string
+		want    []subtitleCue
+		wantErr bool
+	}{
+		{
+			name: "dialogue sorted by start",
+			text: header + "Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+				"Dialogue: 0,0:00:05.00,0:00:06.00,Default,,0,0,0,,Later, with a comma\n" +
+				"Comment: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,Not shown\n" +
+				"Dialogue: 0,0:00:01.00,0:00:02.50,Default,,0,0,0,,{\\i1}First{\\i0}\\Nline\n",
+			want: []subtitleCue{
+				{time.Second, 2500 * time.Millisecond, "<i>First</i>\nline"},
+				{5 * time.Second, 6 * time.Second, "Later, with a comma"},
+			},
+		},
+		{
+			name: "default field order",
+			text: "[Events]\nDialogue: Marked=0,0:00:01.00,0:00:02.00,Default,,0000,0000,0000,,Old style\n",
+			want: []subtitleCue{{time.Second, 2 * time.Second, "Old style"}},
+		},
+		{
+			name: "drawings, empty and reversed dialogue are dropped",
+			text: header + "Format: Start, End, Text\n" +
+				"Dialogue: 0:00:01.00,0:00:02.00,{\\p1}m 0 0 l 100 0{\\p0}\n" +
+				"Dialogue: 0:00:03.00,0:00:04.00,{\\an8}\n" +
+				"Dialogue: 0:00:06.00,0:00:05.00,Reversed\n" +
+				"Dialogue: 0:00:07.00,0:00:08.00,Kept\n",
+			want: []subtitleCue{{7 * time.Second, 8 * time.Second, "Kept"}},
+		},
+		{name: "no events section", text: "[Script Info]\nDialogue: 0:00:01.00,0:00:02.00,Text\n", wantErr: true},
+		{name: "invalid time", text: header + "Format: Start, End, Text\nDialogue: soon,0:00:02.00,Text\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSSA(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSSA() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSSA() error = %v", err)
+			}
+			if !equalCues(got, tt.want) {
+				t.Errorf("parseSSA() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertSSAText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`{\b1}bold{\b0} plain`, "<b>bold</b> plain"},
+		{`{\i1\u1}both`, "<i><u>both</u></i>"},
+		{`{\i0}not open{\i1}{\i1}once`, "not open<i>once</i>"},
+		{`{\pos(10,20)\fs20}styled`, "styled"},
+		{`hard\hspace<b>&`, "hard space&lt;b&gt;&amp;"},
+		{`{\p1}m 0 0 l 1 1`, ""},
+	}
+
+	for _, tt := range tests {
+		if got := convertSSAText(tt.text); got != tt.want {
+			t.Errorf("convertSSAText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeSubtitleText(t *testing.T) {
+	encode := func(e encoding.Encoding, text string) []byte {
+		t.Helper()
+		b, err := e.NewEncoder().Bytes([]byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	simplified := "我们的时间到了，你好世界"
+	traditional := "我們的時間到了，這個會說"
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		charset encoding.Encoding
+		want    string
+	}{
+		{"utf-8", []byte("plain"), nil, "plain"},
+		{"utf-8 with bom", []byte("\ufeff中文"), nil, "中文"},
+		{"utf-16 little endian", []byte{0xff, 0xfe, 'h', 0, 'i', 0}, nil, "hi"},
+		{"utf-16 big endian", []byte{0xfe, 0xff, 0, 'h', 0, 'i'}, nil, "hi"},
+		{"gbk", encode(simplifiedchinese.GBK, simplified), nil, simplified},
+		{"big5", encode(traditionalchinese.Big5, traditional), nil, traditional},
+		{"explicit charset", encode(traditionalchinese.Big5, traditional), subtitleCharsets["big5"], traditional},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSubtitleText(tt.raw, tt.charset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("decodeSubtitleText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteVTT(t *testing.T) {
+	cues := []subtitleCue{
+		{time.Second, 2 * time.Second, "first"},
+		{3 * time.Second, 5 * time.Second, "second"},
+		{time.Hour + 500*time.Millisecond, time.Hour + time.Second, "third"},
+	}
+
+	tests := []struct {
+		name   string
+		offset time.Duration
+		want   string
+	}{
+		{"no offset", 0, "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nfirst\n\n00:00:03.000 --> 00:00:05.000\nsecond\n\n01:00:00.500 --> 01:00:01.000\nthird\n"},
+		{"later", 1500 * time.Millisecond, "WEBVTT\n\n00:00:02.500 --> 00:00:03.500\nfirst\n\n00:00:04.500 --> 00:00:06.500\nsecond\n\n01:00:02.000 --> 01:00:02.500\nthird\n"},
+		{"earlier drops and truncates cues", -4 * time.Second, "WEBVTT\n\n00:00:00.000 --> 00:00:01.000\nsecond\n\n00:59:56.500 --> 00:59:57.000\nthird\n"},
+	}
+
+	for _, tt := range tests {
+		if got := string(writeVTT(cues, tt.offset)); got != tt.want {
+			t.Errorf("%s: writeVTT() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShiftVTT(t *testing.T) {
+	text := "WEBVTT\n\nintro\n00:01.000 --> 00:02.000 align:start\nHello\n\n00:00:03.000 --> 00:00:04.000\nBye\n"
+
+	tests := []struct {
+		offset time.Duration
+		want   string
+	}{
+		{0, text},
+		{time.Second, "WEBVTT\n\nintro\n00:00:02.000 --> 00:00:03.000 align:start\nHello\n\n00:00:04.000 --> 00:00:05.000\nBye\n"},
+		{-1500 * time.Millisecond, "WEBVTT\n\nintro\n00:00:00.000 --> 00:00:00.500 align:start\nHello\n\n00:00:01.500 --> 00:00:02.500\nBye\n"},
+	}
+
+	for _, tt := range tests {
+		if got := shiftVTT(text, tt.offset); got != tt.want {
+			t.Errorf("shiftVTT(%v) = %q, want %q", tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestServeSubtitle(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"movie.srt":  "1\r\n00:00:01,000 --> 00:00:02,000\r\nHello\r\n",
+		"movie.ass":  "[Events]\nFormat: Start, End, Text\nDialogue: 0:00:01.00,0:00:02.00,Hi\n",
+		"movie.vtt":  "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHey\n",
+		"broken.srt": "no cues here",
+		"movie.mp4":  "\x00\x00\x00\x18ftypisom",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	large, err := os.Create(filepath.Join(dir, "large.srt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := large.Truncate(maxSubtitleSize + 1); err != nil {
+		t.Fatal(err)
+	}
+	large.Close()
+	s := &MediaServer{config: &Config{}, types: NewMediaTypes(defaultMediaTypes(), nil)}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"movie.srt", "format=vtt", http.StatusOK, "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n"},
+		{"movie.srt", "format=vtt&offset=2", http.StatusOK, "WEBVTT\n\n00:00:03.000 --> 00:00:04.000\nHello\n"},
+		{"movie.ass", "format=vtt&offset=-500ms", http.StatusOK, "WEBVTT\n\n00:00:00.500 --> 00:00:01.500\nHi\n"},
+		{"movie.vtt", "format=vtt&offset=1&charset=UTF-8", http.StatusOK, "WEBVTT\n\n00:00:02.000 --> 00:00:03.000\nHey\n"},
+		{"movie.srt", "format=vtt&offset=Inf", http.StatusBadRequest, ""},
+		{"movie.srt", "format=vtt&charset=ebcdic", http.StatusBadRequest, ""},
+		{"movie.mp4", "format=vtt", http.StatusUnsupportedMediaType, ""},
+		{"broken.srt", "format=vtt", http.StatusUnprocessableEntity, ""},
+		{"large.srt", "format=vtt", http.StatusRequestEntityTooLarge, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"?"+tt.query, func(t *testing.T) {
+			fullPath := filepath.Join(dir, tt.name)
+			info, err := os.Stat(fullPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			s.serveFile(w, httptest.NewRequest("GET", "/"+tt.name+"?"+tt.query, nil), fullPath, info)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != "text/vtt; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want text/vtt; charset=utf-8", got)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "movie.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.convertSubtitle(filepath.Join(dir, "movie.mp4"), info, nil, 0); !errors.Is(err, errNoSubtitle) {
+		t.Errorf("convertSubtitle() of a video error = %v, want %v", err, errNoSubtitle)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// Register image decoders
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// thumbnailStep rounds requested widths so the cache holds a bounded
+	// number of sizes per image
+	thumbnailStep = 32
+
+	// maxThumbnailPixels guards against decoding huge images
+	maxThumbnailPixels = 64 * 1000 * 1000
+
+	// thumbnailCleanupInterval is how often the cache is pruned to size
+	thumbnailCleanupInterval = time.Hour
+
+	// thumbnailTouchInterval is how stale a cached thumbnail's modification
+	// time may get before a hit refreshes it, to limit writes
+	thumbnailTouchInterval = time.Hour
+)
+
+// thumbnailExtensions lists the image formats thumbnails can be made from
+var thumbnailExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+var errNoThumbnail = errors.New("thumbnails are not supported for this file type")
+
+// Thumbnailer generates resized JPEG thumbnails and caches them on disk.
+// A cached thumbnail's modification time records when it was last used,
+// and the least recently used ones are removed once the cache exceeds
+// maxSize bytes.
+type Thumbnailer struct {
+	cacheDir string
+	maxSize  int64
+	quality  int
+
+	// sem limits concurrent decodes, which are CPU and memory heavy
+	sem chan struct{}
+
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+// NewThumbnailer creates a thumbnailer that caches up to maxSize bytes
+// under cacheDir
+func NewThumbnailer(cacheDir string, maxSize int64, quality int) (*Thumbnailer, error) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create thumbnail cache directory: %w", err)
+	}
+
+	return &Thumbnailer{
+		cacheDir: cacheDir,
+		maxSize:  maxSize,
+		quality:  quality,
+		sem:      make(chan struct{}, runtime.NumCPU()),
+		inflight: make(map[string]chan struct{}),
+	}, nil
+}
+
+// Thumbnail returns the path of a cached thumbnail of the given width for
+// the source image, generating it if needed. The cache key includes the
+// source modification time and size, so edited images get new thumbnails.
+func (t *Thumbnailer) Thumbnail(sourcePath, urlPath string, info fs.FileInfo, width int) (string, error) {
+	if !thumbnailExtensions[strings.ToLower(filepath.Ext(sourcePath))] {
+		return "", errNoThumbnail
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%d",
+		urlPath, info.ModTime().UnixNano(), info.Size(), width)))
+	key := hex.EncodeToString(sum[:])
+	cachePath := filepath.Join(t.cacheDir, key[:2], key+".jpg")
+
+	if cached, err := os.Stat(cachePath); err == nil {
+		if now := time.Now(); now.Sub(cached.ModTime()) > thumbnailTouchInterval {
+			os.Chtimes(cachePath, now, now)
+		}
+		return cachePath, nil
+	}
+
+	// Only generate each thumbnail once when requested concurrently
+	t.mu.Lock()
+	if done, ok := t.inflight[key]; ok {
+		t.mu.Unlock()
+		<-done
+		if _, err := os.Stat(cachePath); err == nil {
+			return cachePath, nil
+		}
+		t.mu.Lock()
+	}
+	done := make(chan struct{})
+	t.inflight[key] = done
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.inflight, key)
+		t.mu.Unlock()
+		close(done)
+	}()
+
+	t.sem <- struct{}{}
+	data, err := t.generate(sourcePath, width)
+	<-t.sem
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(cachePath, data, 0644); err != nil {
+		return "", err
+	}
+	return cachePath, nil
+}
+
+// Run prunes the cache periodically until ctx is cancelled
+func (t *Thumbnailer) Run(ctx context.Context) {
+	ticker := time.NewTicker(thumbnailCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		t.prune()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// prune removes the least recently used thumbnails until the cache fits
+// in its maximum size
+func (t *Thumbnailer) prune() {
+	type cachedThumbnail struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var thumbnails []cachedThumbnail
+	var total int64
+	filepath.WalkDir(t.cacheDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(d.Name(), ".jpg") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			thumbnails = append(thumbnails, cachedThumbnail{p, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	if total <= t.maxSize {
+		return
+	}
+
+	sort.Slice(thumbnails, func(i, j int) bool {
+		return thumbnails[i].modTime.Before(thumbnails[j].modTime)
+	})
+	removed := 0
+	for _, thumb := range thumbnails {
+		if total <= t.maxSize {
+			break
+		}
+		if err := os.Remove(thumb.path); err == nil {
+			total -= thumb.size
+			removed++
+		}
+	}
+	log.Printf("Removed %d least recently used thumbnail(s) from the cache", removed)
+}
+
+// generate decodes the source image and encodes a JPEG at most width
+// pixels wide, preserving the aspect ratio
+func (t *Thumbnailer) generate(sourcePath string, width int) ([]byte, error) {
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, fmt.Errorf("image too large for thumbnail: %dx%d", config.Width, config.Height)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := src.Bounds()
+	if bounds.Dx() < width {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	// Flatten transparency onto white since JPEG has no alpha channel
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: t.quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handleThumbnail serves /thumb/<path>?w=<width>
+func (s *MediaServer) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if s.thumbnails == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cleanPath, fullPath, err := s.resolvePath(r, strings.TrimPrefix(r.URL.Path, "/thumb"))
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	width := s.config.Thumbnails.DefaultWidth
+	if value := r.URL.Query().Get("w"); value != "" {
+		width, err = strconv.Atoi(value)
+		if err != nil || width < 1 {
+			http.Error(w, "Invalid width", http.StatusBadRequest)
+			return
+		}
+	}
+	width = roundThumbnailWidth(width, s.config.Thumbnails.MaxWidth)
+
+	thumbPath, err := s.thumbnails.Thumbnail(fullPath, cleanPath, info, width)
+	if err != nil {
+		if errors.Is(err, errNoThumbnail) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		log.Printf("Thumbnail generation failed for %s: %v", fullPath, err)
+		http.Error(w, "Unable to generate thumbnail", http.StatusUnprocessableEntity)
+		return
+	}
+
+	thumb, err := os.Open(thumbPath)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer thumb.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", s.cacheControl(24*time.Hour))
+	http.ServeContent(w, r, "", info.ModTime(), thumb)
+}
+
+// roundThumbnailWidth rounds a requested width up to the cache step and
+// clamps it to the configured maximum. Clamping first keeps huge widths
+// from overflowing while rounding.
+func roundThumbnailWidth(width, maxWidth int) int {
+	width = min(width, maxWidth)
+	width = (width + thumbnailStep - 1) / thumbnailStep * thumbnailStep
+	return min(width, maxWidth)
+}
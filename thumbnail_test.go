@@ -0,0 +1,140 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoundThumbnailWidth(t *testing.T) {
+	tests := []struct {
+		width, maxWidth, want int
+	}{
+		{1, 1024, 32},
+		{32, 1024, 32},
+		{33, 1024, 64},
+		{1000, 1024, 1024},
+		{1024, 1024, 1024},
+		{5000, 1024, 1024},
+		{100, 90, 90},
+		{1<<63 - 1, 1024, 1024},
+		{1<<63 - 1, 1000, 1000},
+	}
+
+	for _, tt := range tests {
+		if got := roundThumbnailWidth(tt.width, tt.maxWidth); got != tt.want {
+			t.Errorf("roundThumbnailWidth(%d, %d) = %d, want %d", tt.width, tt.maxWidth, got, tt.want)
+		}
+	}
+}
+
+func TestHandleThumbnail(t *testing.T) {
+	dir := t.TempDir()
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for x := 0; x < 200; x++ {
+		src.Set(x, x/2, color.Black)
+	}
+	file, err := os.Create(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, src); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	thumbnails, err := NewThumbnailer(t.TempDir(), 1<<20, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{}
+	config.Thumbnails.DefaultWidth = 64
+	config.Thumbnails.MaxWidth = 1024
+	s := &MediaServer{
+		config:     config,
+		library:    NewLibrary(MediaConfig{Directory: dir}),
+		types:      NewMediaTypes(nil, nil),
+		thumbnails: thumbnails,
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantWidth  int
+	}{
+		{"default width", "/thumb/a.png", http.StatusOK, 64},
+		{"requested width", "/thumb/a.png?w=100", http.StatusOK, 128},
+		{"not upscaled", "/thumb/a.png?w=1000", http.StatusOK, 200},
+		{"huge width", "/thumb/a.png?w=9223372036854775807", http.StatusOK, 200},
+		{"width out of range", "/thumb/a.png?w=99999999999999999999", http.StatusBadRequest, 0},
+		{"zero width", "/thumb/a.png?w=0", http.StatusBadRequest, 0},
+		{"negative width", "/thumb/a.png?w=-5", http.StatusBadRequest, 0},
+		{"not an image", "/thumb/a.txt", http.StatusUnsupportedMediaType, 0},
+		{"missing", "/thumb/b.png", http.StatusNotFound, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleThumbnail(w, httptest.NewRequest("GET", tt.url, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			thumb, err := jpeg.DecodeConfig(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if thumb.Width != tt.wantWidth || thumb.Height != tt.wantWidth/2 {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", thumb.Width, thumb.Height, tt.wantWidth, tt.wantWidth/2)
+			}
+		})
+	}
+}
+
+func TestThumbnailerPrune(t *testing.T) {
+	cacheDir := t.TempDir()
+	thumbnails, err := NewThumbnailer(cacheDir, 25, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ten bytes each, used from oldest to newest
+	now := time.Now()
+	names := []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"}
+	for i, name := range names {
+		p := filepath.Join(cacheDir, "00", name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, make([]byte, 10), 0644); err != nil {
+			t.Fatal(err)
+		}
+		used := now.Add(time.Duration(i-len(names)) * time.Hour)
+		if err := os.Chtimes(p, used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	thumbnails.prune()
+
+	for i, name := range names {
+		_, err := os.Stat(filepath.Join(cacheDir, "00", name))
+		if kept := err == nil; kept != (i >= 2) {
+			t.Errorf("%s kept = %v, want %v", name, kept, i >= 2)
+		}
+	}
+}
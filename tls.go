@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// selfSignedValidity is how long generated certificates remain valid
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// CertReloader serves the certificate from disk and reloads it whenever
+// the certificate or key file changes
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertReloader loads the initial certificate
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// load reads the key pair from disk and swaps it in
+func (cr *CertReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// Watch reloads the certificate when its files change until the context
+// is cancelled. The containing directories are watched so that files
+// replaced by rename, as certificate tools do, are picked up.
+func (cr *CertReloader) Watch(ctx context.Context) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("TLS: certificate hot reload unavailable: %v", err)
+		return
+	}
+	defer fsw.Close()
+
+	files := map[string]bool{}
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			continue
+		}
+		files[abs] = true
+		if err := fsw.Add(filepath.Dir(abs)); err != nil {
+			log.Printf("TLS: failed to watch %s: %v", filepath.Dir(abs), err)
+		}
+	}
+
+	// Certificate and key are usually written in quick succession, so
+	// wait for writes to settle before reloading
+	timer := time.NewTimer(time.Second)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return
+			}
+			if files[event.Name] {
+				timer.Reset(time.Second)
+			}
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("TLS: watcher error: %v", err)
+		case <-timer.C:
+			if err := cr.load(); err != nil {
+				log.Printf("TLS: keeping previous certificate: %v", err)
+				continue
+			}
+			log.Printf("TLS certificate reloaded from %s", cr.certFile)
+		}
+	}
+}
+
+// ensureCertificate generates a self-signed certificate if the configured
+// files are missing, or if a previously generated one has expired
+func ensureCertificate(config *Config) error {
+	tlsConfig := config.Server.TLS
+
+	_, certErr := os.Stat(tlsConfig.CertFile)
+	_, keyErr := os.Stat(tlsConfig.KeyFile)
+	if certErr == nil && keyErr == nil {
+		if !tlsConfig.SelfSigned || !certificateExpired(tlsConfig.CertFile) {
+			return nil
+		}
+		log.Printf("Self-signed certificate has expired, regenerating")
+	} else if !tlsConfig.SelfSigned {
+		return fmt.Errorf("TLS certificate or key not found (%s, %s) and self_signed is disabled",
+			tlsConfig.CertFile, tlsConfig.KeyFile)
+	}
+
+	hosts := append([]string{"localhost", "127.0.0.1", "::1"}, tlsConfig.Hosts...)
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	if host := config.Server.Host; host != "0.0.0.0" && host != "::" {
+		hosts = append(hosts, host)
+	}
+
+	if err := generateSelfSignedCert(tlsConfig.CertFile, tlsConfig.KeyFile, hosts); err != nil {
+		return fmt.Errorf("failed to generate self-signed certificate: %w", err)
+	}
+	log.Printf("Generated self-signed certificate: %s", tlsConfig.CertFile)
+	return nil
+}
+
+// certificateExpired reports whether the certificate in certFile is past
+// its expiry date
+func certificateExpired(certFile string) bool {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	return time.Now().After(cert.NotAfter)
+}
+
+// generateSelfSignedCert writes a new ECDSA certificate and key valid for
+// the given host names and IP addresses
+func generateSelfSignedCert(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"HTTP Media Server"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	seen := make(map[string]bool)
+	for _, host := range hosts {
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// redirectHandler redirects plain HTTP requests to the HTTPS listener
+func (s *MediaServer) redirectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// The host has no port, but an IPv6 address keeps its brackets
+			host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+		}
+
+		// The default HTTPS port is left out of the URL
+		authority := net.JoinHostPort(host, strconv.Itoa(s.config.Server.Port))
+		if s.config.Server.Port == 443 {
+			authority = strings.TrimSuffix(authority, ":443")
+		}
+		http.Redirect(w, r, "https://"+authority+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
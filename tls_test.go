@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readTestCertificate parses the PEM certificate in certFile
+func readTestCertificate(t *testing.T, certFile string) *x509.Certificate {
+	t.Helper()
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("%s holds no PEM block", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeExpiredCertificate writes a self-signed certificate that expired
+// an hour ago
+func writeExpiredCertificate(t *testing.T, certFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-48 * time.Hour),
+		NotAfter:     time.Now().Add(-time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnsureCertificate(t *testing.T) {
+	tests := []struct {
+		name       string
+		selfSigned bool
+		setup      func(t *testing.T, certFile, keyFile string)
+		wantErr    bool
+		wantNew    bool
+	}{
+		{
+			name:       "missing files are generated",
+			selfSigned: true,
+			setup:      func(t *testing.T, certFile, keyFile string) {},
+			wantNew:    true,
+		},
+		{
+			name:       "missing files without self signing",
+			selfSigned: false,
+			setup:      func(t *testing.T, certFile, keyFile string) {},
+			wantErr:    true,
+		},
+		{
+			name:       "existing files are kept",
+			selfSigned: true,
+			setup: func(t *testing.T, certFile, keyFile string) {
+				writeTestFiles(t, filepath.Dir(certFile), "cert.pem", "key.pem")
+			},
+		},
+		{
+			name:       "expired self-signed certificate is replaced",
+			selfSigned: true,
+			setup: func(t *testing.T, certFile, keyFile string) {
+				writeExpiredCertificate(t, certFile)
+				writeTestFiles(t, filepath.Dir(keyFile), "key.pem")
+			},
+			wantNew: true,
+		},
+		{
+			name:       "expired configured certificate is kept",
+			selfSigned: false,
+			setup: func(t *testing.T, certFile, keyFile string) {
+				writeExpiredCertificate(t, certFile)
+				writeTestFiles(t, filepath.Dir(keyFile), "key.pem")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "tls")
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+			tt.setup(t, certFile, keyFile)
+			before, _ := os.ReadFile(certFile)
+
+			config := &Config{Server: ServerConfig{Host: "media.example", TLS: TLSConfig{
+				SelfSigned: tt.selfSigned,
+				CertFile:   certFile,
+				KeyFile:    keyFile,
+				Hosts:      []string{"192.168.1.10", "nas.local"},
+			}}}
+			err := ensureCertificate(config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ensureCertificate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			after, _ := os.ReadFile(certFile)
+			if changed := string(before) != string(after); changed != tt.wantNew {
+				t.Fatalf("certificate replaced = %v, want %v", changed, tt.wantNew)
+			}
+			if !tt.wantNew {
+				return
+			}
+
+			if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+				t.Fatalf("generated key pair does not load: %v", err)
+			}
+			cert := readTestCertificate(t, certFile)
+			for _, host := range []string{"localhost", "127.0.0.1", "::1", "192.168.1.10", "nas.local", "media.example"} {
+				if err := cert.VerifyHostname(host); err != nil {
+					t.Errorf("certificate is not valid for %s: %v", host, err)
+				}
+			}
+			if certificateExpired(certFile) {
+				t.Error("generated certificate has expired")
+			}
+			if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("key file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+			}
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := NewCertReloader(certFile, keyFile); err == nil {
+		t.Fatal("NewCertReloader() of missing files succeeded")
+	}
+
+	if err := generateSelfSignedCert(certFile, keyFile, []string{"first.example"}); err != nil {
+		t.Fatal(err)
+	}
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, err := cr.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if got := commonName(); got != "first.example" {
+		t.Fatalf("certificate for %q, want first.example", got)
+	}
+
+	if err := generateSelfSignedCert(certFile, keyFile, []string{"second.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(); got != "second.example" {
+		t.Fatalf("reloaded certificate for %q, want second.example", got)
+	}
+
+	// A broken key pair keeps the previous certificate
+	if err := os.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.load(); err == nil {
+		t.Fatal("load() of a broken key succeeded")
+	}
+	if got := commonName(); got != "second.example" {
+		t.Errorf("certificate for %q after a failed reload, want second.example", got)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		port   int
+		host   string
+		target string
+		want   string
+	}{
+		{"host with port", 8443, "media.example:8080", "/movies/a.mp4?t=1", "https://media.example:8443/movies/a.mp4?t=1"},
+		{"host without port", 8443, "media.example", "/", "https://media.example:8443/"},
+		{"default https port", 443, "media.example:80", "/a%20b", "https://media.example/a%20b"},
+		{"ipv6 with port", 8443, "[::1]:8080", "/", "https://[::1]:8443/"},
+		{"ipv6 without port", 443, "[fe80::1]", "/x", "https://[fe80::1]/x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &MediaServer{config: &Config{Server: ServerConfig{Port: tt.port}}}
+			r := httptest.NewRequest("GET", tt.target, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			s.redirectHandler().ServeHTTP(w, r)
+
+			if w.Code != http.StatusMovedPermanently {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusMovedPermanently)
+			}
+			if got := w.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
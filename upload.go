@@ -0,0 +1,753 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// tusVersion is the tus resumable upload protocol version implemented
+	tusVersion = "1.0.0"
+
+	// tusExtensions are the tus protocol extensions supported
+	tusExtensions = "creation,termination,expiration"
+
+	// uploadCleanupInterval is how often expired uploads are removed
+	uploadCleanupInterval = time.Hour
+)
+
+// Upload errors
+var (
+	errUploadNotFound = errors.New("upload not found")
+	errUploadLocked   = errors.New("upload is already being written")
+	errUploadOffset   = errors.New("upload offset does not match")
+	errUploadConflict = errors.New("another upload is writing this file")
+	errQuotaExceeded  = errors.New("upload quota exceeded")
+)
+
+// UploadRecord describes a resumable upload. Incomplete uploads are kept
+// in the staging directory until they finish or expire; completed uploads
+// are remembered to account for the user's quota.
+type UploadRecord struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	User      string    `json:"user,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// uploadStoreFile is the on-disk form of the upload store
+type uploadStoreFile struct {
+	Uploads   []*UploadRecord `json:"uploads"`
+	Completed []*UploadRecord `json:"completed"`
+}
+
+// UploadStore tracks resumable uploads, persisting them as a JSON file in
+// the data directory. The bytes of each incomplete upload are appended to
+// a file in the staging directory, whose size is the upload offset.
+type UploadStore struct {
+	file    string
+	staging string
+
+	mu        sync.Mutex
+	uploads   map[string]*UploadRecord
+	completed []*UploadRecord
+	busy      map[string]bool
+}
+
+// NewUploadStore loads the upload store from the data directory
+func NewUploadStore(dataDir, stagingDir string) (*UploadStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.MkdirAll(stagingDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create upload staging directory: %w", err)
+	}
+
+	store := &UploadStore{
+		file:    filepath.Join(dataDir, "uploads.json"),
+		staging: stagingDir,
+		uploads: make(map[string]*UploadRecord),
+		busy:    make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(store.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("failed to read upload store: %w", err)
+	}
+
+	var saved uploadStoreFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse upload store: %w", err)
+	}
+	for _, record := range saved.Uploads {
+		// The staging file holds every byte received before the restart
+		info, err := os.Stat(store.stagingPath(record.ID))
+		if err != nil {
+			continue
+		}
+		record.Offset = min(info.Size(), record.Size)
+		store.uploads[record.ID] = record
+	}
+	store.completed = saved.Completed
+
+	return store, nil
+}
+
+// Create starts an upload of size bytes to a media path. The user's usage,
+// counting completed uploads that present reports as still in place and
+// the full size of incomplete ones, must stay within quota unless quota
+// is zero.
+func (st *UploadStore) Create(user, urlPath string, size, quota int64, expiry time.Duration, present func(UploadRecord) bool) (UploadRecord, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return UploadRecord{}, err
+	}
+
+	now := time.Now()
+	record := &UploadRecord{
+		ID:        hex.EncodeToString(id),
+		Path:      urlPath,
+		Size:      size,
+		User:      user,
+		CreatedAt: now,
+		ExpiresAt: now.Add(expiry).Truncate(time.Second),
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, upload := range st.uploads {
+		if upload.Path == urlPath {
+			return UploadRecord{}, errUploadConflict
+		}
+	}
+	// Compare against the space left rather than adding, which could
+	// overflow for huge sizes
+	if quota > 0 && (size > quota || size > quota-st.usageLocked(user, present)) {
+		return UploadRecord{}, errQuotaExceeded
+	}
+
+	file, err := os.OpenFile(st.stagingPath(record.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return UploadRecord{}, err
+	}
+	file.Close()
+
+	st.uploads[record.ID] = record
+	if err := st.saveLocked(); err != nil {
+		os.Remove(st.stagingPath(record.ID))
+		delete(st.uploads, record.ID)
+		return UploadRecord{}, err
+	}
+	return *record, nil
+}
+
+// Get returns a user's incomplete upload
+func (st *UploadStore) Get(user, id string) (UploadRecord, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	record, ok := st.uploads[id]
+	if !ok || record.User != user {
+		return UploadRecord{}, errUploadNotFound
+	}
+	return *record, nil
+}
+
+// List returns a user's incomplete uploads, oldest first
+func (st *UploadStore) List(user string) []UploadRecord {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	records := []UploadRecord{}
+	for _, record := range st.uploads {
+		if record.User == user {
+			records = append(records, *record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	return records
+}
+
+// Usage returns the bytes counted against a user's quota
+func (st *UploadStore) Usage(user string, present func(UploadRecord) bool) int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.usageLocked(user, present)
+}
+
+// usageLocked sums a user's incomplete uploads and the completed uploads
+// that are still in place, forgetting those that are gone. The caller
+// must hold the lock.
+func (st *UploadStore) usageLocked(user string, present func(UploadRecord) bool) int64 {
+	var used int64
+	for _, record := range st.uploads {
+		if record.User == user {
+			used += record.Size
+		}
+	}
+
+	kept := st.completed[:0]
+	for _, record := range st.completed {
+		if record.User == user {
+			if !present(*record) {
+				continue
+			}
+			used += record.Size
+		}
+		kept = append(kept, record)
+	}
+	st.completed = kept
+	return used
+}
+
+// Write appends body to an upload at offset, which must match the bytes
+// already received. Bytes beyond the upload size are not read. The
+// returned record carries the new offset, which advances by whatever was
+// written even if reading the body failed. Receiving data moves the
+// upload's expiry to expiry from now, so active uploads are not removed.
+func (st *UploadStore) Write(user, id string, offset int64, body io.Reader, expiry time.Duration) (UploadRecord, error) {
+	st.mu.Lock()
+	record, ok := st.uploads[id]
+	switch {
+	case !ok || record.User != user:
+		st.mu.Unlock()
+		return UploadRecord{}, errUploadNotFound
+	case st.busy[id]:
+		st.mu.Unlock()
+		return UploadRecord{}, errUploadLocked
+	case offset != record.Offset:
+		current := *record
+		st.mu.Unlock()
+		return current, errUploadOffset
+	}
+	st.busy[id] = true
+	remaining := record.Size - record.Offset
+	st.mu.Unlock()
+
+	written, err := appendUpload(st.stagingPath(id), body, remaining)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.busy, id)
+	record.Offset += written
+	if written > 0 {
+		record.ExpiresAt = time.Now().Add(expiry).Truncate(time.Second)
+		if saveErr := st.saveLocked(); saveErr != nil {
+			log.Printf("Failed to save upload store: %v", saveErr)
+		}
+	}
+	return *record, err
+}
+
+// appendUpload appends up to limit bytes of body to a staging file,
+// syncing it to disk once it is complete
+func appendUpload(stagingPath string, body io.Reader, limit int64) (int64, error) {
+	file, err := os.OpenFile(stagingPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(file, io.LimitReader(body, limit))
+	if err == nil && written == limit {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+// Complete moves a finished upload from the staging directory to its
+// destination and records it against the user's quota. The destination
+// must not exist.
+func (st *UploadStore) Complete(id, destination string) error {
+	st.mu.Lock()
+	record, ok := st.uploads[id]
+	switch {
+	case !ok:
+		st.mu.Unlock()
+		return errUploadNotFound
+	case st.busy[id]:
+		st.mu.Unlock()
+		return errUploadLocked
+	case record.Offset != record.Size:
+		st.mu.Unlock()
+		return errUploadOffset
+	}
+	st.busy[id] = true
+	st.mu.Unlock()
+
+	// Moving may copy across filesystems, so it runs without the lock
+	var err error
+	if _, statErr := os.Lstat(destination); statErr == nil {
+		err = os.ErrExist
+	} else {
+		err = moveFile(st.stagingPath(id), destination)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.busy, id)
+	if err != nil {
+		return err
+	}
+
+	delete(st.uploads, id)
+	record.ExpiresAt = time.Time{}
+	st.completed = append(st.completed, record)
+	return st.saveLocked()
+}
+
+// Remove cancels an incomplete upload and deletes its staged bytes
+func (st *UploadStore) Remove(user, id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	record, ok := st.uploads[id]
+	if !ok || record.User != user {
+		return errUploadNotFound
+	}
+	if st.busy[id] {
+		return errUploadLocked
+	}
+	delete(st.uploads, id)
+	os.Remove(st.stagingPath(id))
+	return st.saveLocked()
+}
+
+// Run removes expired incomplete uploads until ctx is cancelled
+func (st *UploadStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(uploadCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		st.removeExpired()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// removeExpired deletes incomplete uploads past their expiry, along with
+// staging files that belong to no upload
+func (st *UploadStore) removeExpired() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for id, record := range st.uploads {
+		if now.After(record.ExpiresAt) && !st.busy[id] {
+			delete(st.uploads, id)
+			os.Remove(st.stagingPath(id))
+			removed++
+		}
+	}
+
+	entries, err := os.ReadDir(st.staging)
+	if err == nil {
+		for _, entry := range entries {
+			if _, ok := st.uploads[entry.Name()]; !ok {
+				os.Remove(filepath.Join(st.staging, entry.Name()))
+			}
+		}
+	}
+
+	if removed > 0 {
+		log.Printf("Removed %d expired upload(s)", removed)
+		if err := st.saveLocked(); err != nil {
+			log.Printf("Failed to save upload store: %v", err)
+		}
+	}
+}
+
+// stagingPath returns the staging file of an upload
+func (st *UploadStore) stagingPath(id string) string {
+	return filepath.Join(st.staging, id)
+}
+
+// saveLocked writes the store to disk. The caller must hold the lock.
+func (st *UploadStore) saveLocked() error {
+	saved := uploadStoreFile{
+		Uploads:   make([]*UploadRecord, 0, len(st.uploads)),
+		Completed: st.completed,
+	}
+	for _, record := range st.uploads {
+		saved.Uploads = append(saved.Uploads, record)
+	}
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upload store: %w", err)
+	}
+
+	return writeFileAtomic(st.file, data, 0600)
+}
+
+// moveFile renames src to dst, making it readable like any other media
+// file. When they are on different filesystems the file is copied to a
+// hidden temporary file next to dst first, so dst still appears atomically.
+func moveFile(src, dst string) error {
+	if err := os.Chmod(src, 0644); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".upload*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// handleUploads implements the tus resumable upload protocol. POST
+// /api/uploads creates an upload, HEAD /api/uploads/<id> reports its
+// offset, PATCH appends a chunk and DELETE cancels it. GET /api/uploads
+// lists the user's incomplete uploads and quota.
+//
+// The destination is given in the Upload-Metadata header as "filename"
+// and "folder". The file appears in the media directory once its last
+// byte has been received.
+func (s *MediaServer) handleUploads(w http.ResponseWriter, r *http.Request) {
+	if s.uploads == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "uploads are disabled")
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/uploads"), "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			user := userFromContext(r.Context())
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"uploads": s.uploads.List(user),
+				"used":    s.uploads.Usage(user, s.uploadPresent),
+				"quota":   s.uploadQuota(user),
+			})
+		case http.MethodPost:
+			s.createUpload(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeJSONError(w, http.StatusPreconditionFailed, "unsupported tus version")
+		return
+	}
+
+	user := userFromContext(r.Context())
+	switch r.Method {
+	case http.MethodHead:
+		record, err := s.uploads.Get(user, id)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		setUploadHeaders(w, record)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			writeJSONError(w, http.StatusUnsupportedMediaType, "content type must be application/offset+octet-stream")
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid Upload-Offset")
+			return
+		}
+
+		s.streamBody(w, r)
+		record, err := s.uploads.Write(user, id, offset, r.Body, s.config.Uploads.Expiry)
+		switch {
+		case errors.Is(err, errUploadNotFound):
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		case errors.Is(err, errUploadLocked):
+			writeJSONError(w, http.StatusLocked, err.Error())
+			return
+		case errors.Is(err, errUploadOffset):
+			w.Header().Set("Upload-Offset", strconv.FormatInt(record.Offset, 10))
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			// The client resumes from the offset reached so far
+			log.Printf("Upload %s interrupted at %d of %d bytes: %v", id, record.Offset, record.Size, err)
+			setUploadHeaders(w, record)
+			writeJSONError(w, http.StatusInternalServerError, "upload interrupted")
+			return
+		}
+
+		if record.Offset == record.Size {
+			if status, err := s.completeUpload(r, record); err != nil {
+				writeJSONError(w, status, err.Error())
+				return
+			}
+		}
+		setUploadHeaders(w, record)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		switch err := s.uploads.Remove(user, id); {
+		case errors.Is(err, errUploadNotFound):
+			writeJSONError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, errUploadLocked):
+			writeJSONError(w, http.StatusLocked, err.Error())
+		case err != nil:
+			log.Printf("Failed to save upload store: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to cancel upload")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createUpload handles POST /api/uploads, checking the destination, file
+// type, size and the user's quota before any data is sent
+func (s *MediaServer) createUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeJSONError(w, http.StatusPreconditionFailed, "unsupported tus version")
+		return
+	}
+
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid Upload-Length")
+		return
+	}
+	if max := int64(s.config.Uploads.MaxFileSize) << 20; max > 0 && size > max {
+		writeJSONError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("file exceeds the maximum upload size of %d MB", s.config.Uploads.MaxFileSize))
+		return
+	}
+
+	metadata := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	name := metadata["filename"]
+	if !validFileName(name) {
+		writeJSONError(w, http.StatusBadRequest, "invalid filename")
+		return
+	}
+	if !s.uploadAllowed(name) {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "file type is not allowed")
+		return
+	}
+
+	user := userFromContext(r.Context())
+	folder, fullFolder, err := s.resolveUserPath(user, metadata["folder"])
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+	if info, err := os.Stat(fullFolder); err != nil || !info.IsDir() {
+		writeJSONError(w, http.StatusNotFound, "folder not found")
+		return
+	}
+	if s.library.Root(folder).ReadOnly {
+		writeJSONError(w, http.StatusForbidden, "folder is read-only")
+		return
+	}
+	urlPath := path.Join(folder, name)
+	if _, err := os.Lstat(filepath.Join(fullFolder, name)); err == nil {
+		writeJSONError(w, http.StatusConflict, "file already exists")
+		return
+	}
+
+	record, err := s.uploads.Create(user, urlPath, size, s.uploadQuota(user), s.config.Uploads.Expiry, s.uploadPresent)
+	switch {
+	case errors.Is(err, errUploadConflict):
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	case errors.Is(err, errQuotaExceeded):
+		writeJSONError(w, http.StatusInsufficientStorage, err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to create upload: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	if record.Size == 0 {
+		if status, err := s.completeUpload(r, record); err != nil {
+			writeJSONError(w, status, err.Error())
+			return
+		}
+	}
+
+	log.Printf("Upload %s started for %s (%d bytes)", record.ID, record.Path, record.Size)
+	w.Header().Set("Location", baseURL(r)+"/api/uploads/"+record.ID)
+	setUploadHeaders(w, record)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// completeUpload moves a finished upload into the media directory and
+// records it in the audit log. It returns the HTTP status to report if
+// that fails.
+func (s *MediaServer) completeUpload(r *http.Request, record UploadRecord) (int, error) {
+	_, fullPath, err := s.resolveMediaPath(record.Path)
+	if err != nil {
+		s.auditFileChange(r, "upload", record.Path, "", err)
+		return http.StatusForbidden, err
+	}
+
+	err = s.uploads.Complete(record.ID, fullPath)
+	s.auditFileChange(r, "upload", record.Path, "", err)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			s.uploads.Remove(record.User, record.ID)
+			return http.StatusConflict, errors.New("file already exists")
+		}
+		log.Printf("Failed to complete upload %s: %v", record.ID, err)
+		return http.StatusInternalServerError, errors.New("failed to complete upload")
+	}
+
+	if s.catalog != nil {
+		s.catalog.Refresh(record.Path)
+	}
+	log.Printf("Upload %s completed: %s", record.ID, record.Path)
+	return http.StatusOK, nil
+}
+
+// uploadQuota returns a user's quota in bytes, or zero for no limit
+func (s *MediaServer) uploadQuota(user string) int64 {
+	quota := s.config.Uploads.Quota
+	if userQuota, ok := s.config.Uploads.UserQuotas[user]; ok {
+		quota = userQuota
+	}
+	return int64(quota) << 20
+}
+
+// uploadPresent reports whether a completed upload is still in place, so
+// that it counts against the user's quota
+func (s *MediaServer) uploadPresent(record UploadRecord) bool {
+	_, fullPath, err := s.resolveMediaPath(record.Path)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(fullPath)
+	return err == nil && info.Size() == record.Size
+}
+
+// uploadAllowed reports whether a file name matches the allowed types,
+// which are media type names or extensions
+func (s *MediaServer) uploadAllowed(name string) bool {
+	allowed := s.config.Uploads.AllowedTypes
+	if len(allowed) == 0 {
+		return true
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	category := s.types.Classify(name, s.types.typeByExtension(ext))
+	for _, t := range allowed {
+		if strings.HasPrefix(t, ".") {
+			if normalizeExt(t) == ext {
+				return true
+			}
+		} else if category != nil && category.Name == t {
+			return true
+		}
+	}
+	return false
+}
+
+// setUploadHeaders sets the tus offset and length of an upload
+func setUploadHeaders(w http.ResponseWriter, record UploadRecord) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(record.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(record.Size, 10))
+	if !record.ExpiresAt.IsZero() {
+		w.Header().Set("Upload-Expires", record.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// setTusOptions advertises the supported tus protocol for OPTIONS requests
+func (s *MediaServer) setTusOptions(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if s.config.Uploads.MaxFileSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(int64(s.config.Uploads.MaxFileSize)<<20, 10))
+	}
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header, a comma
+// separated list of keys with base64 encoded values
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
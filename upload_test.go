@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestUploadStore creates an upload store in a temporary directory
+func newTestUploadStore(t *testing.T) *UploadStore {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := NewUploadStore(filepath.Join(dir, "data"), filepath.Join(dir, "staging"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestUploadStoreQuota(t *testing.T) {
+	present := func(UploadRecord) bool { return true }
+	gone := func(UploadRecord) bool { return false }
+
+	tests := []struct {
+		name    string
+		used    []int64 // sizes of the user's earlier uploads
+		other   int64   // size of another user's upload
+		size    int64
+		quota   int64
+		present func(UploadRecord) bool
+		wantErr error
+	}{
+		{"no quota", nil, 0, math.MaxInt64, 0, present, nil},
+		{"within quota", nil, 0, 100, 100, present, nil},
+		{"over quota", nil, 0, 101, 100, present, errQuotaExceeded},
+		{"huge size", nil, 0, math.MaxInt64, 100, present, errQuotaExceeded},
+		{"huge size after usage", []int64{10}, 0, math.MaxInt64 - 5, 100, present, errQuotaExceeded},
+		{"fills the remaining quota", []int64{60}, 0, 40, 100, present, nil},
+		{"over the remaining quota", []int64{60}, 0, 41, 100, present, errQuotaExceeded},
+		{"usage above a lowered quota", []int64{60, 60}, 0, 0, 100, present, errQuotaExceeded},
+		{"other users do not count", nil, 90, 100, 100, present, nil},
+		{"removed uploads do not count", []int64{0, 100}, 0, 100, 100, gone, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestUploadStore(t)
+			for i, size := range tt.used {
+				// Complete alternate uploads so both kinds are counted
+				record, err := store.Create("bob", "/used"+string(rune('a'+i)), size, 0, time.Hour, present)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i%2 == 1 {
+					store.uploads[record.ID].Offset = size
+					if err := store.Complete(record.ID, filepath.Join(t.TempDir(), "done")); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if tt.other > 0 {
+				if _, err := store.Create("alice", "/other", tt.other, 0, time.Hour, present); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := store.Create("bob", "/new", tt.size, tt.quota, time.Hour, tt.present)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Create(%d) with quota %d error = %v, want %v", tt.size, tt.quota, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUploadStoreConflict(t *testing.T) {
+	store := newTestUploadStore(t)
+	present := func(UploadRecord) bool { return true }
+
+	if _, err := store.Create("bob", "/a.mp4", 10, 0, time.Hour, present); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create("alice", "/a.mp4", 10, 0, time.Hour, present); !errors.Is(err, errUploadConflict) {
+		t.Errorf("second upload to the same path error = %v, want %v", err, errUploadConflict)
+	}
+}
+
+func TestUploadStoreWrite(t *testing.T) {
+	store := newTestUploadStore(t)
+	record, err := store.Create("bob", "/a.txt", 10, 0, time.Minute, func(UploadRecord) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name       string
+		user       string
+		offset     int64
+		body       string
+		wantOffset int64
+		wantErr    error
+	}{
+		{"other user", "alice", 0, "abc", 0, errUploadNotFound},
+		{"first chunk", "bob", 0, "abcd", 4, nil},
+		{"stale offset", "bob", 0, "abcd", 4, errUploadOffset},
+		{"offset ahead", "bob", 8, "abcd", 4, errUploadOffset},
+		{"empty chunk", "bob", 4, "", 4, nil},
+		{"bytes past the size are not read", "bob", 4, "efghijklmn", 10, nil},
+		{"complete", "bob", 10, "x", 10, nil},
+	}
+
+	for _, step := range steps {
+		got, err := store.Write(step.user, record.ID, step.offset, strings.NewReader(step.body), time.Hour)
+		if !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: Write() error = %v, want %v", step.name, err, step.wantErr)
+		}
+		if err == nil || errors.Is(err, errUploadOffset) {
+			if got.Offset != step.wantOffset {
+				t.Errorf("%s: offset = %d, want %d", step.name, got.Offset, step.wantOffset)
+			}
+		}
+	}
+
+	staged, err := os.ReadFile(store.stagingPath(record.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(staged) != "abcdefghij" {
+		t.Errorf("staged bytes = %q, want %q", staged, "abcdefghij")
+	}
+	if got, _ := store.Get("bob", record.ID); time.Until(got.ExpiresAt) < 30*time.Minute {
+		t.Errorf("expiry %v was not extended by the writes", got.ExpiresAt)
+	}
+
+	destination := filepath.Join(t.TempDir(), "a.txt")
+	if err := store.Complete(record.ID, destination); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(destination); err != nil || string(data) != "abcdefghij" {
+		t.Errorf("completed file = %q, %v", data, err)
+	}
+	if _, err := store.Get("bob", record.ID); !errors.Is(err, errUploadNotFound) {
+		t.Errorf("Get() after completing error = %v, want %v", err, errUploadNotFound)
+	}
+	if used := store.Usage("bob", func(UploadRecord) bool { return true }); used != 10 {
+		t.Errorf("usage = %d, want 10", used)
+	}
+}
+
+func TestUploadStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	dataDir, stagingDir := filepath.Join(dir, "data"), filepath.Join(dir, "staging")
+	store, err := NewUploadStore(dataDir, stagingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := store.Create("bob", "/a.txt", 10, 0, time.Hour, func(UploadRecord) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Write("bob", record.ID, 0, strings.NewReader("abc"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bytes that reached the staging file after the last save still count
+	file, err := os.OpenFile(store.stagingPath(record.ID), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("de")
+	file.Close()
+
+	reloaded, err := NewUploadStore(dataDir, stagingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := reloaded.Get("bob", record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Offset != 5 {
+		t.Errorf("offset after reload = %d, want 5", got.Offset)
+	}
+}
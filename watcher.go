@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long the watcher waits for a burst of filesystem
+// events to settle before refreshing the affected paths
+const watchDebounce = 250 * time.Millisecond
+
+// Watcher keeps the catalog in sync with a media root using filesystem
+// notifications (inotify on Linux). When the system watch limit is
+// exhausted it falls back to polling with periodic rescans of its root.
+type Watcher struct {
+	catalog      *Catalog
+	root         *MediaRoot
+	pollInterval time.Duration
+}
+
+// NewWatcher creates a watcher that updates catalog from root
+func NewWatcher(catalog *Catalog, root *MediaRoot, pollInterval time.Duration) *Watcher {
+	return &Watcher{
+		catalog:      catalog,
+		root:         root,
+		pollInterval: pollInterval,
+	}
+}
+
+// Run watches the media directory until the context is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Watcher: failed to initialize filesystem notifications: %v", err)
+		w.poll(ctx)
+		return
+	}
+	defer fsw.Close()
+
+	if err := w.addTree(fsw, w.root.Directory); err != nil {
+		log.Printf("Watcher: %v", err)
+		fsw.Close()
+		w.poll(ctx)
+		return
+	}
+	log.Printf("Watching media directory for changes: %s", w.root.Directory)
+
+	pending := make(map[string]struct{})
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return
+			}
+			urlPath, ok := w.urlPath(event.Name)
+			if !ok {
+				continue
+			}
+			pending[urlPath] = struct{}{}
+			timer.Reset(watchDebounce)
+
+			// New directories need their own watches
+			if event.Has(fsnotify.Create) {
+				if err := w.addTree(fsw, event.Name); err != nil {
+					log.Printf("Watcher: %v", err)
+					fsw.Close()
+					w.poll(ctx)
+					return
+				}
+			}
+
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watcher error: %v", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Events were lost; resynchronize with a rescan of the root
+				if err := w.catalog.ScanRoot(w.root); err != nil {
+					log.Printf("Catalog rescan failed: %v", err)
+				}
+			}
+
+		case <-timer.C:
+			for urlPath := range pending {
+				w.catalog.Refresh(urlPath)
+			}
+			pending = make(map[string]struct{})
+		}
+	}
+}
+
+// addTree adds watches for dir and all visible directories below it. It
+// returns an error only when the watch limit has been exhausted.
+func (w *Watcher) addTree(fsw *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if fullPath != w.root.Directory && w.root.Hidden(d.Name()) {
+			return filepath.SkipDir
+		}
+		if err := fsw.Add(fullPath); err != nil {
+			if isWatchLimitError(err) {
+				return errors.New("filesystem watch limit exhausted, falling back to polling " +
+					"(raise fs.inotify.max_user_watches to avoid this)")
+			}
+			log.Printf("Watcher: failed to watch %s: %v", fullPath, err)
+		}
+		return nil
+	})
+}
+
+// poll rescans the watcher's media root every poll interval until the context
+// is cancelled
+func (w *Watcher) poll(ctx context.Context) {
+	if w.pollInterval <= 0 {
+		log.Printf("Watcher: polling disabled, changes will be picked up by periodic rescans only")
+		return
+	}
+	log.Printf("Polling media directory for changes every %v", w.pollInterval)
+
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.catalog.ScanRoot(w.root); err != nil {
+				log.Printf("Catalog rescan failed: %v", err)
+			}
+		}
+	}
+}
+
+// urlPath converts a filesystem path under the media root to its URL path
+func (w *Watcher) urlPath(fullPath string) (string, bool) {
+	urlPath, ok := w.root.URLPath(fullPath)
+	if !ok || urlPath == w.root.Mount {
+		return "", false
+	}
+	return urlPath, true
+}
+
+// isWatchLimitError reports whether err means no more watches can be added
+func isWatchLimitError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// davWriteMethods are the WebDAV methods that modify the media directory
+var davWriteMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+	"MKCOL":           true,
+	"MOVE":            true,
+	"COPY":            true,
+	"PROPPATCH":       true,
+	"LOCK":            true,
+	"UNLOCK":          true,
+}
+
+// newDAVHandler creates the WebDAV handler serving the media directory
+// under /dav
+func newDAVHandler(s *MediaServer) *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: davFileSystem{s},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) {
+				log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+}
+
+// handleDAV serves /dav/ for file managers and tools such as rclone.
+// Requests pass through authentication like any other path; in read-only
+// mode, and for read-only roots, every method that would modify the
+// library is refused.
+func (s *MediaServer) handleDAV(w http.ResponseWriter, r *http.Request) {
+	if s.dav == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if s.config.WebDAV.ReadOnly && davWriteMethods[r.Method] {
+		http.Error(w, "WebDAV is read-only", http.StatusForbidden)
+		return
+	}
+
+	// Refuse roots the user may not access, and changes to read-only roots,
+	// before the handler turns the errors into less helpful statuses
+	cleanPath, _, err := s.resolveUserPath(userFromContext(r.Context()), strings.TrimPrefix(r.URL.Path, "/dav"))
+	if err != nil {
+		s.writePathError(w, err)
+		return
+	}
+	if root := s.library.Root(cleanPath); davWriteMethods[r.Method] && (root == nil || root.ReadOnly) {
+		http.Error(w, "Folder is read-only", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		// Uploaded HTML or SVG must not run scripts on the server's origin
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		if r.Method == http.MethodGet {
+			w = s.streamWriter(w)
+		}
+	case http.MethodPut:
+		s.streamBody(w, r)
+	}
+
+	// The file system records changes in the audit log, which describes
+	// the request they were made by
+	r = r.WithContext(context.WithValue(r.Context(), davRequestContextKey, r))
+	s.dav.ServeHTTP(w, r)
+}
+
+// davFileSystem exposes the media library to the WebDAV handler. Names
+// are resolved with the same containment and access checks as the rest of
+// the server, hidden files are left out of listings, and changes are
+// applied to the catalog as they happen.
+type davFileSystem struct {
+	s *MediaServer
+}
+
+// resolve maps a WebDAV name onto the media library for the user of ctx
+func (d davFileSystem) resolve(ctx context.Context, name string) (string, string, error) {
+	cleanPath, fullPath, err := d.s.resolveUserPath(userFromContext(ctx), name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", "", fs.ErrNotExist
+	}
+	if err != nil {
+		return "", "", fs.ErrPermission
+	}
+	return cleanPath, fullPath, nil
+}
+
+// writable reports an error if a resolved path may not be modified. The
+// virtual top level and read-only roots are never writable.
+func (d davFileSystem) writable(urlPath string) error {
+	root := d.s.library.Root(urlPath)
+	if d.s.config.WebDAV.ReadOnly || root == nil || root.ReadOnly {
+		return fs.ErrPermission
+	}
+	return nil
+}
+
+// audit records a change in the file management audit log
+func (d davFileSystem) audit(ctx context.Context, action, urlPath, destination string, err error) {
+	if r, ok := ctx.Value(davRequestContextKey).(*http.Request); ok {
+		d.s.auditFileChange(r, action, urlPath, destination, err)
+	}
+}
+
+// refresh updates the catalog entry of a changed path
+func (d davFileSystem) refresh(urlPath string) {
+	if d.s.catalog != nil {
+		d.s.catalog.Refresh(urlPath)
+	}
+}
+
+// Mkdir creates a directory
+func (d davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	cleanPath, fullPath, err := d.resolve(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := d.writable(cleanPath); err != nil {
+		return err
+	}
+	if err := os.Mkdir(fullPath, perm); err != nil {
+		return err
+	}
+	d.refresh(cleanPath)
+	return nil
+}
+
+// OpenFile opens a file, refusing writes in read-only mode
+func (d davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	cleanPath, fullPath, err := d.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if write {
+		if err := d.writable(cleanPath); err != nil {
+			return nil, err
+		}
+	}
+	if fullPath == "" {
+		return &davLibraryDir{fs: d, roots: d.s.library.List(userFromContext(ctx), d.s.types)}, nil
+	}
+	file, err := os.OpenFile(fullPath, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	root := d.s.library.Root(cleanPath)
+	return &davFile{File: file, fs: d, root: root, urlPath: cleanPath, written: write}, nil
+}
+
+// RemoveAll deletes a file or directory tree, but never a root. With file
+// management enabled it is moved to the trash and recorded in the audit
+// log like a deletion from the web interface.
+func (d davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	cleanPath, fullPath, err := d.resolve(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := d.writable(cleanPath); err != nil {
+		return err
+	}
+	if d.s.library.IsMount(cleanPath) {
+		return fs.ErrPermission
+	}
+	if d.s.files != nil {
+		_, err := d.s.files.Trash(userFromContext(ctx), cleanPath, fullPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing to delete, as when a COPY clears its destination
+			return nil
+		}
+		d.audit(ctx, "delete", cleanPath, "", err)
+		if err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(fullPath); err != nil {
+		return err
+	}
+	d.refresh(cleanPath)
+	return nil
+}
+
+// Rename moves a file or directory within its media root. With file
+// management enabled the move is recorded in the audit log.
+func (d davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, oldFull, err := d.resolve(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	newPath, newFull, err := d.resolve(ctx, newName)
+	if err != nil {
+		return err
+	}
+	if err := d.writable(oldPath); err != nil {
+		return err
+	}
+	if d.s.library.IsMount(oldPath) || d.s.library.IsMount(newPath) ||
+		d.s.library.Root(oldPath) != d.s.library.Root(newPath) {
+		return fs.ErrPermission
+	}
+	if d.s.files != nil {
+		err := d.s.files.Move(oldFull, newFull)
+		d.audit(ctx, "move", oldPath, newPath, err)
+		if err != nil {
+			return err
+		}
+	} else if err := renameTree(oldFull, newFull); err != nil {
+		return err
+	}
+	d.refresh(oldPath)
+	d.refresh(newPath)
+	return nil
+}
+
+// Stat returns the info of a file or directory
+func (d davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	_, fullPath, err := d.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if fullPath == "" {
+		return virtualDirInfo{}, nil
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{FileInfo: info, fullPath: fullPath, types: d.s.types}, nil
+}
+
+// davFile is an open file of a media root
+type davFile struct {
+	*os.File
+	fs      davFileSystem
+	root    *MediaRoot
+	urlPath string
+	written bool
+}
+
+// Readdir lists a directory without its hidden entries
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if !f.root.Hidden(info.Name()) {
+			visible = append(visible, davFileInfo{
+				FileInfo: info,
+				fullPath: filepath.Join(f.File.Name(), info.Name()),
+				types:    f.fs.s.types,
+			})
+		}
+	}
+	return visible, err
+}
+
+// Stat returns the file's info with its detected content type
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{FileInfo: info, fullPath: f.File.Name(), types: f.fs.s.types}, nil
+}
+
+// Close closes the file, indexing it if it was written
+func (f *davFile) Close() error {
+	err := f.File.Close()
+	if f.written {
+		f.fs.refresh(f.urlPath)
+	}
+	return err
+}
+
+// davLibraryDir is the virtual top level of a library with several roots,
+// listing the roots the user may access
+type davLibraryDir struct {
+	fs    davFileSystem
+	roots []FileInfo
+	pos   int
+}
+
+func (d *davLibraryDir) Close() error                                 { return nil }
+func (d *davLibraryDir) Read(p []byte) (int, error)                   { return 0, fs.ErrInvalid }
+func (d *davLibraryDir) Write(p []byte) (int, error)                  { return 0, fs.ErrPermission }
+func (d *davLibraryDir) Seek(offset int64, whence int) (int64, error) { return 0, fs.ErrInvalid }
+func (d *davLibraryDir) Stat() (fs.FileInfo, error)                   { return virtualDirInfo{}, nil }
+
+// Readdir returns the info of the roots' directories under the roots'
+// names
+func (d *davLibraryDir) Readdir(count int) ([]fs.FileInfo, error) {
+	var infos []fs.FileInfo
+	for ; d.pos < len(d.roots) && (count <= 0 || len(infos) < count); d.pos++ {
+		root := d.fs.s.library.Root(d.roots[d.pos].Path)
+		info, err := os.Stat(root.Directory)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, davFileInfo{FileInfo: info, name: root.Name, fullPath: root.Directory, types: d.fs.s.types})
+	}
+	if count > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+	return infos, nil
+}
+
+// davFileInfo reports a file's content type from the media type registry
+// rather than the WebDAV handler's own detection
+type davFileInfo struct {
+	fs.FileInfo
+	name     string
+	fullPath string
+	types    *MediaTypes
+}
+
+// Name returns the file's name, or the name of the root it is mounted as
+func (fi davFileInfo) Name() string {
+	if fi.name != "" {
+		return fi.name
+	}
+	return fi.FileInfo.Name()
+}
+
+// ContentType implements webdav.ContentTyper
+func (fi davFileInfo) ContentType(ctx context.Context) (string, error) {
+	return fi.types.TypeOf(fi.fullPath, fi.FileInfo), nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// davTestServer serves a library with a writable, a read-only and a
+// private root over WebDAV, recording changes in an audit log
+func davTestServer(t *testing.T, config *Config) (*MediaServer, map[string]string) {
+	t.Helper()
+	dirs := map[string]string{"media": t.TempDir(), "archive": t.TempDir(), "private": t.TempDir()}
+	writeTestFiles(t, dirs["media"], "a.mp4", ".secret.txt", "sub/")
+	writeTestFiles(t, dirs["archive"], "old.mp3")
+	writeTestFiles(t, dirs["private"], "x.mp4")
+
+	library := NewLibrary(MediaConfig{Roots: []MediaRootConfig{
+		{Name: "media", Directory: dirs["media"]},
+		{Name: "archive", Directory: dirs["archive"], ReadOnly: true},
+		{Name: "private", Directory: dirs["private"], Users: []string{"bob"}},
+	}})
+	data := t.TempDir()
+	files, err := NewFileManager(data, library, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := NewAuditLog(filepath.Join(data, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &MediaServer{
+		config:  config,
+		library: library,
+		types:   NewMediaTypes(defaultMediaTypes(), nil),
+		files:   files,
+		audit:   audit,
+	}
+	s.dav = newDAVHandler(s)
+	dirs["data"] = data
+	return s, dirs
+}
+
+// davRequest runs a WebDAV request as user
+func davRequest(s *MediaServer, user, method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	w := httptest.NewRecorder()
+	s.handleDAV(w, r)
+	return w
+}
+
+func TestHandleDAV(t *testing.T) {
+	s, dirs := davTestServer(t, &Config{WebDAV: WebDAVConfig{Enabled: true}})
+	depth1 := map[string]string{"Depth": "1"}
+	lock := `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+
+	// Steps run in order against the same library
+	steps := []struct {
+		name        string
+		user        string
+		method      string
+		path        string
+		header      map[string]string
+		body        string
+		wantStatus  int
+		wantBody    []string
+		wantMissing []string
+		wantFile    string
+		wantNoFile  string
+	}{
+		{
+			name:        "list the roots",
+			method:      "PROPFIND",
+			path:        "/dav/",
+			header:      depth1,
+			wantStatus:  http.StatusMultiStatus,
+			wantBody:    []string{"<D:href>/dav/media/</D:href>", "<D:href>/dav/archive/</D:href>"},
+			wantMissing: []string{"/dav/private/"},
+		},
+		{
+			name:        "list a root",
+			method:      "PROPFIND",
+			path:        "/dav/media/",
+			header:      depth1,
+			wantStatus:  http.StatusMultiStatus,
+			wantBody:    []string{"<D:href>/dav/media/a.mp4</D:href>", "<D:getcontenttype>video/mp4</D:getcontenttype>", "<D:href>/dav/media/sub/</D:href>"},
+			wantMissing: []string{".secret.txt"},
+		},
+		{name: "list a read-only root", method: "PROPFIND", path: "/dav/archive/", header: depth1, wantStatus: http.StatusMultiStatus, wantBody: []string{"old.mp3"}},
+		{name: "download", method: "GET", path: "/dav/media/a.mp4", wantStatus: http.StatusOK, wantBody: []string{"a.mp4"}},
+		{name: "hidden file", method: "GET", path: "/dav/media/.secret.txt", wantStatus: http.StatusNotFound},
+		{name: "escaping path", method: "GET", path: "/dav/media/..%2f..%2fetc/passwd", wantStatus: http.StatusNotFound},
+		{name: "private root", method: "GET", path: "/dav/private/x.mp4", wantStatus: http.StatusForbidden},
+		{name: "private root with access", user: "bob", method: "GET", path: "/dav/private/x.mp4", wantStatus: http.StatusOK},
+		{name: "upload", method: "PUT", path: "/dav/media/new.mp3", body: "uploaded", wantStatus: http.StatusCreated, wantFile: "media/new.mp3"},
+		{name: "upload to a read-only root", method: "PUT", path: "/dav/archive/new.mp3", body: "uploaded", wantStatus: http.StatusForbidden, wantNoFile: "archive/new.mp3"},
+		{name: "upload outside the roots", method: "PUT", path: "/dav/new.mp3", body: "uploaded", wantStatus: http.StatusNotFound},
+		{name: "upload to a private root", method: "PUT", path: "/dav/private/new.mp3", body: "uploaded", wantStatus: http.StatusForbidden, wantNoFile: "private/new.mp3"},
+		{name: "create a folder", method: "MKCOL", path: "/dav/media/folder", wantStatus: http.StatusCreated, wantFile: "media/folder"},
+		{name: "create a folder in a read-only root", method: "MKCOL", path: "/dav/archive/folder", wantStatus: http.StatusForbidden, wantNoFile: "archive/folder"},
+		{
+			name:       "move",
+			method:     "MOVE",
+			path:       "/dav/media/new.mp3",
+			header:     map[string]string{"Destination": "http://example.com/dav/media/folder/moved.mp3"},
+			wantStatus: http.StatusCreated,
+			wantFile:   "media/folder/moved.mp3",
+			wantNoFile: "media/new.mp3",
+		},
+		{
+			name:       "move to another root",
+			method:     "MOVE",
+			path:       "/dav/media/a.mp4",
+			header:     map[string]string{"Destination": "http://example.com/dav/archive/a.mp4"},
+			wantStatus: http.StatusForbidden,
+			wantFile:   "media/a.mp4",
+			wantNoFile: "archive/a.mp4",
+		},
+		{
+			name:       "move a root",
+			method:     "MOVE",
+			path:       "/dav/media",
+			header:     map[string]string{"Destination": "http://example.com/dav/renamed"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "copy",
+			method:     "COPY",
+			path:       "/dav/media/a.mp4",
+			header:     map[string]string{"Destination": "http://example.com/dav/media/folder/copy.mp4"},
+			wantStatus: http.StatusCreated,
+			wantFile:   "media/folder/copy.mp4",
+		},
+		{name: "delete", method: "DELETE", path: "/dav/media/folder/copy.mp4", wantStatus: http.StatusNoContent, wantNoFile: "media/folder/copy.mp4"},
+		{name: "delete a root", method: "DELETE", path: "/dav/media", wantStatus: http.StatusMethodNotAllowed, wantFile: "media/a.mp4"},
+		{name: "delete the top level", method: "DELETE", path: "/dav/", wantStatus: http.StatusForbidden},
+		{name: "delete in a read-only root", method: "DELETE", path: "/dav/archive/old.mp3", wantStatus: http.StatusForbidden, wantFile: "archive/old.mp3"},
+		{name: "lock", method: "LOCK", path: "/dav/media/a.mp4", body: lock, wantStatus: http.StatusOK, wantBody: []string{"<D:locktoken>"}},
+		{name: "lock in a read-only root", method: "LOCK", path: "/dav/archive/old.mp3", body: lock, wantStatus: http.StatusForbidden},
+	}
+
+	for _, step := range steps {
+		user := step.user
+		if user == "" {
+			user = "alice"
+		}
+		w := davRequest(s, user, step.method, step.path, step.header, step.body)
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body)
+		}
+		for _, want := range step.wantBody {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s: body does not contain %q: %s", step.name, want, w.Body)
+			}
+		}
+		for _, missing := range step.wantMissing {
+			if strings.Contains(w.Body.String(), missing) {
+				t.Errorf("%s: body contains %q", step.name, missing)
+			}
+		}
+		if step.wantFile != "" {
+			root, rel, _ := strings.Cut(step.wantFile, "/")
+			if _, err := os.Stat(filepath.Join(dirs[root], rel)); err != nil {
+				t.Errorf("%s: %v", step.name, err)
+			}
+		}
+		if step.wantNoFile != "" {
+			root, rel, _ := strings.Cut(step.wantNoFile, "/")
+			if _, err := os.Stat(filepath.Join(dirs[root], rel)); !os.IsNotExist(err) {
+				t.Errorf("%s: %s exists", step.name, step.wantNoFile)
+			}
+		}
+	}
+
+	// Downloads cannot run scripts on the server's origin
+	w := davRequest(s, "alice", "GET", "/dav/media/a.mp4", nil, "")
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("download headers = %v, want nosniff and a sandbox", w.Header())
+	}
+
+	// Deleted files go to the trash of their root
+	if trash := s.files.List("alice"); len(trash) != 1 || trash[0].Path != "/media/folder/copy.mp4" || trash[0].User != "alice" {
+		t.Errorf("trash = %+v, want the deleted copy", trash)
+	}
+
+	file, err := os.Open(filepath.Join(dirs["data"], "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var actions []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.User != "alice" {
+			t.Errorf("audit entry %+v, want user alice", entry)
+		}
+		actions = append(actions, entry.Action+" "+entry.Path+" "+entry.Destination)
+	}
+	want := []string{"move /media/new.mp3 /media/folder/moved.mp3", "delete /media/folder/copy.mp4 "}
+	if !equalStrings(actions, want) {
+		t.Errorf("audit log = %q, want %q", actions, want)
+	}
+}
+
+func TestHandleDAVReadOnly(t *testing.T) {
+	s, dirs := davTestServer(t, &Config{WebDAV: WebDAVConfig{Enabled: true, ReadOnly: true}})
+
+	tests := []struct {
+		method     string
+		path       string
+		header     map[string]string
+		wantStatus int
+	}{
+		{"PROPFIND", "/dav/media/", map[string]string{"Depth": "1"}, http.StatusMultiStatus},
+		{"GET", "/dav/media/a.mp4", nil, http.StatusOK},
+		{"HEAD", "/dav/media/a.mp4", nil, http.StatusOK},
+		{"OPTIONS", "/dav/media/", nil, http.StatusOK},
+		{"PUT", "/dav/media/new.mp3", nil, http.StatusForbidden},
+		{"DELETE", "/dav/media/a.mp4", nil, http.StatusForbidden},
+		{"MKCOL", "/dav/media/folder", nil, http.StatusForbidden},
+		{"MOVE", "/dav/media/a.mp4", map[string]string{"Destination": "/dav/media/b.mp4"}, http.StatusForbidden},
+		{"COPY", "/dav/media/a.mp4", map[string]string{"Destination": "/dav/media/b.mp4"}, http.StatusForbidden},
+		{"PROPPATCH", "/dav/media/a.mp4", nil, http.StatusForbidden},
+		{"LOCK", "/dav/media/a.mp4", nil, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			if w := davRequest(s, "alice", tt.method, tt.path, tt.header, ""); w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(dirs["media"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("media root has %d entries after read-only requests, want 3", len(entries))
+	}
+
+	w := httptest.NewRecorder()
+	(&MediaServer{}).handleDAV(w, httptest.NewRequest("PROPFIND", "/dav/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status with WebDAV disabled = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}